@@ -0,0 +1,59 @@
+// Package admin serves health and statistic endpoints over http.
+package admin
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithField("component", "admin")
+
+type Server struct {
+	addr   string
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// NewServer serves /healthz and /debug/vars by default
+func NewServer(addr string) *Server {
+	s := &Server{
+		addr: addr,
+		mux:  http.NewServeMux(),
+	}
+	s.server = &http.Server{Handler: s.mux}
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	s.mux.Handle("/debug/vars", expvar.Handler())
+	return s
+}
+
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+func (s *Server) Listen() (net.Listener, error) {
+	return net.Listen("tcp", s.addr)
+}
+
+// Serve returns http.ErrServerClosed after Shutdown
+func (s *Server) Serve(l net.Listener) error {
+	logger.Infof("start admin server on %s", l.Addr().String())
+	return s.server.Serve(l)
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
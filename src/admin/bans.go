@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"socks5-proxy/src"
+)
+
+// Banlist manages bans and lockouts of a LockoutMngr:
+//
+//	GET                                     list bans and running lockouts
+//	POST   ?cidr=10.0.0.0/8&duration=1h&reason=x  ban a cidr or an ip, forever without duration
+//	DELETE ?cidr=10.0.0.0/8                 lift a ban
+//	DELETE ?ip=10.0.0.1 or ?user=alice      lift a lockout
+type Banlist struct {
+	mngr *src.LockoutMngr
+}
+
+func NewBanlist(mngr *src.LockoutMngr) *Banlist {
+	return &Banlist{mngr: mngr}
+}
+
+func (b *Banlist) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var ret any
+	switch req.Method {
+	case http.MethodGet:
+		ret = map[string]any{"bans": b.mngr.Bans(), "lockouts": b.mngr.Lockouts()}
+	case http.MethodPost:
+		prefix, err := parsePrefix(q.Get("cidr"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if s := q.Get("duration"); s != "" {
+			if duration, err = time.ParseDuration(s); err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("illegal duration %s", s), http.StatusBadRequest)
+				return
+			}
+		}
+		ban := b.mngr.Ban(prefix, duration, q.Get("reason"))
+		logger.Infof("ban %s, reason=%s", ban.Prefix, ban.Reason)
+		ret = ban
+	case http.MethodDelete:
+		var found bool
+		switch {
+		case q.Get("cidr") != "":
+			prefix, err := parsePrefix(q.Get("cidr"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			found = b.mngr.Unban(prefix)
+		case q.Get("ip") != "":
+			if _, err := netip.ParseAddr(q.Get("ip")); err != nil {
+				http.Error(w, fmt.Sprintf("illegal ip %s", q.Get("ip")), http.StatusBadRequest)
+				return
+			}
+			found = b.mngr.Unlock(q.Get("ip"))
+		case q.Get("user") != "":
+			found = b.mngr.Unlock(q.Get("user"))
+		default:
+			http.Error(w, "one of cidr, ip, user is required", http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		logger.Infof("lift %s", req.URL.RawQuery)
+		ret = map[string]bool{"removed": true}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(ret)
+}
+
+// parsePrefix takes a cidr or a single ip
+func parsePrefix(s string) (netip.Prefix, error) {
+	ps, err := src.ParsePrefixes([]string{s})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return ps[0], nil
+}
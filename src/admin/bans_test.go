@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"socks5-proxy/src"
+)
+
+func TestBanlist(t *testing.T) {
+	mngr := src.NewLockoutMngr(src.LockoutOptions{MaxFailures: 1, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+	mngr.Fail(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, "bob")
+	b := NewBanlist(mngr)
+
+	cases := []struct {
+		method, query string
+		status        int
+		// ip checked after the request, and whether it's rejected
+		ip       string
+		rejected bool
+	}{
+		{method: http.MethodPost, query: "cidr=127.0.0.11/31&reason=test", status: http.StatusOK, ip: "127.0.0.10", rejected: true},
+		{method: http.MethodPost, query: "cidr=10.0.0.1&duration=1h", status: http.StatusOK, ip: "10.0.0.1", rejected: true},
+		{method: http.MethodPost, query: "cidr=nope", status: http.StatusBadRequest},
+		{method: http.MethodPost, query: "cidr=10.0.0.2&duration=-1h", status: http.StatusBadRequest, ip: "10.0.0.2"},
+		{method: http.MethodDelete, query: "ip=127.0.0.1", status: http.StatusOK, ip: "127.0.0.1"},
+		{method: http.MethodDelete, query: "ip=127.0.0.1", status: http.StatusNotFound},
+		{method: http.MethodDelete, query: "ip=bob", status: http.StatusBadRequest},
+		{method: http.MethodDelete, query: "user=bob", status: http.StatusOK},
+		{method: http.MethodDelete, query: "cidr=127.0.0.10/31", status: http.StatusOK, ip: "127.0.0.11"},
+		{method: http.MethodDelete, query: "cidr=127.0.0.10/31", status: http.StatusNotFound},
+		{method: http.MethodDelete, status: http.StatusBadRequest},
+		{method: http.MethodPut, status: http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest(c.method, "/bans?"+c.query, nil))
+		if w.Code != c.status {
+			t.Fatalf("%s %s got %d, want %d", c.method, c.query, w.Code, c.status)
+		}
+		if c.ip == "" {
+			continue
+		}
+		if err := mngr.CheckIP(&net.TCPAddr{IP: net.ParseIP(c.ip)}); (err != nil) != c.rejected {
+			t.Fatalf("after %s %s, %s got %v", c.method, c.query, c.ip, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bans", nil))
+	var list struct {
+		Bans     []src.Ban     `json:"bans"`
+		Lockouts []src.Lockout `json:"lockouts"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Bans) != 1 || list.Bans[0].Prefix.String() != "10.0.0.1/32" || list.Bans[0].Until == nil || len(list.Lockouts) != 0 {
+		t.Fatalf("got %+v", list)
+	}
+}
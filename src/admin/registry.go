@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"socks5-proxy/src"
+)
+
+// Conn is a live connection listed by Registry
+type Conn struct {
+	Client   string    `json:"client"`
+	Listener string    `json:"listener"`
+	User     string    `json:"user,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Outbound string    `json:"outbound,omitempty"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	// only counted if progress events are enabled
+	Up   int64 `json:"up,omitempty"`
+	Down int64 `json:"down,omitempty"`
+}
+
+// Registry tracks live connections from the event bus, it serves them as json
+type Registry struct {
+	mu    sync.Mutex
+	conns map[*src.Context]*Conn
+}
+
+func NewRegistry(bus *src.Bus) *Registry {
+	r := &Registry{conns: make(map[*src.Context]*Conn)}
+	bus.Subscribe(r.observe)
+	return r
+}
+
+func (r *Registry) observe(ctx *src.Context, e src.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := e.(src.Accepted); ok {
+		r.conns[ctx] = &Conn{
+			Client:   ctx.ClientAddr().String(),
+			Listener: e.Listener.String(),
+			State:    "handshake",
+			Since:    time.Now(),
+		}
+		return
+	}
+	c, ok := r.conns[ctx]
+	if !ok {
+		return
+	}
+
+	switch e := e.(type) {
+	case src.Authenticated:
+		c.User = e.User
+	case src.CommandParsed:
+		c.Target = e.Target
+	case src.DialStarted:
+		c.State = "dialing"
+	case src.PipeStarted:
+		c.State = "piping"
+		c.Outbound, _ = src.Get(ctx, src.OutboundKey)
+	case src.Progress:
+		c.Up, c.Down = e.Up, e.Down
+	case src.Closed:
+		delete(r.conns, ctx)
+	}
+}
+
+// List returns a snapshot of live connections, oldest first
+func (r *Registry) List() []Conn {
+	r.mu.Lock()
+	ret := make([]Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		ret = append(ret, *c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Since.Before(ret[j].Since)
+	})
+	return ret
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(r.List())
+}
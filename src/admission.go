@@ -0,0 +1,182 @@
+package src
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTooManySessions      = errors.New("too many sessions")
+	ErrTooManyIPSessions    = errors.New("too many sessions from ip")
+	ErrTooManyUserSessions  = errors.New("too many sessions of user")
+	ErrTooManyNewConnsPerIP = errors.New("too many new connections from ip")
+)
+
+const admissionSweepDur = time.Minute
+
+// AdmissionOptions caps concurrency and connection rates, zero means unlimited
+type AdmissionOptions struct {
+	MaxSessions        int
+	MaxSessionsPerIP   int
+	MaxSessionsPerUser int
+	// new connections per second of every ip, bursts up to one second worth
+	NewConnsPerSecPerIP float64
+}
+
+type ipState struct {
+	sessions int
+	tokens   float64
+	last     time.Time
+}
+
+// AdmissionMngr admits new connections before they are served,
+// every successful Acquire* must be paired with the returned release
+type AdmissionMngr struct {
+	opts atomic.Pointer[AdmissionOptions]
+
+	sessions int64
+	mu       sync.Mutex
+	ips      map[netip.Addr]*ipState
+	users    map[string]int
+
+	stats *expvar.Map
+}
+
+func NewAdmissionMngr(opts AdmissionOptions) *AdmissionMngr {
+	mngr := &AdmissionMngr{
+		ips:   make(map[netip.Addr]*ipState),
+		users: make(map[string]int),
+		stats: new(expvar.Map).Init(),
+	}
+	mngr.stats.Set("sessions", expvar.Func(func() any {
+		return atomic.LoadInt64(&mngr.sessions)
+	}))
+	mngr.opts.Store(&opts)
+	go mngr.daemon()
+	return mngr
+}
+
+// UpdateOptions takes effect on new connections, admitted ones are kept
+func (mngr *AdmissionMngr) UpdateOptions(opts AdmissionOptions) {
+	mngr.opts.Store(&opts)
+}
+
+// Stats counts sessions and rejections, published by admin server
+func (mngr *AdmissionMngr) Stats() *expvar.Map {
+	return mngr.stats
+}
+
+// AcquireSession checks the global cap, it's cheap enough for the accept loop
+func (mngr *AdmissionMngr) AcquireSession() (func(), error) {
+	n := atomic.AddInt64(&mngr.sessions, 1)
+	if max := mngr.opts.Load().MaxSessions; max > 0 && n > int64(max) {
+		atomic.AddInt64(&mngr.sessions, -1)
+		return nil, mngr.reject("rejected_sessions", ErrTooManySessions)
+	}
+	return func() { atomic.AddInt64(&mngr.sessions, -1) }, nil
+}
+
+// AcquireIP checks the per-ip cap and rate of the client address, non-ip clients are always admitted
+func (mngr *AdmissionMngr) AcquireIP(addr net.Addr) (func(), error) {
+	// netip.Addr keys avoid formatting the ip of every connection
+	ip, ok := ipOf(addr)
+	if !ok {
+		return func() {}, nil
+	}
+	opts := mngr.opts.Load()
+
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	st, ok := mngr.ips[ip]
+	if !ok {
+		st = &ipState{tokens: burstOf(opts.NewConnsPerSecPerIP), last: time.Now()}
+		mngr.ips[ip] = st
+	}
+	if rate := opts.NewConnsPerSecPerIP; rate > 0 {
+		now := time.Now()
+		st.tokens += now.Sub(st.last).Seconds() * rate
+		if burst := burstOf(rate); st.tokens > burst {
+			st.tokens = burst
+		}
+		st.last = now
+		if st.tokens < 1 {
+			return nil, mngr.reject("rejected_ip_rate", ErrTooManyNewConnsPerIP)
+		}
+		st.tokens--
+	}
+	if max := opts.MaxSessionsPerIP; max > 0 && st.sessions >= max {
+		return nil, mngr.reject("rejected_ip_sessions", ErrTooManyIPSessions)
+	}
+
+	st.sessions++
+	return func() {
+		mngr.mu.Lock()
+		st.sessions--
+		mngr.mu.Unlock()
+	}, nil
+}
+
+// AcquireUser checks the per-user cap, anonymous sessions are always admitted
+func (mngr *AdmissionMngr) AcquireUser(user string) (func(), error) {
+	if user == "" {
+		return func() {}, nil
+	}
+	max := mngr.opts.Load().MaxSessionsPerUser
+
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	if max > 0 && mngr.users[user] >= max {
+		return nil, mngr.reject("rejected_user_sessions", ErrTooManyUserSessions)
+	}
+	mngr.users[user]++
+	return func() {
+		mngr.mu.Lock()
+		if mngr.users[user]--; mngr.users[user] == 0 {
+			delete(mngr.users, user)
+		}
+		mngr.mu.Unlock()
+	}, nil
+}
+
+func (mngr *AdmissionMngr) reject(metric string, err error) error {
+	mngr.stats.Add(metric, 1)
+	return err
+}
+
+// daemon forgets idle ips whose tokens are refilled
+func (mngr *AdmissionMngr) daemon() {
+	sweepT := time.NewTicker(admissionSweepDur)
+	for {
+		<-sweepT.C
+		mngr.sweep(time.Now())
+	}
+}
+
+// sweep drops ips without sessions whose tokens are refilled to burst by now,
+// forgetting one earlier would hand it a fresh burst
+func (mngr *AdmissionMngr) sweep(now time.Time) {
+	rate := mngr.opts.Load().NewConnsPerSecPerIP
+	burst := burstOf(rate)
+
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+	for ip, st := range mngr.ips {
+		if st.sessions == 0 && (rate <= 0 || st.tokens+now.Sub(st.last).Seconds()*rate >= burst) {
+			delete(mngr.ips, ip)
+		}
+	}
+}
+
+func burstOf(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
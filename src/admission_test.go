@@ -0,0 +1,59 @@
+package src
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAdmissionSweep(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	cases := []struct {
+		name     string
+		rate     float64
+		tokens   float64
+		idle     time.Duration
+		sessions int
+		forgot   bool
+	}{
+		{name: "unlimited", forgot: true},
+		{name: "unlimited with sessions", sessions: 1},
+		{name: "refilled", rate: 5, tokens: 0, idle: time.Second, forgot: true},
+		{name: "partly refilled", rate: 5, tokens: 0, idle: 500 * time.Millisecond},
+		{name: "refilled with sessions", rate: 5, tokens: 5, idle: time.Minute, sessions: 1},
+		// burst is 1 while refilling 0.5 a second, the burst is not the rate
+		{name: "rate below one partly refilled", rate: 0.5, tokens: 0, idle: time.Second},
+		{name: "rate below one refilled", rate: 0.5, tokens: 0, idle: 2 * time.Second, forgot: true},
+		{name: "rate below burst", rate: 0.1, tokens: 0.5, idle: 4 * time.Second},
+		{name: "rate below burst refilled", rate: 0.1, tokens: 0.5, idle: 5 * time.Second, forgot: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mngr := NewAdmissionMngr(AdmissionOptions{NewConnsPerSecPerIP: c.rate})
+			now := time.Now()
+			mngr.ips[ip] = &ipState{sessions: c.sessions, tokens: c.tokens, last: now}
+			mngr.sweep(now.Add(c.idle))
+			if _, ok := mngr.ips[ip]; ok == c.forgot {
+				t.Fatalf("forgot=%v, want %v", !ok, c.forgot)
+			}
+		})
+	}
+}
+
+func TestAdmissionSweepKeepsRateOfSlowIP(t *testing.T) {
+	mngr := NewAdmissionMngr(AdmissionOptions{NewConnsPerSecPerIP: 0.5})
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+
+	release, err := mngr.AcquireIP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	// a second later half a token is back, forgetting the ip would admit the next one
+	mngr.sweep(time.Now().Add(time.Second))
+	if _, err := mngr.AcquireIP(addr); !errors.Is(err, ErrTooManyNewConnsPerIP) {
+		t.Fatalf("got %v, want rate limited", err)
+	}
+}
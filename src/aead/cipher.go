@@ -0,0 +1,98 @@
+// Package aead encrypts streams in chunks sealed by a pre-shared key, like shadowsocks AEAD ciphers.
+// Every direction starts with a random salt, the session key is derived from the key and the salt:
+//
+//	[salt][sealed length][sealed payload][sealed length][sealed payload]...
+//
+// Lengths are 2 bytes big endian of at most MaxPayload, nonces are little endian counters.
+// The framing is not compatible with shadowsocks servers, the master key is derived differently.
+package aead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	AES256GCM        = "aes-256-gcm"
+	ChaCha20Poly1305 = "chacha20-poly1305"
+
+	// MaxPayload of a chunk, the upper 2 bits of the length are reserved
+	MaxPayload = 0x3fff
+	// MinKeySize of the pre-shared key, it's stretched to the key size of the cipher
+	MinKeySize = 16
+
+	keySize     = 32
+	masterInfo  = "s5-tunnel-psk"
+	sessionInfo = "ss-subkey"
+)
+
+var (
+	ErrOpen   = errors.New("fail to open sealed chunk")
+	ErrReplay = errors.New("replayed salt")
+)
+
+// Cipher seals connections with the pre-shared key
+type Cipher struct {
+	name    string
+	master  []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewCipher derives the master key from psk, name is one of AES256GCM and ChaCha20Poly1305
+func NewCipher(name string, psk []byte) (*Cipher, error) {
+	c := &Cipher{name: name}
+	switch name {
+	case AES256GCM:
+		c.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case ChaCha20Poly1305:
+		c.newAEAD = chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unknown cipher %s", name)
+	}
+	if len(psk) < MinKeySize {
+		return nil, fmt.Errorf("pre-shared key should have at least %d bytes", MinKeySize)
+	}
+
+	c.master = make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, psk, nil, []byte(masterInfo)), c.master); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cipher) Name() string {
+	return c.name
+}
+
+// session derives the key of a direction from its salt
+func (c *Cipher) session(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.master, salt, []byte(sessionInfo)), key); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(key)
+}
+
+// Client seals conn dialed to the server
+func (c *Cipher) Client(conn net.Conn) *Conn {
+	return newConn(conn, c, nil)
+}
+
+// Server seals accepted conn, salts of clients seen by filter are rejected
+func (c *Cipher) Server(conn net.Conn, filter *ReplayFilter) *Conn {
+	return newConn(conn, c, filter)
+}
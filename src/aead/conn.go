@@ -0,0 +1,183 @@
+package aead
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// chunks sealed per write to the underlying connection
+const chunksPerWrite = 8
+
+// Conn seals written bytes and opens read ones, the salt of a direction is sent with its first write.
+// CloseWrite and CloseRead are passed to the underlying connection, so a FIN ends the stream.
+type Conn struct {
+	net.Conn
+	cipher *Cipher
+	filter *ReplayFilter
+
+	rmu    sync.Mutex
+	opener cipher.AEAD
+	rnonce []byte
+	rbuf   []byte
+	// checked by filter once the first chunk is authenticated, so forged chunks can't burn salts
+	rsalt []byte
+	// opened bytes not read yet
+	plain []byte
+
+	wmu    sync.Mutex
+	sealer cipher.AEAD
+	wnonce []byte
+	wbuf   []byte
+}
+
+func newConn(conn net.Conn, c *Cipher, filter *ReplayFilter) *Conn {
+	return &Conn{Conn: conn, cipher: c, filter: filter}
+}
+
+// NetConn returns the underlying connection like tls.Conn does
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.plain) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// readChunk opens the next chunk into plain, io.EOF only if the peer stopped at a chunk boundary
+func (c *Conn) readChunk() error {
+	if c.opener == nil {
+		salt := make([]byte, keySize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		opener, err := c.cipher.session(salt)
+		if err != nil {
+			return err
+		}
+		c.opener, c.rnonce, c.rsalt = opener, make([]byte, opener.NonceSize()), salt
+		c.rbuf = make([]byte, 2+opener.Overhead()+MaxPayload+opener.Overhead())
+	}
+
+	overhead := c.opener.Overhead()
+	head := c.rbuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, head); err != nil {
+		return err
+	}
+	if _, err := c.opener.Open(head[:0], c.rnonce, head, nil); err != nil {
+		return ErrOpen
+	}
+	if c.rsalt != nil {
+		if c.filter != nil && !c.filter.Check(c.rsalt) {
+			return ErrReplay
+		}
+		c.rsalt = nil
+	}
+	increment(c.rnonce)
+	size := int(binary.BigEndian.Uint16(head))
+	if size > MaxPayload || size == 0 {
+		return fmt.Errorf("%w: illegal length %d", ErrOpen, size)
+	}
+
+	payload := c.rbuf[2+overhead : 2+overhead+size+overhead]
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := c.opener.Open(payload[:0], c.rnonce, payload, nil)
+	if err != nil {
+		return ErrOpen
+	}
+	increment(c.rnonce)
+	c.plain = plain
+	return nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := c.wbuf[:0]
+	if c.sealer == nil {
+		salt := make([]byte, keySize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		sealer, err := c.cipher.session(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.sealer, c.wnonce = sealer, make([]byte, sealer.NonceSize())
+		buf = append(buf, salt...)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		batch := 0
+		for i := 0; i < chunksPerWrite && len(p) > 0; i++ {
+			size := len(p)
+			if size > MaxPayload {
+				size = MaxPayload
+			}
+			var length [2]byte
+			binary.BigEndian.PutUint16(length[:], uint16(size))
+			buf = c.sealer.Seal(buf, c.wnonce, length[:], nil)
+			increment(c.wnonce)
+			buf = c.sealer.Seal(buf, c.wnonce, p[:size], nil)
+			increment(c.wnonce)
+			p = p[size:]
+			batch += size
+		}
+		if _, err := c.Conn.Write(buf); err != nil {
+			c.wbuf = buf
+			return written, err
+		}
+		written += batch
+		buf = buf[:0]
+	}
+	c.wbuf = buf
+	return written, nil
+}
+
+// CloseWrite half closes the underlying connection, if it can
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// CloseRead half closes the underlying connection, if it can
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+// increment the little endian nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package aead
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var ciphers = []string{AES256GCM, ChaCha20Poly1305}
+
+func newCipher(t *testing.T, name, psk string) *Cipher {
+	c, err := NewCipher(name, []byte(psk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// wire is a conn over a recorded stream, sealed bytes are written to and read from it
+type wire struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (w *wire) Read(p []byte) (int, error) {
+	return w.Buffer.Read(p)
+}
+
+func (w *wire) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p)
+}
+
+// seal returns the wire bytes of writes sealed by a client
+func seal(t *testing.T, c *Cipher, writes ...string) []byte {
+	w := &wire{}
+	conn := c.Client(w)
+	for _, s := range writes {
+		if _, err := conn.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Bytes()
+}
+
+// open reads sealed bytes as a server until an error
+func open(c *Cipher, sealed []byte, filter *ReplayFilter) (string, error) {
+	w := &wire{}
+	w.Buffer.Write(sealed)
+	got, err := io.ReadAll(c.Server(w, filter))
+	return string(got), err
+}
+
+func loopback(t *testing.T) (a, b *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = s.SetDeadline(time.Now().Add(5 * time.Second))
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestConn(t *testing.T) {
+	// a chunk, a chunk and a byte, more than a batch of chunks
+	sizes := []int{1, MaxPayload, MaxPayload + 1, chunksPerWrite*MaxPayload + 1, 1 << 20}
+	for _, name := range ciphers {
+		t.Run(name, func(t *testing.T) {
+			c := newCipher(t, name, "0123456789abcdef")
+			a, b := loopback(t)
+			client, server := c.Client(a), c.Server(b, NewReplayFilter(16))
+
+			for _, size := range sizes {
+				data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+				for _, dir := range []struct {
+					name     string
+					from, to *Conn
+				}{{"up", client, server}, {"down", server, client}} {
+					go func() { _, _ = dir.from.Write(data) }()
+					got := make([]byte, size)
+					if _, err := io.ReadFull(dir.to, got); err != nil || !bytes.Equal(got, data) {
+						t.Fatalf("%s %d bytes, err=%v", dir.name, size, err)
+					}
+				}
+			}
+
+			// a FIN at a chunk boundary is a clean end
+			_ = client.CloseWrite()
+			if n, err := server.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Fatalf("got %d bytes, err=%v, want io.EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestSealed(t *testing.T) {
+	const secret = "GET /secret HTTP/1.1"
+	c := newCipher(t, ChaCha20Poly1305, "0123456789abcdef")
+	first, second := seal(t, c, secret), seal(t, c, secret)
+	if bytes.Contains(first, []byte("secret")) {
+		t.Fatal("plaintext is on the wire")
+	}
+	// salt, sealed length and sealed payload
+	if want := keySize + 2 + 16 + len(secret) + 16; len(first) != want {
+		t.Fatalf("got %d bytes on the wire, want %d", len(first), want)
+	}
+	if bytes.Equal(first[keySize:], second[keySize:]) {
+		t.Fatal("sessions are sealed by the same key")
+	}
+}
+
+func TestTamper(t *testing.T) {
+	const overhead = 16
+	c := newCipher(t, AES256GCM, "0123456789abcdef")
+	sealed := seal(t, c, "first", "second")
+	// offsets of the length and the payload of the first chunk
+	length, payload := keySize, keySize+2+overhead
+
+	cases := []struct {
+		name string
+		edit func(b []byte) []byte
+	}{
+		{name: "salt", edit: func(b []byte) []byte { b[0] ^= 1; return b }},
+		{name: "length", edit: func(b []byte) []byte { b[length] ^= 1; return b }},
+		{name: "length tag", edit: func(b []byte) []byte { b[length+2] ^= 1; return b }},
+		{name: "payload", edit: func(b []byte) []byte { b[payload] ^= 1; return b }},
+		{name: "payload tag", edit: func(b []byte) []byte { b[payload+len("first")] ^= 1; return b }},
+		{name: "second chunk", edit: func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		// chunks are bound to their position by the nonce
+		{name: "chunks swapped", edit: func(b []byte) []byte {
+			first := payload + len("first") + overhead
+			ret := append([]byte(nil), b[:keySize]...)
+			ret = append(ret, b[first:]...)
+			return append(ret, b[keySize:first]...)
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			edited := tc.edit(append([]byte(nil), sealed...))
+			if _, err := open(c, edited, nil); !errors.Is(err, ErrOpen) {
+				t.Fatalf("got %v, want %v", err, ErrOpen)
+			}
+		})
+	}
+
+	if got, err := open(c, sealed, nil); got != "firstsecond" || err != nil {
+		t.Fatalf("got %q, err=%v", got, err)
+	}
+	for _, other := range []*Cipher{newCipher(t, AES256GCM, "fedcba9876543210"), newCipher(t, ChaCha20Poly1305, "0123456789abcdef")} {
+		if _, err := open(other, sealed, nil); !errors.Is(err, ErrOpen) {
+			t.Fatalf("%s with another key got %v", other.Name(), err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	c := newCipher(t, ChaCha20Poly1305, "0123456789abcdef")
+	filter := NewReplayFilter(16)
+	sealed := seal(t, c, "hello")
+
+	if got, err := open(c, sealed, filter); got != "hello" || err != nil {
+		t.Fatalf("got %q, err=%v", got, err)
+	}
+	if _, err := open(c, sealed, filter); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay got %v, want %v", err, ErrReplay)
+	}
+	// the salt is remembered only once the first chunk is authenticated,
+	// so forged chunks after a salt seen on the wire don't get its session rejected
+	next := seal(t, c, "hello")
+	forged := append(append([]byte(nil), next[:keySize]...), bytes.Repeat([]byte{0}, len(next)-keySize)...)
+	if _, err := open(c, forged, filter); !errors.Is(err, ErrOpen) {
+		t.Fatalf("forged chunk got %v, want %v", err, ErrOpen)
+	}
+	if _, err := open(c, next[:keySize], filter); errors.Is(err, ErrReplay) {
+		t.Fatal("salt is remembered before its chunk is opened")
+	}
+	if got, err := open(c, next, filter); got != "hello" || err != nil {
+		t.Fatalf("new session got %q, err=%v", got, err)
+	}
+	if _, err := open(c, next, filter); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay got %v, want %v", err, ErrReplay)
+	}
+	// clients have no filter
+	if got, err := open(c, sealed, nil); got != "hello" || err != nil {
+		t.Fatalf("got %q, err=%v without filter", got, err)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter(2)
+	check := func(salt string) bool { return f.Check([]byte(salt)) }
+	steps := []struct {
+		salt string
+		ok   bool
+	}{
+		{"a", true}, {"b", true}, {"a", false},
+		// c rotates a and b into the previous generation, still remembered
+		{"c", true}, {"a", false}, {"b", false},
+		{"d", true},
+		// e drops a and b
+		{"e", true}, {"c", false}, {"a", true},
+	}
+	for i, s := range steps {
+		if got := check(s.salt); got != s.ok {
+			t.Fatalf("step %d: %s got %v, want %v", i, s.salt, got, s.ok)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	c := newCipher(t, AES256GCM, "0123456789abcdef")
+	sealed := seal(t, c, "first", "second")
+	chunk := 2 + 16 + len("first") + 16
+
+	cases := []struct {
+		name string
+		n    int
+		want string
+		err  error
+	}{
+		{name: "nothing", n: 0, err: nil},
+		{name: "in salt", n: keySize / 2, err: io.ErrUnexpectedEOF},
+		{name: "salt only", n: keySize},
+		{name: "in length", n: keySize + 10, err: io.ErrUnexpectedEOF},
+		{name: "length only", n: keySize + 2 + 16, err: io.ErrUnexpectedEOF},
+		{name: "in payload", n: keySize + chunk - 1, err: io.ErrUnexpectedEOF},
+		{name: "chunk boundary", n: keySize + chunk, want: "first"},
+		{name: "in second chunk", n: len(sealed) - 1, want: "first", err: io.ErrUnexpectedEOF},
+		{name: "whole", n: len(sealed), want: "firstsecond"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := open(c, sealed[:tc.n], nil)
+			if got != tc.want || !errors.Is(err, tc.err) {
+				t.Fatalf("got %q, err=%v, want %q, err=%v", got, err, tc.want, tc.err)
+			}
+		})
+	}
+}
+
+func TestNewCipher(t *testing.T) {
+	cases := []struct {
+		name, psk string
+		ok        bool
+	}{
+		{name: AES256GCM, psk: "0123456789abcdef", ok: true},
+		{name: ChaCha20Poly1305, psk: "0123456789abcdef", ok: true},
+		{name: "rc4-md5", psk: "0123456789abcdef"},
+		{name: AES256GCM, psk: "short"},
+	}
+	for _, c := range cases {
+		if _, err := NewCipher(c.name, []byte(c.psk)); (err == nil) != c.ok {
+			t.Errorf("%s with %d bytes key got err=%v", c.name, len(c.psk), err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package aead
+
+import "sync"
+
+// ReplayFilter remembers recent salts in two generations, the older one is dropped
+// once the newer one is full. Salts older than that are forgotten, as well as all of them on restart.
+type ReplayFilter struct {
+	mu       sync.Mutex
+	capacity int
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+// NewReplayFilter remembers between capacity and 2*capacity salts
+func NewReplayFilter(capacity int) *ReplayFilter {
+	return &ReplayFilter{
+		capacity: capacity,
+		current:  make(map[string]struct{}, capacity),
+	}
+}
+
+// Check adds salt, false if it has been seen
+func (f *ReplayFilter) Check(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(salt)
+	if _, ok := f.current[key]; ok {
+		return false
+	}
+	if _, ok := f.previous[key]; ok {
+		return false
+	}
+	if len(f.current) >= f.capacity {
+		f.previous, f.current = f.current, make(map[string]struct{}, f.capacity)
+	}
+	f.current[key] = struct{}{}
+	return true
+}
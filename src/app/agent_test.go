@@ -0,0 +1,166 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"socks5-proxy/src/auth"
+	"socks5-proxy/src/client"
+	"socks5-proxy/src/config"
+	"socks5-proxy/src/socks5"
+)
+
+// serve starts every server of a on the listeners it creates, returns their addresses
+func serve(t *testing.T, a *App) []string {
+	var addrs []string
+	for _, s := range a.servers {
+		ln, err := s.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = s.Serve(ln) }()
+		addrs = append(addrs, ln.Addr().String())
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, s := range a.servers {
+			_ = s.Shutdown(ctx)
+		}
+	})
+	return addrs
+}
+
+// echoTarget echoes every connection until closed
+func echoTarget(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestAgentUserLimits(t *testing.T) {
+	remote := config.Default(config.ModeRemote)
+	remote.Listeners = []config.Listener{{Address: "127.0.0.1:0"}}
+	r, err := New(remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serve(t, r)[0]
+
+	// alice may only reach loopback
+	hash, err := auth.HashBcrypt("secret", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(users, []byte("alice:"+hash+":allow=127.0.0.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default(config.ModeAgent)
+	cfg.Listeners = []config.Listener{{Address: "127.0.0.1:0"}}
+	cfg.Server.Address = server
+	cfg.Auth.Methods = []string{config.AuthPassword}
+	cfg.Auth.Users = users
+	cfg.Admission.MaxSessionsPerUser = 1
+	// neither acl nor routing is configured
+	if parseLocally(config.Default(config.ModeAgent)) {
+		t.Fatal("default agent parses commands")
+	}
+	a, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := client.NewDialer(serve(t, a)[0])
+	d.Username, d.Password = "alice", "secret"
+	d.HandshakeTimeout = 5 * time.Second
+
+	// the destination is checked by the agent before the server is asked
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:80"); !errors.Is(err, socks5.ReplyError(socks5.ConnectionNotAllowed)) {
+		t.Fatalf("alice got %v for a disallowed destination, want connection not allowed", err)
+	}
+
+	target := echoTarget(t)
+	conn, err := d.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q through agent and server, err=%v", got, err)
+	}
+
+	// sessions of alice are capped while the first one is open
+	if _, err := d.DialContext(context.Background(), "tcp", target); !errors.Is(err, socks5.ReplyError(socks5.ConnectionNotAllowed)) {
+		t.Fatalf("second session of alice got %v, want connection not allowed", err)
+	}
+}
+
+func TestRemoteChargesAgents(t *testing.T) {
+	const perHour = 64 << 10
+	remote := config.Default(config.ModeRemote)
+	remote.Listeners = []config.Listener{{Address: "127.0.0.1:0", Compression: []string{"zstd"}}}
+	remote.Quota.PerHour = perHour
+	remote.Quota.Charge = config.ChargeWire
+	r, err := New(remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default(config.ModeAgent)
+	cfg.Listeners = []config.Listener{{Address: "127.0.0.1:0"}}
+	cfg.Server.Address = serve(t, r)[0]
+	cfg.Server.Compression = "zstd"
+	a, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := client.NewDialer(serve(t, a)[0])
+	d.HandshakeTimeout = 5 * time.Second
+	conn, err := d.DialContext(context.Background(), "tcp", echoTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// random bytes don't compress, the wire of the agent's stream runs out of the server's quota
+	data := make([]byte, 16*perHour)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = conn.Write(data) }()
+	n, err := io.ReadFull(conn, make([]byte, len(data)))
+	var timeout net.Error
+	if err == nil || errors.As(err, &timeout) && timeout.Timeout() {
+		t.Fatalf("%d bytes of %d quota are echoed, err=%v", n, perHour, err)
+	}
+}
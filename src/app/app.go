@@ -0,0 +1,540 @@
+// Package app assembles s5server and s5agent from config.
+package app
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/admin"
+	"socks5-proxy/src/aead"
+	"socks5-proxy/src/auth"
+	"socks5-proxy/src/compress"
+	"socks5-proxy/src/config"
+	"socks5-proxy/src/protocol"
+	"socks5-proxy/src/proxyproto"
+	"socks5-proxy/src/route"
+)
+
+var (
+	authMethods = map[string]byte{
+		config.AuthNone:     protocol.NoAuthenticationRequired,
+		config.AuthPassword: protocol.UsernamePassword,
+	}
+	commands = map[string]byte{
+		config.CommandConnect: protocol.Connect,
+	}
+)
+
+// LoadFunc reads and validates the config, used for reloading
+type LoadFunc func() (*config.Config, error)
+
+type App struct {
+	cfg     *config.Config
+	load    LoadFunc
+	mngr    src.ConnMngr
+	admit   *src.AdmissionMngr
+	lockout *src.LockoutMngr
+	events  *src.Bus
+	access  atomic.Bool
+	servers []*src.TcpServer
+	// quic servers serve the udp socket inherited on upgrade
+	listenPacket map[*src.TcpServer]func(net.PacketConn) (net.Listener, error)
+	admin        *admin.Server
+	// admin listener, passed to the new process on upgrade
+	adminListener net.Listener
+
+	// sources of client listeners and of remote listeners serving agents
+	sources      *src.SourceFilter
+	agentSources *src.SourceFilter
+	// salts of sealed agent streams, nil if no listener has a cipher
+	replay *aead.ReplayFilter
+
+	// nil if the password method is not enabled
+	authenticator auth.Authenticator
+	limiter       *auth.Limiter
+
+	// swapped on reload, nil if commands are not parsed locally
+	acl    *route.ACL
+	router *route.Router
+	mu     sync.Mutex
+}
+
+func New(cfg *config.Config, load LoadFunc) (*App, error) {
+	a := &App{cfg: cfg, load: load, listenPacket: map[*src.TcpServer]func(net.PacketConn) (net.Listener, error){}}
+
+	// servers charge agents' streams too, the wire bytes of compressed ones included
+	a.mngr = src.NewConnQuotaMngr(mngrOptions(cfg))
+
+	a.admit = src.NewAdmissionMngr(admissionOptions(cfg.Admission))
+	a.lockout = src.NewLockoutMngr(lockoutOptions(cfg.Lockout))
+	clients, agents, err := buildSources(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.sources, a.agentSources = src.NewSourceFilter(clients), src.NewSourceFilter(agents)
+	if len(cfg.Sources.Allow) == 0 && cfg.Sources.AllowFile == "" && noAuth(cfg) {
+		logrus.Warning("authentication is disabled, only loopback and private sources are allowed unless sources.allow is set")
+	}
+	if err := a.setupAuth(cfg.Auth); err != nil {
+		return nil, err
+	}
+
+	a.events = src.NewBus()
+	a.access.Store(cfg.Log.Access)
+	src.Subscribe(a.events, a.accessLog)
+
+	trusted, err := proxyproto.ParseTrusted(cfg.ProxyProtocol.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	policy := &proxyproto.Policy{Trusted: trusted, HeaderTimeout: time.Duration(cfg.ProxyProtocol.HeaderTimeout)}
+
+	for _, l := range cfg.Listeners {
+		perm, err := l.FileMode()
+		if err != nil {
+			return nil, err
+		}
+		network := l.NetworkOrDefault()
+		if l.QUIC() {
+			network = strings.Replace(network, "tcp", "udp", 1)
+		}
+		s := src.NewTcpServer(&src.ListenAddr{Net: network, Addr: l.Address, Perm: perm})
+		if l.QUIC() {
+			listen, err := quicListen(network, l)
+			if err != nil {
+				return nil, err
+			}
+			s.SetListen(func() (net.Listener, error) { return listen(nil) })
+			a.listenPacket[s] = listen
+		}
+		if l.WebSocket() {
+			wrap, err := webSocketListener(l, policy)
+			if err != nil {
+				return nil, err
+			}
+			s.WrapListener(wrap)
+		}
+		wrap, err := a.connWrapper(l, policy)
+		if err != nil {
+			return nil, err
+		}
+		s.WrapConn(wrap)
+		s.SetAdmission(a.admit)
+		if l.ModeOr(cfg.Mode) == config.ModeRemote {
+			s.SetSourceFilter(a.agentSources)
+		} else {
+			s.SetSourceFilter(a.sources)
+		}
+		s.SetEvents(a.events)
+		s.SetRelisten(l.Relisten)
+		s.Use(src.RecoveryHandler())
+		s.Use(protocol.Lockout(a.lockout))
+		if err := a.registerMiddlewares(s, l); err != nil {
+			return nil, err
+		}
+		s.SetFinalHandler(a.mngr.PipeHandler())
+		a.servers = append(a.servers, s)
+	}
+
+	if cfg.Admin.Listen != "" {
+		a.admin = admin.NewServer(cfg.Admin.Listen)
+		a.admin.HandleFunc("/reload", a.serveReload)
+		a.admin.Handle("/connections", admin.NewRegistry(a.events))
+		a.admin.Handle("/bans", admin.NewBanlist(a.lockout))
+		expvar.Publish("active", expvar.Func(func() any {
+			return a.mngr.Active()
+		}))
+		expvar.Publish("admission", a.admit.Stats())
+		expvar.Publish("lockout", a.lockout.Stats())
+		expvar.Publish("events", eventStats(a.events))
+		expvar.Publish("compression", compress.Stats())
+		publishQUIC()
+		accept := expvar.NewMap("accept")
+		for _, s := range a.servers {
+			accept.Set(s.Addr().String(), s.Stats())
+		}
+	}
+	return a, nil
+}
+
+func (a *App) registerMiddlewares(s *src.TcpServer, l config.Listener) error {
+	cfg := a.cfg
+
+	switch l.ModeOr(cfg.Mode) {
+	case config.ModeLocal:
+		logrus.Infof("%s is running in local mode", s.Addr())
+		s.Use(protocol.AuthMethodNegotiation(bytesOf(cfg.Auth.Methods, authMethods)), protocol.Auth(a.authenticator, a.lockout))
+	case config.ModeRemote:
+		logrus.Infof("%s is running in remote mode", s.Addr())
+		s.Use(protocol.ServerSayHello(a.lockout, compressions(l.Compression)))
+	case config.ModeAgent:
+		logrus.Infof("%s is running in agent mode", s.Addr())
+		s.Use(protocol.AuthMethodNegotiation(bytesOf(cfg.Auth.Methods, authMethods)), protocol.Auth(a.authenticator, a.lockout))
+
+		if !parseLocally(cfg) {
+			// commands are parsed by the socks server
+			serverAddr, serverDialer, err := a.serverDialer(cfg)
+			if err != nil {
+				return err
+			}
+			s.Use(protocol.ClientSayHello(serverDialer, serverAddr, helloOptions(cfg.Server)))
+			return nil
+		}
+	}
+
+	// acl and router are shared by all listeners
+	if a.router == nil {
+		acl, router, err := a.buildPolicies(cfg)
+		if err != nil {
+			return err
+		}
+		a.acl, a.router = acl, router
+	}
+
+	s.Use(
+		protocol.CommandNegotiation(bytesOf(cfg.Auth.Commands, commands)),
+		protocol.UserAdmission(a.admit),
+		protocol.UserPolicy(a.limiter),
+		protocol.ACL(a.acl),
+		protocol.Route(a.router),
+		protocol.Command(a.mngr.Dialer()),
+	)
+	switch cfg.ProxyProtocol.Send {
+	case "v1":
+		s.Use(protocol.SendProxyHeader(proxyproto.V1))
+	case "v2":
+		s.Use(protocol.SendProxyHeader(proxyproto.V2))
+	}
+	return nil
+}
+
+// setupAuth opens the user store if the password method is enabled, it's swapped on reload
+func (a *App) setupAuth(cfg config.Auth) error {
+	a.limiter = auth.NewLimiter()
+	authenticator, err := buildAuthenticator(cfg)
+	if err != nil {
+		return err
+	}
+	if authenticator != nil {
+		a.authenticator = auth.NewSwap(authenticator)
+	}
+	return nil
+}
+
+// buildAuthenticator chains the configured user stores, nil if the password method is disabled
+func buildAuthenticator(cfg config.Auth) (auth.Authenticator, error) {
+	password := false
+	for _, m := range cfg.Methods {
+		password = password || m == config.AuthPassword
+	}
+	if !password {
+		return nil, nil
+	}
+
+	// tokens are checked offline first, users of the file take precedence over ldap
+	var chain auth.Chain
+	fail := func(err error) (auth.Authenticator, error) {
+		_ = chain.Close()
+		return nil, err
+	}
+	if t := cfg.Tokens; len(t.Keys) > 0 {
+		keys := make([]*auth.TokenKey, 0, len(t.Keys))
+		for _, k := range t.Keys {
+			material, err := os.ReadFile(k.File)
+			if err != nil {
+				return fail(fmt.Errorf("fail to read token key, err=%w", err))
+			}
+			key, err := auth.ParseTokenKey(k.ID, k.Algorithm, material)
+			if err != nil {
+				return fail(err)
+			}
+			keys = append(keys, key)
+		}
+		chain = append(chain, auth.NewTokens(keys, time.Duration(t.Leeway)))
+	}
+	if cfg.Users != "" {
+		users, err := auth.OpenHtpasswd(cfg.Users)
+		if err != nil {
+			return fail(err)
+		}
+		chain = append(chain, users)
+	}
+	if l := cfg.LDAP; l.URL != "" {
+		directory, err := auth.NewLDAP(auth.LDAPOptions{
+			URL:            l.URL,
+			StartTLS:       l.StartTLS,
+			BindDN:         l.BindDN,
+			BindPassword:   l.BindPassword,
+			BaseDN:         l.BaseDN,
+			UserFilter:     l.UserFilter,
+			GroupAttribute: l.GroupAttribute,
+			Roles:          l.Roles,
+			CacheTTL:       time.Duration(l.CacheTTL),
+			Timeout:        time.Duration(l.Timeout),
+		})
+		if err != nil {
+			return fail(err)
+		}
+		chain = append(chain, directory)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// buildPolicies creates acl and router for the parsed commands of new connections
+func (a *App) buildPolicies(cfg *config.Config) (*route.ACL, *route.Router, error) {
+	dialer := a.mngr.Dialer()
+	if cfg.Routing.Upstream != "" {
+		var err error
+		if dialer, err = protocol.ParseChain(dialer, cfg.Routing.Upstream); err != nil {
+			return nil, nil, fmt.Errorf("fail to parse upstream proxies, err=%w", err)
+		}
+	}
+	factory := protocol.Outbounds(dialer)
+	def := route.NewOutbound("direct", dialer)
+
+	if cfg.Mode == config.ModeAgent {
+		serverAddr, serverDialer, err := a.serverDialer(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		hello := helloOptions(cfg.Server)
+		factory = agentOutbounds(factory, serverDialer, serverAddr, hello)
+		def = route.NewOutbound("server", protocol.RemoteDialer(serverDialer, serverAddr, hello))
+	}
+
+	acl, err := buildACL(cfg.ACL)
+	if err != nil {
+		return nil, nil, err
+	}
+	router, err := buildRouter(cfg.Routing, factory, def)
+	if err != nil {
+		return nil, nil, err
+	}
+	return acl, router, nil
+}
+
+func (a *App) serverDialer(cfg *config.Config) (net.Addr, src.Dialer, error) {
+	serverAddr, err := net.ResolveTCPAddr("tcp", cfg.Server.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to parse socks server address, err=%w", err)
+	}
+	dialer := a.mngr.Dialer()
+	if cfg.Server.QUIC() {
+		if dialer, err = quicDialer(cfg.Server); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cfg.Server.Upstream != "" {
+		if dialer, err = protocol.ParseChain(dialer, cfg.Server.Upstream); err != nil {
+			return nil, nil, fmt.Errorf("fail to parse upstream proxies, err=%w", err)
+		}
+	}
+	if cfg.Server.WebSocket() {
+		if dialer, err = webSocketDialer(cfg.Server, dialer); err != nil {
+			return nil, nil, err
+		}
+	}
+	c, err := loadCipher(cfg.Server.Cipher, cfg.Server.PSKFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c != nil {
+		dialer = protocol.SealedDialer(dialer, c)
+	}
+	return serverAddr, dialer, nil
+}
+
+// parseLocally reports whether agent should parse commands itself for acl, routing,
+// or per user limits, which need the target and the user authenticated by the agent
+func parseLocally(cfg *config.Config) bool {
+	r := cfg.Routing
+	return len(cfg.ACL.Rules) > 0 || cfg.ACL.Default != config.ActionAllow ||
+		r.RulesFile != "" || r.Default != "" || userLimited(cfg)
+}
+
+// userLimited reports whether users may be limited, by attributes of the password method or admission
+func userLimited(cfg *config.Config) bool {
+	for _, m := range cfg.Auth.Methods {
+		if m == config.AuthPassword {
+			return true
+		}
+	}
+	return cfg.Admission.MaxSessionsPerUser > 0
+}
+
+func mngrOptions(cfg *config.Config) src.MngrOptions {
+	return src.MngrOptions{
+		QuotaPerHour: int64(cfg.Quota.PerHour),
+		UpdateDur:    time.Duration(cfg.Quota.UpdateInterval),
+		DialTimeout:  time.Duration(cfg.Quota.DialTimeout),
+		AnalysisDur:  time.Duration(cfg.Quota.AnalysisInterval),
+		PipeLinger:   time.Duration(cfg.Pipe.Linger),
+		ChargeWire:   cfg.Quota.Charge == config.ChargeWire,
+	}
+}
+
+// helloOptions offers the compression of the agent to the server
+func helloOptions(cfg config.Server) protocol.HelloOptions {
+	alg, _ := compress.Parse(cfg.Compression)
+	return protocol.HelloOptions{Compression: alg, Adaptive: cfg.AdaptiveCompression}
+}
+
+// compressions accepted from agents
+func compressions(names []string) []byte {
+	ret := make([]byte, 0, len(names))
+	for _, name := range names {
+		if alg, ok := compress.Parse(name); ok {
+			ret = append(ret, alg)
+		}
+	}
+	return ret
+}
+
+func admissionOptions(cfg config.Admission) src.AdmissionOptions {
+	return src.AdmissionOptions{
+		MaxSessions:         cfg.MaxSessions,
+		MaxSessionsPerIP:    cfg.MaxSessionsPerIP,
+		MaxSessionsPerUser:  cfg.MaxSessionsPerUser,
+		NewConnsPerSecPerIP: cfg.NewConnsPerSecPerIP,
+	}
+}
+
+func lockoutOptions(cfg config.Lockout) src.LockoutOptions {
+	return src.LockoutOptions{
+		MaxFailures: cfg.MaxFailures,
+		Window:      time.Duration(cfg.Window),
+		Duration:    time.Duration(cfg.Duration),
+		MaxDuration: time.Duration(cfg.MaxDuration),
+		Tarpit:      time.Duration(cfg.Tarpit),
+	}
+}
+
+func agentOutbounds(factory route.DialerFactory, serverDialer src.Dialer, serverAddr net.Addr, hello protocol.HelloOptions) route.DialerFactory {
+	return func(kind string, args []string, forward src.Dialer) (src.Dialer, error) {
+		if kind == "server" {
+			if forward == nil {
+				forward = serverDialer
+			}
+			return protocol.RemoteDialer(forward, serverAddr, hello), nil
+		}
+		return factory(kind, args, forward)
+	}
+}
+
+func buildACL(cfg config.ACL) (*route.ACL, error) {
+	acl := route.NewACL(cfg.Default == config.ActionAllow)
+	for _, rule := range cfg.Rules {
+		var all route.All
+		if len(rule.Domains) > 0 {
+			all = append(all, route.DomainSuffix(rule.Domains))
+		}
+		if len(rule.CIDRs) > 0 {
+			m, err := route.ParseCIDR(rule.CIDRs)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, m)
+		}
+		if len(rule.Ports) > 0 {
+			m, err := route.ParsePort(rule.Ports)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, m)
+		}
+		if len(rule.Users) > 0 {
+			all = append(all, route.User(rule.Users))
+		}
+		if len(rule.Roles) > 0 {
+			all = append(all, route.Role(rule.Roles))
+		}
+		acl.Add(all, rule.Action == config.ActionAllow)
+	}
+	return acl, nil
+}
+
+// buildRouter routes everything to def if routing is not configured
+func buildRouter(cfg config.Routing, factory route.DialerFactory, def *route.Outbound) (*route.Router, error) {
+	if cfg.RulesFile != "" {
+		return route.LoadFile(cfg.RulesFile, factory)
+	}
+	if cfg.Default == "" {
+		return route.NewRouter(def), nil
+	}
+
+	b := route.NewBuilder(factory)
+	if cfg.GeoIP != "" {
+		if err := b.SetGeoIP(cfg.GeoIP); err != nil {
+			return nil, err
+		}
+	}
+	for _, out := range cfg.Outbounds {
+		if err := b.AddOutbound(out.Name, out.Kind, out.Args, out.Via); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range cfg.Rules {
+		if err := b.AddRule(rule.Type, rule.Values, rule.Outbound); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.SetDefault(cfg.Default); err != nil {
+		return nil, err
+	}
+	return b.Build()
+}
+
+func bytesOf(names []string, known map[string]byte) []byte {
+	ret := make([]byte, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, known[name])
+	}
+	return ret
+}
+
+// logFile is the current output of the standard logger, closed once replaced
+var logFile *os.File
+
+// SetupLogger configures the standard logger used by all components
+func SetupLogger(cfg config.Log) error {
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stderr
+	var f *os.File
+	if cfg.File != "" {
+		if f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("fail to open log file, err=%w", err)
+		}
+		out = f
+	}
+
+	logrus.SetLevel(level)
+	// SetOutput holds the lock of writes, so no entry goes to the closed file
+	logrus.SetOutput(out)
+	if logFile != nil {
+		_ = logFile.Close()
+	}
+	logFile = f
+	if cfg.Format == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src/config"
+)
+
+func TestSetupLoggerClosesReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Log{Level: "info", Format: "text", File: filepath.Join(dir, "first.log")}
+	if err := SetupLogger(cfg); err != nil {
+		t.Fatal(err)
+	}
+	first := logFile
+
+	cfg.File = filepath.Join(dir, "second.log")
+	if err := SetupLogger(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Write([]byte("x")); err == nil {
+		t.Fatal("replaced log file is left open")
+	}
+	logrus.Info("after reload")
+	if data, _ := os.ReadFile(cfg.File); len(data) == 0 {
+		t.Fatal("nothing is logged to the new file")
+	}
+
+	if err := SetupLogger(config.Log{Level: "info", Format: "text"}); err != nil {
+		t.Fatal(err)
+	}
+	if logFile != nil {
+		t.Fatal("log file is kept after switching to stderr")
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"expvar"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src"
+)
+
+// eventStats counts events by name, closed connections by reason, failed dials and piped bytes
+func eventStats(bus *src.Bus) *expvar.Map {
+	stats := new(expvar.Map).Init()
+	reasons := new(expvar.Map).Init()
+	stats.Set("closed_reasons", reasons)
+
+	bus.Subscribe(func(ctx *src.Context, e src.Event) {
+		stats.Add(e.Name(), 1)
+		switch e := e.(type) {
+		case src.DialFinished:
+			if e.Err != nil {
+				stats.Add("dial_errors", 1)
+			}
+		case src.Closed:
+			reasons.Add(e.Reason(), 1)
+			if e.Pipe != nil {
+				stats.Add("bytes_up", e.Pipe.Up.Bytes)
+				stats.Add("bytes_down", e.Pipe.Down.Bytes)
+			}
+		}
+	})
+	return stats
+}
+
+// accessLog writes a line per closed connection, carrying the id of the connection logger
+func (a *App) accessLog(ctx *src.Context, e src.Closed) {
+	if !a.access.Load() {
+		return
+	}
+
+	fields := logrus.Fields{
+		"component": "access",
+		"client":    ctx.ClientAddr().String(),
+		"duration":  e.Duration.String(),
+		"reason":    e.Reason(),
+	}
+	if ctx.Host != "" {
+		fields["target"] = ctx.TargetAddr()
+	}
+	if user, ok := src.Get(ctx, src.UserKey); ok {
+		fields["user"] = user
+	}
+	if out, ok := src.Get(ctx, src.OutboundKey); ok {
+		fields["outbound"] = out
+	}
+	if e.Pipe != nil {
+		fields["up"] = e.Pipe.Up.Bytes
+		fields["down"] = e.Pipe.Down.Bytes
+	}
+	ctx.Logger().WithFields(fields).Info("access")
+}
@@ -0,0 +1,52 @@
+//go:build quic
+
+package app
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/config"
+	"socks5-proxy/src/quic"
+)
+
+// quicListen accepts the streams of agents' QUIC connections on the udp socket inherited on upgrade,
+// or on a new one if it's nil, network is one of udp, udp4 and udp6
+func quicListen(network string, l config.Listener) (func(net.PacketConn) (net.Listener, error), error) {
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load certificate of %s, err=%w", l.Address, err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return func(udp net.PacketConn) (net.Listener, error) {
+		if udp != nil {
+			return quic.ListenPacket(udp, tlsConfig)
+		}
+		return quic.Listen(network, l.Address, tlsConfig)
+	}, nil
+}
+
+// quicDialer reaches the server in streams of one QUIC connection
+func quicDialer(cfg config.Server) (src.Dialer, error) {
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = cfg.Host
+	if tlsConfig.ServerName == "" {
+		// the resolved address is dialed, the name is kept for sni
+		host, _, err := net.SplitHostPort(cfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse socks server address, err=%w", err)
+		}
+		tlsConfig.ServerName = host
+	}
+	return quic.NewClient(cfg.Address, tlsConfig)
+}
+
+func publishQUIC() {
+	expvar.Publish("quic", quic.Stats())
+}
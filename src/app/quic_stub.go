@@ -0,0 +1,23 @@
+//go:build !quic
+
+package app
+
+import (
+	"errors"
+	"net"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/config"
+)
+
+var errNoQUIC = errors.New("quic transport is not built in, build with -tags quic")
+
+func quicListen(string, config.Listener) (func(net.PacketConn) (net.Listener, error), error) {
+	return nil, errNoQUIC
+}
+
+func quicDialer(config.Server) (src.Dialer, error) {
+	return nil, errNoQUIC
+}
+
+func publishQUIC() {}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src/auth"
+	"socks5-proxy/src/config"
+)
+
+var reloadLogger = logrus.WithField("component", "reload")
+
+// Reload re-reads the config and swaps acl, routing, authentication, quota, admission, lockout, sources
+// and logging (access log included) for new connections, established connections keep running.
+// The current config is kept if anything fails.
+func (a *App) Reload() ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cfg, err := a.load()
+	if err != nil {
+		reloadLogger.Errorf("fail to load config, keep the current one, err=%s", err.Error())
+		return nil, err
+	}
+
+	for _, field := range restartRequired(a.cfg, cfg) {
+		reloadLogger.Warningf("%s changed, restart required to take effect", field)
+	}
+	keepStatic(a.cfg, cfg)
+
+	// list files may change while the config doesn't
+	clients, agents, err := buildSources(cfg)
+	if err != nil {
+		reloadLogger.Errorf("fail to read sources, keep the current config, err=%s", err.Error())
+		return nil, err
+	}
+	diff := config.Diff(a.cfg, cfg)
+	if len(diff) == 0 && (!reflect.DeepEqual(clients, a.sources.Rules()) || !reflect.DeepEqual(agents, a.agentSources.Rules())) {
+		diff = append(diff, "sources: list files changed")
+	}
+	if len(diff) == 0 {
+		reloadLogger.Info("config not changed")
+		return diff, nil
+	}
+
+	// prepare everything before swapping, so a failure changes nothing
+	var policies func()
+	if a.router != nil {
+		acl, router, err := a.buildPolicies(cfg)
+		if err != nil {
+			reloadLogger.Errorf("fail to build policies, keep the current config, err=%s", err.Error())
+			return nil, err
+		}
+		policies = func() {
+			a.acl.Update(acl)
+			a.router.Update(router)
+		}
+	}
+	// the swap exists if the password method is enabled, which requires restart to change
+	swap, _ := a.authenticator.(*auth.Swap)
+	var authenticator auth.Authenticator
+	if swap != nil && !reflect.DeepEqual(cfg.Auth, a.cfg.Auth) {
+		if authenticator, err = buildAuthenticator(cfg.Auth); err != nil {
+			reloadLogger.Errorf("fail to build authenticator, keep the current config, err=%s", err.Error())
+			return nil, err
+		}
+	}
+	if cfg.Log != a.cfg.Log {
+		if err := SetupLogger(cfg.Log); err != nil {
+			if closer, ok := authenticator.(io.Closer); ok {
+				_ = closer.Close()
+			}
+			reloadLogger.Errorf("fail to setup logger, keep the current config, err=%s", err.Error())
+			return nil, err
+		}
+	}
+
+	if policies != nil {
+		policies()
+	}
+	if authenticator != nil {
+		swap.Update(authenticator)
+	}
+	a.mngr.UpdateOptions(mngrOptions(cfg))
+	a.admit.UpdateOptions(admissionOptions(cfg.Admission))
+	a.lockout.UpdateOptions(lockoutOptions(cfg.Lockout))
+	a.sources.Update(clients)
+	a.agentSources.Update(agents)
+	a.access.Store(cfg.Log.Access)
+	a.cfg = cfg
+
+	for _, line := range diff {
+		reloadLogger.Infof("changed %s", line)
+	}
+	reloadLogger.Info("config reloaded")
+	return diff, nil
+}
+
+func (a *App) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	diff, err := a.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(map[string][]string{"changed": diff})
+}
+
+// restartRequired lists changed fields which can't be swapped while serving
+func restartRequired(old, new *config.Config) []string {
+	var ret []string
+	if old.Mode != new.Mode {
+		ret = append(ret, "mode")
+	}
+	if !reflect.DeepEqual(old.Listeners, new.Listeners) {
+		ret = append(ret, "listeners")
+	}
+	if !reflect.DeepEqual(old.Auth.Methods, new.Auth.Methods) {
+		ret = append(ret, "auth.methods")
+	}
+	if !reflect.DeepEqual(old.Auth.Commands, new.Auth.Commands) {
+		ret = append(ret, "auth.commands")
+	}
+	if old.Admin != new.Admin {
+		ret = append(ret, "admin")
+	}
+	if !reflect.DeepEqual(old.ProxyProtocol, new.ProxyProtocol) {
+		ret = append(ret, "proxy_protocol")
+	}
+	if old.Mode == config.ModeAgent && parseLocally(old) != parseLocally(new) {
+		ret = append(ret, "acl/routing/user limits of agent")
+	}
+	if old.Mode == config.ModeAgent && !parseLocally(old) && old.Server != new.Server {
+		ret = append(ret, "server")
+	}
+	return ret
+}
+
+// keepStatic copies fields requiring restart from old, so they are reported until restarted
+func keepStatic(old, new *config.Config) {
+	new.Mode = old.Mode
+	new.Listeners = old.Listeners
+	new.Auth.Methods = old.Auth.Methods
+	new.Auth.Commands = old.Auth.Commands
+	new.Admin = old.Admin
+	new.ProxyProtocol = old.ProxyProtocol
+	if old.Mode == config.ModeAgent && !parseLocally(old) {
+		new.Server = old.Server
+		new.ACL = old.ACL
+		new.Routing = old.Routing
+	}
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/config"
+	"socks5-proxy/src/upgrade"
+)
+
+// Run serves until a listener fails, or a shutdown/upgrade signal is handled
+func (a *App) Run() error {
+	listeners, err := a.listen()
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, len(a.servers))
+	for i, s := range a.servers {
+		go func(s *src.TcpServer, l net.Listener) {
+			errCh <- s.Serve(l)
+		}(s, listeners[i])
+	}
+	if a.admin != nil {
+		go func() {
+			if err := a.admin.Serve(a.adminListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Errorf("admin server stopped, err=%s", err.Error())
+			}
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, append(upgradeSignals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)...)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case err := <-errCh:
+			a.shutdown(false)
+			return err
+		case sig := <-sigCh:
+			switch {
+			case sig == syscall.SIGHUP:
+				_, _ = a.Reload()
+			case isUpgradeSignal(sig):
+				if err := a.upgrade(); err != nil {
+					logrus.Errorf("fail to upgrade, keep serving, err=%s", err.Error())
+					continue
+				}
+				a.shutdown(true)
+				return nil
+			default:
+				logrus.Infof("receive %s, shutting down", sig)
+				a.shutdown(false)
+				return nil
+			}
+		}
+	}
+}
+
+// listen prefers listeners inherited from systemd or the previous process
+func (a *App) listen() ([]net.Listener, error) {
+	pool, err := upgrade.Inherit()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	var listeners []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		return nil, err
+	}
+
+	for _, s := range a.servers {
+		network, address := s.Addr().Network(), s.Addr().String()
+		l, ok := pool.Take(network, address)
+		if listen := a.listenPacket[s]; !ok && listen != nil {
+			// quic listeners are passed as their udp sockets
+			if udp, inherited := pool.TakePacket(network, address); inherited {
+				if l, err = listen(udp); err != nil {
+					return fail(err)
+				}
+				ok = true
+			}
+		}
+		if !ok {
+			if l, err = s.Listen(); err != nil {
+				return fail(err)
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	if a.admin != nil {
+		l, ok := pool.Take("tcp", a.admin.Addr())
+		if !ok {
+			if l, err = a.admin.Listen(); err != nil {
+				return fail(err)
+			}
+		}
+		a.adminListener = l
+	}
+
+	pool.Ready()
+	return listeners, nil
+}
+
+func (a *App) upgrade() error {
+	var listeners []net.Listener
+	for _, s := range a.servers {
+		if l := s.Listener(); l != nil {
+			listeners = append(listeners, l)
+		}
+	}
+	if a.adminListener != nil {
+		listeners = append(listeners, a.adminListener)
+	}
+
+	logrus.Infof("upgrading, pass %d listeners to the new process", len(listeners))
+	p, err := upgrade.Spawn(listeners, time.Duration(a.config().Shutdown.UpgradeTimeout))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("new process %d took over, draining connections", p.Pid)
+	return nil
+}
+
+// shutdown stops accepting and drains in-flight connections,
+// unix socket files are kept if they are served by the new process.
+// QUIC connections are closed instead, the new process reads their udp sockets.
+func (a *App) shutdown(upgraded bool) {
+	if upgraded {
+		for _, s := range a.servers {
+			switch l := s.Listener().(type) {
+			case *net.UnixListener:
+				l.SetUnlinkOnClose(false)
+			case interface{ SetDrainOnClose(bool) }:
+				l.SetDrainOnClose(false)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.config().Shutdown.DrainTimeout))
+	defer cancel()
+
+	if a.admin != nil {
+		_ = a.admin.Shutdown(ctx)
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range a.servers {
+		wg.Add(1)
+		go func(s *src.TcpServer) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logrus.Warningf("%s is not drained in time, remaining connections are cancelled, err=%s", s.Addr(), err.Error())
+			}
+		}(s)
+	}
+	wg.Wait()
+	logrus.Info("shutdown finished")
+}
+
+func (a *App) config() *config.Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
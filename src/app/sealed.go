@@ -0,0 +1,51 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+
+	"socks5-proxy/src/aead"
+	"socks5-proxy/src/config"
+	"socks5-proxy/src/proxyproto"
+)
+
+// salts of agents remembered by servers, 32 bytes each in two generations
+const replayFilterSize = 1 << 16
+
+// loadCipher reads the pre-shared key sealing the stream of agents, nil if no cipher is set
+func loadCipher(name, pskFile string) (*aead.Cipher, error) {
+	if name == "" {
+		return nil, nil
+	}
+	psk, err := os.ReadFile(pskFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read pre-shared key, err=%w", err)
+	}
+	return aead.NewCipher(name, bytes.TrimSpace(psk))
+}
+
+// connWrapper reads PROXY headers of tcp listeners before opening sealed streams, nil if neither is enabled
+func (a *App) connWrapper(l config.Listener, policy *proxyproto.Policy) (func(net.Conn) net.Conn, error) {
+	var proxy func(net.Conn) net.Conn
+	if l.ProxyProtocol && !l.WebSocket() {
+		proxy = policy.Wrap
+	}
+	c, err := loadCipher(l.Cipher, l.PSKFile)
+	if err != nil || c == nil {
+		return proxy, err
+	}
+
+	// shared by listeners, so a salt can't be replayed on another one
+	if a.replay == nil {
+		a.replay = aead.NewReplayFilter(replayFilterSize)
+	}
+	filter := a.replay
+	return func(conn net.Conn) net.Conn {
+		if proxy != nil {
+			conn = proxy(conn)
+		}
+		return c.Server(conn, filter)
+	}, nil
+}
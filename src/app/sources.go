@@ -0,0 +1,82 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/config"
+)
+
+// privateSources are allowed by default when clients may connect without authentication
+var privateSources = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// sourceRules merges inline lists with list files. Rules of client listeners fall back to
+// private ranges if the none auth method would otherwise make an open proxy, agents connecting
+// to remote listeners are authenticated by the secret key.
+func sourceRules(cfg *config.Config, clients bool) (src.SourceRules, error) {
+	allow, err := readSourceList(cfg.Sources.Allow, cfg.Sources.AllowFile)
+	if err != nil {
+		return src.SourceRules{}, err
+	}
+	deny, err := readSourceList(cfg.Sources.Deny, cfg.Sources.DenyFile)
+	if err != nil {
+		return src.SourceRules{}, err
+	}
+	if len(allow) == 0 && clients && noAuth(cfg) {
+		allow = privateSources
+	}
+
+	var rules src.SourceRules
+	if rules.Allow, err = src.ParsePrefixes(allow); err != nil {
+		return rules, err
+	}
+	if rules.Deny, err = src.ParsePrefixes(deny); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+func readSourceList(inline []string, path string) ([]string, error) {
+	if path == "" {
+		return inline, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read source list, err=%w", err)
+	}
+
+	ret := append([]string(nil), inline...)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret, nil
+}
+
+func noAuth(cfg *config.Config) bool {
+	for _, m := range cfg.Auth.Methods {
+		if m == config.AuthNone {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSources prepares rules of client listeners and of remote listeners serving agents
+func buildSources(cfg *config.Config) (clients, agents src.SourceRules, err error) {
+	if clients, err = sourceRules(cfg, true); err != nil {
+		return
+	}
+	agents, err = sourceRules(cfg, false)
+	return
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/config"
+)
+
+func TestSourceRules(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(list, []byte("# loopback clients\n127.0.0.1\n127.0.0.2/31   # .2 and .3\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		cfg     func(cfg *config.Config)
+		clients bool
+		// clients checked against the rules
+		allowed, dropped []string
+	}{
+		{name: "list file", cfg: func(cfg *config.Config) {
+			cfg.Sources.AllowFile = list
+			cfg.Sources.Deny = []string{"127.0.0.3"}
+		}, clients: true, allowed: []string{"127.0.0.1", "127.0.0.2"}, dropped: []string{"127.0.0.3", "127.0.0.4"}},
+		{name: "inline and file", cfg: func(cfg *config.Config) {
+			cfg.Sources.Allow = []string{"10.0.0.0/8"}
+			cfg.Sources.AllowFile = list
+		}, clients: true, allowed: []string{"10.1.2.3", "127.0.0.3"}, dropped: []string{"192.0.2.1"}},
+		{name: "private default without authentication", cfg: func(cfg *config.Config) {
+			cfg.Auth.Methods = []string{config.AuthNone}
+			cfg.Sources.Deny = []string{"127.0.0.3"}
+		}, clients: true, allowed: []string{"127.0.0.4", "192.168.1.1", "fd00::1"}, dropped: []string{"127.0.0.3", "192.0.2.1"}},
+		{name: "no default with authentication", cfg: func(cfg *config.Config) {
+			cfg.Auth.Methods = []string{config.AuthPassword}
+		}, clients: true, allowed: []string{"192.0.2.1"}},
+		// agents are authenticated by the secret key
+		{name: "no default for agents", cfg: func(cfg *config.Config) {
+			cfg.Auth.Methods = []string{config.AuthNone}
+		}, allowed: []string{"192.0.2.1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.Default(config.ModeLocal)
+			c.cfg(cfg)
+			rules, err := sourceRules(cfg, c.clients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := src.NewSourceFilter(rules)
+			for _, ip := range c.allowed {
+				if !f.Allowed(&net.TCPAddr{IP: net.ParseIP(ip)}) {
+					t.Errorf("%s is dropped", ip)
+				}
+			}
+			for _, ip := range c.dropped {
+				if f.Allowed(&net.TCPAddr{IP: net.ParseIP(ip)}) {
+					t.Errorf("%s is allowed", ip)
+				}
+			}
+		})
+	}
+
+	cfg := config.Default(config.ModeLocal)
+	cfg.Sources.AllowFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := sourceRules(cfg, true); err == nil {
+		t.Fatal("missing list file is ignored")
+	}
+	cfg.Sources.AllowFile = ""
+	cfg.Sources.Deny = []string{"localhost"}
+	if _, err := sourceRules(cfg, true); err == nil {
+		t.Fatal("illegal cidr is accepted")
+	}
+}
+
+func TestReloadRereadsSourceLists(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(list, []byte("127.0.0.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default(config.ModeLocal)
+	cfg.Sources.AllowFile = list
+	a, err := New(cfg, func() (*config.Config, error) { return cfg, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("127.0.0.4")}
+	if a.sources.Allowed(client) {
+		t.Fatal("client not listed is allowed")
+	}
+
+	// the config is unchanged, only the list file is
+	if err := os.WriteFile(list, []byte("127.0.0.1\n127.0.0.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := a.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) == 0 || !a.sources.Allowed(client) {
+		t.Fatalf("list file is not re-read, diff=%v", diff)
+	}
+}
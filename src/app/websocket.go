@@ -0,0 +1,84 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/config"
+	"socks5-proxy/src/protocol"
+	"socks5-proxy/src/proxyproto"
+	"socks5-proxy/src/websocket"
+)
+
+// webSocketListener accepts agents upgrading to websocket, PROXY headers come before http
+func webSocketListener(l config.Listener, policy *proxyproto.Policy) (func(net.Listener) net.Listener, error) {
+	var tlsConfig *tls.Config
+	if l.Transport == config.TransportWebSocketTLS {
+		cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load certificate of %s, err=%w", l.Address, err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return func(raw net.Listener) net.Listener {
+		if l.ProxyProtocol {
+			raw = &wrapConnListener{Listener: raw, wrap: policy.Wrap}
+		}
+		return websocket.NewListener(raw, l.PathOrDefault(), tlsConfig)
+	}, nil
+}
+
+type wrapConnListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+func (l *wrapConnListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(conn), nil
+}
+
+// webSocketDialer reaches the server in websocket through the dialer of upstream proxies
+func webSocketDialer(cfg config.Server, dialer src.Dialer) (src.Dialer, error) {
+	opts := protocol.WebSocketOptions{Host: cfg.Host, Path: cfg.PathOrDefault()}
+	if opts.Host == "" {
+		// the resolved address is dialed, the name is kept for Host and sni
+		opts.Host = cfg.Address
+	}
+	if cfg.Transport == config.TransportWebSocketTLS {
+		tlsConfig, err := serverTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return protocol.WebSocketDialer(dialer, opts), nil
+}
+
+// serverTLSConfig trusts the certificates in CAFile besides system ones
+func serverTLSConfig(cfg config.Server) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read ca file, err=%w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
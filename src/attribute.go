@@ -0,0 +1,76 @@
+package src
+
+import (
+	"net"
+)
+
+// Key identifies a typed attribute of Context. Keys are compared by identity,
+// so each package declares its own with NewKey and no two packages collide.
+type Key[T any] struct {
+	name string
+}
+
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+// ACLRule is the acl decision of a connection, Index is -1 if no rule matched and the default applied
+type ACLRule struct {
+	Index int
+	Allow bool
+}
+
+// well-known attributes set by the built-in handlers
+var (
+	// UserKey is the authenticated user, unset for anonymous connections
+	UserKey = NewKey[string]("user")
+	// RolesKey are the roles of the authenticated user
+	RolesKey = NewKey[[]string]("roles")
+	// ACLRuleKey is set by the acl handler
+	ACLRuleKey = NewKey[ACLRule]("acl rule")
+	// OutboundKey is the name of the outbound chosen by the route handler
+	OutboundKey = NewKey[string]("outbound")
+	// ResolvedIPKey is the peer ip of the target conn, that is the target itself for
+	// direct outbounds and the next proxy for chained ones
+	ResolvedIPKey = NewKey[net.IP]("resolved ip")
+	// QuotaKey is charged besides the global quota, e.g. the quota of the user
+	QuotaKey = NewKey[*QuotaMngr]("quota")
+)
+
+// Set stores an attribute of the connection, it's safe for concurrent use
+func Set[T any](c *Context, k *Key[T], v T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.attrs == nil {
+		c.attrs = make(map[any]any)
+	}
+	c.attrs[k] = v
+}
+
+// Get returns the attribute and whether it is set
+func Get[T any](c *Context, k *Key[T]) (T, bool) {
+	c.mu.Lock()
+	v, ok := c.attrs[k]
+	c.mu.Unlock()
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return v.(T), true
+}
+
+// Value makes the attributes visible to code holding only the context.Context,
+// e.g. ctx.Value(src.UserKey).(string) in a Dialer
+func (c *Context) Value(key any) any {
+	c.mu.Lock()
+	v, ok := c.attrs[key]
+	c.mu.Unlock()
+	if ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,291 @@
+// Package auth verifies credentials of rfc1929 username/password authentication
+// and enforces the limits of authenticated users.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/units"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/route"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrDisabled           = errors.New("account disabled")
+	ErrRateLimited        = errors.New("too many new connections of user")
+)
+
+// Authenticator checks credentials, rejections are ErrInvalidCredentials or ErrDisabled,
+// any other error means the backend failed
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*User, error)
+}
+
+// Chain tries authenticators in order, users rejected as invalid by one are passed to the next.
+// If all reject, the first rejection with details is returned, e.g. why a token is bad.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	ret := ErrInvalidCredentials
+	for _, a := range c {
+		u, err := a.Authenticate(ctx, username, password)
+		if !errors.Is(err, ErrInvalidCredentials) {
+			return u, err
+		}
+		if ret == ErrInvalidCredentials {
+			ret = err
+		}
+	}
+	return nil, ret
+}
+
+// Close stops the background work of the members
+func (c Chain) Close() error {
+	for _, a := range c {
+		if closer, ok := a.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+	return nil
+}
+
+// Swap passes logins to an authenticator which is replaced on reload,
+// logins in flight finish on the one they started with
+type Swap struct {
+	current atomic.Pointer[Authenticator]
+}
+
+func NewSwap(a Authenticator) *Swap {
+	s := &Swap{}
+	s.current.Store(&a)
+	return s
+}
+
+// Update replaces the authenticator, the replaced one is closed if it's an io.Closer
+func (s *Swap) Update(a Authenticator) {
+	old := s.current.Swap(&a)
+	if closer, ok := (*old).(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (s *Swap) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	return (*s.current.Load()).Authenticate(ctx, username, password)
+}
+
+// UserInfoKey is set on Context once authenticated, src.UserKey carries the name
+var UserInfoKey = src.NewKey[*User]("user info")
+
+// Attributes are per-user limits, zero means unlimited
+type Attributes struct {
+	// QuotaPerHour caps bytes of each direction per hour
+	QuotaPerHour units.Base2Bytes
+	// NewConnsPerSec limits new connections, bursts up to one second worth
+	NewConnsPerSec float64
+	// Allow limits destinations to domain suffixes, ips and cidrs, empty allows all.
+	// Like acl, cidrs only match ip targets and domains are never resolved.
+	Allow []string
+	// Roles are matched by acl rules, mapped from groups by ldap
+	Roles []string
+}
+
+// ParseAttributes parses comma separated key=value pairs, allow and role may be repeated
+//
+//	quota=10GiB,rate=5,allow=example.com,allow=10.0.0.0/8,role=admin
+func ParseAttributes(s string) (Attributes, error) {
+	var attrs Attributes
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		key, value, found := strings.Cut(kv, "=")
+		if !found {
+			return attrs, fmt.Errorf("illegal attribute %s", kv)
+		}
+		switch key {
+		case "quota":
+			n, err := units.ParseBase2Bytes(value)
+			if err != nil || n < 0 {
+				return attrs, fmt.Errorf("illegal quota %s", value)
+			}
+			attrs.QuotaPerHour = n
+		case "rate":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 {
+				return attrs, fmt.Errorf("illegal rate %s", value)
+			}
+			attrs.NewConnsPerSec = f
+		case "allow":
+			attrs.Allow = append(attrs.Allow, value)
+		case "role":
+			attrs.Roles = append(attrs.Roles, value)
+		default:
+			return attrs, fmt.Errorf("unknown attribute %s", key)
+		}
+	}
+	return attrs, nil
+}
+
+func (a Attributes) String() string {
+	var ret []string
+	if a.QuotaPerHour > 0 {
+		ret = append(ret, "quota="+a.QuotaPerHour.String())
+	}
+	if a.NewConnsPerSec > 0 {
+		ret = append(ret, "rate="+strconv.FormatFloat(a.NewConnsPerSec, 'f', -1, 64))
+	}
+	for _, v := range a.Allow {
+		ret = append(ret, "allow="+v)
+	}
+	for _, v := range a.Roles {
+		ret = append(ret, "role="+v)
+	}
+	return strings.Join(ret, ",")
+}
+
+// User is an authenticated user, shared by its connections
+type User struct {
+	Name  string
+	Attrs Attributes
+	// nil allows all destinations
+	allow route.Matcher
+}
+
+func NewUser(name string, attrs Attributes) (*User, error) {
+	u := &User{Name: name, Attrs: attrs}
+	if len(attrs.Allow) == 0 {
+		return u, nil
+	}
+
+	var domains route.DomainSuffix
+	var cidrs []string
+	for _, v := range attrs.Allow {
+		switch ip := net.ParseIP(v); {
+		case ip != nil && ip.To4() != nil:
+			cidrs = append(cidrs, v+"/32")
+		case ip != nil:
+			cidrs = append(cidrs, v+"/128")
+		case strings.Contains(v, "/"):
+			cidrs = append(cidrs, v)
+		default:
+			domains = append(domains, v)
+		}
+	}
+	cidr, err := route.ParseCIDR(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	u.allow = route.MatchFunc(func(ctx *src.Context) bool {
+		return domains.Match(ctx) || cidr.Match(ctx)
+	})
+	return u, nil
+}
+
+// Allowed reports whether the parsed target of ctx is an allowed destination
+func (u *User) Allowed(ctx *src.Context) bool {
+	return u.allow == nil || u.allow.Match(ctx)
+}
+
+const (
+	quotaRefillDur = time.Hour
+	// users without quota idle for this long are forgotten, quotas are kept
+	// as long-lived connections still charge them
+	limiterIdleDur = time.Hour
+)
+
+type userState struct {
+	tokens float64
+	last   time.Time
+	quota  *src.QuotaMngr
+	// refilled to the latest attributes of the user
+	perHour int64
+}
+
+// Limiter enforces connection rates and quotas of users, state is kept by user name
+// so it survives reloads of the user store
+type Limiter struct {
+	mu    sync.Mutex
+	users map[string]*userState
+}
+
+func NewLimiter() *Limiter {
+	l := &Limiter{users: make(map[string]*userState)}
+	go l.daemon()
+	return l
+}
+
+// Admit takes a token of the user, the returned quota is nil if the user has no quota
+func (l *Limiter) Admit(u *User) (*src.QuotaMngr, error) {
+	rate, perHour := u.Attrs.NewConnsPerSec, int64(u.Attrs.QuotaPerHour)
+	if rate <= 0 && perHour <= 0 {
+		return nil, nil
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st, ok := l.users[u.Name]
+	if !ok {
+		st = &userState{tokens: burstOf(rate), last: now}
+		l.users[u.Name] = st
+	}
+	if rate > 0 {
+		st.tokens += now.Sub(st.last).Seconds() * rate
+		if burst := burstOf(rate); st.tokens > burst {
+			st.tokens = burst
+		}
+		if st.tokens < 1 {
+			st.last = now
+			return nil, ErrRateLimited
+		}
+		st.tokens--
+	}
+	st.last = now
+
+	st.perHour = perHour
+	if perHour > 0 && st.quota == nil {
+		st.quota = src.NewQuotaMngr(perHour, perHour)
+	}
+	if perHour <= 0 {
+		return nil, nil
+	}
+	return st.quota, nil
+}
+
+// daemon refills quotas every hour and forgets idle users without quota
+func (l *Limiter) daemon() {
+	refillT := time.NewTicker(quotaRefillDur)
+	for {
+		<-refillT.C
+		now := time.Now()
+
+		l.mu.Lock()
+		for name, st := range l.users {
+			if st.quota != nil {
+				st.quota.Update(st.perHour, st.perHour)
+			} else if now.Sub(st.last) > limiterIdleDur {
+				delete(l.users, name)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func burstOf(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
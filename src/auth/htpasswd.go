@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var logger = logrus.WithField("component", "auth")
+
+const htpasswdPollDur = 2 * time.Second
+
+// Entry is a line of a htpasswd file, plain htpasswd files of bcrypt hashes are valid
+//
+//	name:hash[:attributes]
+//
+// A hash prefixed with ! is a disabled account, like a locked password of /etc/shadow.
+// Blank and comment lines are kept as entries without Name, so edits preserve them.
+type Entry struct {
+	Name     string
+	Hash     string
+	Disabled bool
+	Attrs    Attributes
+
+	raw string
+}
+
+func (e Entry) String() string {
+	if e.Name == "" {
+		return e.raw
+	}
+	hash := e.Hash
+	if e.Disabled {
+		hash = "!" + hash
+	}
+	line := e.Name + ":" + hash
+	if attrs := e.Attrs.String(); attrs != "" {
+		line += ":" + attrs
+	}
+	return line
+}
+
+func ParseHtpasswd(r io.Reader) ([]Entry, error) {
+	var ret []Entry
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			ret = append(ret, Entry{raw: line})
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: should be name:hash[:attributes]", lineNo)
+		}
+		e := Entry{Name: fields[0], Hash: fields[1]}
+		if names[e.Name] {
+			return nil, fmt.Errorf("line %d: duplicated user %s", lineNo, e.Name)
+		}
+		names[e.Name] = true
+		if strings.HasPrefix(e.Hash, "!") {
+			e.Disabled, e.Hash = true, e.Hash[1:]
+		}
+		if len(fields) == 3 {
+			attrs, err := ParseAttributes(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			e.Attrs = attrs
+		}
+		ret = append(ret, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("fail to read htpasswd, err=%w", err)
+	}
+	return ret, nil
+}
+
+func ReadHtpasswdFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open htpasswd, err=%w", err)
+	}
+	defer func() { _ = f.Close() }()
+	return ParseHtpasswd(f)
+}
+
+// EditHtpasswd rewrites the file with the entries returned by fn. Concurrent editors are kept out
+// by a lock file, and the new content is renamed over the old one, so the server never reads
+// a partial file. A missing file is created with mode 0600.
+func EditHtpasswd(path string, fn func(entries []Entry) ([]Entry, error)) error {
+	lock := path + ".lock"
+	l, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s is being edited, remove %s if it's stale", path, lock)
+	} else if err != nil {
+		return fmt.Errorf("fail to lock htpasswd, err=%w", err)
+	}
+	_ = l.Close()
+	defer func() { _ = os.Remove(lock) }()
+
+	var entries []Entry
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+		if entries, err = ReadHtpasswdFile(path); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("fail to stat htpasswd, err=%w", err)
+	}
+
+	if entries, err = fn(entries); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("fail to create temp file, err=%w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	w := bufio.NewWriter(tmp)
+	for _, e := range entries {
+		_, _ = w.WriteString(e.String() + "\n")
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("fail to write htpasswd, err=%w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("fail to replace htpasswd, err=%w", err)
+	}
+	return nil
+}
+
+type htUser struct {
+	hash     string
+	disabled bool
+	user     *User
+}
+
+// Htpasswd authenticates against a htpasswd file, which is reloaded once changed.
+// A reload failure keeps the users loaded before.
+type Htpasswd struct {
+	path  string
+	users atomic.Pointer[map[string]*htUser]
+	// size and mod time of the loaded file
+	fileMu  sync.Mutex
+	size    int64
+	modTime time.Time
+
+	// verified keeps a mac of the last accepted password and hash of every user,
+	// so the slow hash is computed once per user instead of once per connection
+	mu       sync.Mutex
+	macKey   []byte
+	verified map[string][]byte
+
+	done chan struct{}
+	once sync.Once
+}
+
+func OpenHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{
+		path:     path,
+		macKey:   make([]byte, 32),
+		verified: make(map[string][]byte),
+		done:     make(chan struct{}),
+	}
+	if _, err := rand.Read(h.macKey); err != nil {
+		return nil, fmt.Errorf("fail to generate mac key, err=%w", err)
+	}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	go h.watch()
+	return h, nil
+}
+
+// Reload is called by the watcher, it may also be called on demand
+func (h *Htpasswd) Reload() error {
+	h.fileMu.Lock()
+	defer h.fileMu.Unlock()
+	return h.reload()
+}
+
+func (h *Htpasswd) reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("fail to stat htpasswd, err=%w", err)
+	}
+	entries, err := ReadHtpasswdFile(h.path)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*htUser, len(entries))
+	for _, e := range entries {
+		if e.Name == "" {
+			continue
+		}
+		u, err := NewUser(e.Name, e.Attrs)
+		if err != nil {
+			return fmt.Errorf("illegal attributes of %s, err=%w", e.Name, err)
+		}
+		users[e.Name] = &htUser{hash: e.Hash, disabled: e.Disabled, user: u}
+	}
+	h.users.Store(&users)
+	h.size, h.modTime = info.Size(), info.ModTime()
+	logger.Infof("loaded %d users from %s", len(users), h.path)
+	return nil
+}
+
+// watch polls the file, the lock file and rename of EditHtpasswd make partial reads unlikely
+func (h *Htpasswd) watch() {
+	pollT := time.NewTicker(htpasswdPollDur)
+	defer pollT.Stop()
+	for {
+		select {
+		case <-pollT.C:
+		case <-h.done:
+			return
+		}
+		info, err := os.Stat(h.path)
+		if err != nil {
+			continue
+		}
+
+		h.fileMu.Lock()
+		if info.Size() != h.size || !info.ModTime().Equal(h.modTime) {
+			if err := h.reload(); err != nil {
+				logger.Errorf("fail to reload htpasswd, keep the loaded users, err=%s", err.Error())
+				// don't retry until the file changes again
+				h.size, h.modTime = info.Size(), info.ModTime()
+			}
+		}
+		h.fileMu.Unlock()
+	}
+}
+
+// Close stops watching the file, loaded users are still authenticated
+func (h *Htpasswd) Close() error {
+	h.once.Do(func() { close(h.done) })
+	return nil
+}
+
+func (h *Htpasswd) Authenticate(_ context.Context, username, password string) (*User, error) {
+	u, ok := (*h.users.Load())[username]
+	if !ok {
+		// spend the time of a real check, so existing names can't be told by timing
+		_, _ = Verify(dummyHash(), password)
+		return nil, ErrInvalidCredentials
+	}
+
+	mac := hmac.New(sha256.New, h.macKey)
+	mac.Write([]byte(u.hash + "\x00" + password))
+	sum := mac.Sum(nil)
+
+	h.mu.Lock()
+	cached := hmac.Equal(h.verified[username], sum)
+	h.mu.Unlock()
+	if !cached {
+		matched, err := Verify(u.hash, password)
+		if err != nil {
+			return nil, fmt.Errorf("fail to verify password of %s, err=%w", username, err)
+		}
+		if !matched {
+			return nil, ErrInvalidCredentials
+		}
+		h.mu.Lock()
+		h.verified[username] = sum
+		h.mu.Unlock()
+	}
+
+	if u.disabled {
+		return nil, ErrDisabled
+	}
+	return u.user, nil
+}
+
+var (
+	dummyOnce sync.Once
+	dummy     string
+)
+
+func dummyHash() string {
+	dummyOnce.Do(func() {
+		dummy, _ = HashBcrypt("dummy", bcrypt.DefaultCost)
+	})
+	return dummy
+}
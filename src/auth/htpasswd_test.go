@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"socks5-proxy/src"
+)
+
+// writeUsers creates a htpasswd file by EditHtpasswd, like s5server passwd does
+func writeUsers(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	err := EditHtpasswd(path, func([]Entry) ([]Entry, error) {
+		return ParseHtpasswd(strings.NewReader(strings.Join(lines, "\n")))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bcryptOf(t *testing.T, password string) string {
+	hash, err := HashBcrypt(password, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func argon2idOf(t *testing.T, password string) string {
+	hash, err := HashArgon2id(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func openUsers(t *testing.T, lines ...string) (*Htpasswd, string) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsers(t, path, lines...)
+	h, err := OpenHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h, path
+}
+
+func TestHtpasswd(t *testing.T) {
+	h, _ := openUsers(t,
+		"# test users",
+		"alice:"+bcryptOf(t, "secret1"),
+		"bob:"+argon2idOf(t, "secret2")+":allow=127.0.0.2,rate=1",
+		"carol:!"+bcryptOf(t, "secret3"),
+	)
+
+	cases := []struct {
+		name, username, password string
+		err                      error
+	}{
+		{name: "bcrypt", username: "alice", password: "secret1"},
+		{name: "cached", username: "alice", password: "secret1"},
+		{name: "wrong password after cached", username: "alice", password: "secret2", err: ErrInvalidCredentials},
+		{name: "argon2id", username: "bob", password: "secret2"},
+		{name: "wrong password", username: "bob", password: "nope", err: ErrInvalidCredentials},
+		{name: "empty password", username: "alice", password: "", err: ErrInvalidCredentials},
+		{name: "unknown user", username: "nobody", password: "secret1", err: ErrInvalidCredentials},
+		{name: "disabled", username: "carol", password: "secret3", err: ErrDisabled},
+		// the password of a disabled user is checked first, so a guess can't tell it's disabled
+		{name: "disabled wrong password", username: "carol", password: "nope", err: ErrInvalidCredentials},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u, err := h.Authenticate(context.Background(), c.username, c.password)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+			if c.err == nil && u.Name != c.username {
+				t.Fatalf("got user %s", u.Name)
+			}
+		})
+	}
+}
+
+func TestUserAllowed(t *testing.T) {
+	h, _ := openUsers(t,
+		"alice:"+bcryptOf(t, "secret1"),
+		"bob:"+bcryptOf(t, "secret2")+":allow=127.0.0.2,allow=example.com,allow=10.0.0.0/8",
+	)
+	alice, err := h.Authenticate(context.Background(), "alice", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := h.Authenticate(context.Background(), "bob", "secret2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host  string
+		alice bool
+		bob   bool
+	}{
+		{host: "127.0.0.2", alice: true, bob: true},
+		{host: "127.0.0.1", alice: true},
+		{host: "10.1.2.3", alice: true, bob: true},
+		{host: "www.example.com", alice: true, bob: true},
+		{host: "example.org", alice: true},
+	}
+	for _, c := range cases {
+		_, conn := net.Pipe()
+		ctx := src.NewContext(context.Background(), conn, nil)
+		ctx.Host = c.host
+		if got := alice.Allowed(ctx); got != c.alice {
+			t.Errorf("alice to %s allowed=%v, want %v", c.host, got, c.alice)
+		}
+		if got := bob.Allowed(ctx); got != c.bob {
+			t.Errorf("bob to %s allowed=%v, want %v", c.host, got, c.bob)
+		}
+		ctx.Release()
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter()
+	limited, err := NewUser("bob", Attributes{NewConnsPerSec: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Admit(limited); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Admit(limited); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want rate limited", err)
+	}
+
+	quoted, err := NewUser("alice", Attributes{QuotaPerHour: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota, err := l.Admit(quoted)
+	if err != nil || quota == nil {
+		t.Fatalf("got quota %v, err=%v", quota, err)
+	}
+	// connections of the user share the quota
+	if again, _ := l.Admit(quoted); again != quota {
+		t.Fatal("connections of a user are charged separately")
+	}
+	if !quota.TryWrite(1<<20) || quota.TryWrite(1) {
+		t.Fatal("quota is not cut at 1MiB")
+	}
+
+	unlimited, err := NewUser("carol", Attributes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota, err := l.Admit(unlimited); quota != nil || err != nil {
+		t.Fatalf("got quota %v, err=%v", quota, err)
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	h, path := openUsers(t, "alice:"+bcryptOf(t, "old"))
+	if _, err := h.Authenticate(context.Background(), "alice", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeUsers(t, path, "alice:"+bcryptOf(t, "new")+":quota=1MiB")
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Authenticate(context.Background(), "alice", "old"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("old password got %v after reload", err)
+	}
+	u, err := h.Authenticate(context.Background(), "alice", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Attrs.QuotaPerHour != 1<<20 {
+		t.Fatalf("got attributes %s", u.Attrs)
+	}
+
+	// a broken file keeps the loaded users
+	if err := os.WriteFile(path, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Fatal("broken file is loaded")
+	}
+	if _, err := h.Authenticate(context.Background(), "alice", "new"); err != nil {
+		t.Fatalf("loaded users are dropped, err=%v", err)
+	}
+}
+
+func TestHtpasswdWatch(t *testing.T) {
+	h, path := openUsers(t, "alice:"+bcryptOf(t, "secret1"))
+	writeUsers(t, path, "alice:"+bcryptOf(t, "secret1"), "bob:"+bcryptOf(t, "secret2"))
+
+	deadline := time.Now().Add(3 * htpasswdPollDur)
+	for {
+		if _, err := h.Authenticate(context.Background(), "bob", "secret2"); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("edited file is not picked up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestEditHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsers(t, path, "# managed by s5server passwd", "", "alice:"+bcryptOf(t, "secret1"))
+
+	err := EditHtpasswd(path, func(entries []Entry) ([]Entry, error) {
+		for i := range entries {
+			if entries[i].Name == "alice" {
+				entries[i].Disabled = true
+				entries[i].Attrs.Roles = []string{"admin"}
+			}
+		}
+		return entries, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].String() != "# managed by s5server passwd" || entries[1].String() != "" {
+		t.Fatalf("comments are not kept, got %v", entries)
+	}
+	if e := entries[2]; !e.Disabled || !strings.HasPrefix(e.String(), "alice:!$2y$") || !strings.HasSuffix(e.String(), ":role=admin") {
+		t.Fatalf("got %s", e)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("got mode %v, err=%v", info.Mode(), err)
+	}
+
+	// a concurrent editor is kept out
+	if err := os.WriteFile(path+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EditHtpasswd(path, func(e []Entry) ([]Entry, error) { return e, nil }); err == nil {
+		t.Fatal("edited while locked")
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{name: "plain htpasswd", data: "alice:$2y$05$abc\n", ok: true},
+		{name: "attributes", data: "alice:$2y$05$abc:quota=10GiB,rate=5,allow=example.com\n", ok: true},
+		{name: "no hash", data: "alice\n"},
+		{name: "no name", data: ":$2y$05$abc\n"},
+		{name: "duplicated", data: "alice:a\nalice:b\n"},
+		{name: "unknown attribute", data: "alice:a:color=red\n"},
+		{name: "illegal quota", data: "alice:a:quota=lots\n"},
+		{name: "negative rate", data: "alice:a:rate=-1\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ParseHtpasswd(strings.NewReader(c.data))
+			if (err == nil) != c.ok {
+				t.Fatalf("got err=%v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPOptions configures search+bind authentication:
+// the user entry is searched by the service account, then bound with the given password.
+type LDAPOptions struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL      string
+	StartTLS bool
+	// BindDN and BindPassword are the service account, searching anonymously if empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter has a %s for the escaped username, e.g. (uid=%s)
+	UserFilter string
+	// GroupAttribute of the user entry lists the DNs of its groups, e.g. memberOf
+	GroupAttribute string
+	// Roles maps group DNs to proxy roles, DNs are compared case insensitively
+	Roles map[string]string
+	// CacheTTL keeps successful logins, zero disables caching. Failures are never cached.
+	CacheTTL time.Duration
+	Timeout  time.Duration
+	// TLSConfig is used by ldaps and StartTLS, nil verifies against the system roots
+	TLSConfig *tls.Config
+}
+
+type ldapCached struct {
+	mac     []byte
+	user    *User
+	expires time.Time
+}
+
+// LDAP authenticates against a directory, every login not in cache takes a new connection
+type LDAP struct {
+	opts  LDAPOptions
+	roles map[string]string
+
+	mu     sync.Mutex
+	macKey []byte
+	cache  map[string]*ldapCached
+
+	done chan struct{}
+	once sync.Once
+}
+
+func NewLDAP(opts LDAPOptions) (*LDAP, error) {
+	l := &LDAP{
+		opts:   opts,
+		roles:  make(map[string]string, len(opts.Roles)),
+		macKey: make([]byte, 32),
+		cache:  make(map[string]*ldapCached),
+		done:   make(chan struct{}),
+	}
+	for dn, role := range opts.Roles {
+		l.roles[normalizeDN(dn)] = role
+	}
+	if _, err := rand.Read(l.macKey); err != nil {
+		return nil, fmt.Errorf("fail to generate mac key, err=%w", err)
+	}
+	if opts.CacheTTL > 0 {
+		go l.daemon()
+	}
+	return l, nil
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	// an empty password would be an unauthenticated bind, which succeeds on most servers
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	mac := hmac.New(sha256.New, l.macKey)
+	mac.Write([]byte(username + "\x00" + password))
+	sum := mac.Sum(nil)
+	if u := l.cached(username, sum); u != nil {
+		return u, nil
+	}
+
+	u, err := l.authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	if l.opts.CacheTTL > 0 {
+		l.mu.Lock()
+		l.cache[username] = &ldapCached{mac: sum, user: u, expires: time.Now().Add(l.opts.CacheTTL)}
+		l.mu.Unlock()
+	}
+	return u, nil
+}
+
+func (l *LDAP) cached(username string, sum []byte) *User {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.cache[username]
+	if !ok || time.Now().After(c.expires) || !hmac.Equal(c.mac, sum) {
+		return nil
+	}
+	return c.user
+}
+
+func (l *LDAP) authenticate(ctx context.Context, username, password string) (*User, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// go-ldap knows no context, closing the conn unblocks it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if l.opts.BindDN != "" {
+		if err := conn.Bind(l.opts.BindDN, l.opts.BindPassword); err != nil {
+			return nil, fmt.Errorf("fail to bind service account, err=%w", err)
+		}
+	}
+	req := ldap.NewSearchRequest(l.opts.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.opts.UserFilter, ldap.EscapeFilter(username)), []string{l.opts.GroupAttribute}, nil)
+	res, err := conn.Search(req)
+	if res == nil || (err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded)) {
+		return nil, fmt.Errorf("fail to search user, err=%w", err)
+	}
+	switch {
+	case len(res.Entries) == 0:
+		// like htpasswd, unknown users are invalid credentials
+		return nil, ErrInvalidCredentials
+	case len(res.Entries) > 1:
+		return nil, fmt.Errorf("user filter matched more than one entry of %s", username)
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to bind user, err=%w", err)
+	}
+
+	var attrs Attributes
+	for _, group := range entry.GetAttributeValues(l.opts.GroupAttribute) {
+		if role, ok := l.roles[normalizeDN(group)]; ok {
+			attrs.Roles = append(attrs.Roles, role)
+		}
+	}
+	return NewUser(username, attrs)
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	tlsConfig := l.opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		if u, err := url.Parse(l.opts.URL); err == nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = u.Hostname()
+		}
+	}
+
+	conn, err := ldap.DialURL(l.opts.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: l.opts.Timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect to ldap, err=%w", err)
+	}
+	conn.SetTimeout(l.opts.Timeout)
+	if l.opts.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("fail to start tls, err=%w", err)
+		}
+	}
+	return conn, nil
+}
+
+// Close stops sweeping the cache
+func (l *LDAP) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// daemon drops expired logins
+func (l *LDAP) daemon() {
+	sweepT := time.NewTicker(l.opts.CacheTTL)
+	defer sweepT.Stop()
+	for {
+		select {
+		case <-sweepT.C:
+		case <-l.done:
+			return
+		}
+		now := time.Now()
+		l.mu.Lock()
+		for name, c := range l.cache {
+			if now.After(c.expires) {
+				delete(l.cache, name)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// normalizeDN drops spaces around separators and case, enough to compare DNs written by hand
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		k, v, _ := strings.Cut(p, "=")
+		parts[i] = strings.TrimSpace(k) + "=" + strings.TrimSpace(v)
+	}
+	return strings.ToLower(strings.Join(parts, ","))
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"socks5-proxy/src/auth/ldaptest"
+)
+
+const (
+	svcDN   = "cn=svc,dc=example,dc=org"
+	adminDN = "cn=admins,ou=groups,dc=example,dc=org"
+	staffDN = "cn=staff,ou=groups,dc=example,dc=org"
+)
+
+// directory serves the stand-in on loopback until the test ends
+func directory(t *testing.T) *ldaptest.Server {
+	s, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: svcDN, Password: "svcpass"},
+		ldaptest.Entry{DN: "uid=alice,ou=people,dc=example,dc=org", Password: "secret1", Attrs: map[string][]string{
+			"uid": {"alice"}, "memberOf": {adminDN, staffDN},
+		}},
+		ldaptest.Entry{DN: "uid=bob,ou=people,dc=example,dc=org", Password: "secret2", Attrs: map[string][]string{
+			"uid": {"bob"}, "memberOf": {staffDN},
+		}},
+		ldaptest.Entry{DN: "uid=carol,ou=people,dc=example,dc=org", Password: "secret3", Attrs: map[string][]string{
+			"uid": {"carol"},
+		}},
+		ldaptest.Entry{DN: "uid=dave,ou=people,dc=example,dc=org", Password: "ldap1", Attrs: map[string][]string{
+			"uid": {"dave"},
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func newLDAP(t *testing.T, url string, ttl time.Duration) *LDAP {
+	l, err := NewLDAP(LDAPOptions{
+		URL:            url,
+		BindDN:         svcDN,
+		BindPassword:   "svcpass",
+		BaseDN:         "dc=example,dc=org",
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		// written by hand, compared normalized
+		Roles:    map[string]string{"CN=Admins, OU=Groups, DC=example, DC=org": "admin"},
+		CacheTTL: ttl,
+		Timeout:  5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func TestLDAP(t *testing.T) {
+	s := directory(t)
+	l := newLDAP(t, s.URL, 0)
+
+	cases := []struct {
+		name, username, password string
+		roles                    []string
+		err                      error
+		// binds of the service account and the user
+		binds int
+	}{
+		{name: "search and bind", username: "alice", password: "secret1", roles: []string{"admin"}, binds: 2},
+		{name: "unmapped group", username: "bob", password: "secret2", binds: 2},
+		{name: "no group", username: "carol", password: "secret3", binds: 2},
+		{name: "wrong password", username: "alice", password: "nope", err: ErrInvalidCredentials, binds: 2},
+		{name: "unknown user", username: "nobody", password: "secret1", err: ErrInvalidCredentials, binds: 1},
+		{name: "filter injection", username: "*", password: "secret1", err: ErrInvalidCredentials, binds: 1},
+		// an empty password is an unauthenticated bind, which most servers accept
+		{name: "empty password", username: "alice", password: "", err: ErrInvalidCredentials},
+		{name: "empty username", username: "", password: "secret1", err: ErrInvalidCredentials},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := s.Binds()
+			u, err := l.Authenticate(context.Background(), c.username, c.password)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+			if n := s.Binds() - before; n != c.binds {
+				t.Fatalf("got %d binds, want %d", n, c.binds)
+			}
+			if c.err != nil {
+				return
+			}
+			if u.Name != c.username || !reflect.DeepEqual(u.Attrs.Roles, c.roles) {
+				t.Fatalf("got %s with roles %v, want roles %v", u.Name, u.Attrs.Roles, c.roles)
+			}
+		})
+	}
+}
+
+func TestLDAPCache(t *testing.T) {
+	s := directory(t)
+	const ttl = 300 * time.Millisecond
+	l := newLDAP(t, s.URL, ttl)
+	login := func(password string) (int, error) {
+		before := s.Binds()
+		_, err := l.Authenticate(context.Background(), "alice", password)
+		return s.Binds() - before, err
+	}
+
+	if binds, err := login("secret1"); err != nil || binds != 2 {
+		t.Fatalf("first login got %d binds, err=%v", binds, err)
+	}
+	if binds, err := login("secret1"); err != nil || binds != 0 {
+		t.Fatalf("cached login got %d binds, err=%v", binds, err)
+	}
+	// only the cached password is served from cache, failures are never cached
+	for i := 0; i < 2; i++ {
+		if binds, err := login("nope"); !errors.Is(err, ErrInvalidCredentials) || binds != 2 {
+			t.Fatalf("wrong password got %d binds, err=%v", binds, err)
+		}
+	}
+
+	time.Sleep(ttl + 100*time.Millisecond)
+	if binds, err := login("secret1"); err != nil || binds != 2 {
+		t.Fatalf("login after ttl got %d binds, err=%v", binds, err)
+	}
+}
+
+func TestLDAPUnreachable(t *testing.T) {
+	s := directory(t)
+	url := s.URL
+	_ = s.Close()
+
+	l := newLDAP(t, url, time.Minute)
+	_, err := l.Authenticate(context.Background(), "alice", "secret1")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("got %v, want a backend failure", err)
+	}
+}
+
+func TestChainTriesHtpasswdFirst(t *testing.T) {
+	s := directory(t)
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsers(t, path, "dave:"+bcryptOf(t, "local1"))
+	users, err := OpenHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := Chain{users, newLDAP(t, s.URL, 0)}
+	defer chain.Close()
+
+	cases := []struct {
+		name, username, password string
+		binds                    int
+		err                      error
+	}{
+		{name: "htpasswd first", username: "dave", password: "local1"},
+		{name: "ldap fallback", username: "dave", password: "ldap1", binds: 2},
+		{name: "ldap only", username: "alice", password: "secret1", binds: 2},
+		{name: "rejected by both", username: "dave", password: "nope", binds: 2, err: ErrInvalidCredentials},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := s.Binds()
+			_, err := chain.Authenticate(context.Background(), c.username, c.password)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+			if n := s.Binds() - before; n != c.binds {
+				t.Fatalf("got %d binds, want %d", n, c.binds)
+			}
+		})
+	}
+}
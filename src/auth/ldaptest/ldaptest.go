@@ -0,0 +1,281 @@
+// Package ldaptest is an in-process LDAP stand-in, it serves simple binds and searches
+// of an in-memory directory, which is enough to exercise the ldap backend of auth.
+package ldaptest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+const (
+	appBindRequest     = 0
+	appBindResponse    = 1
+	appUnbindRequest   = 2
+	appSearchRequest   = 3
+	appSearchEntry     = 4
+	appSearchDone      = 5
+	appExtendedRequest = 23
+	appExtendedResp    = 24
+
+	filterAnd      = 0
+	filterOr       = 1
+	filterNot      = 2
+	filterEquality = 3
+	filterPresent  = 7
+
+	resultSuccess             = 0
+	resultProtocolError       = 2
+	resultSizeLimitExceeded   = 4
+	resultInvalidCredentials  = 49
+	resultUnwillingToPerform  = 53
+	authSimple                = 0
+	maxEntriesOfUnlimitedSize = 1000
+)
+
+// Entry of the directory, attribute names and values are matched case insensitively
+type Entry struct {
+	DN string
+	// Password of simple binds, entries without password can't bind
+	Password string
+	Attrs    map[string][]string
+}
+
+// Server serves the directory until Close
+type Server struct {
+	// URL is ldap://<listening address>
+	URL string
+
+	l       net.Listener
+	entries []Entry
+	binds   int64
+	wg      sync.WaitGroup
+}
+
+// NewServer serves entries on a random local port
+func NewServer(entries ...Entry) (*Server, error) {
+	return Listen("127.0.0.1:0", entries...)
+}
+
+func Listen(address string, entries ...Entry) (*Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("fail to listen, err=%w", err)
+	}
+	s := &Server{URL: "ldap://" + l.Addr().String(), l: l, entries: entries}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Binds counts bind requests, e.g. to check whether a login was served from cache
+func (s *Server) Binds() int {
+	return int(atomic.LoadInt64(&s.binds))
+}
+
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(req.Children) < 2 {
+			return
+		}
+		id, _ := req.Children[0].Value.(int64)
+		op := req.Children[1]
+
+		var resp []*ber.Packet
+		switch op.Tag {
+		case appBindRequest:
+			resp = []*ber.Packet{s.bind(op)}
+		case appSearchRequest:
+			resp = s.search(op)
+		case appUnbindRequest:
+			return
+		case appExtendedRequest:
+			// e.g. StartTLS
+			resp = []*ber.Packet{result(appExtendedResp, resultUnwillingToPerform, "extended operations are not supported")}
+		default:
+			return
+		}
+		for _, p := range resp {
+			if _, err := conn.Write(message(id, p).Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) bind(op *ber.Packet) *ber.Packet {
+	atomic.AddInt64(&s.binds, 1)
+	if len(op.Children) < 3 || op.Children[2].Tag != authSimple {
+		return result(appBindResponse, resultProtocolError, "only simple bind is supported")
+	}
+	dn, password := str(op.Children[1]), str(op.Children[2])
+	if dn == "" && password == "" {
+		return result(appBindResponse, resultSuccess, "")
+	}
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) && e.Password != "" && e.Password == password {
+			return result(appBindResponse, resultSuccess, "")
+		}
+	}
+	return result(appBindResponse, resultInvalidCredentials, "invalid credentials")
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{result(appSearchDone, resultProtocolError, "malformed search request")}
+	}
+	base := strings.ToLower(str(op.Children[0]))
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	if sizeLimit == 0 {
+		sizeLimit = maxEntriesOfUnlimitedSize
+	}
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		attrs = append(attrs, str(a))
+	}
+
+	var ret []*ber.Packet
+	for _, e := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(e.DN), base) {
+			continue
+		}
+		matched, err := match(filter, e)
+		if err != nil {
+			return []*ber.Packet{result(appSearchDone, resultProtocolError, err.Error())}
+		}
+		if !matched {
+			continue
+		}
+		if int64(len(ret)) == sizeLimit {
+			return append(ret, result(appSearchDone, resultSizeLimitExceeded, "size limit exceeded"))
+		}
+		ret = append(ret, entry(e, attrs))
+	}
+	return append(ret, result(appSearchDone, resultSuccess, ""))
+}
+
+func match(filter *ber.Packet, e Entry) (bool, error) {
+	switch filter.Tag {
+	case filterAnd:
+		for _, f := range filter.Children {
+			if ok, err := match(f, e); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case filterOr:
+		for _, f := range filter.Children {
+			if ok, err := match(f, e); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case filterNot:
+		if len(filter.Children) != 1 {
+			return false, errors.New("malformed not filter")
+		}
+		ok, err := match(filter.Children[0], e)
+		return !ok, err
+	case filterEquality:
+		if len(filter.Children) != 2 {
+			return false, errors.New("malformed equality filter")
+		}
+		want := str(filter.Children[1])
+		for _, v := range values(e, str(filter.Children[0])) {
+			if strings.EqualFold(v, want) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case filterPresent:
+		return len(values(e, str(filter))) > 0, nil
+	default:
+		return false, fmt.Errorf("filter %d is not supported", filter.Tag)
+	}
+}
+
+func values(e Entry, attr string) []string {
+	for k, v := range e.Attrs {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+func entry(e Entry, attrs []string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, appSearchEntry, nil, "Search Result Entry")
+	p.AppendChild(octets(e.DN))
+	list := ber.NewSequence("Attributes")
+	for _, attr := range attrs {
+		vals := values(e, attr)
+		if len(vals) == 0 {
+			continue
+		}
+		a := ber.NewSequence("Attribute")
+		a.AppendChild(octets(attr))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range vals {
+			set.AppendChild(octets(v))
+		}
+		a.AppendChild(set)
+		list.AppendChild(a)
+	}
+	p.AppendChild(list)
+	return p
+}
+
+func result(app ber.Tag, code int64, msg string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, app, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	p.AppendChild(octets(""))
+	p.AppendChild(octets(msg))
+	return p
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.NewSequence("LDAP Message")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	p.AppendChild(op)
+	return p
+}
+
+func octets(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+// str reads octet strings of any class, e.g. the context specific password of simple binds
+func str(p *ber.Packet) string {
+	if p.Data == nil {
+		return ""
+	}
+	return p.Data.String()
+}
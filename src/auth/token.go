@@ -0,0 +1,382 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+
+	// compactPrefix marks compact tokens: s5.<kid>.<payload>.<mac>, signed by HS256 keys
+	compactPrefix = "s5."
+	// maxUserPassLen of rfc1929, longer tokens are split into username and password
+	maxUserPassLen  = 255
+	minHMACKeyLen   = 32
+	minRSAKeyBitLen = 2048
+)
+
+var b64 = base64.RawURLEncoding
+
+// TokenKey signs or verifies tokens of one algorithm:
+// HS256 keys are secrets, RS256 and EdDSA keys are public keys to verify or private keys to sign.
+type TokenKey struct {
+	ID        string
+	Algorithm string
+	key       any
+}
+
+// ParseTokenKey parses a HS256 secret or a pem encoded key, public keys verify and private keys sign
+func ParseTokenKey(id, alg string, material []byte) (*TokenKey, error) {
+	k := &TokenKey{ID: id, Algorithm: alg}
+	if alg == AlgHS256 {
+		secret := []byte(strings.TrimSpace(string(material)))
+		if len(secret) < minHMACKeyLen {
+			return nil, fmt.Errorf("secret of key %s should be at least %d bytes", id, minHMACKeyLen)
+		}
+		k.key = secret
+		return k, nil
+	}
+	if alg != AlgRS256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+
+	block, _ := pem.Decode(material)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block in key %s", id)
+	}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		k.key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		k.key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PRIVATE KEY":
+		k.key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		k.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block %s in key %s", block.Type, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse key %s, err=%w", id, err)
+	}
+
+	switch key := k.key.(type) {
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		if alg != AlgRS256 {
+			return nil, fmt.Errorf("key %s is a rsa key, not %s", id, alg)
+		}
+		if pub, ok := key.(*rsa.PrivateKey); ok {
+			key = &pub.PublicKey
+		}
+		if key.(*rsa.PublicKey).N.BitLen() < minRSAKeyBitLen {
+			return nil, fmt.Errorf("rsa key %s should be at least %d bits", id, minRSAKeyBitLen)
+		}
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		if alg != AlgEdDSA {
+			return nil, fmt.Errorf("key %s is a ed25519 key, not %s", id, alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T of key %s", key, id)
+	}
+	return k, nil
+}
+
+func (k *TokenKey) sign(data []byte) ([]byte, error) {
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data), nil
+	default:
+		return nil, fmt.Errorf("key %s can't sign, a private key is required", k.ID)
+	}
+}
+
+func (k *TokenKey) verify(data, sig []byte) bool {
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	case ed25519.PrivateKey:
+		return ed25519.Verify(key.Public().(ed25519.PublicKey), data, sig)
+	default:
+		return false
+	}
+}
+
+// Claims of a token, Expires is required
+type Claims struct {
+	Subject   string
+	Expires   time.Time
+	NotBefore time.Time
+	Attrs     Attributes
+}
+
+// jwtClaims are registered claims plus the attributes of the user, quota is like 10GiB
+type jwtClaims struct {
+	Sub   string   `json:"sub"`
+	Exp   int64    `json:"exp"`
+	Nbf   int64    `json:"nbf,omitempty"`
+	Iat   int64    `json:"iat,omitempty"`
+	Allow []string `json:"allow,omitempty"`
+	Quota string   `json:"quota,omitempty"`
+	Rate  float64  `json:"rate,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// MintJWT signs claims as a JWT by the private key or secret of k
+func MintJWT(k *TokenKey, c Claims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: k.Algorithm, Typ: "JWT", Kid: k.ID})
+	if err != nil {
+		return "", err
+	}
+	jc := jwtClaims{
+		Sub:   c.Subject,
+		Exp:   c.Expires.Unix(),
+		Iat:   time.Now().Unix(),
+		Allow: c.Attrs.Allow,
+		Rate:  c.Attrs.NewConnsPerSec,
+		Roles: c.Attrs.Roles,
+	}
+	if !c.NotBefore.IsZero() {
+		jc.Nbf = c.NotBefore.Unix()
+	}
+	if c.Attrs.QuotaPerHour > 0 {
+		jc.Quota = c.Attrs.QuotaPerHour.String()
+	}
+	payload, err := json.Marshal(jc)
+	if err != nil {
+		return "", err
+	}
+
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sig, err := k.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + b64.EncodeToString(sig), nil
+}
+
+// MintCompact signs claims as a compact token, shorter than a JWT but HS256 only:
+//
+//	s5.<kid>.<base64 of user:expires:attributes>.<base64 of hmac-sha256>
+func MintCompact(k *TokenKey, c Claims) (string, error) {
+	if k.Algorithm != AlgHS256 {
+		return "", fmt.Errorf("compact tokens are signed by %s keys only", AlgHS256)
+	}
+	if strings.Contains(c.Subject, ":") {
+		return "", fmt.Errorf("illegal user name %q", c.Subject)
+	}
+	payload := c.Subject + ":" + strconv.FormatInt(c.Expires.Unix(), 10) + ":" + c.Attrs.String()
+	signed := compactPrefix + k.ID + "." + b64.EncodeToString([]byte(payload))
+	sig, err := k.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + b64.EncodeToString(sig), nil
+}
+
+// SplitToken returns the username and password to pass a token, tokens longer than
+// a rfc1929 password like RS256 ones are split, otherwise the username is the subject
+func SplitToken(token, subject string) (username, password string, err error) {
+	switch {
+	case len(token) <= maxUserPassLen:
+		return subject, token, nil
+	case len(token) <= 2*maxUserPassLen:
+		return token[:maxUserPassLen], token[maxUserPassLen:], nil
+	default:
+		return "", "", fmt.Errorf("token of %d bytes is longer than username and password together", len(token))
+	}
+}
+
+// Tokens authenticates signed tokens passed as the password offline, the username should be the
+// subject of the token. A token too long for the password is split: the username carries the
+// first 255 bytes and the password the rest. Passwords that aren't tokens are invalid credentials.
+type Tokens struct {
+	keys []*TokenKey
+	// leeway tolerates clock skew on expires and not before
+	leeway time.Duration
+	now    func() time.Time
+}
+
+func NewTokens(keys []*TokenKey, leeway time.Duration) *Tokens {
+	return &Tokens{keys: keys, leeway: leeway, now: time.Now}
+}
+
+func (t *Tokens) Authenticate(_ context.Context, username, password string) (*User, error) {
+	var c *Claims
+	var err error
+	switch {
+	case isToken(password):
+		if c, err = t.parse(password); err == nil && c.Subject != username {
+			err = fmt.Errorf("%w: token of user %s", ErrInvalidCredentials, c.Subject)
+		}
+	case len(username) == maxUserPassLen && isToken(username+password):
+		c, err = t.parse(username + password)
+	default:
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := t.now()
+	if now.After(c.Expires.Add(t.leeway)) {
+		return nil, fmt.Errorf("%w: token expired at %s", ErrInvalidCredentials, c.Expires.Format(time.RFC3339))
+	}
+	if !c.NotBefore.IsZero() && now.Add(t.leeway).Before(c.NotBefore) {
+		return nil, fmt.Errorf("%w: token not valid before %s", ErrInvalidCredentials, c.NotBefore.Format(time.RFC3339))
+	}
+	return NewUser(c.Subject, c.Attrs)
+}
+
+// isToken tells tokens from passwords by their shape, signatures are checked by parse
+func isToken(s string) bool {
+	if strings.HasPrefix(s, compactPrefix) {
+		return strings.Count(s, ".") == 3
+	}
+	return strings.Count(s, ".") == 2 && strings.HasPrefix(s, "eyJ")
+}
+
+func (t *Tokens) parse(token string) (*Claims, error) {
+	if strings.HasPrefix(token, compactPrefix) {
+		return t.parseCompact(token)
+	}
+	return t.parseJWT(token)
+}
+
+func (t *Tokens) parseJWT(token string) (*Claims, error) {
+	i := strings.LastIndexByte(token, '.')
+	signed, encodedSig := token[:i], token[i+1:]
+	encodedHeader, encodedPayload, _ := strings.Cut(signed, ".")
+
+	var header jwtHeader
+	if err := decodeJSON(encodedHeader, &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed token header", ErrInvalidCredentials)
+	}
+	sig, err := b64.DecodeString(encodedSig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token signature", ErrInvalidCredentials)
+	}
+	// the algorithm of the key must match the header, so a public key is never used as a hmac secret
+	if !t.verify(header.Alg, header.Kid, []byte(signed), sig) {
+		return nil, fmt.Errorf("%w: bad token signature", ErrInvalidCredentials)
+	}
+
+	var jc jwtClaims
+	if err := decodeJSON(encodedPayload, &jc); err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", ErrInvalidCredentials)
+	}
+	if jc.Sub == "" || jc.Exp == 0 {
+		return nil, fmt.Errorf("%w: token without sub or exp", ErrInvalidCredentials)
+	}
+	c := &Claims{Subject: jc.Sub, Expires: time.Unix(jc.Exp, 0)}
+	if jc.Nbf != 0 {
+		c.NotBefore = time.Unix(jc.Nbf, 0)
+	}
+	c.Attrs = Attributes{NewConnsPerSec: jc.Rate, Allow: jc.Allow, Roles: jc.Roles}
+	if jc.Quota != "" {
+		n, err := units.ParseBase2Bytes(jc.Quota)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("illegal quota %s of token", jc.Quota)
+		}
+		c.Attrs.QuotaPerHour = n
+	}
+	if jc.Rate < 0 {
+		return nil, fmt.Errorf("illegal rate %v of token", jc.Rate)
+	}
+	return c, nil
+}
+
+func (t *Tokens) parseCompact(token string) (*Claims, error) {
+	i := strings.LastIndexByte(token, '.')
+	signed, encodedSig := token[:i], token[i+1:]
+	kid, encodedPayload, _ := strings.Cut(strings.TrimPrefix(signed, compactPrefix), ".")
+
+	sig, err := b64.DecodeString(encodedSig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token signature", ErrInvalidCredentials)
+	}
+	if !t.verify(AlgHS256, kid, []byte(signed), sig) {
+		return nil, fmt.Errorf("%w: bad token signature", ErrInvalidCredentials)
+	}
+
+	payload, err := b64.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", ErrInvalidCredentials)
+	}
+	parts := strings.SplitN(string(payload), ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("%w: malformed token claims", ErrInvalidCredentials)
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", ErrInvalidCredentials)
+	}
+	attrs, err := ParseAttributes(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("illegal attributes of token, err=%w", err)
+	}
+	return &Claims{Subject: parts[0], Expires: time.Unix(exp, 0), Attrs: attrs}, nil
+}
+
+// verify tries keys of the algorithm, only the one of kid if the token names it
+func (t *Tokens) verify(alg, kid string, data, sig []byte) bool {
+	for _, k := range t.keys {
+		if k.Algorithm == alg && (kid == "" || k.ID == kid) && k.verify(data, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJSON(s string, v any) error {
+	b, err := b64.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return errors.New("empty")
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokenKeys are the signing keys of a minter and the verifying keys of the server
+type tokenKeys struct {
+	hs, other, rs, ed *TokenKey
+	// public key of rs as pem, a secret for the alg confusion attack
+	rsPub []byte
+	// keys of the server, public keys only
+	verifiers []*TokenKey
+}
+
+func pemOf(t *testing.T, typ string, der []byte, err error) []byte {
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
+
+func parseKey(t *testing.T, id, alg string, material []byte) *TokenKey {
+	k, err := ParseTokenKey(id, alg, material)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func newTokenKeys(t *testing.T) *tokenKeys {
+	rsKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsPriv, err := x509.MarshalPKCS8PrivateKey(rsKey)
+	rsPrivPEM := pemOf(t, "PRIVATE KEY", rsPriv, err)
+	rsPub, err := x509.MarshalPKIXPublicKey(&rsKey.PublicKey)
+	rsPubPEM := pemOf(t, "PUBLIC KEY", rsPub, err)
+	edPriv, err := x509.MarshalPKCS8PrivateKey(edKey)
+	edPrivPEM := pemOf(t, "PRIVATE KEY", edPriv, err)
+	edPubDER, err := x509.MarshalPKIXPublicKey(edPub)
+	edPubPEM := pemOf(t, "PUBLIC KEY", edPubDER, err)
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	k := &tokenKeys{
+		hs:    parseKey(t, "hs", AlgHS256, secret),
+		other: parseKey(t, "other", AlgHS256, []byte("fedcba9876543210fedcba9876543210")),
+		rs:    parseKey(t, "rs", AlgRS256, rsPrivPEM),
+		ed:    parseKey(t, "ed", AlgEdDSA, edPrivPEM),
+		rsPub: rsPubPEM,
+	}
+	k.verifiers = []*TokenKey{
+		parseKey(t, "hs", AlgHS256, secret),
+		parseKey(t, "rs", AlgRS256, rsPubPEM),
+		parseKey(t, "ed", AlgEdDSA, edPubPEM),
+	}
+	return k
+}
+
+func TestTokens(t *testing.T) {
+	keys := newTokenKeys(t)
+	now := time.Now().Truncate(time.Second)
+	tokens := NewTokens(keys.verifiers, 30*time.Second)
+	tokens.now = func() time.Time { return now }
+	valid := Claims{Subject: "ci", Expires: now.Add(time.Hour)}
+
+	mint := func(k *TokenKey, c Claims) string {
+		token, err := MintJWT(k, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	compact := func(k *TokenKey, c Claims) string {
+		token, err := MintCompact(k, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	noKid := *keys.hs
+	noKid.ID = ""
+	confused := parseKey(t, "rs", AlgHS256, keys.rsPub)
+	withAttrs := valid
+	withAttrs.Attrs = Attributes{QuotaPerHour: 1 << 30, NewConnsPerSec: 2, Allow: []string{"127.0.0.2"}, Roles: []string{"ci"}}
+	// the first character of the signature carries no padding bits
+	tampered := mint(keys.hs, valid)
+	sig := strings.LastIndexByte(tampered, '.') + 1
+	flipped := byte('A')
+	if tampered[sig] == flipped {
+		flipped = 'B'
+	}
+	tampered = tampered[:sig] + string(flipped) + tampered[sig+1:]
+
+	cases := []struct {
+		name     string
+		username string
+		// the username is the first part of a split token if empty
+		token string
+		attrs Attributes
+		err   error
+	}{
+		{name: "hs256", username: "ci", token: mint(keys.hs, valid)},
+		{name: "compact", username: "ci", token: compact(keys.hs, valid)},
+		{name: "eddsa", username: "ci", token: mint(keys.ed, valid)},
+		{name: "rs256 split", token: mint(keys.rs, valid)},
+		{name: "no kid", username: "ci", token: mint(&noKid, valid)},
+		{name: "attributes", username: "ci", token: mint(keys.hs, withAttrs), attrs: withAttrs.Attrs},
+		{name: "compact attributes", username: "ci", token: compact(keys.hs, withAttrs), attrs: withAttrs.Attrs},
+		{name: "expired in leeway", username: "ci", token: mint(keys.hs, Claims{Subject: "ci", Expires: now.Add(-10 * time.Second)})},
+		{name: "expired", username: "ci", token: mint(keys.hs, Claims{Subject: "ci", Expires: now.Add(-time.Minute)}), err: ErrInvalidCredentials},
+		{name: "compact expired", username: "ci", token: compact(keys.hs, Claims{Subject: "ci", Expires: now.Add(-time.Minute)}), err: ErrInvalidCredentials},
+		{name: "not yet valid", username: "ci", token: mint(keys.hs, Claims{Subject: "ci", Expires: now.Add(time.Hour), NotBefore: now.Add(time.Minute)}), err: ErrInvalidCredentials},
+		{name: "other user", username: "bob", token: mint(keys.hs, valid), err: ErrInvalidCredentials},
+		{name: "tampered", username: "ci", token: tampered, err: ErrInvalidCredentials},
+		{name: "unknown key", username: "ci", token: mint(keys.other, valid), err: ErrInvalidCredentials},
+		{name: "compact unknown key", username: "ci", token: compact(keys.other, valid), err: ErrInvalidCredentials},
+		// a public key used as hmac secret must not verify
+		{name: "alg confusion", username: "ci", token: mint(confused, valid), err: ErrInvalidCredentials},
+		{name: "password", username: "ci", token: "secret1", err: ErrInvalidCredentials},
+		{name: "malformed", username: "ci", token: "eyJ.eyJ.sig", err: ErrInvalidCredentials},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			username, password := c.username, c.token
+			if username == "" {
+				var err error
+				if username, password, err = SplitToken(c.token, "ci"); err != nil {
+					t.Fatal(err)
+				}
+				if len(username) != maxUserPassLen {
+					t.Fatalf("token of %d bytes is not split", len(c.token))
+				}
+			}
+			u, err := tokens.Authenticate(context.Background(), username, password)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+			if c.err != nil {
+				return
+			}
+			if u.Name != "ci" || !reflect.DeepEqual(u.Attrs, c.attrs) {
+				t.Fatalf("got %s with %+v, want %+v", u.Name, u.Attrs, c.attrs)
+			}
+		})
+	}
+}
+
+func TestSplitToken(t *testing.T) {
+	cases := []struct {
+		size     int
+		username int
+		ok       bool
+	}{
+		{size: 100, username: 2, ok: true},
+		{size: maxUserPassLen, username: 2, ok: true},
+		{size: maxUserPassLen + 1, username: maxUserPassLen, ok: true},
+		{size: 2 * maxUserPassLen, username: maxUserPassLen, ok: true},
+		{size: 2*maxUserPassLen + 1},
+	}
+	for _, c := range cases {
+		token := strings.Repeat("x", c.size)
+		username, password, err := SplitToken(token, "ci")
+		if (err == nil) != c.ok {
+			t.Fatalf("token of %d bytes got err=%v", c.size, err)
+		}
+		if c.ok && (len(username) != c.username || (username != "ci" && username+password != token)) {
+			t.Fatalf("token of %d bytes is split into %d and %d bytes", c.size, len(username), len(password))
+		}
+	}
+}
+
+func TestParseTokenKey(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallPub, err := x509.MarshalPKIXPublicKey(&small.PublicKey)
+	smallPEM := pemOf(t, "PUBLIC KEY", smallPub, err)
+	keys := newTokenKeys(t)
+	edPub, err := x509.MarshalPKIXPublicKey(keys.ed.key.(ed25519.PrivateKey).Public())
+	edPEM := pemOf(t, "PUBLIC KEY", edPub, err)
+
+	cases := []struct {
+		name, alg string
+		material  []byte
+	}{
+		{name: "short secret", alg: AlgHS256, material: []byte("short")},
+		{name: "unknown algorithm", alg: "HS512", material: keys.rsPub},
+		{name: "no pem", alg: AlgRS256, material: []byte("not a key")},
+		{name: "rsa key as eddsa", alg: AlgEdDSA, material: keys.rsPub},
+		{name: "ed25519 key as rs256", alg: AlgRS256, material: edPEM},
+		{name: "small rsa key", alg: AlgRS256, material: smallPEM},
+		{name: "unknown pem block", alg: AlgRS256, material: pemOf(t, "CERTIFICATE", []byte{1}, nil)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseTokenKey("k", c.alg, c.material); err == nil {
+				t.Fatal("key is accepted")
+			}
+		})
+	}
+
+	// public keys can't sign
+	if _, err := MintJWT(keys.verifiers[1], Claims{Subject: "ci", Expires: time.Now()}); err == nil {
+		t.Fatal("token signed by a public key")
+	}
+	if _, err := MintCompact(keys.rs, Claims{Subject: "ci", Expires: time.Now()}); err == nil {
+		t.Fatal("compact token signed by a rsa key")
+	}
+}
@@ -0,0 +1,42 @@
+package src
+
+import (
+	"io"
+	"sync"
+)
+
+const pipeBufferSize = 32 * 1024
+
+var (
+	handshakeBuffers = newBufferPool(maxBufferSize)
+	pipeBuffers      = newBufferPool(pipeBufferSize)
+)
+
+// bufferPool reuses buffers of a fixed size, pointers are pooled to avoid allocating on Put
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}},
+	}
+}
+
+func (p *bufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// copyBuffer copies with a pooled buffer, callers have ruled out ReaderFrom and WriterTo
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := pipeBuffers.Get()
+	defer pipeBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
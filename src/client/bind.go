@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"socks5-proxy/src/socks5"
+)
+
+// Bind asks the proxy to accept one connection from address by BIND,
+// the remote peer should connect to Addr() of the returned listener
+func (d *Dialer) Bind(ctx context.Context, address string) (*BindListener, error) {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bound, err := d.handshake(ctx, conn, socks5.Bind, address)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &BindListener{conn: conn, addr: bound}, nil
+}
+
+// BindListener is a net.Listener accepting exactly one connection,
+// which shares the control connection, so closing either closes both
+type BindListener struct {
+	conn     net.Conn
+	addr     *socks5.Addr
+	accepted sync.Once
+}
+
+func (l *BindListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	err := fmt.Errorf("bind listener accepts only once")
+
+	l.accepted.Do(func() {
+		var peer *socks5.Addr
+		peer, err = socks5.ReadReply(l.conn, make([]byte, socks5.MaxAddrSize))
+		if err != nil {
+			_ = l.conn.Close()
+			err = fmt.Errorf("fail to read second reply, err=%w", err)
+			return
+		}
+		conn = &boundConn{Conn: l.conn, peer: peer}
+	})
+	return conn, err
+}
+
+func (l *BindListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+type boundConn struct {
+	net.Conn
+	peer net.Addr
+}
+
+func (c *boundConn) RemoteAddr() net.Addr {
+	return c.peer
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"socks5-proxy/src/socks5"
+)
+
+// bind accepts one connection from a new listener and relays it on the control connection
+func bind(conn net.Conn, _ string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_, _ = conn.Write(socks5.AppendReply(nil, socks5.GeneralFailure, ""))
+		return
+	}
+	defer ln.Close()
+	if _, err := conn.Write(socks5.AppendReply(nil, socks5.Succeeded, ln.Addr().String())); err != nil {
+		return
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer peer.Close()
+	if _, err := conn.Write(socks5.AppendReply(nil, socks5.Succeeded, peer.RemoteAddr().String())); err != nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(peer, conn)
+		_ = peer.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(conn, peer)
+}
+
+func TestBind(t *testing.T) {
+	s := newFakeServer(t)
+	s.username, s.password = "alice", "secret"
+	s.commands[socks5.Bind] = bind
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ln, err := s.dialer().Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conn.RemoteAddr().String(), peer.LocalAddr().String(); got != want {
+		t.Fatalf("remote addr is %s, want %s", got, want)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("bind listener accepts twice")
+	}
+
+	if _, err := peer.Write([]byte("from peer")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "from peer" {
+		t.Fatalf("got %q, err=%v", buf, err)
+	}
+	if _, err := conn.Write([]byte("to peer")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "to peer" {
+		t.Fatalf("got %q, err=%v", got, err)
+	}
+}
+
+func TestBindFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		handle func(conn net.Conn, address string)
+		// Bind fails if true, Accept otherwise
+		bindFails bool
+		want      error
+	}{
+		{
+			name: "rejected",
+			handle: func(conn net.Conn, _ string) {
+				_, _ = conn.Write(socks5.AppendReply(nil, socks5.ConnectionNotAllowed, ""))
+			},
+			bindFails: true,
+			want:      socks5.ReplyError(socks5.ConnectionNotAllowed),
+		},
+		{
+			name:      "not supported",
+			bindFails: true,
+			want:      socks5.ReplyError(socks5.CommandNotSupported),
+		},
+		{
+			name: "no peer",
+			handle: func(conn net.Conn, _ string) {
+				_, _ = conn.Write(socks5.AppendReply(nil, socks5.Succeeded, "127.0.0.1:1"))
+			},
+			want: io.EOF,
+		},
+		{
+			name: "peer refused",
+			handle: func(conn net.Conn, _ string) {
+				_, _ = conn.Write(socks5.AppendReply(nil, socks5.Succeeded, "127.0.0.1:1"))
+				_, _ = conn.Write(socks5.AppendReply(nil, socks5.HostUnreachable, ""))
+			},
+			want: socks5.ReplyError(socks5.HostUnreachable),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			if tc.handle != nil {
+				s.commands[socks5.Bind] = tc.handle
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			ln, err := s.dialer().Bind(ctx, "127.0.0.1:0")
+			if err == nil {
+				defer ln.Close()
+				if tc.bindFails {
+					t.Fatal("bind succeeded")
+				}
+				_, err = ln.Accept()
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Package client dials through a socks5 proxy, e.g.
+//
+//	d := client.NewDialer("127.0.0.1:1080")
+//	d.Username, d.Password = "alice", "secret"
+//	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"socks5-proxy/src/socks5"
+)
+
+// ForwardFunc dials the proxy itself
+type ForwardFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+type Dialer struct {
+	ProxyAddr string
+	// username/password authentication is offered when Username is not empty
+	Username, Password string
+	// Forward defaults to a net.Dialer
+	Forward ForwardFunc
+	// HandshakeTimeout limits greeting, authentication and command, zero means no limit
+	HandshakeTimeout time.Duration
+}
+
+func NewDialer(proxyAddr string) *Dialer {
+	return &Dialer{
+		ProxyAddr: proxyAddr,
+	}
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy by CONNECT,
+// use ListenPacket for udp and Bind for incoming connections
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s is not supported", network)
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.handshake(ctx, conn, socks5.Connect, address); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Handshake runs greeting, authentication and cmd on a connection to the proxy,
+// returns the bound address replied by the proxy
+func (d *Dialer) Handshake(conn net.Conn, cmd byte, address string) (*socks5.Addr, error) {
+	return d.handshake(context.Background(), conn, cmd, address)
+}
+
+// HandshakeContext is Handshake giving up once ctx is done
+func (d *Dialer) HandshakeContext(ctx context.Context, conn net.Conn, cmd byte, address string) (*socks5.Addr, error) {
+	return d.handshake(ctx, conn, cmd, address)
+}
+
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		var dialer net.Dialer
+		forward = dialer.DialContext
+	}
+	conn, err := forward(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("fail to dial proxy %s, err=%w", d.ProxyAddr, err)
+	}
+	return conn, nil
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, cmd byte, address string) (bound *socks5.Addr, err error) {
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	// reads/writes fail once ctx is done
+	err = socks5.Interruptible(ctx, conn, func() error {
+		buf := make([]byte, 0, socks5.MaxUserPassSize)
+		if err := d.authenticate(conn, buf); err != nil {
+			return err
+		}
+
+		req, err := socks5.AppendRequest(buf[:0], cmd, address)
+		if err != nil {
+			return fmt.Errorf("illegal address %s, err=%w", address, err)
+		}
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("fail to send command, err=%w", err)
+		}
+		if bound, err = socks5.ReadReply(conn, buf[:cap(buf)]); err != nil {
+			return fmt.Errorf("fail to read command reply, err=%w", err)
+		}
+		return nil
+	})
+	return bound, err
+}
+
+func (d *Dialer) authenticate(conn net.Conn, buf []byte) error {
+	buf = append(buf[:0], socks5.Version, 1, socks5.NoAuthenticationRequired)
+	if d.Username != "" {
+		buf[1] = 2
+		buf = append(buf, socks5.UsernamePassword)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("fail to send auth methods, err=%w", err)
+	}
+
+	buf = buf[:2]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("fail to read auth method, err=%w", err)
+	}
+	if err := socks5.CheckVersion(buf[0]); err != nil {
+		return err
+	}
+
+	switch buf[1] {
+	case socks5.NoAuthenticationRequired:
+		return nil
+	case socks5.UsernamePassword:
+		if d.Username == "" {
+			return fmt.Errorf("proxy requires username/password")
+		}
+		req, err := socks5.AppendUserPass(buf[:0], d.Username, d.Password)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("fail to send username/password, err=%w", err)
+		}
+		buf = buf[:2]
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("fail to read auth status, err=%w", err)
+		}
+		if buf[1] != socks5.UserPassSucceed {
+			return fmt.Errorf("username/password rejected")
+		}
+		return nil
+	default:
+		return fmt.Errorf("no acceptable auth methods")
+	}
+}
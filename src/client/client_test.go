@@ -0,0 +1,253 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"socks5-proxy/src/socks5"
+)
+
+// fakeServer is a socks5 proxy on loopback handing each command to a test
+type fakeServer struct {
+	t  *testing.T
+	ln net.Listener
+	// username/password is required if username is not empty
+	username, password string
+	commands           map[byte]func(conn net.Conn, address string)
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, ln: ln, commands: make(map[byte]func(net.Conn, string))}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) dialer() *Dialer {
+	d := NewDialer(s.ln.Addr().String())
+	d.Username, d.Password = s.username, s.password
+	return d
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, socks5.MaxUserPassSize)
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	method := byte(socks5.NoAuthenticationRequired)
+	if s.username != "" {
+		method = socks5.UsernamePassword
+	}
+	if _, err := conn.Write([]byte{socks5.Version, method}); err != nil {
+		return
+	}
+	if s.username != "" {
+		username, password, err := socks5.ReadUserPass(conn, buf)
+		if err != nil {
+			return
+		}
+		status := byte(socks5.UserPassSucceed)
+		if username != s.username || password != s.password {
+			status = socks5.UserPassFailure
+		}
+		if _, err := conn.Write([]byte{socks5.UserPassVersion, status}); err != nil || status != socks5.UserPassSucceed {
+			return
+		}
+	}
+
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return
+	}
+	cmd := buf[1]
+	host, port, err := socks5.ReadAddr(conn, buf)
+	if err != nil {
+		return
+	}
+	handle, ok := s.commands[cmd]
+	if !ok {
+		_, _ = conn.Write(socks5.AppendReply(nil, socks5.CommandNotSupported, ""))
+		return
+	}
+	handle(conn, net.JoinHostPort(host, port))
+}
+
+// connect dials the target and relays it on the connection
+func connect(conn net.Conn, address string) {
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		_, _ = conn.Write(socks5.AppendReply(nil, socks5.ConnectionRefused, ""))
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write(socks5.AppendReply(nil, socks5.Succeeded, target.LocalAddr().String())); err != nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, conn)
+		_ = target.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+// echoTCP echoes until the FIN of each connection
+func echoTCP(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialContext(t *testing.T) {
+	target := echoTCP(t)
+	for _, tc := range []struct {
+		name string
+		// credentials of the proxy and of the dialer
+		proxyUser, proxyPass string
+		username, password   string
+	}{
+		{name: "no authentication"},
+		{name: "username/password", proxyUser: "alice", proxyPass: "secret", username: "alice", password: "secret"},
+		// the dialer offers both methods, the proxy picks none
+		{name: "credentials not required", username: "alice", password: "secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			s.username, s.password = tc.proxyUser, tc.proxyPass
+			s.commands[socks5.Connect] = connect
+			d := s.dialer()
+			d.Username, d.Password = tc.username, tc.password
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := d.DialContext(ctx, "tcp", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.(*net.TCPConn).CloseWrite()
+			if got, err := io.ReadAll(conn); err != nil || string(got) != "ping" {
+				t.Fatalf("got %q, err=%v", got, err)
+			}
+		})
+	}
+}
+
+func TestDialContextFailures(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	_ = closed.Close()
+
+	for _, tc := range []struct {
+		name               string
+		proxyUser          string
+		username, password string
+		network, address   string
+		// errors.Is, or a part of the message if want is nil
+		want error
+		msg  string
+	}{
+		{name: "wrong password", proxyUser: "alice", username: "alice", password: "nope", msg: "username/password rejected"},
+		{name: "wrong username", proxyUser: "alice", username: "bob", password: "secret", msg: "username/password rejected"},
+		{name: "credentials required", proxyUser: "alice", msg: "proxy requires username/password"},
+		{name: "connect refused", address: refused, want: socks5.ReplyError(socks5.ConnectionRefused)},
+		{name: "udp", network: "udp", msg: "network udp is not supported"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			s.username, s.password = tc.proxyUser, "secret"
+			s.commands[socks5.Connect] = connect
+			d := s.dialer()
+			d.Username, d.Password = tc.username, tc.password
+
+			network, address := tc.network, tc.address
+			if network == "" {
+				network = "tcp"
+			}
+			if address == "" {
+				address = echoTCP(t)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := d.DialContext(ctx, network, address)
+			if err == nil {
+				_ = conn.Close()
+				t.Fatal("connected")
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) || tc.want == nil && !strings.Contains(err.Error(), tc.msg) {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	// the proxy never replies the greeting
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	d := NewDialer(ln.Addr().String())
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	d.HandshakeTimeout = 50 * time.Millisecond
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:443"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
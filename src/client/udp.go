@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"socks5-proxy/src/socks5"
+)
+
+const maxUdpHeaderSize = 3 + socks5.MaxAddrSize
+
+// ListenPacket associates a udp relay by UDP ASSOCIATE,
+// the association lives until the returned PacketConn is closed
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	ctrl, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// relays may only accept datagrams from the requested address, so it's listened where the proxy is reached from
+	laddr := &net.UDPAddr{}
+	if addr, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, fmt.Errorf("fail to listen udp, err=%w", err)
+	}
+
+	bound, err := d.handshake(ctx, ctrl, socks5.UdpAssociate, udp.LocalAddr().String())
+	if err != nil {
+		_ = ctrl.Close()
+		_ = udp.Close()
+		return nil, err
+	}
+
+	// the relay may reply an unspecified address, it's the proxy itself
+	host := bound.Host
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(ctrl.RemoteAddr().String())
+	}
+	relay, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, bound.Port))
+	if err != nil {
+		_ = ctrl.Close()
+		_ = udp.Close()
+		return nil, fmt.Errorf("fail to resolve relay addr, err=%w", err)
+	}
+
+	c := &packetConn{
+		udp:   udp,
+		ctrl:  ctrl,
+		relay: relay,
+	}
+	go c.watch()
+	return c, nil
+}
+
+type packetConn struct {
+	udp   *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	rmu sync.Mutex
+	// datagrams with the socks header, reused by reads
+	rbuf []byte
+}
+
+// watch closes the udp socket once the proxy terminates the association
+func (c *packetConn) watch() {
+	_, _ = io.Copy(io.Discard, c.ctrl)
+	_ = c.udp.Close()
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	size := len(p) + maxUdpHeaderSize
+	if cap(c.rbuf) < size {
+		c.rbuf = make([]byte, size)
+	}
+	buf := c.rbuf[:size]
+	for {
+		n, from, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// drop datagrams not coming from the relay
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		addr, payload, err := socks5.ParseUdpHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(p, payload), toUdpAddr(addr), nil
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	buf, err := socks5.AppendUdpHeader(make([]byte, 0, maxUdpHeaderSize+len(p)), addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.udp.WriteToUDP(append(buf, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *packetConn) Close() error {
+	_ = c.ctrl.Close()
+	return c.udp.Close()
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
+
+func toUdpAddr(addr *socks5.Addr) net.Addr {
+	ip := net.ParseIP(addr.Host)
+	if ip == nil {
+		return addr
+	}
+	port, _ := net.LookupPort("udp", addr.Port)
+	return &net.UDPAddr{IP: ip, Port: port}
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"socks5-proxy/src/socks5"
+)
+
+// associate relays datagrams between the client and targets until the control connection closes,
+// the relay is replied as the host replied with the port of the relay. Like strict relays,
+// only datagrams from the requested address are relayed, unless it's unspecified.
+func associate(replied string) func(conn net.Conn, address string) {
+	return func(conn net.Conn, address string) {
+		requested, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			_, _ = conn.Write(socks5.AppendReply(nil, socks5.GeneralFailure, ""))
+			return
+		}
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			_, _ = conn.Write(socks5.AppendReply(nil, socks5.GeneralFailure, ""))
+			return
+		}
+		defer relay.Close()
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		bound := net.JoinHostPort(replied, strconv.Itoa(port))
+		if _, err := conn.Write(socks5.AppendReply(nil, socks5.Succeeded, bound)); err != nil {
+			return
+		}
+
+		go func() {
+			var client *net.UDPAddr
+			if requested.Port != 0 && !requested.IP.IsUnspecified() {
+				client = requested
+			}
+			buf := make([]byte, 64<<10)
+			for {
+				n, from, err := relay.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if client == nil || (from.IP.Equal(client.IP) && from.Port == client.Port) {
+					client = from
+					addr, payload, err := socks5.ParseUdpHeader(buf[:n])
+					if err != nil {
+						continue
+					}
+					target, err := net.ResolveUDPAddr("udp", addr.String())
+					if err != nil {
+						continue
+					}
+					_, _ = relay.WriteToUDP(payload, target)
+					continue
+				}
+				packet, _ := socks5.AppendUdpHeader(nil, from.String())
+				_, _ = relay.WriteToUDP(append(packet, buf[:n]...), client)
+			}
+		}()
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
+
+// echoUDP replies every datagram with a prefix
+func echoUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+	return conn
+}
+
+func listenPacket(t *testing.T, s *fakeServer) net.PacketConn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := s.dialer().ListenPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+	return pc
+}
+
+func TestListenPacket(t *testing.T) {
+	// the relay may be replied as the unspecified address, which is the proxy itself
+	for _, replied := range []string{"127.0.0.1", "0.0.0.0"} {
+		t.Run(replied, func(t *testing.T) {
+			s := newFakeServer(t)
+			s.username, s.password = "alice", "secret"
+			requested, relay := make(chan string, 1), associate(replied)
+			s.commands[socks5.UdpAssociate] = func(conn net.Conn, address string) {
+				requested <- address
+				relay(conn, address)
+			}
+			target := echoUDP(t)
+			pc := listenPacket(t, s)
+			// the address datagrams are sent from
+			if got := <-requested; got != pc.LocalAddr().String() {
+				t.Fatalf("requested %s, want %s", got, pc.LocalAddr())
+			}
+
+			for _, msg := range []string{"one", "two"} {
+				if _, err := pc.WriteTo([]byte(msg), target.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 64)
+				n, from, err := pc.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buf[:n]) != "echo "+msg {
+					t.Fatalf("got %q", buf[:n])
+				}
+				if from.String() != target.LocalAddr().String() {
+					t.Fatalf("from %s, want %s", from, target.LocalAddr())
+				}
+			}
+		})
+	}
+}
+
+func TestListenPacketDropsStrangers(t *testing.T) {
+	s := newFakeServer(t)
+	s.commands[socks5.UdpAssociate] = associate("127.0.0.1")
+	target := echoUDP(t)
+	pc := listenPacket(t, s)
+
+	// a datagram in the socks header sent by someone other than the relay
+	stranger, err := net.DialUDP("udp", nil, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	forged, _ := socks5.AppendUdpHeader(nil, target.LocalAddr().String())
+	if _, err := stranger.Write(append(forged, "forged"...)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := pc.WriteTo([]byte("real"), target.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "echo real" {
+		t.Fatalf("got %q, err=%v", buf[:n], err)
+	}
+}
+
+func TestListenPacketEndsWithAssociation(t *testing.T) {
+	s := newFakeServer(t)
+	s.commands[socks5.UdpAssociate] = func(conn net.Conn, _ string) {
+		_, _ = conn.Write(socks5.AppendReply(nil, socks5.Succeeded, "127.0.0.1:1"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	pc := listenPacket(t, s)
+
+	// the proxy closing the control connection terminates the association
+	if _, _, err := pc.ReadFrom(make([]byte, 64)); err == nil {
+		t.Fatal("read after the association ended")
+	}
+}
+
+func TestListenPacketRejected(t *testing.T) {
+	s := newFakeServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.dialer().ListenPacket(ctx); !errors.Is(err, socks5.ReplyError(socks5.CommandNotSupported)) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -3,13 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net"
 	"os"
 
 	"github.com/sirupsen/logrus"
 
-	"socks5-proxy/src"
-	"socks5-proxy/src/protocol"
+	"socks5-proxy/src/app"
+	"socks5-proxy/src/config"
 )
 
 var (
@@ -17,46 +16,82 @@ var (
 	agentPort  string
 	serverIp   string
 	serverPort string
+	rules      string
+	upstream   string
+	configFile string
 )
 
-func parse() {
+func parse(args []string) {
 	flag.StringVar(&agentIp, "agent-ip", "0.0.0.0", "socks agent ip")
 	flag.StringVar(&agentPort, "agent-port", "1080", "socks agent port")
 	flag.StringVar(&serverIp, "server-ip", "0.0.0.0", "socks server ip")
 	flag.StringVar(&serverPort, "server-port", "1081", "socks server port")
+	flag.StringVar(&rules, "rules", "", "routing rules file, outbound kind \"server\" dials the socks server")
+	flag.StringVar(&upstream, "upstream", "", "comma separated upstream proxy chain to reach the socks server")
+	flag.StringVar(&configFile, "config", "", "yaml/json config file, other flags are ignored if set")
 
-	flag.Parse()
+	_ = flag.CommandLine.Parse(args)
 }
 
+// usage: s5agent [validate] [flags]
 func main() {
-	parse()
+	validate := len(os.Args) > 1 && os.Args[1] == "validate"
+	if validate {
+		parse(os.Args[2:])
+	} else {
+		parse(os.Args[1:])
+	}
 
-	serverAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", serverIp, serverPort))
+	cfg, err := loadConfig()
+	if validate {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("config is valid")
+		return
+	}
 	if err != nil {
-		logrus.Errorf("fail to parse socks server ip/port, err=%s", err.Error())
+		logrus.Errorf("invalid config, err=%s", err.Error())
 		os.Exit(1)
 	}
 
-	agentAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", agentIp, agentPort))
-	if err != nil {
-		logrus.Errorf("fail to parse socks server ip/port, err=%s", err.Error())
+	if err := app.SetupLogger(cfg.Log); err != nil {
+		logrus.Errorf("fail to setup logger, err=%s", err.Error())
 		os.Exit(1)
 	}
 
-	mngr := src.NewConnQuotaMngr()
-	s := src.NewTcpServer(agentAddr)
-	s.Use(src.RecoveryHandler())
-
-	s.Use(
-		protocol.AuthMethodNegotiation([]byte{protocol.NoAuthenticationRequired}),
-		protocol.Auth(),
-		protocol.ClientSayHello(mngr.Dialer(), serverAddr),
-	)
-
-	s.SetFinalHandler(mngr.PipeHandler())
-
-	if err := s.ListenAndServe(); err != nil {
+	a, err := app.New(cfg, loadConfig)
+	if err != nil {
+		logrus.Errorf("fail to create agent, err=%s", err.Error())
+		os.Exit(1)
+	}
+	if err := a.Run(); err != nil {
 		logrus.Errorf("an error happened when serve tcp, err=%s", err.Error())
 		os.Exit(1)
 	}
 }
+
+func loadConfig() (*config.Config, error) {
+	var cfg *config.Config
+	if configFile != "" {
+		var err error
+		if cfg, err = config.Load(configFile, config.ModeAgent); err != nil {
+			return nil, err
+		}
+	} else {
+		cfg = config.Default(config.ModeAgent)
+		cfg.Listeners = []config.Listener{{Address: fmt.Sprintf("%s:%s", agentIp, agentPort)}}
+		cfg.Server.Address = fmt.Sprintf("%s:%s", serverIp, serverPort)
+		cfg.Server.Upstream = upstream
+		cfg.Routing.RulesFile = rules
+		if err := config.ApplyEnv(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Mode != config.ModeAgent {
+		return nil, fmt.Errorf("mode should be agent")
+	}
+	return cfg, cfg.Validate()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"socks5-proxy/src/auth"
+)
+
+const passwdUsage = `usage: s5server passwd [flags] <file> <command> [args]
+
+commands:
+  add <user> [attributes]   add a user, the password is read from stdin
+  password <user>           change the password, read from stdin
+  attrs <user> [attributes] replace the attributes
+  disable <user>            keep the user but reject its logins
+  enable <user>
+  del <user>
+  list
+
+attributes are comma separated, e.g. quota=10GiB,rate=5,allow=example.com,allow=10.0.0.0/8
+
+flags:
+`
+
+// passwd edits the htpasswd file of the password auth method, the running server picks changes up
+func passwd(args []string) error {
+	fs := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	argon2id := fs.Bool("argon2id", false, "hash with argon2id instead of bcrypt")
+	cost := fs.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), passwdUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	args = fs.Args()
+	if len(args) < 2 || (args[1] != "list" && len(args) < 3) {
+		fs.Usage()
+		return fmt.Errorf("missing arguments")
+	}
+	path, cmd := args[0], args[1]
+
+	if cmd == "list" {
+		entries, err := auth.ReadHtpasswdFile(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Name == "" {
+				continue
+			}
+			state := "enabled"
+			if e.Disabled {
+				state = "disabled"
+			}
+			fmt.Printf("%s\t%s\t%s\n", e.Name, state, e.Attrs)
+		}
+		return nil
+	}
+
+	name := args[2]
+	if strings.ContainsAny(name, ":\n") || len(name) > 255 {
+		return fmt.Errorf("illegal user name %q", name)
+	}
+	var attrs auth.Attributes
+	if cmd == "add" || cmd == "attrs" {
+		var err error
+		if attrs, err = auth.ParseAttributes(strings.Join(args[3:], ",")); err != nil {
+			return err
+		}
+		if _, err := auth.NewUser(name, attrs); err != nil {
+			return err
+		}
+	}
+	var hash string
+	if cmd == "add" || cmd == "password" {
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if *argon2id {
+			hash, err = auth.HashArgon2id(password)
+		} else {
+			hash, err = auth.HashBcrypt(password, *cost)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return auth.EditHtpasswd(path, func(entries []auth.Entry) ([]auth.Entry, error) {
+		i := -1
+		for j, e := range entries {
+			if e.Name == name {
+				i = j
+			}
+		}
+		if cmd == "add" {
+			if i >= 0 {
+				return nil, fmt.Errorf("user %s exists", name)
+			}
+			return append(entries, auth.Entry{Name: name, Hash: hash, Attrs: attrs}), nil
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("user %s not found", name)
+		}
+
+		switch cmd {
+		case "password":
+			entries[i].Hash = hash
+		case "attrs":
+			entries[i].Attrs = attrs
+		case "disable":
+			entries[i].Disabled = true
+		case "enable":
+			entries[i].Disabled = false
+		case "del":
+			entries = append(entries[:i], entries[i+1:]...)
+		default:
+			return nil, fmt.Errorf("unknown command %s", cmd)
+		}
+		return entries, nil
+	})
+}
+
+// readPassword reads the first line, so both a terminal and a pipe work
+func readPassword(r io.Reader) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "password (echoed): ")
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("fail to read password, err=%w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" || len(password) > 255 {
+		return "", fmt.Errorf("password should be 1 to 255 bytes")
+	}
+	return password, nil
+}
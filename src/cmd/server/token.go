@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"socks5-proxy/src/auth"
+)
+
+const tokenUsage = `usage: s5server token <command> [flags] [args]
+
+commands:
+  genkey [flags] <prefix>               write a HS256 secret to <prefix>.key, or a private key
+                                        to <prefix>.key and its public key to <prefix>.pub
+  mint [flags] <user> [attributes]      print the username and the password on two lines,
+                                        tokens too long for the password are split in both
+
+attributes are comma separated, e.g. quota=10GiB,rate=5,allow=example.com,allow=10.0.0.0/8
+
+flags:
+`
+
+// token creates keys and mints tokens of the password auth method
+func token(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	alg := fs.String("alg", auth.AlgHS256, "algorithm, one of HS256, RS256, EdDSA")
+	keyFile := fs.String("key", "", "secret or private key file to sign by, mint only")
+	kid := fs.String("kid", "", "key id, mint only")
+	ttl := fs.Duration("ttl", time.Hour, "lifetime of the token, mint only")
+	compact := fs.Bool("compact", false, "mint a compact token instead of a JWT, HS256 only")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), tokenUsage)
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = fs.Args()
+
+	switch cmd {
+	case "genkey":
+		if len(args) != 1 {
+			fs.Usage()
+			return fmt.Errorf("missing prefix")
+		}
+		return genkey(*alg, args[0])
+	case "mint":
+		if len(args) < 1 || *keyFile == "" {
+			fs.Usage()
+			return fmt.Errorf("missing user or key")
+		}
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+
+	name := args[0]
+	if strings.ContainsAny(name, ":\n") || len(name) > 255 {
+		return fmt.Errorf("illegal user name %q", name)
+	}
+	attrs, err := auth.ParseAttributes(strings.Join(args[1:], ","))
+	if err != nil {
+		return err
+	}
+	if _, err := auth.NewUser(name, attrs); err != nil {
+		return err
+	}
+	material, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return fmt.Errorf("fail to read key, err=%w", err)
+	}
+	key, err := auth.ParseTokenKey(*kid, *alg, material)
+	if err != nil {
+		return err
+	}
+
+	claims := auth.Claims{Subject: name, Expires: time.Now().Add(*ttl), Attrs: attrs}
+	var t string
+	if *compact {
+		t, err = auth.MintCompact(key, claims)
+	} else {
+		t, err = auth.MintJWT(key, claims)
+	}
+	if err != nil {
+		return err
+	}
+	username, password, err := auth.SplitToken(t, name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(username)
+	fmt.Println(password)
+	return nil
+}
+
+// genkey writes keys with mode 0600, public keys with 0644
+func genkey(alg, prefix string) error {
+	var private crypto.Signer
+	switch alg {
+	case auth.AlgHS256:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return os.WriteFile(prefix+".key", []byte(base64.RawURLEncoding.EncodeToString(secret)+"\n"), 0600)
+	case auth.AlgRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		private = key
+	case auth.AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		private = key
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	public, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(prefix+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(prefix+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644)
+}
@@ -0,0 +1,88 @@
+// Package compress compresses the stream between agent and server. Compressed bytes are carried in frames
+// of a 2 bytes big endian length, every write is flushed into frames so interactive traffic isn't delayed.
+// An empty frame ends the compressed stream, the rest of that direction is sent as is:
+//
+//	[length][compressed]...[length][compressed][0x0000][raw bytes]...
+//
+// It's sent on half close, or once adaptive compression finds the data incompressible.
+package compress
+
+import (
+	"compress/flate"
+	"expvar"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// algorithms negotiated in the internal handshake, None declines compression
+const (
+	None   byte = 0
+	Flate  byte = 1
+	Zstd   byte = 2
+	Snappy byte = 3
+)
+
+var names = map[string]byte{"flate": Flate, "zstd": Zstd, "snappy": Snappy}
+
+var stats = new(expvar.Map).Init()
+
+// Parse returns the algorithm of name, false if unknown
+func Parse(name string) (byte, bool) {
+	alg, ok := names[name]
+	return alg, ok
+}
+
+func Name(alg byte) string {
+	for name, a := range names {
+		if a == alg {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", alg)
+}
+
+// Stats counts payload and wire bytes of all compressed streams and streams giving up compression
+func Stats() *expvar.Map {
+	return stats
+}
+
+// encoder flushes every write, Close ends the compressed stream
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(alg byte, w io.Writer) (encoder, error) {
+	switch alg {
+	case Flate:
+		return flate.NewWriter(w, flate.BestSpeed)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(256<<10), zstd.WithLowerEncoderMem(true))
+	case Snappy:
+		return s2.NewWriter(w, s2.WriterSnappyCompat(), s2.WriterConcurrency(1), s2.WriterBlockSize(64<<10)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", alg)
+	}
+}
+
+func newDecoder(alg byte, r io.Reader) (io.Reader, error) {
+	switch alg {
+	case Flate:
+		return flate.NewReader(r), nil
+	case Zstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(8<<20))
+		if err != nil {
+			return nil, err
+		}
+		return dec, nil
+	case Snappy:
+		return s2.NewReader(r, s2.ReaderMaxBlockSize(64<<10)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", alg)
+	}
+}
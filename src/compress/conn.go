@@ -0,0 +1,289 @@
+package compress
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	maxFrame = 0xffff
+	// adaptive compression decides after every sample of payload written
+	adaptiveSample = 256 << 10
+	// compression is given up if wire bytes exceed this permille of payload
+	adaptiveMaxRatio = 900
+)
+
+// Conn compresses both directions of conn, it reports wire bytes as src.WireCounter.
+// Adaptive connections send the rest as is once a sample doesn't shrink enough.
+type Conn struct {
+	net.Conn
+	wireRead, wireWritten atomic.Int64
+
+	rmu  sync.Mutex
+	br   *bufio.Reader
+	fr   *frameReader
+	dec  io.Reader
+	rraw bool
+
+	wmu      sync.Mutex
+	fw       *frameWriter
+	enc      encoder
+	wraw     bool
+	adaptive bool
+	// payload and wire bytes of the current sample
+	sampleIn, sampleOut int64
+}
+
+func New(conn net.Conn, alg byte, adaptive bool) (*Conn, error) {
+	c := &Conn{Conn: conn, adaptive: adaptive}
+	c.br = bufio.NewReader(countingReader{r: conn, n: &c.wireRead})
+	c.fr = &frameReader{r: c.br}
+	c.fw = &frameWriter{open: -1}
+
+	var err error
+	if c.enc, err = newEncoder(alg, c.fw); err != nil {
+		return nil, err
+	}
+	if c.dec, err = newDecoder(alg, c.fr); err != nil {
+		return nil, err
+	}
+	stats.Add(Name(alg)+"_streams", 1)
+	return c, nil
+}
+
+func (c *Conn) WireRead() int64 {
+	return c.wireRead.Load()
+}
+
+func (c *Conn) WireWritten() int64 {
+	return c.wireWritten.Load()
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if !c.rraw {
+		n, err := c.dec.Read(p)
+		stats.Add("payload_read", int64(n))
+		if err != io.EOF {
+			return n, err
+		}
+		// raw bytes follow the end frame, which flate stops short of
+		if err := c.fr.skip(); err != nil {
+			return n, err
+		}
+		c.rraw = true
+		if n > 0 {
+			return n, nil
+		}
+	}
+	n, err := c.br.Read(p)
+	stats.Add("payload_read", int64(n))
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.wraw {
+		n, err := c.Conn.Write(p)
+		c.wireWritten.Add(int64(n))
+		stats.Add("payload_written", int64(n))
+		stats.Add("wire_written", int64(n))
+		return n, err
+	}
+
+	if _, err := c.enc.Write(p); err != nil {
+		return 0, err
+	}
+	if err := c.enc.Flush(); err != nil {
+		return 0, err
+	}
+	out, err := c.flush()
+	if err != nil {
+		return 0, err
+	}
+	stats.Add("payload_written", int64(len(p)))
+
+	if c.adaptive {
+		c.sampleIn, c.sampleOut = c.sampleIn+int64(len(p)), c.sampleOut+out
+		if c.sampleIn >= adaptiveSample {
+			if c.sampleOut*1000 > c.sampleIn*adaptiveMaxRatio {
+				stats.Add("adaptive_disabled", 1)
+				if err := c.end(); err != nil {
+					return len(p), err
+				}
+			}
+			c.sampleIn, c.sampleOut = 0, 0
+		}
+	}
+	return len(p), nil
+}
+
+// end finishes the compressed stream with the end frame, the rest is written as is
+func (c *Conn) end() error {
+	c.wraw = true
+	if err := c.enc.Close(); err != nil {
+		return err
+	}
+	c.fw.end()
+	_, err := c.flush()
+	return err
+}
+
+// flush writes pending frames at once
+func (c *Conn) flush() (int64, error) {
+	if len(c.fw.buf) == 0 {
+		return 0, nil
+	}
+	n, err := c.Conn.Write(c.fw.buf)
+	c.fw.buf = c.fw.buf[:0]
+	c.wireWritten.Add(int64(n))
+	stats.Add("wire_written", int64(n))
+	return int64(n), err
+}
+
+// CloseWrite ends the compressed stream before the FIN, so the peer reads a clean io.EOF
+func (c *Conn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if !c.wraw {
+		if err := c.end(); err != nil {
+			return err
+		}
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+// frameWriter collects compressed bytes into frames until flushed
+type frameWriter struct {
+	buf []byte
+	// offset of the length of the open frame, -1 if none
+	open int
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.open < 0 || len(w.buf) == 0 || len(w.buf)-w.open-2 >= maxFrame {
+			w.open = len(w.buf)
+			w.buf = append(w.buf, 0, 0)
+		}
+		size := maxFrame - (len(w.buf) - w.open - 2)
+		if size > len(p) {
+			size = len(p)
+		}
+		w.buf = append(w.buf, p[:size]...)
+		p = p[size:]
+		binary.BigEndian.PutUint16(w.buf[w.open:], uint16(len(w.buf)-w.open-2))
+	}
+	return n, nil
+}
+
+func (w *frameWriter) end() {
+	w.buf = append(w.buf, 0, 0)
+	w.open = -1
+}
+
+var errTruncated = errors.New("compressed stream truncated")
+
+// frameReader reads compressed bytes out of frames, io.EOF means the end frame
+type frameReader struct {
+	r    *bufio.Reader
+	left int
+	done bool
+}
+
+func (r *frameReader) next() error {
+	for r.left == 0 {
+		if r.done {
+			return io.EOF
+		}
+		var head [2]byte
+		if _, err := io.ReadFull(r.r, head[:]); err != nil {
+			// the peer is gone without ending the stream
+			if err == io.EOF {
+				return errTruncated
+			}
+			return err
+		}
+		r.left = int(binary.BigEndian.Uint16(head[:]))
+		r.done = r.left == 0
+	}
+	return nil
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if err := r.next(); err != nil {
+		return 0, err
+	}
+	if len(p) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= n
+	if err == io.EOF {
+		err = errTruncated
+	}
+	return n, err
+}
+
+// skip discards the rest of the compressed stream up to the end frame
+func (r *frameReader) skip() error {
+	for {
+		err := r.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := r.r.Discard(r.left); err != nil {
+			return errTruncated
+		}
+		r.left = 0
+	}
+}
+
+// ReadByte saves flate a bufio.Reader of its own
+func (r *frameReader) ReadByte() (byte, error) {
+	if err := r.next(); err != nil {
+		return 0, err
+	}
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.left--
+	} else if err == io.EOF {
+		err = errTruncated
+	}
+	return b, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	stats.Add("wire_read", int64(n))
+	return n, err
+}
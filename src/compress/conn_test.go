@@ -0,0 +1,204 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var algs = []byte{Flate, Zstd, Snappy}
+
+var text = bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: text/html\r\n\r\n"), 4096)
+
+// wire is a conn over a recorded stream, compressed bytes are written to and read from it
+type wire struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (w *wire) Read(p []byte) (int, error) {
+	return w.Buffer.Read(p)
+}
+
+func (w *wire) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p)
+}
+
+func newConn(t *testing.T, conn net.Conn, alg byte, adaptive bool) *Conn {
+	c, err := New(conn, alg, adaptive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// compressed returns the wire bytes of writes ended by CloseWrite
+func compressed(t *testing.T, alg byte, adaptive bool, writes ...[]byte) []byte {
+	w := &wire{}
+	c := newConn(t, w, alg, adaptive)
+	for _, b := range writes {
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Bytes()
+}
+
+// decompress reads wire bytes until an error
+func decompress(t *testing.T, alg byte, b []byte) ([]byte, error) {
+	w := &wire{}
+	w.Buffer.Write(b)
+	return io.ReadAll(newConn(t, w, alg, false))
+}
+
+func loopback(t *testing.T) (a, b *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = s.SetDeadline(time.Now().Add(5 * time.Second))
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func stat(name string) int64 {
+	if v, ok := stats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestConn(t *testing.T) {
+	for _, alg := range algs {
+		t.Run(Name(alg), func(t *testing.T) {
+			a, b := loopback(t)
+			agent, server := newConn(t, a, alg, false), newConn(t, b, alg, false)
+			// a short write and one spanning frames
+			for _, data := range [][]byte{[]byte("ping"), text} {
+				for _, dir := range []struct {
+					name     string
+					from, to *Conn
+				}{{"up", agent, server}, {"down", server, agent}} {
+					go func() { _, _ = dir.from.Write(data) }()
+					got := make([]byte, len(data))
+					if _, err := io.ReadFull(dir.to, got); err != nil || !bytes.Equal(got, data) {
+						t.Fatalf("%s %d bytes, err=%v", dir.name, len(data), err)
+					}
+				}
+			}
+			if agent.WireWritten()*10 > int64(len(text)) || agent.WireWritten() != server.WireRead() {
+				t.Fatalf("%d bytes written, %d read on the wire for %d bytes", agent.WireWritten(), server.WireRead(), len(text))
+			}
+
+			// the end frame comes before the fin, the other direction is still compressed
+			_ = agent.CloseWrite()
+			if n, err := server.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Fatalf("got %d bytes, err=%v, want io.EOF", n, err)
+			}
+			go func() { _, _ = server.Write([]byte("after fin")) }()
+			got := make([]byte, len("after fin"))
+			if _, err := io.ReadFull(agent, got); err != nil || string(got) != "after fin" {
+				t.Fatalf("got %q, err=%v", got, err)
+			}
+		})
+	}
+}
+
+func TestEndFrame(t *testing.T) {
+	for _, alg := range algs {
+		t.Run(Name(alg), func(t *testing.T) {
+			b := compressed(t, alg, false, []byte("first"), []byte("second"))
+			if !bytes.HasSuffix(b, []byte{0, 0}) {
+				t.Fatalf("got % x, want the end frame last", b)
+			}
+			if got, err := decompress(t, alg, b); string(got) != "firstsecond" || err != nil {
+				t.Fatalf("got %q, err=%v", got, err)
+			}
+			// raw bytes follow the end frame
+			if got, err := decompress(t, alg, append(b, "raw"...)); string(got) != "firstsecondraw" || err != nil {
+				t.Fatalf("got %q, err=%v", got, err)
+			}
+			// the peer is gone before the end frame
+			if _, err := decompress(t, alg, b[:len(b)-2]); !errors.Is(err, errTruncated) {
+				t.Fatalf("got %v, want %v", err, errTruncated)
+			}
+			if _, err := decompress(t, alg, b[:len(b)-3]); err == nil {
+				t.Fatal("truncated frame is read")
+			}
+		})
+	}
+
+	// frames are at most maxFrame long
+	w := &frameWriter{open: -1}
+	_, _ = w.Write(make([]byte, maxFrame+1))
+	w.end()
+	if len(w.buf) != 2+maxFrame+2+1+2 || w.buf[0] != 0xff || w.buf[1] != 0xff || w.buf[2+maxFrame+1] != 1 {
+		t.Fatalf("got %d bytes of frames", len(w.buf))
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	random := make([]byte, 2*adaptiveSample)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		adaptive bool
+		writes   [][]byte
+		disabled int64
+	}{
+		{name: "random", adaptive: true, writes: [][]byte{random[:adaptiveSample], random[adaptiveSample:], []byte("raw")}, disabled: 1},
+		{name: "text", adaptive: true, writes: [][]byte{text, text}},
+		{name: "not adaptive", writes: [][]byte{random}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &wire{}
+			conn := newConn(t, w, Zstd, c.adaptive)
+			disabled := stat("adaptive_disabled")
+			for i, b := range c.writes {
+				before := conn.WireWritten()
+				if _, err := conn.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				// the sample giving up compression is the last one compressed
+				if c.disabled > 0 && i > 0 && conn.WireWritten()-before != int64(len(b)) {
+					t.Fatalf("write %d got %d wire bytes for %d bytes, want them as is", i, conn.WireWritten()-before, len(b))
+				}
+			}
+			if got := stat("adaptive_disabled") - disabled; got != c.disabled {
+				t.Fatalf("disabled %d times, want %d", got, c.disabled)
+			}
+			sent := bytes.Join(c.writes, nil)
+			if c.disabled > 0 && !bytes.HasSuffix(w.Bytes(), sent[adaptiveSample:]) {
+				t.Fatal("data after the switch is not sent as is")
+			}
+			_ = conn.CloseWrite()
+			if got, err := io.ReadAll(newConn(t, w, Zstd, false)); !bytes.Equal(got, sent) || err != nil {
+				t.Fatalf("got %d bytes of %d, err=%v", len(got), len(sent), err)
+			}
+		})
+	}
+}
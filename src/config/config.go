@@ -0,0 +1,409 @@
+// Package config describes s5server and s5agent in a yaml or json file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ModeLocal  = "local"
+	ModeRemote = "remote"
+	ModeAgent  = "agent"
+
+	TransportTCP       = "tcp"
+	TransportWebSocket = "ws"
+	// websocket in tls
+	TransportWebSocketTLS = "wss"
+	DefaultWebSocketPath  = "/s5"
+	// streams of one QUIC connection over udp, in binaries built with -tags quic
+	TransportQUIC = "quic"
+
+	AuthNone     = "none"
+	AuthPassword = "password"
+
+	CommandConnect = "connect"
+
+	ChargePayload = "payload"
+	ChargeWire    = "wire"
+
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+type Config struct {
+	// local and remote for s5server, agent for s5agent
+	Mode      string     `json:"mode" yaml:"mode" env:"S5_MODE"`
+	Listeners []Listener `json:"listeners" yaml:"listeners"`
+	Server    Server     `json:"server" yaml:"server"`
+	Auth      Auth       `json:"auth" yaml:"auth"`
+	Quota     Quota      `json:"quota" yaml:"quota"`
+	Pipe      Pipe       `json:"pipe" yaml:"pipe"`
+	ACL       ACL        `json:"acl" yaml:"acl"`
+	Routing   Routing    `json:"routing" yaml:"routing"`
+	Log       Log        `json:"log" yaml:"log"`
+	Admin     Admin      `json:"admin" yaml:"admin"`
+	Shutdown  Shutdown   `json:"shutdown" yaml:"shutdown"`
+	Admission Admission  `json:"admission" yaml:"admission"`
+	// PROXY protocol behind or in front of L4 load balancers
+	ProxyProtocol ProxyProtocol `json:"proxy_protocol" yaml:"proxy_protocol"`
+	Lockout       Lockout       `json:"lockout" yaml:"lockout"`
+	Sources       Sources       `json:"sources" yaml:"sources"`
+}
+
+type Listener struct {
+	// tcp by default, tcp4, tcp6 and unix are supported as well
+	Network string `json:"network" yaml:"network"`
+	// ip:port, or the socket path for unix
+	Address string `json:"address" yaml:"address"`
+	// octal file permission of unix socket, e.g. "0660"
+	Perm string `json:"perm" yaml:"perm"`
+	// overrides the top level mode, so a listener can serve another protocol set
+	Mode string `json:"mode" yaml:"mode"`
+	// accepts PROXY protocol headers from proxy_protocol.trusted senders
+	ProxyProtocol bool `json:"proxy_protocol" yaml:"proxy_protocol"`
+	// listens again if the listener fails, instead of exiting
+	Relisten bool `json:"relisten" yaml:"relisten"`
+	// tcp by default, ws and wss accept agents upgrading to websocket on Path,
+	// quic accepts agents on the udp port of Address, it's not passed on upgrade
+	Transport string `json:"transport" yaml:"transport"`
+	Path      string `json:"path" yaml:"path"`
+	// certificate and key in pem, required by wss and quic
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+	// seals the stream of agents by a pre-shared key, e.g. where tls is blocked
+	Cipher  string `json:"cipher" yaml:"cipher"`
+	PSKFile string `json:"psk_file" yaml:"psk_file"`
+	// compression accepted from agents, one of flate, zstd, snappy each, none if empty
+	Compression []string `json:"compression" yaml:"compression"`
+}
+
+func (l Listener) NetworkOrDefault() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+func (l Listener) ModeOr(mode string) string {
+	if l.Mode == "" {
+		return mode
+	}
+	return l.Mode
+}
+
+func (l Listener) WebSocket() bool {
+	return l.Transport == TransportWebSocket || l.Transport == TransportWebSocketTLS
+}
+
+func (l Listener) QUIC() bool {
+	return l.Transport == TransportQUIC
+}
+
+func (l Listener) PathOrDefault() string {
+	return pathOrDefault(l.Path)
+}
+
+func (l Listener) FileMode() (os.FileMode, error) {
+	if l.Perm == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(l.Perm, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("illegal perm %s", l.Perm)
+	}
+	return os.FileMode(perm), nil
+}
+
+// Server is the socks server in remote mode, used by agent only
+type Server struct {
+	Address string `json:"address" yaml:"address" env:"S5_SERVER_ADDRESS"`
+	// comma separated upstream proxy chain to reach the server
+	Upstream string `json:"upstream" yaml:"upstream" env:"S5_SERVER_UPSTREAM" secret:"true"`
+	// tcp by default, ws and wss tunnel in websocket, e.g. through http proxies or cdns,
+	// quic carries connections in streams of one QUIC connection, e.g. on lossy mobile links
+	Transport string `json:"transport" yaml:"transport" env:"S5_SERVER_TRANSPORT"`
+	Path      string `json:"path" yaml:"path" env:"S5_SERVER_PATH"`
+	// Host header and tls server name of websocket, tls server name of quic, the host of Address if empty
+	Host string `json:"host" yaml:"host" env:"S5_SERVER_HOST"`
+	// pem certificates trusted by wss and quic besides system ones
+	CAFile string `json:"ca_file" yaml:"ca_file" env:"S5_SERVER_CA_FILE"`
+	// aes-256-gcm or chacha20-poly1305 sealing by the key in PSKFile, same as the listener of the server
+	Cipher  string `json:"cipher" yaml:"cipher" env:"S5_SERVER_CIPHER"`
+	PSKFile string `json:"psk_file" yaml:"psk_file" env:"S5_SERVER_PSK_FILE"`
+	// flate, zstd or snappy offered to the server, adaptive compression gives up on incompressible data
+	Compression         string `json:"compression" yaml:"compression" env:"S5_SERVER_COMPRESSION"`
+	AdaptiveCompression bool   `json:"adaptive_compression" yaml:"adaptive_compression" env:"S5_SERVER_ADAPTIVE_COMPRESSION"`
+}
+
+func (s Server) WebSocket() bool {
+	return s.Transport == TransportWebSocket || s.Transport == TransportWebSocketTLS
+}
+
+func (s Server) QUIC() bool {
+	return s.Transport == TransportQUIC
+}
+
+func (s Server) PathOrDefault() string {
+	return pathOrDefault(s.Path)
+}
+
+func pathOrDefault(path string) string {
+	if path == "" {
+		return DefaultWebSocketPath
+	}
+	return path
+}
+
+type Auth struct {
+	Methods  []string `json:"methods" yaml:"methods" env:"S5_AUTH_METHODS"`
+	Commands []string `json:"commands" yaml:"commands" env:"S5_AUTH_COMMANDS"`
+	// Users is a htpasswd file of bcrypt or argon2id hashes, required by the password method.
+	// It's reloaded once changed, edit it with s5server passwd.
+	Users string `json:"users" yaml:"users" env:"S5_AUTH_USERS"`
+	// LDAP is consulted by the password method for users not in Users, disabled if URL is empty
+	LDAP LDAP `json:"ldap" yaml:"ldap"`
+	// Tokens are signed credentials passed as the password, mint them with s5server token
+	Tokens Tokens `json:"tokens" yaml:"tokens"`
+}
+
+// Tokens are verified offline by Keys, disabled if Keys is empty
+type Tokens struct {
+	Keys []TokenKey `json:"keys" yaml:"keys"`
+	// Leeway tolerates clock skew on expiry
+	Leeway Duration `json:"leeway" yaml:"leeway" env:"S5_AUTH_TOKENS_LEEWAY"`
+}
+
+type TokenKey struct {
+	// ID is matched against the kid of tokens, tokens without kid are tried on all keys
+	ID string `json:"id" yaml:"id"`
+	// Algorithm is one of HS256, RS256, EdDSA, compact tokens are signed by HS256 keys
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	// File is the secret of HS256 or the pem public key of RS256 and EdDSA
+	File string `json:"file" yaml:"file"`
+}
+
+// LDAP searches the user entry by the service account, then binds with the user password
+type LDAP struct {
+	URL          string `json:"url" yaml:"url" env:"S5_AUTH_LDAP_URL"`
+	StartTLS     bool   `json:"start_tls" yaml:"start_tls" env:"S5_AUTH_LDAP_START_TLS"`
+	BindDN       string `json:"bind_dn" yaml:"bind_dn" env:"S5_AUTH_LDAP_BIND_DN"`
+	BindPassword string `json:"bind_password" yaml:"bind_password" env:"S5_AUTH_LDAP_BIND_PASSWORD" secret:"true"`
+	BaseDN       string `json:"base_dn" yaml:"base_dn" env:"S5_AUTH_LDAP_BASE_DN"`
+	// UserFilter has a %s for the username
+	UserFilter     string `json:"user_filter" yaml:"user_filter" env:"S5_AUTH_LDAP_USER_FILTER"`
+	GroupAttribute string `json:"group_attribute" yaml:"group_attribute" env:"S5_AUTH_LDAP_GROUP_ATTRIBUTE"`
+	// Roles maps group DNs to roles matched by acl rules
+	Roles    map[string]string `json:"roles" yaml:"roles"`
+	CacheTTL Duration          `json:"cache_ttl" yaml:"cache_ttl" env:"S5_AUTH_LDAP_CACHE_TTL"`
+	Timeout  Duration          `json:"timeout" yaml:"timeout" env:"S5_AUTH_LDAP_TIMEOUT"`
+}
+
+type Quota struct {
+	PerHour          units.Base2Bytes `json:"per_hour" yaml:"per_hour" env:"S5_QUOTA_PER_HOUR"`
+	UpdateInterval   Duration         `json:"update_interval" yaml:"update_interval" env:"S5_QUOTA_UPDATE_INTERVAL"`
+	DialTimeout      Duration         `json:"dial_timeout" yaml:"dial_timeout" env:"S5_DIAL_TIMEOUT"`
+	AnalysisInterval Duration         `json:"analysis_interval" yaml:"analysis_interval" env:"S5_ANALYSIS_INTERVAL"`
+	// payload charges bytes clients send and receive, wire charges compressed bytes to the server
+	Charge string `json:"charge" yaml:"charge" env:"S5_QUOTA_CHARGE"`
+}
+
+type Pipe struct {
+	// a direction still running this long after the other one is closed is stopped, 0 waits forever
+	Linger Duration `json:"linger" yaml:"linger" env:"S5_PIPE_LINGER"`
+}
+
+type ACL struct {
+	Default string    `json:"default" yaml:"default" env:"S5_ACL_DEFAULT"`
+	Rules   []ACLRule `json:"rules" yaml:"rules"`
+}
+
+// ACLRule matches when all non-empty fields match
+type ACLRule struct {
+	Action  string   `json:"action" yaml:"action"`
+	Domains []string `json:"domains" yaml:"domains"`
+	CIDRs   []string `json:"cidrs" yaml:"cidrs"`
+	Ports   []string `json:"ports" yaml:"ports"`
+	Users   []string `json:"users" yaml:"users"`
+	Roles   []string `json:"roles" yaml:"roles"`
+}
+
+// Routing rules are either declared inline or in RulesFile
+type Routing struct {
+	RulesFile string `json:"rules_file" yaml:"rules_file" env:"S5_ROUTING_RULES_FILE"`
+	// comma separated upstream proxy chain for direct connections
+	Upstream  string      `json:"upstream" yaml:"upstream" env:"S5_ROUTING_UPSTREAM" secret:"true"`
+	GeoIP     string      `json:"geoip" yaml:"geoip"`
+	Outbounds []Outbound  `json:"outbounds" yaml:"outbounds"`
+	Rules     []RouteRule `json:"rules" yaml:"rules"`
+	Default   string      `json:"default" yaml:"default"`
+}
+
+type Outbound struct {
+	Name string   `json:"name" yaml:"name"`
+	Kind string   `json:"kind" yaml:"kind"`
+	Args []string `json:"args" yaml:"args" secret:"true"`
+	Via  string   `json:"via" yaml:"via"`
+}
+
+type RouteRule struct {
+	Type     string   `json:"type" yaml:"type"`
+	Values   []string `json:"values" yaml:"values"`
+	Outbound string   `json:"outbound" yaml:"outbound"`
+}
+
+type Log struct {
+	Level  string `json:"level" yaml:"level" env:"S5_LOG_LEVEL"`
+	Format string `json:"format" yaml:"format" env:"S5_LOG_FORMAT"`
+	File   string `json:"file" yaml:"file" env:"S5_LOG_FILE"`
+	// Access logs a line per closed connection at info level
+	Access bool `json:"access" yaml:"access" env:"S5_LOG_ACCESS"`
+}
+
+// Admin serves health and statistic endpoints over http, disabled if Listen is empty
+type Admin struct {
+	Listen string `json:"listen" yaml:"listen" env:"S5_ADMIN_LISTEN"`
+}
+
+// Shutdown happens on SIGTERM/SIGINT, or after handing listeners to a new process on SIGUSR2
+type Shutdown struct {
+	// in-flight connections are waited at most DrainTimeout
+	DrainTimeout Duration `json:"drain_timeout" yaml:"drain_timeout" env:"S5_DRAIN_TIMEOUT"`
+	// the new process should be serving in UpgradeTimeout, otherwise it's killed
+	UpgradeTimeout Duration `json:"upgrade_timeout" yaml:"upgrade_timeout" env:"S5_UPGRADE_TIMEOUT"`
+}
+
+// Admission limits connections before they are served, zero means unlimited
+type Admission struct {
+	MaxSessions         int     `json:"max_sessions" yaml:"max_sessions" env:"S5_MAX_SESSIONS"`
+	MaxSessionsPerIP    int     `json:"max_sessions_per_ip" yaml:"max_sessions_per_ip" env:"S5_MAX_SESSIONS_PER_IP"`
+	MaxSessionsPerUser  int     `json:"max_sessions_per_user" yaml:"max_sessions_per_user" env:"S5_MAX_SESSIONS_PER_USER"`
+	NewConnsPerSecPerIP float64 `json:"new_conns_per_sec_per_ip" yaml:"new_conns_per_sec_per_ip" env:"S5_NEW_CONNS_PER_SEC_PER_IP"`
+}
+
+// Sources filters clients by ip before anything is read, deny wins over allow. If allow is empty
+// and the none auth method is enabled, only loopback and private ranges are allowed.
+// List files have a cidr or an ip per line and # comments, they are re-read on reload.
+type Sources struct {
+	Allow     []string `json:"allow" yaml:"allow" env:"S5_SOURCES_ALLOW"`
+	Deny      []string `json:"deny" yaml:"deny" env:"S5_SOURCES_DENY"`
+	AllowFile string   `json:"allow_file" yaml:"allow_file" env:"S5_SOURCES_ALLOW_FILE"`
+	DenyFile  string   `json:"deny_file" yaml:"deny_file" env:"S5_SOURCES_DENY_FILE"`
+}
+
+// Lockout rejects ips and usernames failing authentication too often, zero max_failures disables it.
+// Bans are managed by the admin api.
+type Lockout struct {
+	MaxFailures int      `json:"max_failures" yaml:"max_failures" env:"S5_LOCKOUT_MAX_FAILURES"`
+	Window      Duration `json:"window" yaml:"window" env:"S5_LOCKOUT_WINDOW"`
+	// Duration of the first lockout, doubled by every following one up to MaxDuration
+	Duration    Duration `json:"duration" yaml:"duration" env:"S5_LOCKOUT_DURATION"`
+	MaxDuration Duration `json:"max_duration" yaml:"max_duration" env:"S5_LOCKOUT_MAX_DURATION"`
+	// Tarpit delays failure replies
+	Tarpit Duration `json:"tarpit" yaml:"tarpit" env:"S5_LOCKOUT_TARPIT"`
+}
+
+type ProxyProtocol struct {
+	// cidrs of load balancers allowed to send headers, unix peers are always trusted
+	Trusted       []string `json:"trusted" yaml:"trusted" env:"S5_PROXY_PROTOCOL_TRUSTED"`
+	HeaderTimeout Duration `json:"header_timeout" yaml:"header_timeout" env:"S5_PROXY_PROTOCOL_HEADER_TIMEOUT"`
+	// v1 or v2 to send headers on outbound connections, disabled if empty
+	Send string `json:"send" yaml:"send" env:"S5_PROXY_PROTOCOL_SEND"`
+}
+
+func Default(mode string) *Config {
+	return &Config{
+		Mode:      mode,
+		Listeners: []Listener{{Address: "0.0.0.0:1080"}},
+		Server:    Server{Address: "0.0.0.0:1081"},
+		Auth: Auth{
+			Methods:  []string{AuthNone},
+			Commands: []string{CommandConnect},
+			LDAP: LDAP{
+				UserFilter:     "(uid=%s)",
+				GroupAttribute: "memberOf",
+				CacheTTL:       Duration(5 * time.Minute),
+				Timeout:        Duration(5 * time.Second),
+			},
+			Tokens: Tokens{Leeway: Duration(30 * time.Second)},
+		},
+		Quota: Quota{
+			PerHour:          10 * units.GiB,
+			UpdateInterval:   Duration(time.Hour),
+			DialTimeout:      Duration(30 * time.Second),
+			AnalysisInterval: Duration(2 * time.Minute),
+			Charge:           ChargePayload,
+		},
+		Pipe: Pipe{Linger: Duration(30 * time.Second)},
+		ACL:  ACL{Default: ActionAllow},
+		Log:  Log{Level: "info", Format: "text"},
+		Shutdown: Shutdown{
+			DrainTimeout:   Duration(time.Minute),
+			UpgradeTimeout: Duration(30 * time.Second),
+		},
+		Admission:     Admission{MaxSessions: 10000},
+		ProxyProtocol: ProxyProtocol{HeaderTimeout: Duration(5 * time.Second)},
+		Lockout: Lockout{
+			MaxFailures: 5,
+			Window:      Duration(10 * time.Minute),
+			Duration:    Duration(time.Minute),
+			MaxDuration: Duration(time.Hour),
+		},
+	}
+}
+
+// Load reads the file over defaults of mode then applies environment variable overrides,
+// the format is decided by extension, .json or .yaml/.yml
+func Load(path, mode string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read config file, err=%w", err)
+	}
+
+	cfg := Default(mode)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	default:
+		return nil, fmt.Errorf("unknown config format %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse config file, err=%w", err)
+	}
+
+	if err := ApplyEnv(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Duration accepts strings like "30s" in both json and yaml
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	cases := []struct {
+		name, content string
+	}{
+		{name: "s5.yaml", content: `
+mode: remote
+listeners:
+  - address: 127.0.0.1:1081
+    compression: [zstd]
+quota:
+  per_hour: 1GiB
+  update_interval: 30m
+admission:
+  max_sessions_per_ip: 8
+`},
+		{name: "s5.yml", content: "listeners: [{address: 127.0.0.1:1081, compression: [zstd]}]\n" +
+			"quota: {per_hour: 1GiB, update_interval: 30m}\nadmission: {max_sessions_per_ip: 8}\n"},
+		{name: "s5.json", content: `{
+	"listeners": [{"address": "127.0.0.1:1081", "compression": ["zstd"]}],
+	"quota": {"per_hour": "1GiB", "update_interval": "30m"},
+	"admission": {"max_sessions_per_ip": 8}
+}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := Load(writeFile(t, c.name, c.content), ModeRemote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Default(ModeRemote)
+			want.Listeners = []Listener{{Address: "127.0.0.1:1081", Compression: []string{"zstd"}}}
+			want.Quota.PerHour = units.GiB
+			want.Quota.UpdateInterval = Duration(30 * time.Minute)
+			want.Admission.MaxSessionsPerIP = 8
+			// everything else keeps the defaults, e.g. max_sessions next to max_sessions_per_ip
+			if !reflect.DeepEqual(cfg, want) {
+				t.Fatalf("got %+v\nwant %+v", cfg, want)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name, content string
+		// part of the error
+		want string
+	}{
+		{name: "s5.yaml", content: "listeners:\n  - address: 127.0.0.1:1080\n    adress: typo\n", want: "field adress not found"},
+		{name: "s5.yaml", content: "qouta:\n  per_hour: 1GiB\n", want: "field qouta not found"},
+		{name: "s5.json", content: `{"quota": {"per_hour": "1GiB", "perhour": "2GiB"}}`, want: `unknown field "perhour"`},
+		{name: "s5.yaml", content: "pipe:\n  linger: soon\n", want: "fail to parse config file"},
+		{name: "s5.json", content: `{"mode": `, want: "fail to parse config file"},
+		{name: "s5.toml", content: "mode = \"local\"\n", want: "unknown config format .toml"},
+	}
+	for _, c := range cases {
+		t.Run(c.want, func(t *testing.T) {
+			if _, err := Load(writeFile(t, c.name, c.content), ModeLocal); err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("got %v, want %q", err, c.want)
+			}
+		})
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), ModeLocal); err == nil {
+		t.Fatal("missing file is loaded")
+	}
+}
+
+func TestLoadAppliesEnv(t *testing.T) {
+	t.Setenv("S5_LOG_LEVEL", "debug")
+	cfg, err := Load(writeFile(t, "s5.yaml", "log:\n  level: warn\n  format: json\n"), ModeLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the environment wins over the file
+	if cfg.Log.Level != "debug" || cfg.Log.Format != "json" {
+		t.Fatalf("got %+v", cfg.Log)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	cases := []struct {
+		perm string
+		want os.FileMode
+		ok   bool
+	}{
+		{perm: "", want: 0, ok: true},
+		{perm: "0660", want: 0660, ok: true},
+		{perm: "600", want: 0600, ok: true},
+		{perm: "0999"},
+		{perm: "01777"},
+		{perm: "rw"},
+	}
+	for _, c := range cases {
+		got, err := Listener{Perm: c.perm}.FileMode()
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("%q got %o, err=%v", c.perm, got, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff lists changed fields as "path: old -> new", sorted by path.
+// Values of fields tagged secret:"true" are printed as <redacted>, e.g. passwords and proxy urls with credentials.
+func Diff(old, new *Config) []string {
+	before, after := flatten(old), flatten(new)
+
+	var ret []string
+	for path, v := range before {
+		if w, ok := after[path]; !ok {
+			ret = append(ret, fmt.Sprintf("%s: %s -> <none>", path, v))
+		} else if v.value != w.value {
+			ret = append(ret, fmt.Sprintf("%s: %s -> %s", path, v, w))
+		}
+	}
+	for path, w := range after {
+		if _, ok := before[path]; !ok {
+			ret = append(ret, fmt.Sprintf("%s: <none> -> %s", path, w))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// leaf is a json encoded value
+type leaf struct {
+	value  string
+	secret bool
+}
+
+func (l leaf) String() string {
+	if l.secret && l.value != `""` && l.value != "null" {
+		return "<redacted>"
+	}
+	return l.value
+}
+
+// flatten maps dotted paths to leaf values
+func flatten(cfg *Config) map[string]leaf {
+	data, _ := json.Marshal(cfg)
+	var tree interface{}
+	_ = json.Unmarshal(data, &tree)
+
+	secrets := make(map[string]bool)
+	secretPaths(reflect.ValueOf(*cfg), "", secrets)
+
+	ret := make(map[string]leaf)
+	var walk func(prefix string, v interface{}, secret bool)
+	walk = func(prefix string, v interface{}, secret bool) {
+		// everything under a secret field is secret
+		secret = secret || secrets[prefix]
+		switch node := v.(type) {
+		case map[string]interface{}:
+			for k, child := range node {
+				if prefix != "" {
+					k = prefix + "." + k
+				}
+				walk(k, child, secret)
+			}
+		case []interface{}:
+			for i, child := range node {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), child, secret)
+			}
+		default:
+			value, _ := json.Marshal(node)
+			ret[prefix] = leaf{value: string(value), secret: secret}
+		}
+	}
+	walk("", tree, false)
+	return ret
+}
+
+// secretPaths collects paths of fields tagged secret:"true", named as flatten does
+func secretPaths(v reflect.Value, prefix string, ret map[string]bool) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			if f.Tag.Get("secret") == "true" {
+				ret[name] = true
+				continue
+			}
+			secretPaths(v.Field(i), name, ret)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			secretPaths(v.Index(i), fmt.Sprintf("%s[%d]", prefix, i), ret)
+		}
+	}
+}
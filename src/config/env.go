@@ -0,0 +1,100 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envListen overrides all listeners, comma separated,
+// unix sockets are prefixed by "unix:"
+const envListen = "S5_LISTEN"
+
+// ApplyEnv overrides fields tagged with env by environment variables,
+// lists are comma separated
+func ApplyEnv(cfg *Config) error {
+	if v, ok := os.LookupEnv(envListen); ok {
+		cfg.Listeners = cfg.Listeners[:0]
+		for _, addr := range splitList(v) {
+			if strings.HasPrefix(addr, "unix:") {
+				cfg.Listeners = append(cfg.Listeners, Listener{Network: "unix", Address: strings.TrimPrefix(addr, "unix:")})
+			} else {
+				cfg.Listeners = append(cfg.Listeners, Listener{Address: addr})
+			}
+		}
+	}
+	return applyEnv(reflect.ValueOf(cfg).Elem())
+}
+
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+
+		name, ok := field.Tag.Lookup("env")
+		if !ok {
+			if value.Kind() == reflect.Struct {
+				if err := applyEnv(value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(value, env); err != nil {
+			return fmt.Errorf("illegal environment variable %s, err=%w", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		v.Set(reflect.ValueOf(splitList(s)))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
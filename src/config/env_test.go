@@ -0,0 +1,68 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+)
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"S5_MODE":                     "remote",
+		"S5_LISTEN":                   "127.0.0.1:1080, unix:/run/s5.sock,",
+		"S5_SERVER_ADDRESS":           "10.0.0.1:1081",
+		"S5_AUTH_METHODS":             "none,password",
+		"S5_AUTH_LDAP_TIMEOUT":        "3s",
+		"S5_QUOTA_PER_HOUR":           "2GiB",
+		"S5_LOG_ACCESS":               "true",
+		"S5_MAX_SESSIONS":             "64",
+		"S5_NEW_CONNS_PER_SEC_PER_IP": "0.5",
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg := Default(ModeLocal)
+	cfg.Listeners = append(cfg.Listeners, Listener{Address: "127.0.0.1:1082", Mode: ModeRemote})
+	if err := ApplyEnv(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default(ModeLocal)
+	want.Mode = ModeRemote
+	// S5_LISTEN replaces all listeners
+	want.Listeners = []Listener{{Address: "127.0.0.1:1080"}, {Network: "unix", Address: "/run/s5.sock"}}
+	want.Server.Address = "10.0.0.1:1081"
+	want.Auth.Methods = []string{AuthNone, AuthPassword}
+	want.Auth.LDAP.Timeout = Duration(3 * time.Second)
+	want.Quota.PerHour = 2 * units.GiB
+	want.Log.Access = true
+	want.Admission.MaxSessions = 64
+	want.Admission.NewConnsPerSecPerIP = 0.5
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("got %+v\nwant %+v", cfg, want)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	cases := []struct {
+		name, value string
+	}{
+		{name: "S5_LOG_ACCESS", value: "maybe"},
+		{name: "S5_MAX_SESSIONS", value: "many"},
+		{name: "S5_NEW_CONNS_PER_SEC_PER_IP", value: "fast"},
+		{name: "S5_PIPE_LINGER", value: "30"},
+		{name: "S5_QUOTA_PER_HOUR", value: "lots"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(c.name, c.value)
+			err := ApplyEnv(Default(ModeLocal))
+			if err == nil || !strings.Contains(err.Error(), "illegal environment variable "+c.name) {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
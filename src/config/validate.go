@@ -0,0 +1,337 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/aead"
+	"socks5-proxy/src/compress"
+	"socks5-proxy/src/proxyproto"
+	"socks5-proxy/src/route"
+)
+
+// Validate checks the whole config and reports all problems at once
+func (cfg *Config) Validate() error {
+	v := &validator{}
+
+	switch cfg.Mode {
+	case ModeLocal, ModeRemote, ModeAgent:
+	default:
+		v.fail("mode", "should be one of local, remote, agent")
+	}
+
+	if len(cfg.Listeners) == 0 {
+		v.fail("listeners", "should not be empty")
+	}
+	for i, l := range cfg.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		switch l.NetworkOrDefault() {
+		case "tcp", "tcp4", "tcp6":
+			v.hostPort(field+".address", l.Address)
+			if l.Perm != "" {
+				v.fail(field+".perm", "only for unix socket")
+			}
+		case "unix":
+			if l.Address == "" {
+				v.fail(field+".address", "should not be empty")
+			}
+			if _, err := l.FileMode(); err != nil {
+				v.fail(field+".perm", err.Error())
+			}
+		default:
+			v.fail(field+".network", "should be one of tcp, tcp4, tcp6, unix")
+		}
+		if l.ProxyProtocol && l.NetworkOrDefault() != "unix" && len(cfg.ProxyProtocol.Trusted) == 0 {
+			v.fail(field+".proxy_protocol", "proxy_protocol.trusted should not be empty")
+		}
+		switch l.Transport {
+		case "", TransportTCP:
+		case TransportWebSocket, TransportWebSocketTLS:
+			if l.ModeOr(cfg.Mode) != ModeRemote {
+				v.fail(field+".transport", "websocket only serves agents in remote mode")
+			}
+			v.path(field+".path", l.Path)
+			if l.Transport == TransportWebSocketTLS && (l.CertFile == "" || l.KeyFile == "") {
+				v.fail(field+".cert_file", "cert_file and key_file are required by wss")
+			}
+		case TransportQUIC:
+			if l.ModeOr(cfg.Mode) != ModeRemote {
+				v.fail(field+".transport", "quic only serves agents in remote mode")
+			}
+			if l.NetworkOrDefault() == "unix" {
+				v.fail(field+".network", "quic listens on udp")
+			}
+			if l.ProxyProtocol {
+				v.fail(field+".proxy_protocol", "not supported by quic")
+			}
+			if l.CertFile == "" || l.KeyFile == "" {
+				v.fail(field+".cert_file", "cert_file and key_file are required by quic")
+			}
+		default:
+			v.fail(field+".transport", "should be one of tcp, ws, wss, quic")
+		}
+		if l.Cipher != "" && l.ModeOr(cfg.Mode) != ModeRemote {
+			v.fail(field+".cipher", "only serves agents in remote mode")
+		}
+		v.cipher(field, l.Cipher, l.PSKFile)
+		if len(l.Compression) > 0 && l.ModeOr(cfg.Mode) != ModeRemote {
+			v.fail(field+".compression", "only accepted from agents in remote mode")
+		}
+		for _, name := range l.Compression {
+			v.compression(field+".compression", name)
+		}
+		// agent and server protocol sets can't be mixed in one process
+		mode := l.ModeOr(cfg.Mode)
+		if (mode == ModeAgent) != (cfg.Mode == ModeAgent) || (mode != ModeLocal && mode != ModeRemote && mode != ModeAgent) {
+			v.fail(field+".mode", fmt.Sprintf("illegal mode %s", mode))
+		}
+	}
+
+	if cfg.Mode == ModeAgent {
+		v.hostPort("server.address", cfg.Server.Address)
+		switch cfg.Server.Transport {
+		case "", TransportTCP:
+		case TransportWebSocket, TransportWebSocketTLS:
+			v.path("server.path", cfg.Server.Path)
+		case TransportQUIC:
+			if cfg.Server.Upstream != "" {
+				v.fail("server.upstream", "upstream proxies can't pass quic")
+			}
+		default:
+			v.fail("server.transport", "should be one of tcp, ws, wss, quic")
+		}
+		v.cipher("server", cfg.Server.Cipher, cfg.Server.PSKFile)
+		if cfg.Server.Compression != "" {
+			v.compression("server.compression", cfg.Server.Compression)
+		}
+	}
+
+	if cfg.Mode != ModeRemote {
+		if len(cfg.Auth.Methods) == 0 {
+			v.fail("auth.methods", "should not be empty")
+		}
+		for _, m := range cfg.Auth.Methods {
+			switch m {
+			case AuthNone:
+			case AuthPassword:
+				if cfg.Auth.Users == "" && cfg.Auth.LDAP.URL == "" && len(cfg.Auth.Tokens.Keys) == 0 {
+					v.fail("auth.users", "one of users, ldap.url, tokens.keys is required by the password method")
+				}
+			default:
+				v.fail("auth.methods", fmt.Sprintf("unsupported method %s", m))
+			}
+		}
+	}
+	if l := cfg.Auth.LDAP; l.URL != "" {
+		if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			v.fail("auth.ldap.url", "should be ldap://host:port or ldaps://host:port")
+		}
+		if l.BaseDN == "" {
+			v.fail("auth.ldap.base_dn", "should not be empty")
+		}
+		if strings.Count(l.UserFilter, "%s") != 1 || strings.Count(l.UserFilter, "%") != 1 {
+			v.fail("auth.ldap.user_filter", "should have exactly one %s for the username")
+		}
+		if l.CacheTTL < 0 {
+			v.fail("auth.ldap.cache_ttl", "should not be negative")
+		}
+		if l.Timeout <= 0 {
+			v.fail("auth.ldap.timeout", "should be positive")
+		}
+	}
+	ids := make(map[string]bool)
+	for i, k := range cfg.Auth.Tokens.Keys {
+		field := fmt.Sprintf("auth.tokens.keys[%d]", i)
+		switch k.Algorithm {
+		case "HS256", "RS256", "EdDSA":
+		default:
+			v.fail(field+".algorithm", "should be one of HS256, RS256, EdDSA")
+		}
+		if k.File == "" {
+			v.fail(field+".file", "should not be empty")
+		}
+		if k.ID != "" && ids[k.ID] {
+			v.fail(field+".id", fmt.Sprintf("duplicated id %s", k.ID))
+		}
+		ids[k.ID] = true
+	}
+	if cfg.Auth.Tokens.Leeway < 0 {
+		v.fail("auth.tokens.leeway", "should not be negative")
+	}
+	if len(cfg.Auth.Commands) == 0 {
+		v.fail("auth.commands", "should not be empty")
+	}
+	for _, c := range cfg.Auth.Commands {
+		if c != CommandConnect {
+			v.fail("auth.commands", fmt.Sprintf("unsupported command %s", c))
+		}
+	}
+
+	if cfg.Quota.PerHour <= 0 {
+		v.fail("quota.per_hour", "should be positive")
+	}
+	if cfg.Quota.UpdateInterval <= 0 {
+		v.fail("quota.update_interval", "should be positive")
+	}
+	if cfg.Quota.DialTimeout <= 0 {
+		v.fail("quota.dial_timeout", "should be positive")
+	}
+	if cfg.Quota.AnalysisInterval <= 0 {
+		v.fail("quota.analysis_interval", "should be positive")
+	}
+	if cfg.Quota.Charge != ChargePayload && cfg.Quota.Charge != ChargeWire {
+		v.fail("quota.charge", "should be one of payload, wire")
+	}
+
+	if cfg.Pipe.Linger < 0 {
+		v.fail("pipe.linger", "should not be negative")
+	}
+
+	v.action("acl.default", cfg.ACL.Default)
+	for i, rule := range cfg.ACL.Rules {
+		field := fmt.Sprintf("acl.rules[%d]", i)
+		v.action(field+".action", rule.Action)
+		if len(rule.Domains)+len(rule.CIDRs)+len(rule.Ports)+len(rule.Users)+len(rule.Roles) == 0 {
+			v.fail(field, "should match on at least one of domains, cidrs, ports, users, roles")
+		}
+		if _, err := route.ParseCIDR(rule.CIDRs); err != nil {
+			v.fail(field+".cidrs", err.Error())
+		}
+		if _, err := route.ParsePort(rule.Ports); err != nil {
+			v.fail(field+".ports", err.Error())
+		}
+	}
+
+	r := cfg.Routing
+	inline := len(r.Outbounds) > 0 || len(r.Rules) > 0 || r.Default != "" || r.GeoIP != ""
+	if inline && r.RulesFile != "" {
+		v.fail("routing", "rules_file and inline rules are exclusive")
+	}
+	if inline && r.Default == "" {
+		v.fail("routing.default", "should not be empty")
+	}
+	for i, out := range r.Outbounds {
+		if out.Name == "" || out.Kind == "" {
+			v.fail(fmt.Sprintf("routing.outbounds[%d]", i), "name and kind are required")
+		}
+	}
+	for i, rule := range r.Rules {
+		if rule.Type == "" || len(rule.Values) == 0 || rule.Outbound == "" {
+			v.fail(fmt.Sprintf("routing.rules[%d]", i), "type, values and outbound are required")
+		}
+	}
+
+	if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+		v.fail("log.level", err.Error())
+	}
+	switch cfg.Log.Format {
+	case "text", "json":
+	default:
+		v.fail("log.format", "should be one of text, json")
+	}
+
+	if cfg.Admin.Listen != "" {
+		v.hostPort("admin.listen", cfg.Admin.Listen)
+	}
+
+	if cfg.Shutdown.DrainTimeout <= 0 {
+		v.fail("shutdown.drain_timeout", "should be positive")
+	}
+	if cfg.Shutdown.UpgradeTimeout <= 0 {
+		v.fail("shutdown.upgrade_timeout", "should be positive")
+	}
+
+	a := cfg.Admission
+	if a.MaxSessions < 0 || a.MaxSessionsPerIP < 0 || a.MaxSessionsPerUser < 0 || a.NewConnsPerSecPerIP < 0 {
+		v.fail("admission", "limits should not be negative")
+	}
+
+	if _, err := proxyproto.ParseTrusted(cfg.ProxyProtocol.Trusted); err != nil {
+		v.fail("proxy_protocol.trusted", err.Error())
+	}
+	if cfg.ProxyProtocol.HeaderTimeout <= 0 {
+		v.fail("proxy_protocol.header_timeout", "should be positive")
+	}
+	switch cfg.ProxyProtocol.Send {
+	case "", "v1", "v2":
+	default:
+		v.fail("proxy_protocol.send", "should be one of v1, v2")
+	}
+
+	if _, err := src.ParsePrefixes(cfg.Sources.Allow); err != nil {
+		v.fail("sources.allow", err.Error())
+	}
+	if _, err := src.ParsePrefixes(cfg.Sources.Deny); err != nil {
+		v.fail("sources.deny", err.Error())
+	}
+
+	l := cfg.Lockout
+	if l.MaxFailures < 0 || l.Tarpit < 0 {
+		v.fail("lockout", "max_failures and tarpit should not be negative")
+	}
+	if l.MaxFailures > 0 && (l.Window <= 0 || l.Duration <= 0 || l.MaxDuration < l.Duration) {
+		v.fail("lockout", "window and duration should be positive, max_duration should not be less than duration")
+	}
+
+	return v.err()
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) fail(field, msg string) {
+	v.problems = append(v.problems, fmt.Sprintf("%s: %s", field, msg))
+}
+
+func (v *validator) hostPort(field, addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		v.fail(field, err.Error())
+	}
+}
+
+// path of websocket, empty for the default
+func (v *validator) path(field, path string) {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		v.fail(field, "should start with /")
+	}
+}
+
+// cipher of the agent and server stream, disabled if empty
+func (v *validator) cipher(field, cipher, pskFile string) {
+	switch cipher {
+	case "":
+		return
+	case aead.AES256GCM, aead.ChaCha20Poly1305:
+	default:
+		v.fail(field+".cipher", "should be one of aes-256-gcm, chacha20-poly1305")
+	}
+	if pskFile == "" {
+		v.fail(field+".psk_file", "should not be empty")
+	}
+}
+
+func (v *validator) compression(field, name string) {
+	if _, ok := compress.Parse(name); !ok {
+		v.fail(field, fmt.Sprintf("unknown compression %s, should be one of flate, zstd, snappy", name))
+	}
+}
+
+func (v *validator) action(field, action string) {
+	if action != ActionAllow && action != ActionDeny {
+		v.fail(field, "should be one of allow, deny")
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid config:\n\t" + strings.Join(v.problems, "\n\t"))
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		mode   string
+		mutate func(cfg *Config)
+		// problems reported, all of them
+		want []string
+	}{
+		{name: "mode", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Mode = "relay" }, want: []string{
+			"mode: should be one of local, remote, agent", "listeners[0].mode: illegal mode relay",
+		}},
+		{name: "no listeners", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners = nil }, want: []string{"listeners: should not be empty"}},
+		{name: "listener address", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners[0].Address = "1080" }, want: []string{"listeners[0].address: "}},
+		{name: "perm of tcp", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners[0].Perm = "0600" }, want: []string{"listeners[0].perm: only for unix socket"}},
+		{name: "unix perm", mode: ModeLocal, mutate: func(cfg *Config) {
+			cfg.Listeners[0] = Listener{Network: "unix", Address: "/run/s5.sock", Perm: "0999"}
+		}, want: []string{"listeners[0].perm: "}},
+		{name: "network", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners[0].Network = "udp" }, want: []string{"listeners[0].network: should be one of tcp, tcp4, tcp6, unix"}},
+		{name: "untrusted proxy protocol", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners[0].ProxyProtocol = true }, want: []string{"listeners[0].proxy_protocol: proxy_protocol.trusted should not be empty"}},
+		{name: "websocket in local mode", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners[0].Transport = TransportWebSocket }, want: []string{"listeners[0].transport: websocket only serves agents in remote mode"}},
+		{name: "wss without cert", mode: ModeRemote, mutate: func(cfg *Config) {
+			cfg.Listeners[0].Transport, cfg.Listeners[0].Path = TransportWebSocketTLS, "tunnel"
+		}, want: []string{"listeners[0].path: should start with /", "listeners[0].cert_file: cert_file and key_file are required by wss"}},
+		{name: "cipher", mode: ModeRemote, mutate: func(cfg *Config) { cfg.Listeners[0].Cipher = "rc4" }, want: []string{
+			"listeners[0].cipher: should be one of aes-256-gcm, chacha20-poly1305", "listeners[0].psk_file: should not be empty",
+		}},
+		{name: "compression", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Listeners[0].Compression = []string{"lz4"} }, want: []string{
+			"listeners[0].compression: only accepted from agents in remote mode", "listeners[0].compression: unknown compression lz4",
+		}},
+		{name: "agent listener in remote mode", mode: ModeRemote, mutate: func(cfg *Config) { cfg.Listeners[0].Mode = ModeAgent }, want: []string{"listeners[0].mode: illegal mode agent"}},
+		{name: "server address", mode: ModeAgent, mutate: func(cfg *Config) { cfg.Server.Address = "" }, want: []string{"server.address: "}},
+		{name: "quic upstream", mode: ModeAgent, mutate: func(cfg *Config) {
+			cfg.Server.Transport, cfg.Server.Upstream = TransportQUIC, "http://127.0.0.1:3128"
+		}, want: []string{"server.upstream: upstream proxies can't pass quic"}},
+		{name: "auth methods", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Auth.Methods = []string{"gssapi"} }, want: []string{"auth.methods: unsupported method gssapi"}},
+		{name: "password without users", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Auth.Methods = []string{AuthPassword} }, want: []string{"auth.users: one of users, ldap.url, tokens.keys is required"}},
+		{name: "ldap", mode: ModeLocal, mutate: func(cfg *Config) {
+			cfg.Auth.LDAP.URL, cfg.Auth.LDAP.UserFilter, cfg.Auth.LDAP.Timeout = "http://ldap", "(uid=%s%d)", 0
+		}, want: []string{"auth.ldap.url: ", "auth.ldap.base_dn: ", "auth.ldap.user_filter: ", "auth.ldap.timeout: should be positive"}},
+		{name: "token keys", mode: ModeLocal, mutate: func(cfg *Config) {
+			cfg.Auth.Tokens.Keys = []TokenKey{{ID: "a", Algorithm: "HS256", File: "a.key"}, {ID: "a", Algorithm: "none"}}
+		}, want: []string{"auth.tokens.keys[1].algorithm: ", "auth.tokens.keys[1].file: ", "auth.tokens.keys[1].id: duplicated id a"}},
+		{name: "commands", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Auth.Commands = []string{"bind"} }, want: []string{"auth.commands: unsupported command bind"}},
+		{name: "quota", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Quota.PerHour, cfg.Quota.Charge = 0, "time" }, want: []string{
+			"quota.per_hour: should be positive", "quota.charge: should be one of payload, wire",
+		}},
+		{name: "acl", mode: ModeLocal, mutate: func(cfg *Config) {
+			cfg.ACL.Rules = []ACLRule{{Action: "drop"}, {Action: ActionDeny, CIDRs: []string{"10.0.0.0/33"}}}
+		}, want: []string{"acl.rules[0].action: ", "acl.rules[0]: should match on at least one", "acl.rules[1].cidrs: "}},
+		{name: "routing", mode: ModeLocal, mutate: func(cfg *Config) {
+			cfg.Routing.RulesFile, cfg.Routing.Outbounds = "rules.txt", []Outbound{{Name: "hk"}}
+		}, want: []string{"routing: rules_file and inline rules are exclusive", "routing.default: should not be empty", "routing.outbounds[0]: name and kind are required"}},
+		{name: "log", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Log.Level, cfg.Log.Format = "loud", "xml" }, want: []string{"log.level: ", "log.format: should be one of text, json"}},
+		{name: "admission", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Admission.MaxSessionsPerIP = -1 }, want: []string{"admission: limits should not be negative"}},
+		{name: "lockout", mode: ModeLocal, mutate: func(cfg *Config) {
+			cfg.Lockout.MaxFailures, cfg.Lockout.Duration, cfg.Lockout.MaxDuration = 5, Duration(time.Hour), Duration(time.Minute)
+		}, want: []string{"lockout: window and duration should be positive, max_duration should not be less than duration"}},
+		{name: "sources", mode: ModeLocal, mutate: func(cfg *Config) { cfg.Sources.Deny = []string{"10.0.0.0/33"} }, want: []string{"sources.deny: "}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Default(c.mode)
+			c.mutate(cfg)
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatal("invalid config is accepted")
+			}
+			problems := strings.Split(strings.TrimPrefix(err.Error(), "invalid config:\n\t"), "\n\t")
+			if len(problems) != len(c.want) {
+				t.Fatalf("got %q, want %d problems", problems, len(c.want))
+			}
+			for i, want := range c.want {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Fatalf("problem %d got %q, want %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+
+	for _, mode := range []string{ModeLocal, ModeRemote, ModeAgent} {
+		if err := Default(mode).Validate(); err != nil {
+			t.Errorf("default %s config got %v", mode, err)
+		}
+	}
+}
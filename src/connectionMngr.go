@@ -1,6 +1,7 @@
 package src
 
 import (
+	"context"
 	"net"
 	"sync/atomic"
 	"time"
@@ -11,53 +12,116 @@ import (
 
 const (
 	defaultAnalysisDur  = 2 * time.Minute
-	updateDur           = time.Hour
+	defaultUpdateDur    = time.Hour
 	defaultDialTimeout  = time.Second * 30
 	defaultQuotaPerHour = int64(10 * units.GB)
+	defaultPipeLinger   = 30 * time.Second
 )
 
 var _logger = logrus.WithField("comp", "mngr")
 
+type MngrOptions struct {
+	// quota is refilled to QuotaPerHour every UpdateDur
+	QuotaPerHour int64
+	UpdateDur    time.Duration
+	DialTimeout  time.Duration
+	AnalysisDur  time.Duration
+	// PipeLinger limits a direction still running after the other one is closed
+	PipeLinger time.Duration
+	// ChargeWire charges compressed bytes on the wire instead of payload
+	ChargeWire bool
+}
+
+func DefaultMngrOptions() MngrOptions {
+	return MngrOptions{
+		QuotaPerHour: defaultQuotaPerHour,
+		UpdateDur:    defaultUpdateDur,
+		DialTimeout:  defaultDialTimeout,
+		AnalysisDur:  defaultAnalysisDur,
+		PipeLinger:   defaultPipeLinger,
+	}
+}
+
 type ConnMngr interface {
 	Dialer() Dialer
 	PipeHandler() TcpHandler
+	Active() int32
+	// UpdateOptions takes effect on new dials and the next tick of daemons
+	UpdateOptions(opts MngrOptions)
 }
 
 type ConnQuotaMngr struct {
 	quota *QuotaMngr
-	mngr  ConnMngr
+	mngr  *ConnAccessMngr
+	opts  atomic.Pointer[MngrOptions]
 }
 
-func NewConnQuotaMngr() *ConnQuotaMngr {
+func NewConnQuotaMngr(opts MngrOptions) *ConnQuotaMngr {
 	mngr := &ConnQuotaMngr{
 		quota: &QuotaMngr{
-			quotaWritten: defaultQuotaPerHour,
-			quotaRead:    defaultQuotaPerHour,
+			quotaWritten: opts.QuotaPerHour,
+			quotaRead:    opts.QuotaPerHour,
 		},
-		mngr: NewConnAccessMngr(),
+		mngr: NewConnAccessMngr(opts),
 	}
+	mngr.opts.Store(&opts)
 	go mngr.daemon()
 	return mngr
 }
 
 func (mngr *ConnQuotaMngr) daemon() {
-	updateT := time.NewTicker(updateDur)
+	dur := mngr.opts.Load().UpdateDur
+	updateT := time.NewTicker(dur)
 	for {
 		<-updateT.C
-		mngr.quota.Update(defaultQuotaPerHour, defaultQuotaPerHour)
+		opts := mngr.opts.Load()
+		mngr.quota.Update(opts.QuotaPerHour, opts.QuotaPerHour)
+		if opts.UpdateDur != dur {
+			dur = opts.UpdateDur
+			updateT.Reset(dur)
+		}
 	}
 }
 
+func (mngr *ConnQuotaMngr) UpdateOptions(opts MngrOptions) {
+	mngr.opts.Store(&opts)
+	mngr.mngr.UpdateOptions(opts)
+}
+
+func (mngr *ConnQuotaMngr) Active() int32 {
+	return mngr.mngr.Active()
+}
+
 func (mngr *ConnQuotaMngr) PipeHandler() TcpHandler {
 	fn := mngr.mngr.PipeHandler()
 	return TcpHandleFunc(func(ctx *Context) {
-		target, ok := ctx.TargetConn().(*net.TCPConn)
+		target, ok := ctx.TargetConn().(TcpConn)
 		if !ok {
-			ctx.Logger.Error("target connection is not TCP connection.")
+			ctx.Logger().Error("target connection is not TCP connection.")
 			ctx.Close()
 			return
 		}
-		ctx.SetTargetConn(mngr.quota.WrapTcpConnection(target))
+		var extra []*QuotaMngr
+		if quota, ok := Get(ctx, QuotaKey); ok {
+			extra = append(extra, quota)
+		}
+		chargeWire := mngr.opts.Load().ChargeWire
+		// servers get the compressed stream from the agent as source, agents send it to the target
+		if source, ok := ctx.SourceConn().(interface {
+			TcpConn
+			WireCounter
+		}); ok && chargeWire {
+			conn := mngr.quota.WrapSourceConnection(source, extra...)
+			conn.ChargeWire()
+			ctx.SetSourceConn(conn)
+			fn.ServeTcp(ctx)
+			return
+		}
+		conn := mngr.quota.WrapTcpConnection(target, extra...)
+		if chargeWire {
+			conn.ChargeWire()
+		}
+		ctx.SetTargetConn(conn)
 
 		fn.ServeTcp(ctx)
 	})
@@ -65,32 +129,43 @@ func (mngr *ConnQuotaMngr) PipeHandler() TcpHandler {
 
 func (mngr *ConnQuotaMngr) Dialer() Dialer {
 	dialer := mngr.mngr.Dialer()
-	return DialHandleFunc(func(network, address string) (net.Conn, error) {
+	return DialHandleFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
 		if !mngr.quota.Enough() {
 			return nil, NotEnoughQuota
 		}
-		return dialer.Dial(network, address)
+		return dialer.DialContext(ctx, network, address)
 	})
 }
 
 type ConnAccessMngr struct {
 	active int32
+	opts   atomic.Pointer[MngrOptions]
 }
 
-func NewConnAccessMngr() *ConnAccessMngr {
+func NewConnAccessMngr(opts MngrOptions) *ConnAccessMngr {
 	mngr := &ConnAccessMngr{}
+	mngr.opts.Store(&opts)
 	go mngr.daemon()
 	return mngr
 }
 
+func (mngr *ConnAccessMngr) UpdateOptions(opts MngrOptions) {
+	mngr.opts.Store(&opts)
+}
+
+func (mngr *ConnAccessMngr) Active() int32 {
+	return atomic.LoadInt32(&mngr.active)
+}
+
 func (mngr *ConnAccessMngr) PipeHandler() TcpHandler {
 	return TcpHandleFunc(func(ctx *Context) {
 		p, err := NewTcpPiper(ctx)
 		if err != nil {
-			ctx.Logger.Errorf("fail to create piper: err=%s", err.Error())
+			ctx.Logger().Errorf("fail to create piper: err=%s", err.Error())
 			ctx.Close()
 			return
 		}
+		p.Linger = mngr.opts.Load().PipeLinger
 
 		atomic.AddInt32(&mngr.active, 1)
 		defer atomic.AddInt32(&mngr.active, -1)
@@ -100,28 +175,34 @@ func (mngr *ConnAccessMngr) PipeHandler() TcpHandler {
 }
 
 func (mngr *ConnAccessMngr) Dialer() Dialer {
-	dialer := &net.Dialer{
-		Timeout: defaultDialTimeout,
-	}
-	return DialHandleFunc(func(network, address string) (net.Conn, error) {
-		return dialer.Dial(network, address)
+	return DialHandleFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialer := &net.Dialer{
+			Timeout: mngr.opts.Load().DialTimeout,
+		}
+		return dialer.DialContext(ctx, network, address)
 	})
 }
 
 func (mngr *ConnAccessMngr) daemon() {
-	analysisT := time.NewTicker(defaultAnalysisDur)
+	dur := mngr.opts.Load().AnalysisDur
+	analysisT := time.NewTicker(dur)
 	for {
 		<-analysisT.C
-		_logger.Infof("[statistic] active=%d", atomic.LoadInt32(&mngr.active))
+		_logger.Infof("[statistic] active=%d", mngr.Active())
+		if d := mngr.opts.Load().AnalysisDur; d != dur {
+			dur = d
+			analysisT.Reset(dur)
+		}
 	}
 }
 
+// Dialer gives up once ctx is done, *src.Context can be passed as ctx
 type Dialer interface {
-	Dial(network, address string) (net.Conn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
-type DialHandleFunc func(network, address string) (net.Conn, error)
+type DialHandleFunc func(ctx context.Context, network, address string) (net.Conn, error)
 
-func (d DialHandleFunc) Dial(network, address string) (net.Conn, error) {
-	return d(network, address)
+func (d DialHandleFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
 }
@@ -1,8 +1,11 @@
 package src
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
@@ -13,40 +16,97 @@ const (
 	maxBufferSize          = 1 + 1 + 255 + 2
 )
 
+// Context carries a connection through the handler chain. The embedded context.Context
+// is cancelled on shutdown or by Cancel, which closes both connections to unblock io.
 type Context struct {
-	correlationId uuid.UUID
-	Logger        *logrus.Entry
-	from, to      net.Conn
-	buf           []byte
+	context.Context
+	cancel context.CancelFunc
+	// stops closing both connections on cancel
+	stopClose func() bool
+
+	logger atomic.Pointer[logrus.Entry]
+	from   net.Conn
+	mu     sync.Mutex
+	to     net.Conn
+	attrs  map[any]any
+	buf    *[]byte
+	dialer Dialer
+	bus    *Bus
+	// set by TcpPiper, reported by the Closed event
+	pipe *PipeResult
 
 	// for middleware
 	handlers  []TcpHandler
 	nextIndex int
 
-	// for socks5 protocol
+	// for socks5 protocol, anything else goes to attributes, see Set and Get
 	Auth byte
 	Cmd  byte
 	Host string
 	Port string
 }
 
-func NewContext(from net.Conn, handlers []TcpHandler) *Context {
+func NewContext(parent context.Context, from net.Conn, handlers []TcpHandler) *Context {
+	inner, cancel := context.WithCancel(parent)
 	ctx := &Context{
-		correlationId: uuid.NewV4(),
-		from:          from,
-		handlers:      handlers,
-		nextIndex:     -1,
-		buf:           make([]byte, maxBufferSize),
+		Context:   inner,
+		cancel:    cancel,
+		from:      from,
+		handlers:  handlers,
+		nextIndex: -1,
+		buf:       handshakeBuffers.Get(),
 	}
-	ctx.Logger = logrus.WithField("id", ctx.correlationId)
-	ctx.Logger.Infof("new connection from %s", from.RemoteAddr().String())
+	if logrus.IsLevelEnabled(logrus.InfoLevel) {
+		ctx.Logger().Infof("new connection from %s", ctx.ClientAddr().String())
+	}
+	// no goroutine is parked per connection until cancelled
+	ctx.stopClose = context.AfterFunc(inner, ctx.Close)
 	return ctx
 }
 
+// Cancel stops the connection wherever it is, dialing, handshaking or piping
+func (c *Context) Cancel() {
+	c.cancel()
+}
+
+// Logger is created on first use, so nothing is allocated for logging if the level is above info.
+// It's safe to call from both piping goroutines.
+func (c *Context) Logger() *logrus.Entry {
+	if l := c.logger.Load(); l != nil {
+		return l
+	}
+	l := logrus.WithField("id", uuid.NewV4())
+	if !c.logger.CompareAndSwap(nil, l) {
+		return c.logger.Load()
+	}
+	return l
+}
+
+// Release closes both connections and returns the buffer to the pool,
+// ctx should not be used after the handler chain returns
+func (c *Context) Release() {
+	// both connections are closed once the handler chain returns, here rather than in a new goroutine
+	if c.stopClose() {
+		c.Close()
+	}
+	c.cancel()
+	if c.buf != nil {
+		handshakeBuffers.Put(c.buf)
+		c.buf = nil
+	}
+}
+
+// Emit publishes e to the event bus of the server, if any
+func (c *Context) Emit(e Event) {
+	if c.bus != nil {
+		c.bus.Publish(c, e)
+	}
+}
+
 func (c *Context) Close() {
-	_ = c.from.Close()
-	if c.to != nil {
-		_ = c.to.Close()
+	_ = c.SourceConn().Close()
+	if to := c.TargetConn(); to != nil {
+		_ = to.Close()
 	}
 }
 
@@ -67,12 +127,12 @@ func (c *Context) Abort() {
 func (c *Context) AbortAndCloseSourceConn() {
 	c.Abort()
 	if err := c.SourceConn().Close(); err != nil {
-		c.Logger.Warningf("fail to close source conn, err=%s", err.Error())
+		c.Logger().Warningf("fail to close source conn, err=%s", err.Error())
 	}
 }
 
 func (c *Context) Buffer() []byte {
-	return c.buf
+	return *c.buf
 }
 
 func (c *Context) SetAuthMethod(m byte) {
@@ -84,17 +144,48 @@ func (c *Context) TargetAddr() string {
 }
 
 func (c *Context) SourceConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.from
 }
 
+// SetSourceConn replaces the source by a stream negotiated in a handshake, e.g. compression
+func (c *Context) SetSourceConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.from = conn
+}
+
 func (c *Context) TargetConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.to
 }
 
+// SetTargetConn closes conn at once if ctx is already cancelled
 func (c *Context) SetTargetConn(conn net.Conn) {
+	c.mu.Lock()
 	c.to = conn
+	c.mu.Unlock()
+	if c.Err() != nil {
+		_ = conn.Close()
+	}
+}
+
+// SetDialer overrides the dialer used to reach the target of this connection
+func (c *Context) SetDialer(d Dialer) {
+	c.dialer = d
+}
+
+func (c *Context) Dialer() Dialer {
+	return c.dialer
+}
+
+// ClientAddr is the real client address, carried by PROXY protocol header if behind a load balancer
+func (c *Context) ClientAddr() net.Addr {
+	return c.SourceConn().RemoteAddr()
 }
 
 func (c *Context) Key() string {
-	return fmt.Sprintf("%s->%s", c.SourceConn().RemoteAddr().String(), c.Host)
+	return fmt.Sprintf("%s->%s", c.ClientAddr().String(), c.Host)
 }
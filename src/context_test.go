@@ -0,0 +1,76 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestContextParksNoGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctxs := make([]*Context, 0, 100)
+	for i := 0; i < 100; i++ {
+		_, source := net.Pipe()
+		ctxs = append(ctxs, NewContext(context.Background(), source, nil))
+	}
+	if n := runtime.NumGoroutine() - before; n > 10 {
+		t.Fatalf("%d goroutines parked by 100 contexts", n)
+	}
+	for _, ctx := range ctxs {
+		ctx.Release()
+	}
+}
+
+// closed reports whether the peer of conn sees it closed
+func closed(peer net.Conn) bool {
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+func TestContextClose(t *testing.T) {
+	cases := []struct {
+		name string
+		done func(ctx *Context, cancel context.CancelFunc)
+	}{
+		{name: "cancel", done: func(ctx *Context, _ context.CancelFunc) { ctx.Cancel() }},
+		{name: "parent cancel", done: func(_ *Context, cancel context.CancelFunc) { cancel() }},
+		{name: "release", done: func(ctx *Context, _ context.CancelFunc) { ctx.Release() }},
+		{name: "cancel then release", done: func(ctx *Context, _ context.CancelFunc) {
+			ctx.Cancel()
+			ctx.Release()
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, source := net.Pipe()
+			target, sink := net.Pipe()
+			parent, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctx := NewContext(parent, source, nil)
+			ctx.SetTargetConn(target)
+
+			c.done(ctx, cancel)
+			if !closed(client) || !closed(sink) {
+				t.Fatal("connections are left open")
+			}
+			ctx.Release()
+		})
+	}
+}
+
+func TestSetTargetConnAfterCancel(t *testing.T) {
+	_, source := net.Pipe()
+	target, sink := net.Pipe()
+	ctx := NewContext(context.Background(), source, nil)
+	defer ctx.Release()
+	ctx.Cancel()
+	ctx.SetTargetConn(target)
+	if !closed(sink) {
+		t.Fatal("target set after cancel is left open")
+	}
+}
@@ -0,0 +1,165 @@
+package src
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is published to the Bus along the life of a connection, handlers may define their own
+type Event interface {
+	Name() string
+}
+
+// Accepted is published before the handler chain runs
+type Accepted struct {
+	Listener net.Addr
+}
+
+// Authenticated is published once the client is authenticated, User is empty for anonymous clients
+type Authenticated struct {
+	Method byte
+	User   string
+}
+
+// AuthFailed is published when credentials are rejected, User is empty if the client sent none
+type AuthFailed struct {
+	User string
+	Err  error
+}
+
+// LockedOut is published for every ip or username locked out by a failure
+type LockedOut struct {
+	Lockout
+}
+
+// CommandParsed is published once Cmd, Host and Port of Context are set
+type CommandParsed struct {
+	Cmd    byte
+	Target string
+}
+
+type DialStarted struct {
+	Address string
+}
+
+// DialFinished carries the error if the dial failed
+type DialFinished struct {
+	Address  string
+	Duration time.Duration
+	Err      error
+}
+
+type PipeStarted struct{}
+
+// Progress counts the bytes piped so far, published every Bus.ProgressInterval
+type Progress struct {
+	Up, Down int64
+}
+
+// Closed is published after the handler chain returns, Pipe is nil if the connection never piped
+type Closed struct {
+	Duration time.Duration
+	Pipe     *PipeResult
+}
+
+func (Accepted) Name() string      { return "accepted" }
+func (Authenticated) Name() string { return "authenticated" }
+func (AuthFailed) Name() string    { return "auth_failed" }
+func (LockedOut) Name() string     { return "locked_out" }
+func (CommandParsed) Name() string { return "command_parsed" }
+func (DialStarted) Name() string   { return "dial_started" }
+func (DialFinished) Name() string  { return "dial_finished" }
+func (PipeStarted) Name() string   { return "pipe_started" }
+func (Progress) Name() string      { return "progress" }
+func (Closed) Name() string        { return "closed" }
+
+// Reason is "handshake" if the connection closed before piping, otherwise the cause
+// which ended the pipe, "eof" if both directions closed cleanly
+func (e Closed) Reason() string {
+	switch {
+	case e.Pipe == nil:
+		return "handshake"
+	case e.Pipe.Up.Cause != CauseEOF && e.Pipe.Up.Cause != CauseAborted:
+		return e.Pipe.Up.Cause.String()
+	case e.Pipe.Down.Cause != CauseEOF:
+		return e.Pipe.Down.Cause.String()
+	default:
+		return e.Pipe.Up.Cause.String()
+	}
+}
+
+type subscriber struct {
+	id int
+	fn func(ctx *Context, e Event)
+}
+
+// Bus delivers events synchronously on the goroutine of the connection,
+// so subscribers should be quick and must not block.
+type Bus struct {
+	// ProgressInterval enables Progress events, zero disables them.
+	// Piping with progress counts every write, which gives up splicing.
+	ProgressInterval time.Duration
+
+	mu     sync.Mutex
+	nextID int
+	subs   atomic.Pointer[[]subscriber]
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe receives all events until the returned func is called
+func (b *Bus) Subscribe(fn func(ctx *Context, e Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	id := b.nextID
+	subs := b.load()
+	ret := make([]subscriber, 0, len(subs)+1)
+	b.store(append(append(ret, subs...), subscriber{id: id, fn: fn}))
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subs := b.load()
+		ret := make([]subscriber, 0, len(subs))
+		for _, s := range subs {
+			if s.id != id {
+				ret = append(ret, s)
+			}
+		}
+		b.store(ret)
+	}
+}
+
+// Subscribe receives events of type E only
+//
+//	src.Subscribe(bus, func(ctx *src.Context, e src.Closed) { ... })
+func Subscribe[E Event](b *Bus, fn func(ctx *Context, e E)) (unsubscribe func()) {
+	return b.Subscribe(func(ctx *Context, e Event) {
+		if e, ok := e.(E); ok {
+			fn(ctx, e)
+		}
+	})
+}
+
+func (b *Bus) Publish(ctx *Context, e Event) {
+	for _, s := range b.load() {
+		s.fn(ctx, e)
+	}
+}
+
+// load returns a copy-on-write snapshot, callers must not modify it
+func (b *Bus) load() []subscriber {
+	if subs := b.subs.Load(); subs != nil {
+		return *subs
+	}
+	return nil
+}
+
+func (b *Bus) store(subs []subscriber) {
+	b.subs.Store(&subs)
+}
@@ -0,0 +1,142 @@
+package src
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newEventContext(t *testing.T, bus *Bus) *Context {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	ctx := NewContext(context.Background(), a, nil)
+	t.Cleanup(ctx.Release)
+	ctx.bus = bus
+	return ctx
+}
+
+func TestBusSubscribe(t *testing.T) {
+	bus := NewBus()
+	ctx := newEventContext(t, bus)
+
+	var got []string
+	record := func(name string) func(*Context, Event) {
+		return func(c *Context, e Event) {
+			if c != ctx {
+				t.Errorf("%s got another context", name)
+			}
+			got = append(got, name+" "+e.Name())
+		}
+	}
+	unsubscribeA := bus.Subscribe(record("a"))
+	bus.Subscribe(record("b"))
+	Subscribe(bus, func(c *Context, e DialFinished) {
+		got = append(got, "dial "+e.Address)
+	})
+
+	// subscribers in subscription order, events in publish order
+	ctx.Emit(Accepted{})
+	ctx.Emit(DialFinished{Address: "example.com:443"})
+	want := []string{"a accepted", "b accepted", "a dial_finished", "b dial_finished", "dial example.com:443"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	got = nil
+	unsubscribeA()
+	// unsubscribing twice is harmless
+	unsubscribeA()
+	ctx.Emit(PipeStarted{})
+	if want := []string{"b pipe_started"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q after unsubscribe, want %q", got, want)
+	}
+
+	// contexts out of servers have no bus
+	ctx.bus = nil
+	got = nil
+	ctx.Emit(PipeStarted{})
+	if len(got) != 0 {
+		t.Fatalf("got %q without bus", got)
+	}
+}
+
+func TestBusSlowSubscriber(t *testing.T) {
+	bus := NewBus()
+	slow, fast := newEventContext(t, bus), newEventContext(t, bus)
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	bus.Subscribe(func(c *Context, e Event) {
+		if c == slow {
+			close(blocked)
+			<-release
+		}
+	})
+	delivered := make(chan Event, 10)
+	bus.Subscribe(func(c *Context, e Event) {
+		if c == fast {
+			delivered <- e
+		}
+	})
+
+	// delivery runs on the goroutine of the connection, the slow one blocks only itself
+	go slow.Emit(Accepted{})
+	<-blocked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fast.Emit(Accepted{})
+		// subscribing while delivering takes no lock held by publish
+		unsubscribe := bus.Subscribe(func(*Context, Event) {})
+		unsubscribe()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish is blocked by the slow subscriber of another connection")
+	}
+	close(release)
+	if e := <-delivered; e.Name() != "accepted" {
+		t.Fatalf("got %s", e.Name())
+	}
+}
+
+func TestBusConcurrent(t *testing.T) {
+	bus := NewBus()
+	var mu sync.Mutex
+	counts := make(map[*Context]int)
+	bus.Subscribe(func(c *Context, e Event) {
+		mu.Lock()
+		counts[c]++
+		mu.Unlock()
+	})
+
+	// publishing races subscribing and unsubscribing
+	var wg sync.WaitGroup
+	ctxs := make([]*Context, 8)
+	for i := range ctxs {
+		ctxs[i] = newEventContext(t, bus)
+		wg.Add(1)
+		go func(ctx *Context) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ctx.Emit(Progress{Up: int64(j)})
+			}
+		}(ctxs[i])
+	}
+	for i := 0; i < 100; i++ {
+		unsubscribe := bus.Subscribe(func(*Context, Event) {})
+		unsubscribe()
+	}
+	wg.Wait()
+	for i, ctx := range ctxs {
+		if counts[ctx] != 100 {
+			t.Fatalf("context %d got %d events, want 100", i, counts[ctx])
+		}
+	}
+}
@@ -14,7 +14,7 @@ func RecoveryHandler() TcpHandler {
 	return TcpHandleFunc(func(ctx *Context) {
 		defer func() {
 			if r := recover(); r != nil {
-				ctx.Logger.Errorf("recovery from %s", r)
+				ctx.Logger().Errorf("recovery from %s", r)
 			}
 			ctx.Close()
 		}()
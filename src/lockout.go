@@ -0,0 +1,362 @@
+package src
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrBanned    = errors.New("banned")
+	ErrLockedOut = errors.New("locked out after too many failures")
+)
+
+const lockoutSweepDur = time.Minute
+
+// maxFailStates bounds tracked ips and usernames each, failures offering random usernames can't grow them
+var maxFailStates = 10000
+
+// LockoutOptions locks out ips and usernames failing authentication, zero MaxFailures disables lockouts
+type LockoutOptions struct {
+	// MaxFailures within Window lock the ip or username out
+	MaxFailures int
+	Window      time.Duration
+	// Duration of the first lockout, doubled by every following one up to MaxDuration
+	Duration    time.Duration
+	MaxDuration time.Duration
+	// Tarpit delays failure replies, zero replies at once
+	Tarpit time.Duration
+}
+
+type failState struct {
+	failures int
+	since    time.Time
+	// consecutive lockouts, reset once idle for MaxDuration
+	lockouts int
+	until    time.Time
+	last     time.Time
+}
+
+// Lockout is an ip or a username locked out, either IP or User is set
+type Lockout struct {
+	IP       string    `json:"ip,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Until    time.Time `json:"until"`
+	Lockouts int       `json:"lockouts"`
+}
+
+func (l Lockout) String() string {
+	if l.IP != "" {
+		return "ip " + l.IP
+	}
+	return "user " + l.User
+}
+
+// Ban rejects a cidr until removed, or until Until if set
+type Ban struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Until  *time.Time   `json:"until,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+}
+
+// LockoutMngr counts authentication failures of ips and usernames and keeps the banlist,
+// failures of unix clients are counted by username only
+type LockoutMngr struct {
+	opts atomic.Pointer[LockoutOptions]
+
+	mu    sync.Mutex
+	ips   map[netip.Addr]*failState
+	users map[string]*failState
+	bans  map[netip.Prefix]Ban
+
+	stats *expvar.Map
+}
+
+func NewLockoutMngr(opts LockoutOptions) *LockoutMngr {
+	mngr := &LockoutMngr{
+		ips:   make(map[netip.Addr]*failState),
+		users: make(map[string]*failState),
+		bans:  make(map[netip.Prefix]Ban),
+		stats: new(expvar.Map).Init(),
+	}
+	mngr.stats.Set("locked", expvar.Func(func() any {
+		return len(mngr.Lockouts())
+	}))
+	mngr.stats.Set("bans", expvar.Func(func() any {
+		mngr.mu.Lock()
+		defer mngr.mu.Unlock()
+		return len(mngr.bans)
+	}))
+	mngr.opts.Store(&opts)
+	go mngr.daemon()
+	return mngr
+}
+
+// UpdateOptions takes effect on following failures, running lockouts are kept
+func (mngr *LockoutMngr) UpdateOptions(opts LockoutOptions) {
+	mngr.opts.Store(&opts)
+}
+
+// Stats counts failures, lockouts, evictions and rejections, published by admin server
+func (mngr *LockoutMngr) Stats() *expvar.Map {
+	return mngr.stats
+}
+
+func (mngr *LockoutMngr) Tarpit() time.Duration {
+	return mngr.opts.Load().Tarpit
+}
+
+// CheckIP rejects banned and locked out clients, non-ip clients are always allowed
+func (mngr *LockoutMngr) CheckIP(addr net.Addr) error {
+	ip, ok := ipOf(addr)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	for p, ban := range mngr.bans {
+		if p.Contains(ip) && (ban.Until == nil || now.Before(*ban.Until)) {
+			return mngr.reject("rejected_banned", ErrBanned)
+		}
+	}
+	if st, ok := mngr.ips[ip]; ok && now.Before(st.until) {
+		return mngr.reject("rejected_locked_ip", ErrLockedOut)
+	}
+	return nil
+}
+
+// CheckUser rejects locked out usernames, checked before verifying credentials
+func (mngr *LockoutMngr) CheckUser(user string) error {
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	if st, ok := mngr.users[user]; ok && time.Now().Before(st.until) {
+		return mngr.reject("rejected_locked_user", ErrLockedOut)
+	}
+	return nil
+}
+
+// Fail records a failure of the client and the username if not empty, returns the lockouts it causes
+func (mngr *LockoutMngr) Fail(addr net.Addr, user string) []Lockout {
+	mngr.stats.Add("failures", 1)
+	opts := mngr.opts.Load()
+	if opts.MaxFailures <= 0 {
+		return nil
+	}
+	now := time.Now()
+
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	var ret []Lockout
+	if ip, ok := ipOf(addr); ok {
+		if st := track(mngr, mngr.ips, ip, now); st != nil && st.fail(opts, now) {
+			ret = append(ret, Lockout{IP: ip.String(), Until: st.until, Lockouts: st.lockouts})
+		}
+	}
+	if user != "" {
+		if st := track(mngr, mngr.users, user, now); st != nil && st.fail(opts, now) {
+			ret = append(ret, Lockout{User: user, Until: st.until, Lockouts: st.lockouts})
+		}
+	}
+	mngr.stats.Add("lockouts", int64(len(ret)))
+	return ret
+}
+
+// track returns the state of key, a new one evicts a state not locked out once maxFailStates are tracked.
+// It's nil if all of them are locked out, so the failure is counted on the other key only.
+func track[K comparable](mngr *LockoutMngr, states map[K]*failState, key K, now time.Time) *failState {
+	if st, ok := states[key]; ok {
+		return st
+	}
+	if len(states) >= maxFailStates {
+		evicted := false
+		for k, st := range states {
+			if !now.Before(st.until) {
+				delete(states, k)
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			mngr.stats.Add("untracked_failures", 1)
+			return nil
+		}
+		mngr.stats.Add("evicted", 1)
+	}
+	st := &failState{}
+	states[key] = st
+	return st
+}
+
+// fail counts a failure in the window, reports whether it locks out
+func (st *failState) fail(opts *LockoutOptions, now time.Time) bool {
+	if now.Sub(st.last) > opts.MaxDuration && now.After(st.until) {
+		st.lockouts = 0
+	}
+	if now.Sub(st.since) > opts.Window {
+		st.failures, st.since = 0, now
+	}
+	st.last = now
+	st.failures++
+	if st.failures < opts.MaxFailures {
+		return false
+	}
+
+	d := opts.Duration << st.lockouts
+	if d > opts.MaxDuration || d <= 0 {
+		d = opts.MaxDuration
+	}
+	st.lockouts++
+	st.failures, st.since = 0, now
+	st.until = now.Add(d)
+	return true
+}
+
+// Succeed forgets failures of the username. Failures of the ip are kept, otherwise a client
+// knowing one password could guess others without being locked out.
+func (mngr *LockoutMngr) Succeed(user string) {
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	if st, ok := mngr.users[user]; ok && time.Now().After(st.until) {
+		delete(mngr.users, user)
+	}
+}
+
+// Unlock lifts the lockout and forgets failures of an ip or a username, reports whether any was kept
+func (mngr *LockoutMngr) Unlock(ipOrUser string) bool {
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	if ip, err := netip.ParseAddr(ipOrUser); err == nil {
+		_, ok := mngr.ips[ip.Unmap()]
+		delete(mngr.ips, ip.Unmap())
+		return ok
+	}
+	_, ok := mngr.users[ipOrUser]
+	delete(mngr.users, ipOrUser)
+	return ok
+}
+
+// Lockouts lists running lockouts, soonest lifted first
+func (mngr *LockoutMngr) Lockouts() []Lockout {
+	now := time.Now()
+	var ret []Lockout
+
+	mngr.mu.Lock()
+	for ip, st := range mngr.ips {
+		if now.Before(st.until) {
+			ret = append(ret, Lockout{IP: ip.String(), Until: st.until, Lockouts: st.lockouts})
+		}
+	}
+	for user, st := range mngr.users {
+		if now.Before(st.until) {
+			ret = append(ret, Lockout{User: user, Until: st.until, Lockouts: st.lockouts})
+		}
+	}
+	mngr.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Until.Before(ret[j].Until)
+	})
+	return ret
+}
+
+// Ban adds or replaces the ban of the prefix, zero duration bans until removed
+func (mngr *LockoutMngr) Ban(prefix netip.Prefix, duration time.Duration, reason string) Ban {
+	ban := Ban{Prefix: prefix.Masked(), Reason: reason}
+	if duration > 0 {
+		until := time.Now().Add(duration)
+		ban.Until = &until
+	}
+
+	mngr.mu.Lock()
+	mngr.bans[ban.Prefix] = ban
+	mngr.mu.Unlock()
+	return ban
+}
+
+// Unban reports whether the prefix was banned
+func (mngr *LockoutMngr) Unban(prefix netip.Prefix) bool {
+	mngr.mu.Lock()
+	defer mngr.mu.Unlock()
+
+	_, ok := mngr.bans[prefix.Masked()]
+	delete(mngr.bans, prefix.Masked())
+	return ok
+}
+
+// Bans lists bans by prefix
+func (mngr *LockoutMngr) Bans() []Ban {
+	mngr.mu.Lock()
+	ret := make([]Ban, 0, len(mngr.bans))
+	for _, ban := range mngr.bans {
+		ret = append(ret, ban)
+	}
+	mngr.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Prefix.String() < ret[j].Prefix.String()
+	})
+	return ret
+}
+
+func (mngr *LockoutMngr) reject(metric string, err error) error {
+	mngr.stats.Add(metric, 1)
+	return err
+}
+
+// daemon drops expired bans and states which would neither lock out nor extend a lockout
+func (mngr *LockoutMngr) daemon() {
+	sweepT := time.NewTicker(lockoutSweepDur)
+	for {
+		<-sweepT.C
+		opts := mngr.opts.Load()
+		now := time.Now()
+		idle := func(st *failState) bool {
+			return now.After(st.until) && now.Sub(st.last) > opts.Window && now.Sub(st.last) > opts.MaxDuration
+		}
+
+		mngr.mu.Lock()
+		for ip, st := range mngr.ips {
+			if idle(st) {
+				delete(mngr.ips, ip)
+			}
+		}
+		for user, st := range mngr.users {
+			if idle(st) {
+				delete(mngr.users, user)
+			}
+		}
+		for p, ban := range mngr.bans {
+			if ban.Until != nil && now.After(*ban.Until) {
+				delete(mngr.bans, p)
+			}
+		}
+		mngr.mu.Unlock()
+	}
+}
+
+// ipOf returns the unmapped ip of tcp addresses, and udp ones of quic streams
+func ipOf(addr net.Addr) (netip.Addr, bool) {
+	var raw net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		raw = a.IP
+	case *net.UDPAddr:
+		raw = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(raw)
+	return ip.Unmap(), ok
+}
@@ -0,0 +1,214 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestLockout(t *testing.T) {
+	opts := LockoutOptions{MaxFailures: 3, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour}
+	cases := []struct {
+		name string
+		opts LockoutOptions
+		// failures of the ip and the username, an empty username counts the ip only
+		fails []struct{ ip, user string }
+		ip    string
+		user  string
+		// expected errors of CheckIP and CheckUser
+		ipErr, userErr error
+	}{
+		{name: "below max failures", opts: opts, fails: []struct{ ip, user string }{
+			{"127.0.0.2", "alice"}, {"127.0.0.2", "alice"},
+		}, ip: "127.0.0.2", user: "alice"},
+		{name: "ip locked", opts: opts, fails: []struct{ ip, user string }{
+			{"127.0.0.2", "alice"}, {"127.0.0.2", "bob"}, {"127.0.0.2", "carol"},
+		}, ip: "127.0.0.2", user: "alice", ipErr: ErrLockedOut},
+		{name: "user locked from many ips", opts: opts, fails: []struct{ ip, user string }{
+			{"127.0.0.2", "bob"}, {"127.0.0.3", "bob"}, {"127.0.0.4", "bob"},
+		}, ip: "127.0.0.5", user: "bob", userErr: ErrLockedOut},
+		{name: "other user of a locked user's ip", opts: opts, fails: []struct{ ip, user string }{
+			{"127.0.0.2", "bob"}, {"127.0.0.3", "bob"}, {"127.0.0.4", "bob"},
+		}, ip: "127.0.0.2", user: "alice"},
+		{name: "agent key guesses", opts: opts, fails: []struct{ ip, user string }{
+			{"127.0.0.8", ""}, {"127.0.0.8", ""}, {"127.0.0.8", ""},
+		}, ip: "127.0.0.8", ipErr: ErrLockedOut},
+		{name: "mapped ipv4", opts: opts, fails: []struct{ ip, user string }{
+			{"::ffff:127.0.0.2", ""}, {"127.0.0.2", ""}, {"::ffff:127.0.0.2", ""},
+		}, ip: "127.0.0.2", ipErr: ErrLockedOut},
+		{name: "failures out of window", opts: LockoutOptions{MaxFailures: 3, Duration: time.Minute, MaxDuration: time.Hour}, fails: []struct{ ip, user string }{
+			{"127.0.0.2", "alice"}, {"127.0.0.2", "alice"}, {"127.0.0.2", "alice"},
+		}, ip: "127.0.0.2", user: "alice"},
+		{name: "disabled", fails: []struct{ ip, user string }{
+			{"127.0.0.2", "alice"}, {"127.0.0.2", "alice"}, {"127.0.0.2", "alice"},
+		}, ip: "127.0.0.2", user: "alice"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mngr := NewLockoutMngr(c.opts)
+			for _, f := range c.fails {
+				mngr.Fail(tcpAddr(f.ip), f.user)
+			}
+			if err := mngr.CheckIP(tcpAddr(c.ip)); !errors.Is(err, c.ipErr) {
+				t.Fatalf("ip got %v, want %v", err, c.ipErr)
+			}
+			if err := mngr.CheckUser(c.user); !errors.Is(err, c.userErr) {
+				t.Fatalf("user got %v, want %v", err, c.userErr)
+			}
+		})
+	}
+}
+
+func TestLockoutDoubles(t *testing.T) {
+	mngr := NewLockoutMngr(LockoutOptions{MaxFailures: 1, Window: time.Minute, Duration: time.Minute, MaxDuration: 3 * time.Minute})
+	addr := tcpAddr("127.0.0.6")
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		ls := mngr.Fail(addr, "")
+		if len(ls) != 1 || ls[0].Lockouts != i+1 {
+			t.Fatalf("failure %d got %v", i, ls)
+		}
+		if d := time.Until(ls[0].Until); d > want || d < want-time.Second {
+			t.Fatalf("lockout %d got %s, want %s", i+1, d, want)
+		}
+	}
+
+	// lockouts start over once idle for MaxDuration
+	mngr.mu.Lock()
+	st := mngr.ips[netip.MustParseAddr("127.0.0.6")]
+	st.until = time.Now().Add(-time.Second)
+	st.last = time.Now().Add(-4 * time.Minute)
+	mngr.mu.Unlock()
+	if ls := mngr.Fail(addr, ""); len(ls) != 1 || ls[0].Lockouts != 1 {
+		t.Fatalf("got %v after idle", ls)
+	}
+}
+
+func TestLockoutUnlock(t *testing.T) {
+	mngr := NewLockoutMngr(LockoutOptions{MaxFailures: 1, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+	mngr.Fail(tcpAddr("127.0.0.2"), "bob")
+	if ls := mngr.Lockouts(); len(ls) != 2 {
+		t.Fatalf("got lockouts %v", ls)
+	}
+
+	if !mngr.Unlock("127.0.0.2") || mngr.CheckIP(tcpAddr("127.0.0.2")) != nil {
+		t.Fatal("ip is not unlocked")
+	}
+	if !mngr.Unlock("bob") || mngr.CheckUser("bob") != nil {
+		t.Fatal("user is not unlocked")
+	}
+	if mngr.Unlock("bob") || mngr.Unlock("127.0.0.2") || len(mngr.Lockouts()) != 0 {
+		t.Fatal("unlocked twice")
+	}
+	if got := mngr.Stats().Get("lockouts").String(); got != "2" {
+		t.Fatalf("got %s lockouts", got)
+	}
+}
+
+func TestBan(t *testing.T) {
+	mngr := NewLockoutMngr(LockoutOptions{})
+	ban := mngr.Ban(netip.MustParsePrefix("127.0.0.11/31"), 0, "test")
+	if ban.Prefix.String() != "127.0.0.10/31" || ban.Until != nil {
+		t.Fatalf("got %+v", ban)
+	}
+	mngr.Ban(netip.MustParsePrefix("10.0.0.1/32"), -time.Second, "")
+	expired := mngr.Ban(netip.MustParsePrefix("10.0.0.2/32"), time.Nanosecond, "")
+	time.Sleep(time.Millisecond)
+
+	cases := []struct {
+		addr net.Addr
+		err  error
+	}{
+		{addr: tcpAddr("127.0.0.10"), err: ErrBanned},
+		{addr: tcpAddr("::ffff:127.0.0.11"), err: ErrBanned},
+		{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.11")}, err: ErrBanned},
+		{addr: tcpAddr("127.0.0.12")},
+		// zero and negative durations ban until removed
+		{addr: tcpAddr("10.0.0.1"), err: ErrBanned},
+		{addr: tcpAddr(expired.Prefix.Addr().String())},
+		// unix clients have no ip
+		{addr: &net.UnixAddr{Name: "@", Net: "unix"}},
+	}
+	for _, c := range cases {
+		if err := mngr.CheckIP(c.addr); !errors.Is(err, c.err) {
+			t.Errorf("%s got %v, want %v", c.addr, err, c.err)
+		}
+	}
+
+	if bans := mngr.Bans(); len(bans) != 3 || bans[2].Prefix != ban.Prefix {
+		t.Fatalf("got bans %v", bans)
+	}
+	if !mngr.Unban(netip.MustParsePrefix("127.0.0.10/31")) || mngr.CheckIP(tcpAddr("127.0.0.11")) != nil {
+		t.Fatal("prefix is not unbanned")
+	}
+	if mngr.Unban(netip.MustParsePrefix("127.0.0.10/31")) {
+		t.Fatal("unbanned twice")
+	}
+}
+
+func TestLockoutSucceed(t *testing.T) {
+	mngr := NewLockoutMngr(LockoutOptions{MaxFailures: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+	mngr.Fail(tcpAddr("127.0.0.2"), "alice")
+	mngr.Succeed("alice")
+	// failures of the username are forgotten, the ip's are kept
+	mngr.Fail(tcpAddr("127.0.0.2"), "alice")
+	if err := mngr.CheckUser("alice"); err != nil {
+		t.Fatalf("user got %v after a success", err)
+	}
+	if err := mngr.CheckIP(tcpAddr("127.0.0.2")); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("ip got %v, want locked out", err)
+	}
+
+	// a success doesn't lift a running lockout
+	mngr.Fail(tcpAddr("127.0.0.3"), "alice")
+	mngr.Succeed("alice")
+	if err := mngr.CheckUser("alice"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("user got %v, want locked out", err)
+	}
+}
+
+func TestLockoutBounded(t *testing.T) {
+	defer func(n int) { maxFailStates = n }(maxFailStates)
+	maxFailStates = 3
+	mngr := NewLockoutMngr(LockoutOptions{MaxFailures: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+	// unix clients are counted by username only
+	unix := &net.UnixAddr{Name: "@", Net: "unix"}
+	users := func() int {
+		mngr.mu.Lock()
+		defer mngr.mu.Unlock()
+		return len(mngr.users)
+	}
+
+	mngr.Fail(unix, "alice")
+	mngr.Fail(unix, "alice")
+	// guessing usernames evicts failures, never a lockout
+	for i := 0; i < 100; i++ {
+		mngr.Fail(unix, fmt.Sprintf("guess-%d", i))
+	}
+	if n := users(); n != maxFailStates {
+		t.Fatalf("%d usernames tracked, want %d", n, maxFailStates)
+	}
+	if err := mngr.CheckUser("alice"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("alice got %v, want %v", err, ErrLockedOut)
+	}
+
+	// all tracked usernames locked out, failures of others are not tracked
+	for _, user := range []string{"bob", "bob", "carol", "carol"} {
+		mngr.Fail(unix, user)
+	}
+	if got := mngr.Fail(unix, "dave"); len(got) != 0 || users() != maxFailStates {
+		t.Fatalf("got %v, %d usernames tracked", got, users())
+	}
+	if len(mngr.Lockouts()) != 3 {
+		t.Fatalf("got lockouts %v", mngr.Lockouts())
+	}
+	if v := mngr.Stats().Get("untracked_failures"); v == nil || v.String() != "1" {
+		t.Fatalf("got %v untracked failures, want 1", v)
+	}
+}
@@ -1,12 +1,15 @@
 package src
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
-
-	"github.com/sirupsen/logrus"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type TcpConn interface {
@@ -15,9 +18,60 @@ type TcpConn interface {
 	CloseRead() error
 }
 
+// Cause is why a direction of the pipe stopped
+type Cause int
+
+const (
+	// CauseEOF is a clean close, the FIN is passed on to the other side
+	CauseEOF Cause = iota
+	// CauseReset is a reset by peer, the reset is passed on to the other side
+	CauseReset
+	// CauseLinger means the direction didn't finish in linger after the other one
+	CauseLinger
+	// CauseQuota means quota ran out
+	CauseQuota
+	// CauseAborted means the direction was stopped because the other one failed
+	CauseAborted
+	// CauseCanceled means the context was cancelled, e.g. on shutdown
+	CauseCanceled
+	CauseError
+)
+
+var causeNames = [...]string{"eof", "reset", "linger timeout", "quota", "aborted", "canceled", "error"}
+
+func (c Cause) String() string {
+	return causeNames[c]
+}
+
+// DirectionResult describes one direction of a finished pipe
+type DirectionResult struct {
+	Bytes int64
+	Cause Cause
+	// Err is nil for CauseEOF
+	Err error
+}
+
+func (r DirectionResult) String() string {
+	return fmt.Sprintf("%d bytes, %s", r.Bytes, r.Cause)
+}
+
+type PipeResult struct {
+	// Up is from source to target, Down is from target to source
+	Up, Down DirectionResult
+}
+
+// TcpPiper copies both directions independently, a clean close of one direction
+// half-closes the other side, any failure tears down both connections
 type TcpPiper struct {
 	ctx            *Context
 	source, target TcpConn
+	// Linger limits how long a direction may continue after the other one finished cleanly,
+	// zero means no limit
+	Linger time.Duration
+
+	mu       sync.Mutex
+	aborted  bool
+	lingered bool
 }
 
 func NewTcpPiper(ctx *Context) (*TcpPiper, error) {
@@ -44,56 +98,164 @@ func (p *TcpPiper) Close() error {
 	return p.target.Close()
 }
 
-func (p *TcpPiper) readLoop() {
-	_, err := io.Copy(p.source, p.target)
-	handleLoopError(err, p.source, p.target, p.ctx.Logger.WithField("loop", "read"))
+type directionResult struct {
+	up bool
+	DirectionResult
 }
 
-func (p *TcpPiper) writeLoop() {
-	_, err := io.Copy(p.target, p.source)
-	handleLoopError(err, p.target, p.source, p.ctx.Logger.WithField("loop", "write"))
+func (p *TcpPiper) Pipe() PipeResult {
+	p.ctx.Logger().Infof("start piping, target addr=%s", p.ctx.TargetAddr())
+	p.ctx.Emit(PipeStarted{})
+
+	// counters are only kept for progress events, counting gives up splicing
+	var up, down *int64
+	if bus := p.ctx.bus; bus != nil && bus.ProgressInterval > 0 {
+		up, down = new(int64), new(int64)
+		stop := make(chan struct{})
+		defer close(stop)
+		go p.progress(bus.ProgressInterval, up, down, stop)
+	}
+
+	results := make(chan directionResult, 2)
+	go func() {
+		results <- directionResult{up: true, DirectionResult: p.copy(p.target, p.source, up)}
+	}()
+	go func() {
+		results <- directionResult{up: false, DirectionResult: p.copy(p.source, p.target, down)}
+	}()
+
+	var ret PipeResult
+	var timer *time.Timer
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.up {
+			ret.Up = r.DirectionResult
+		} else {
+			ret.Down = r.DirectionResult
+		}
+
+		switch {
+		case r.Cause != CauseEOF:
+			p.abort(r.Cause)
+		case i == 0 && p.Linger > 0:
+			timer = time.AfterFunc(p.Linger, p.linger)
+		}
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+
+	p.ctx.Logger().Infof("finish piping, up: %s, down: %s", ret.Up, ret.Down)
+	p.ctx.pipe = &ret
+	return ret
 }
 
-func handleLoopError(err error, source, target TcpConn, logger *logrus.Entry) {
-	if err != nil {
-		logger.Errorf("loop err: %s", err.Error())
-		if rErr, ok := err.(*net.OpError); ok {
-			switch rErr.Op {
-			case "read":
-				if err := target.CloseWrite(); err != nil {
-					logger.Warningf("fail to close(write) target conn, err=%s", err.Error())
-				}
-			case "write":
-				if err := source.CloseRead(); err != nil {
-					logger.Warningf("fail to close(read) source conn, err=%s", err.Error())
-				}
-			}
+func (p *TcpPiper) progress(interval time.Duration, up, down *int64, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.ctx.Emit(Progress{Up: atomic.LoadInt64(up), Down: atomic.LoadInt64(down)})
+		case <-stop:
+			return
 		}
-		return
 	}
-	if err := source.CloseRead(); err != nil {
-		logger.Warningf("fail to close(read) source conn, err=%s", err.Error())
+}
+
+// copy counts written bytes to counter if not nil
+func (p *TcpPiper) copy(dst, src TcpConn, counter *int64) DirectionResult {
+	var n int64
+	var err error
+	if counter != nil {
+		n, err = copyBuffer(countingWriter{w: dst, n: counter}, src)
+	} else {
+		n, err = pipeCopy(dst, src)
 	}
-	if err := target.CloseWrite(); err != nil {
-		logger.Warningf("fail to close(write) target conn, err=%s", err.Error())
+	if err != nil {
+		return DirectionResult{Bytes: n, Cause: p.causeOf(err), Err: err}
 	}
+
+	// pass the FIN on, the other direction keeps going
+	if err := dst.CloseWrite(); err != nil && !errors.Is(err, net.ErrClosed) {
+		p.ctx.Logger().Debugf("fail to close(write), err=%s", err.Error())
+	}
+	return DirectionResult{Bytes: n, Cause: CauseEOF}
 }
 
-func (p *TcpPiper) Pipe() {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	p.ctx.Logger.Infof("start piping, target addr=%s", p.ctx.TargetAddr())
+func (p *TcpPiper) causeOf(err error) Cause {
+	p.mu.Lock()
+	aborted, lingered := p.aborted, p.lingered
+	p.mu.Unlock()
 
-	go func() {
-		defer wg.Done()
-		p.readLoop()
-	}()
+	switch {
+	case errors.Is(err, NotEnoughQuota):
+		return CauseQuota
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return CauseReset
+	case p.ctx.Err() != nil:
+		return CauseCanceled
+	// in-memory connections like net.Pipe report the local close as io.ErrClosedPipe
+	case aborted || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe):
+		return CauseAborted
+	case lingered && errors.Is(err, os.ErrDeadlineExceeded):
+		return CauseLinger
+	default:
+		return CauseError
+	}
+}
 
-	go func() {
-		defer wg.Done()
-		p.writeLoop()
-	}()
+// abort closes both connections, which unblocks the other direction.
+// Resets are passed on by closing with SO_LINGER 0.
+func (p *TcpPiper) abort(cause Cause) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.aborted {
+		return
+	}
+	p.aborted = true
 
-	wg.Wait()
-	p.ctx.Logger.Infof("finish piping")
+	for _, conn := range []TcpConn{p.source, p.target} {
+		if l, ok := conn.(interface{ SetLinger(sec int) error }); ok && cause == CauseReset {
+			_ = l.SetLinger(0)
+		}
+		_ = conn.Close()
+	}
+}
+
+// linger stops the direction still running
+func (p *TcpPiper) linger() {
+	p.mu.Lock()
+	p.lingered = true
+	p.mu.Unlock()
+
+	now := time.Now()
+	_ = p.source.SetDeadline(now)
+	_ = p.target.SetDeadline(now)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// pipeCopy lets wrappers drive the copy, so they can account bytes and pass the raw
+// connections to (*net.TCPConn).ReadFrom which splices on linux. io.Copy would prefer
+// (*net.TCPConn).WriteTo of a raw source, which hides it behind a plain reader.
+func pipeCopy(dst io.Writer, src io.Reader) (int64, error) {
+	if _, raw := src.(*net.TCPConn); !raw {
+		if wt, ok := src.(io.WriterTo); ok {
+			return wt.WriteTo(dst)
+		}
+	}
+	if rf, ok := dst.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return copyBuffer(dst, src)
 }
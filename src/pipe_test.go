@@ -0,0 +1,309 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tcpPair returns both ends of a tcp connection on loopback
+func tcpPair(tb testing.TB) (client, server *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// memConn is an end of net.Pipe, which can't be half closed
+type memConn struct {
+	net.Conn
+}
+
+var errNotHalfClosable = errors.New("net.Pipe can't be half closed")
+
+func (memConn) CloseWrite() error {
+	return errNotHalfClosable
+}
+
+func (memConn) CloseRead() error {
+	return errNotHalfClosable
+}
+
+// pipeEnds are the connections of a pipe, client and sink are driven by the test
+type pipeEnds struct {
+	client, sink   net.Conn
+	source, target TcpConn
+	ctx            *Context
+}
+
+var transports = []struct {
+	name string
+	ends func(t *testing.T) *pipeEnds
+}{
+	{name: "tcp", ends: func(t *testing.T) *pipeEnds {
+		client, source := tcpPair(t)
+		target, sink := tcpPair(t)
+		return &pipeEnds{client: client, sink: sink, source: source, target: target}
+	}},
+	{name: "net.Pipe", ends: func(t *testing.T) *pipeEnds {
+		client, source := net.Pipe()
+		target, sink := net.Pipe()
+		t.Cleanup(func() {
+			for _, c := range []net.Conn{client, source, target, sink} {
+				_ = c.Close()
+			}
+		})
+		return &pipeEnds{client: client, sink: sink, source: memConn{source}, target: memConn{target}}
+	}},
+}
+
+// finish sends a FIN, or closes ends which can't be half closed
+func finish(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+func reset(conn net.Conn) {
+	_ = conn.(*net.TCPConn).SetLinger(0)
+	_ = conn.Close()
+}
+
+func readAll(conn net.Conn) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	return string(b), err
+}
+
+// flood writes more than the quota to conn and drains peer, failures are expected
+func flood(conn, peer net.Conn) {
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	go func() {
+		buf := make([]byte, 64<<10)
+		for i := 0; i < 128; i++ {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestPipe(t *testing.T) {
+	cases := []struct {
+		name string
+		// half close and resets only exist on tcp
+		tcpOnly bool
+		// quota of the target, if charged
+		quota  func() *QuotaMngr
+		linger time.Duration
+		run    func(t *testing.T, e *pipeEnds)
+		up     Cause
+		down   Cause
+	}{
+		{name: "client fin first", tcpOnly: true, run: func(t *testing.T, e *pipeEnds) {
+			_, _ = e.client.Write([]byte("request"))
+			finish(e.client)
+			if got, err := readAll(e.sink); got != "request" || err != nil {
+				t.Errorf("target got %q, err=%v", got, err)
+			}
+			// the target keeps sending after the fin of the client
+			_, _ = e.sink.Write([]byte("response"))
+			finish(e.sink)
+			if got, err := readAll(e.client); got != "response" || err != nil {
+				t.Errorf("client got %q, err=%v", got, err)
+			}
+		}, up: CauseEOF, down: CauseEOF},
+		{name: "target fin first", tcpOnly: true, run: func(t *testing.T, e *pipeEnds) {
+			_, _ = e.sink.Write([]byte("banner"))
+			finish(e.sink)
+			if got, err := readAll(e.client); got != "banner" || err != nil {
+				t.Errorf("client got %q, err=%v", got, err)
+			}
+			_, _ = e.client.Write([]byte("upload"))
+			finish(e.client)
+			if got, err := readAll(e.sink); got != "upload" || err != nil {
+				t.Errorf("target got %q, err=%v", got, err)
+			}
+		}, up: CauseEOF, down: CauseEOF},
+		{name: "simultaneous close", run: func(t *testing.T, e *pipeEnds) {
+			go finish(e.client)
+			go finish(e.sink)
+		}, up: CauseEOF, down: CauseEOF},
+		{name: "client reset", tcpOnly: true, run: func(t *testing.T, e *pipeEnds) {
+			reset(e.client)
+			if _, err := readAll(e.sink); !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("target got %v, want a reset", err)
+			}
+		}, up: CauseReset, down: CauseAborted},
+		{name: "target reset", tcpOnly: true, run: func(t *testing.T, e *pipeEnds) {
+			reset(e.sink)
+			if _, err := readAll(e.client); !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("client got %v, want a reset", err)
+			}
+		}, up: CauseAborted, down: CauseReset},
+		{name: "target reset after client fin", tcpOnly: true, run: func(t *testing.T, e *pipeEnds) {
+			finish(e.client)
+			if _, err := readAll(e.sink); err != nil {
+				t.Errorf("target got %v, want the fin", err)
+			}
+			reset(e.sink)
+			if _, err := readAll(e.client); !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("client got %v, want a reset", err)
+			}
+		}, up: CauseEOF, down: CauseReset},
+		{name: "client reset after target fin", tcpOnly: true, run: func(t *testing.T, e *pipeEnds) {
+			finish(e.sink)
+			if _, err := readAll(e.client); err != nil {
+				t.Errorf("client got %v, want the fin", err)
+			}
+			reset(e.client)
+			if _, err := readAll(e.sink); !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("target got %v, want a reset", err)
+			}
+		}, up: CauseReset, down: CauseEOF},
+		{name: "linger after client fin", linger: 100 * time.Millisecond, run: func(t *testing.T, e *pipeEnds) {
+			finish(e.client)
+		}, up: CauseEOF, down: CauseLinger},
+		{name: "linger after target fin", linger: 100 * time.Millisecond, run: func(t *testing.T, e *pipeEnds) {
+			finish(e.sink)
+		}, up: CauseLinger, down: CauseEOF},
+		{name: "quota up", quota: func() *QuotaMngr { return NewQuotaMngr(1<<62, 1<<20) }, run: func(t *testing.T, e *pipeEnds) {
+			flood(e.client, e.sink)
+		}, up: CauseQuota, down: CauseAborted},
+		{name: "quota down", quota: func() *QuotaMngr { return NewQuotaMngr(1<<20, 1<<62) }, run: func(t *testing.T, e *pipeEnds) {
+			flood(e.sink, e.client)
+		}, up: CauseAborted, down: CauseQuota},
+		{name: "context cancel", run: func(t *testing.T, e *pipeEnds) {
+			go func() { _, _ = e.client.Write([]byte("ping")) }()
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(e.sink, buf); err != nil {
+				t.Errorf("target got %v", err)
+			}
+			e.ctx.Cancel()
+		}, up: CauseCanceled, down: CauseCanceled},
+		{name: "source error", run: func(t *testing.T, e *pipeEnds) {
+			_ = e.source.SetReadDeadline(time.Now())
+		}, up: CauseError, down: CauseAborted},
+		{name: "target error", run: func(t *testing.T, e *pipeEnds) {
+			_ = e.target.SetReadDeadline(time.Now())
+		}, up: CauseAborted, down: CauseError},
+	}
+	for _, tr := range transports {
+		for _, c := range cases {
+			if c.tcpOnly && tr.name != "tcp" {
+				continue
+			}
+			t.Run(tr.name+"/"+c.name, func(t *testing.T) {
+				e := tr.ends(t)
+				e.ctx = NewContext(context.Background(), e.source, nil)
+				defer e.ctx.Release()
+				if c.quota != nil {
+					e.ctx.SetTargetConn(c.quota().WrapTcpConnection(e.target))
+				} else {
+					e.ctx.SetTargetConn(e.target)
+				}
+				p, err := NewTcpPiper(e.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Linger = c.linger; p.Linger == 0 {
+					p.Linger = 5 * time.Second
+				}
+				piped := make(chan PipeResult, 1)
+				go func() { piped <- p.Pipe() }()
+
+				c.run(t, e)
+				select {
+				case r := <-piped:
+					if r.Up.Cause != c.up || r.Down.Cause != c.down {
+						t.Fatalf("got up: %s, down: %s, want up: %s, down: %s", r.Up, r.Down, c.up, c.down)
+					}
+					if (r.Up.Err == nil) != (c.up == CauseEOF) || (r.Down.Err == nil) != (c.down == CauseEOF) {
+						t.Fatalf("got errors up: %v, down: %v", r.Up.Err, r.Down.Err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("pipe is not finished")
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkPipe pushes 32KiB writes from client through a pipe to a draining sink,
+// with and without the quota connection, TestQuotaSplice checks it keeps the raw connections reachable to splice
+func BenchmarkPipe(b *testing.B) {
+	const chunk = 32 << 10
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	cases := []struct {
+		name string
+		wrap func(target TcpConn) TcpConn
+	}{
+		{name: "tcp", wrap: func(target TcpConn) TcpConn { return target }},
+		{name: "quota", wrap: func(target TcpConn) TcpConn {
+			return NewQuotaMngr(1<<62, 1<<62).WrapTcpConnection(target, NewQuotaMngr(1<<62, 1<<62))
+		}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			client, source := tcpPair(b)
+			target, sink := tcpPair(b)
+			ctx := NewContext(context.Background(), source, nil)
+			defer ctx.Release()
+			ctx.SetTargetConn(c.wrap(target))
+			p, err := NewTcpPiper(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			piped := make(chan PipeResult, 1)
+			go func() { piped <- p.Pipe() }()
+			drained := make(chan int64, 1)
+			go func() {
+				n, _ := io.Copy(io.Discard, sink)
+				_ = sink.CloseWrite()
+				drained <- n
+			}()
+
+			buf := make([]byte, chunk)
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			_ = client.CloseWrite()
+			n := <-drained
+			b.StopTimer()
+
+			if r := <-piped; n != int64(b.N)*chunk || r.Up.Cause != CauseEOF {
+				b.Fatalf("drained %d bytes of %d, up: %s", n, int64(b.N)*chunk, r.Up)
+			}
+		})
+	}
+}
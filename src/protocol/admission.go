@@ -0,0 +1,20 @@
+package protocol
+
+import (
+	"socks5-proxy/src"
+)
+
+// UserAdmission caps concurrent sessions of the authenticated user, should be used after CommandNegotiation
+func UserAdmission(mngr *src.AdmissionMngr) src.TcpHandler {
+	return src.TcpHandleFunc(func(ctx *src.Context) {
+		user, _ := src.Get(ctx, src.UserKey)
+		release, err := mngr.AcquireUser(user)
+		if err != nil {
+			ctx.Logger().Warningf("rejected, user=%s, err=%s", user, err.Error())
+			rejectCommand(ctx)
+			return
+		}
+		defer release()
+		ctx.Next()
+	})
+}
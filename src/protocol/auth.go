@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"errors"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/auth"
+	"socks5-proxy/src/socks5"
+)
+
+// passwordAuth runs the rfc1929 sub negotiation, the user is set on ctx once authenticated.
+// Locked out usernames are rejected without checking the password.
+func passwordAuth(ctx *src.Context, authenticator auth.Authenticator, lockout *src.LockoutMngr) {
+	conn := ctx.SourceConn()
+	buf := ctx.Buffer()
+
+	username, password, err := socks5.ReadUserPass(conn, buf)
+	if err != nil {
+		ctx.Logger().Warningf("fail to read username/password from source conn, err=%s", err.Error())
+		ctx.AbortAndCloseSourceConn()
+		return
+	}
+
+	var user *auth.User
+	if err = lockout.CheckUser(username); err == nil {
+		user, err = authenticator.Authenticate(ctx, username, password)
+	}
+	status := byte(socks5.UserPassSucceed)
+	switch {
+	case err == nil:
+		lockout.Succeed(username)
+	case errors.Is(err, src.ErrLockedOut):
+		status = socks5.UserPassFailure
+		tarpit(ctx, lockout.Tarpit())
+	case errors.Is(err, auth.ErrInvalidCredentials) || errors.Is(err, auth.ErrDisabled):
+		status = socks5.UserPassFailure
+		authFailed(ctx, lockout, username, err)
+	default:
+		status = socks5.UserPassFailure
+	}
+	if _, err := conn.Write([]byte{socks5.UserPassVersion, status}); err != nil {
+		ctx.Logger().Warningf("fail to send auth status to source conn, err=%s", err.Error())
+		ctx.Abort()
+		return
+	}
+
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials) || errors.Is(err, auth.ErrDisabled) || errors.Is(err, src.ErrLockedOut):
+		ctx.Logger().Warningf("authentication failed, user=%s, err=%s", username, err.Error())
+		ctx.AbortAndCloseSourceConn()
+	case err != nil:
+		ctx.Logger().Errorf("fail to authenticate, user=%s, err=%s", username, err.Error())
+		ctx.AbortAndCloseSourceConn()
+	default:
+		ctx.Logger().Infof("authenticated, user=%s", user.Name)
+		src.Set(ctx, src.UserKey, user.Name)
+		if len(user.Attrs.Roles) > 0 {
+			src.Set(ctx, src.RolesKey, user.Attrs.Roles)
+		}
+		src.Set(ctx, auth.UserInfoKey, user)
+		ctx.Emit(src.Authenticated{Method: ctx.Auth, User: user.Name})
+	}
+}
+
+// UserPolicy enforces allowed destinations, connection rate and quota of the authenticated user,
+// should be used after CommandNegotiation. Anonymous connections are passed through.
+func UserPolicy(limiter *auth.Limiter) src.TcpHandler {
+	return src.TcpHandleFunc(func(ctx *src.Context) {
+		user, ok := src.Get(ctx, auth.UserInfoKey)
+		if !ok {
+			return
+		}
+
+		if !user.Allowed(ctx) {
+			ctx.Logger().Warningf("destination not allowed for user %s, target addr=%s", user.Name, ctx.TargetAddr())
+			rejectCommand(ctx)
+			return
+		}
+		quota, err := limiter.Admit(user)
+		if err != nil {
+			ctx.Logger().Warningf("rejected, user=%s, err=%s", user.Name, err.Error())
+			rejectCommand(ctx)
+			return
+		}
+		if quota != nil {
+			src.Set(ctx, src.QuotaKey, quota)
+		}
+	})
+}
+
+// rejectCommand replies connectionNotAllowed to the parsed command and closes the source conn
+func rejectCommand(ctx *src.Context) {
+	if _, err := ctx.SourceConn().Write(commandErrorReply(connectionNotAllowed, ctx.Buffer())); err != nil {
+		ctx.Logger().Warningf("fail to send reply, err=%s", err.Error())
+	}
+	ctx.AbortAndCloseSourceConn()
+}
@@ -2,78 +2,207 @@ package protocol
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 
 	"socks5-proxy/src"
+	"socks5-proxy/src/aead"
+	"socks5-proxy/src/compress"
+	"socks5-proxy/src/socks5"
 )
 
 var clientSecretKey = []byte("dfb06f") // hard code for now
 var serverSecretKey = []byte("be6048")
 
-func ClientSayHello(dialer src.Dialer, addr net.Addr) src.TcpHandler {
+// clientCompressKey is followed by the offered compression and flags,
+// the server replies serverSecretKey followed by the accepted compression
+var clientCompressKey = []byte("dfb06c")
+
+const flagAdaptive = 0x01
+
+var errSecretKeyMismatch = errors.New("secret key mismatch")
+
+// HelloOptions are offered by agents in the internal handshake
+type HelloOptions struct {
+	// compress.None offers no compression, servers not accepting it reply compress.None
+	Compression byte
+	// Adaptive gives up compression of a direction if data doesn't shrink
+	Adaptive bool
+}
+
+func ClientSayHello(dialer src.Dialer, addr net.Addr, hello HelloOptions) src.TcpHandler {
 	return src.TcpHandleFunc(func(ctx *src.Context) {
-		conn, err := dialer.Dial("tcp", addr.String())
+		conn, err := dial(ctx, dialer, addr.String())
 		if err != nil {
-			ctx.Logger.Errorf("fail to connect to target conn, err=%s", err.Error())
+			ctx.Logger().Errorf("fail to connect to target conn, err=%s", err.Error())
 			ctx.AbortAndCloseSourceConn()
 			return
 		}
 
-		ctx.Logger.Info("client say hello")
-		if _, err := conn.Write(clientSecretKey); err != nil {
-			ctx.Logger.Errorf("fail to say hello, err=%s", err.Error())
+		ctx.Logger().Info("client say hello")
+		var stream net.Conn
+		err = socks5.Interruptible(ctx, conn, func() (err error) {
+			stream, err = clientHandshake(conn, ctx.Buffer(), hello)
+			return err
+		})
+		if err != nil {
+			ctx.Logger().Errorf("fail to handshake, err=%s", err.Error())
+			_ = conn.Close()
 			ctx.AbortAndCloseSourceConn()
 			return
 		}
+		if hello.Compression != compress.None && stream == conn {
+			ctx.Logger().Warning("server declined compression")
+		}
 
-		buf := ctx.Buffer()
-		buf = buf[:len(serverSecretKey)]
+		ctx.Logger().Info("handshake successfully")
+		ctx.SetTargetConn(stream)
+		ctx.Host = conn.RemoteAddr().String()
+	})
+}
 
-		ctx.Logger.Info("waiting for server")
-		if _, err := io.ReadFull(conn, buf); err != nil {
-			ctx.Logger.Errorf("fail to recieve hello, err=%s", err.Error())
-			ctx.AbortAndCloseSourceConn()
-			return
+// RemoteDialer reaches the target through a socks server running in remote mode
+func RemoteDialer(dialer src.Dialer, addr net.Addr, hello HelloOptions) src.Dialer {
+	return src.DialHandleFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return nil, err
 		}
 
-		if bytes.Equal(buf, serverSecretKey) {
-			ctx.Logger.Info("handshake successfully")
-			ctx.SetTargetConn(conn)
-			ctx.Host = conn.RemoteAddr().String()
-		} else {
-			ctx.Logger.Errorf("secret key mismatch, key=%s", string(buf))
-			ctx.AbortAndCloseSourceConn()
+		stream := conn
+		err = socks5.Interruptible(ctx, conn, func() error {
+			buf := make([]byte, 0, socks5.MaxRequestSize)
+			if stream, err = clientHandshake(conn, buf, hello); err != nil {
+				return err
+			}
+			req, err := socks5.AppendRequest(buf, Connect, address)
+			if err != nil {
+				return err
+			}
+			if _, err := stream.Write(req); err != nil {
+				return fmt.Errorf("fail to send command, err=%w", err)
+			}
+			if _, err := socks5.ReadReply(stream, buf[:cap(buf)]); err != nil {
+				return fmt.Errorf("fail to read command reply, err=%w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
 		}
+		return stream, nil
 	})
 }
 
-func ServerSayHello() src.TcpHandler {
+// clientHandshake returns conn itself, or the compressed stream if the server accepted compression
+func clientHandshake(conn net.Conn, buf []byte, hello HelloOptions) (net.Conn, error) {
+	var hi []byte
+	if hello.Compression == compress.None {
+		hi = append(buf[:0], clientSecretKey...)
+	} else {
+		flags := byte(0)
+		if hello.Adaptive {
+			flags |= flagAdaptive
+		}
+		hi = append(append(buf[:0], clientCompressKey...), hello.Compression, flags)
+	}
+	if _, err := conn.Write(hi); err != nil {
+		return nil, fmt.Errorf("fail to say hello, err=%w", err)
+	}
+
+	n := len(serverSecretKey)
+	if hello.Compression != compress.None {
+		n++
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, fmt.Errorf("fail to recieve hello, err=%w", err)
+	}
+	if !bytes.Equal(buf[:len(serverSecretKey)], serverSecretKey) {
+		return nil, errSecretKeyMismatch
+	}
+
+	if hello.Compression == compress.None {
+		return conn, nil
+	}
+	switch accepted := buf[len(serverSecretKey)]; accepted {
+	case compress.None:
+		return conn, nil
+	case hello.Compression:
+		return compress.New(conn, accepted, hello.Adaptive)
+	default:
+		return nil, fmt.Errorf("server accepted compression %s not offered", compress.Name(accepted))
+	}
+}
+
+// ServerSayHello checks the secret key of agents, mismatches count as authentication failures.
+// Compression offered by agents is accepted if it's one of accept.
+func ServerSayHello(lockout *src.LockoutMngr, accept []byte) src.TcpHandler {
 	return src.TcpHandleFunc(func(ctx *src.Context) {
 		conn := ctx.SourceConn()
 		buf := ctx.Buffer()
 		buf = buf[:len(clientSecretKey)]
 
-		ctx.Logger.Debug("waiting for client")
+		ctx.Logger().Debug("waiting for client")
 		if _, err := io.ReadFull(conn, buf); err != nil {
-			ctx.Logger.Errorf("fail to recieve hello, err=%s", err.Error())
+			ctx.Logger().Errorf("fail to recieve hello, err=%s", err.Error())
+			// sealed by another key or replayed
+			if errors.Is(err, aead.ErrOpen) || errors.Is(err, aead.ErrReplay) {
+				authFailed(ctx, lockout, "", err)
+				ctx.AbortAndCloseSourceConn()
+				return
+			}
 			ctx.Abort()
 			return
 		}
 
-		if !bytes.Equal(buf, clientSecretKey) {
-			ctx.Logger.Errorf("secret key mismatch, key=%s", string(buf))
+		var offer []byte
+		switch {
+		case bytes.Equal(buf, clientSecretKey):
+		case bytes.Equal(buf, clientCompressKey):
+			offer = buf[len(clientCompressKey) : len(clientCompressKey)+2]
+			if _, err := io.ReadFull(conn, offer); err != nil {
+				ctx.Logger().Errorf("fail to recieve compression, err=%s", err.Error())
+				ctx.Abort()
+				return
+			}
+		default:
+			// never log the offered key, it's a guess of the secret
+			ctx.Logger().Errorf("fail to recieve hello, err=%s", errSecretKeyMismatch.Error())
+			authFailed(ctx, lockout, "", errSecretKeyMismatch)
 			ctx.AbortAndCloseSourceConn()
 			return
 		}
 
-		ctx.Logger.Debug("server say hello")
-		if _, err := conn.Write(serverSecretKey); err != nil {
-			ctx.Logger.Errorf("fail to send hello, err=%s", err.Error())
+		ctx.Logger().Debug("server say hello")
+		reply := append(make([]byte, 0, len(serverSecretKey)+1), serverSecretKey...)
+		accepted := compress.None
+		if offer != nil {
+			if bytes.IndexByte(accept, offer[0]) >= 0 {
+				accepted = offer[0]
+			}
+			reply = append(reply, accepted)
+		}
+		if _, err := conn.Write(reply); err != nil {
+			ctx.Logger().Errorf("fail to send hello, err=%s", err.Error())
 			ctx.Abort()
 			return
 		}
 
-		ctx.Logger.Info("handshake successfully")
+		if accepted != compress.None {
+			stream, err := compress.New(conn, accepted, offer[1]&flagAdaptive != 0)
+			if err != nil {
+				ctx.Logger().Errorf("fail to compress, err=%s", err.Error())
+				ctx.AbortAndCloseSourceConn()
+				return
+			}
+			ctx.Logger().Debugf("compress by %s", compress.Name(accepted))
+			ctx.SetSourceConn(stream)
+		}
+		ctx.Logger().Info("handshake successfully")
 	})
 }
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"time"
+
+	"socks5-proxy/src"
+)
+
+// Lockout drops banned and locked out clients before reading anything, should be the first handler
+func Lockout(mngr *src.LockoutMngr) src.TcpHandler {
+	return src.TcpHandleFunc(func(ctx *src.Context) {
+		if err := mngr.CheckIP(ctx.ClientAddr()); err != nil {
+			ctx.Logger().Infof("drop connection, err=%s", err.Error())
+			ctx.AbortAndCloseSourceConn()
+		}
+	})
+}
+
+// authFailed counts the failure and publishes the lockouts it causes, then waits out the tarpit
+func authFailed(ctx *src.Context, mngr *src.LockoutMngr, user string, err error) {
+	ctx.Emit(src.AuthFailed{User: user, Err: err})
+	for _, l := range mngr.Fail(ctx.ClientAddr(), user) {
+		ctx.Logger().Warningf("lock out %s until %s, lockouts=%d", l.String(), l.Until.Format(time.RFC3339), l.Lockouts)
+		ctx.Emit(src.LockedOut{Lockout: l})
+	}
+	tarpit(ctx, mngr.Tarpit())
+}
+
+// tarpit delays the failure reply to slow down guessing, cut short by shutdown
+func tarpit(ctx *src.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,302 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/aead"
+	"socks5-proxy/src/auth"
+	"socks5-proxy/src/socks5"
+)
+
+// passwords authenticates by plain passwords
+type passwords map[string]string
+
+func (p passwords) Authenticate(_ context.Context, username, password string) (*auth.User, error) {
+	if want, ok := p[username]; !ok || want != password {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return auth.NewUser(username, auth.Attributes{})
+}
+
+// serve runs a server of handlers on loopback until the test ends
+func serve(t *testing.T, handlers ...src.TcpHandler) string {
+	s := src.NewTcpServer(&src.ListenAddr{Net: "tcp", Addr: "127.0.0.1:0"})
+	s.Use(src.RecoveryHandler())
+	s.Use(handlers...)
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+// dialFrom connects from a loopback ip of its own, lockouts of one case don't leak into others
+func dialFrom(t *testing.T, addr, ip string) net.Conn {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+const (
+	authOK      = "ok"
+	authFailure = "auth failed"
+	dropped     = "dropped"
+)
+
+// login runs the password authentication from ip
+func login(t *testing.T, addr, ip, username, password string) string {
+	conn := dialFrom(t, addr, ip)
+	defer conn.Close()
+	request := []byte{version, 1, UsernamePassword, socks5.UserPassVersion, byte(len(username))}
+	request = append(request, username...)
+	request = append(append(request, byte(len(password))), password...)
+	if _, err := conn.Write(request); err != nil {
+		return dropped
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return dropped
+	}
+	if reply[3] != socks5.UserPassSucceed {
+		return authFailure
+	}
+	return authOK
+}
+
+func TestLockout(t *testing.T) {
+	mngr := src.NewLockoutMngr(src.LockoutOptions{
+		MaxFailures: 3, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour,
+	})
+	addr := serve(t,
+		Lockout(mngr),
+		AuthMethodNegotiation([]byte{UsernamePassword}),
+		Auth(passwords{"alice": "secret1", "bob": "secret2"}, mngr),
+	)
+
+	cases := []struct {
+		name string
+		// usernames failing from ip before the login, none of them reaches MaxFailures
+		fails                  []string
+		ip, username, password string
+		want                   string
+	}{
+		{name: "wrong password", ip: "127.0.0.2", username: "carol", password: "nope", want: authFailure},
+		// guesses of unknown users count for the ip
+		{name: "ip locked", fails: []string{"carol", "dave", "erin"}, ip: "127.0.0.3", username: "alice", password: "secret1", want: dropped},
+		{name: "below max failures", fails: []string{"dave", "erin"}, ip: "127.0.0.4", username: "alice", password: "secret1", want: authOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, username := range c.fails {
+				if got := login(t, addr, c.ip, username, "nope"); got != authFailure {
+					t.Fatalf("failure of %s got %s", username, got)
+				}
+			}
+			if got := login(t, addr, c.ip, c.username, c.password); got != c.want {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+
+	t.Run("user locked from many ips", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			login(t, addr, fmt.Sprintf("127.0.1.%d", i+1), "bob", "nope")
+		}
+		// the password isn't checked, and other users of the ip go on
+		if got := login(t, addr, "127.0.1.9", "bob", "secret2"); got != authFailure {
+			t.Fatalf("bob got %s", got)
+		}
+		if got := login(t, addr, "127.0.1.9", "alice", "secret1"); got != authOK {
+			t.Fatalf("alice got %s", got)
+		}
+		mngr.Unlock("bob")
+		if got := login(t, addr, "127.0.1.9", "bob", "secret2"); got != authOK {
+			t.Fatalf("bob got %s after unlock", got)
+		}
+	})
+
+	t.Run("banned", func(t *testing.T) {
+		mngr.Ban(netip.MustParsePrefix("127.0.2.0/24"), 0, "test")
+		if got := login(t, addr, "127.0.2.1", "alice", "secret1"); got != dropped {
+			t.Fatalf("got %s", got)
+		}
+		if got := mngr.Stats().Get("rejected_banned"); got == nil || got.String() != "1" {
+			t.Fatalf("got %v rejections", got)
+		}
+	})
+}
+
+func TestTarpit(t *testing.T) {
+	const tarpit = 300 * time.Millisecond
+	mngr := src.NewLockoutMngr(src.LockoutOptions{
+		MaxFailures: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour, Tarpit: tarpit,
+	})
+	addr := serve(t,
+		Lockout(mngr),
+		AuthMethodNegotiation([]byte{UsernamePassword}),
+		Auth(passwords{"alice": "secret1"}, mngr),
+	)
+
+	cases := []struct {
+		name, username, password string
+		want                     string
+		delayed                  bool
+	}{
+		{name: "success at once", username: "alice", password: "secret1", want: authOK},
+		{name: "failure delayed", username: "alice", password: "nope", want: authFailure, delayed: true},
+		// locked out users are delayed alike, so a guess can't tell the lockout
+		{name: "locked user delayed", username: "alice", password: "nope", want: authFailure, delayed: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start := time.Now()
+			got := login(t, addr, "127.0.3.1", c.username, c.password)
+			if got != c.want || (time.Since(start) >= tarpit) != c.delayed {
+				t.Fatalf("got %s after %s", got, time.Since(start))
+			}
+		})
+	}
+}
+
+func TestServerSayHelloLockout(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logs.Reset()
+	mngr := src.NewLockoutMngr(src.LockoutOptions{
+		MaxFailures: 3, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour,
+	})
+	addr := serve(t, Lockout(mngr), ServerSayHello(mngr, nil))
+	hello := func(ip string, key []byte) string {
+		conn := dialFrom(t, addr, ip)
+		defer conn.Close()
+		if _, err := conn.Write(key); err != nil {
+			return dropped
+		}
+		reply := make([]byte, len(serverSecretKey))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != string(serverSecretKey) {
+			return dropped
+		}
+		return authOK
+	}
+
+	guess := []byte("guess1")
+	for i := 0; i < 3; i++ {
+		if got := hello("127.0.4.1", guess); got != dropped {
+			t.Fatalf("guess got %s", got)
+		}
+	}
+	if got := hello("127.0.4.1", clientSecretKey); got != dropped {
+		t.Fatalf("locked out agent got %s", got)
+	}
+	if got := hello("127.0.4.2", clientSecretKey); got != authOK {
+		t.Fatalf("agent of another ip got %s", got)
+	}
+
+	// the failure is logged, guesses of the secret key never are
+	var mismatches int
+	for _, e := range logs.AllEntries() {
+		line, err := e.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, string(guess)) {
+			t.Fatalf("guess is logged: %s", line)
+		}
+		if strings.Contains(line, errSecretKeyMismatch.Error()) {
+			mismatches++
+		}
+	}
+	if mismatches != 3 {
+		t.Fatalf("%d mismatches are logged, want 3", mismatches)
+	}
+}
+
+// sealedHello returns the wire bytes of the hello of an agent sealed by c
+func sealedHello(t *testing.T, c *aead.Cipher) []byte {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() { _, _ = c.Client(b).Write(clientSecretKey); _ = b.Close() }()
+	sealed, err := io.ReadAll(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestServerSayHelloSealed(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	c, err := aead.NewCipher(aead.ChaCha20Poly1305, psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := aead.NewCipher(aead.ChaCha20Poly1305, []byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mngr := src.NewLockoutMngr(src.LockoutOptions{})
+	filter := aead.NewReplayFilter(16)
+	s := src.NewTcpServer(&src.ListenAddr{Net: "tcp", Addr: "127.0.0.1:0"})
+	s.WrapConn(func(conn net.Conn) net.Conn { return c.Server(conn, filter) })
+	s.Use(src.RecoveryHandler(), ServerSayHello(mngr, nil))
+	s.SetFinalHandler(src.TcpHandleFunc(func(*src.Context) {}))
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(ln) }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	}()
+
+	replayed := sealedHello(t, c)
+	cases := []struct {
+		name  string
+		hello []byte
+		ok    bool
+		// failures counted so far
+		failed string
+	}{
+		{name: "sealed", hello: replayed, ok: true},
+		{name: "replayed", hello: replayed, failed: "1"},
+		{name: "other key", hello: sealedHello(t, other), failed: "2"},
+		// shorter than a salt, the agent isn't sealed rather than sealed by another key
+		{name: "not sealed", hello: clientSecretKey, failed: "2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := dialFrom(t, ln.Addr().String(), "127.0.0.1")
+			_, _ = conn.Write(tc.hello)
+			_ = conn.(*net.TCPConn).CloseWrite()
+			// the reply is sealed as well, so only its arrival is checked
+			n, _ := io.ReadFull(conn, make([]byte, len(serverSecretKey)))
+			if (n > 0) != tc.ok {
+				t.Fatalf("got %d bytes of reply", n)
+			}
+			if got := mngr.Stats().Get("failures"); (got == nil && tc.failed != "") || (got != nil && got.String() != tc.failed) {
+				t.Fatalf("got %v failures, want %s", got, tc.failed)
+			}
+		})
+	}
+}
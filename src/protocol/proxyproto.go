@@ -0,0 +1,20 @@
+package protocol
+
+import (
+	"socks5-proxy/src"
+	"socks5-proxy/src/proxyproto"
+)
+
+// SendProxyHeader tells the target the real client address by PROXY protocol,
+// should be used after Command. The header goes to whatever the outbound connects to,
+// so targets behind upstream proxies would receive it as payload.
+func SendProxyHeader(version int) src.TcpHandler {
+	return src.TcpHandleFunc(func(ctx *src.Context) {
+		target := ctx.TargetConn()
+		h := proxyproto.NewHeader(version, ctx.ClientAddr(), target.RemoteAddr())
+		if _, err := target.Write(h.Append(ctx.Buffer()[:0])); err != nil {
+			ctx.Logger().Errorf("fail to send proxy protocol header, err=%s", err.Error())
+			ctx.AbortAndCloseSourceConn()
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/route"
+)
+
+// Route chooses the outbound for the parsed command, should be used after CommandNegotiation
+func Route(router *route.Router) src.TcpHandler {
+	return src.TcpHandleFunc(func(ctx *src.Context) {
+		out := router.Match(ctx)
+		src.Set(ctx, src.OutboundKey, out.Name)
+		if out.Reject() {
+			ctx.Logger().Warningf("rejected by outbound %s, target addr=%s", out.Name, ctx.TargetAddr())
+			rejectCommand(ctx)
+			return
+		}
+
+		ctx.Logger().Infof("route to outbound %s", out.Name)
+		ctx.SetDialer(out.Dialer)
+	})
+}
+
+// ACL rejects the parsed command if not allowed, should be used after CommandNegotiation
+func ACL(acl *route.ACL) src.TcpHandler {
+	return src.TcpHandleFunc(func(ctx *src.Context) {
+		rule := acl.Match(ctx)
+		src.Set(ctx, src.ACLRuleKey, rule)
+		if rule.Allow {
+			return
+		}
+
+		ctx.Logger().Warningf("denied by acl rule %d, target addr=%s", rule.Index, ctx.TargetAddr())
+		rejectCommand(ctx)
+	})
+}
+
+// Outbounds creates the dialers of outbounds declared in rules file, through forward if set by via=
+//
+//	direct
+//	remote <server ip:port>
+//	socks5 <proxy ip:port> [username password]
+//	http <proxy ip:port> [username password]
+func Outbounds(dialer src.Dialer) route.DialerFactory {
+	return func(kind string, args []string, forward src.Dialer) (src.Dialer, error) {
+		if forward == nil {
+			forward = dialer
+		}
+
+		switch kind {
+		case "direct":
+			return forward, nil
+		case "remote":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("usage: remote <server ip:port>")
+			}
+			addr, err := net.ResolveTCPAddr("tcp", args[0])
+			if err != nil {
+				return nil, fmt.Errorf("fail to parse server addr, err=%w", err)
+			}
+			return RemoteDialer(forward, addr, HelloOptions{}), nil
+		case "socks5", "http":
+			if len(args) != 1 && len(args) != 3 {
+				return nil, fmt.Errorf("usage: %s <proxy ip:port> [username password]", kind)
+			}
+			var username, password string
+			if len(args) == 3 {
+				username, password = args[1], args[2]
+			}
+			if kind == "socks5" {
+				return Socks5Dialer(forward, args[0], username, password), nil
+			}
+			return HttpDialer(forward, args[0], username, password), nil
+		default:
+			return nil, fmt.Errorf("unknown outbound kind %s", kind)
+		}
+	}
+}
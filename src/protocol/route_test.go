@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"socks5-proxy/src"
+)
+
+// namedDialer reports its name instead of dialing
+type namedDialer struct {
+	name string
+}
+
+func (d *namedDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: d.name}
+}
+
+func TestOutboundsDialThroughForward(t *testing.T) {
+	base, via := &namedDialer{name: "base"}, &namedDialer{name: "via"}
+	factory := Outbounds(base)
+
+	for _, tc := range []struct {
+		kind    string
+		args    []string
+		forward src.Dialer
+		want    string
+	}{
+		{kind: "direct", want: "base"},
+		{kind: "direct", forward: via, want: "via"},
+		{kind: "socks5", args: []string{"127.0.0.1:1080"}, want: "base"},
+		{kind: "socks5", args: []string{"127.0.0.1:1080"}, forward: via, want: "via"},
+		{kind: "http", args: []string{"127.0.0.1:3128"}, forward: via, want: "via"},
+		{kind: "remote", args: []string{"127.0.0.1:1080"}, forward: via, want: "via"},
+	} {
+		dialer, err := factory(tc.kind, tc.args, tc.forward)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.kind, err)
+		}
+		_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || opErr.Net != tc.want {
+			t.Errorf("%s via %v: dialed by %v, want %s", tc.kind, tc.forward, err, tc.want)
+		}
+	}
+}
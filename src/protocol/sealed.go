@@ -0,0 +1,20 @@
+package protocol
+
+import (
+	"context"
+	"net"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/aead"
+)
+
+// SealedDialer seals connections to the server by the pre-shared key of c, the internal handshake runs inside
+func SealedDialer(forward src.Dialer, c *aead.Cipher) src.Dialer {
+	return src.DialHandleFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return c.Client(conn), nil
+	})
+}
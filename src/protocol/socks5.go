@@ -1,40 +1,36 @@
 package protocol
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"net"
-	"strconv"
+	"time"
 
 	"socks5-proxy/src"
+	"socks5-proxy/src/auth"
+	"socks5-proxy/src/socks5"
 )
 
 const (
-	version = 0x05
-	rsv     = 0x00
+	version = socks5.Version
 
-	NoAuthenticationRequired = 0x00
+	NoAuthenticationRequired = socks5.NoAuthenticationRequired
+	UsernamePassword         = socks5.UsernamePassword
 
-	noAcceptMethods = 0xff
+	noAcceptMethods = socks5.NoAcceptableMethods
 
-	ipv4   = 0x01
-	domain = 0x03
-	ipv6   = 0x04
+	Connect = socks5.Connect
 
-	Connect = 0x01
-
-	succeed                   = 0x00
-	generalSocksServerFailure = 0x01
-	networkUnreachable        = 0x03
-	commandNotSupport         = 0x07
-	addressTypeNotSupported   = 0x08
+	succeed                   = socks5.Succeeded
+	generalSocksServerFailure = socks5.GeneralFailure
+	connectionNotAllowed      = socks5.ConnectionNotAllowed
+	networkUnreachable        = socks5.NetworkUnreachable
+	commandNotSupport         = socks5.CommandNotSupported
+	addressTypeNotSupported   = socks5.AddressTypeNotSupported
 )
 
 func checkVersion(v byte) error {
-	if v == version {
-		return nil
-	}
-	return fmt.Errorf("unknown protocol")
+	return socks5.CheckVersion(v)
 }
 
 func AuthMethodNegotiation(allowedMethods []byte) src.TcpHandler {
@@ -43,20 +39,20 @@ func AuthMethodNegotiation(allowedMethods []byte) src.TcpHandler {
 		buf := ctx.Buffer()
 
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			ctx.Logger.Warningf("fail to read message header from source conn, err=%s", err.Error())
+			ctx.Logger().Warningf("fail to read message header from source conn, err=%s", err.Error())
 			ctx.Abort()
 			return
 		}
 
 		if err := checkVersion(buf[0]); err != nil {
-			ctx.Logger.Warningf("fail to check version, err=%s", err.Error())
+			ctx.Logger().Warningf("fail to check version, err=%s", err.Error())
 			ctx.AbortAndCloseSourceConn()
 			return
 		}
 
 		n := int(buf[1])
 		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
-			ctx.Logger.Warningf("fail to read auth methods to source conn, err=%s", err.Error())
+			ctx.Logger().Warningf("fail to read auth methods to source conn, err=%s", err.Error())
 			ctx.Abort()
 			return
 		}
@@ -65,7 +61,7 @@ func AuthMethodNegotiation(allowedMethods []byte) src.TcpHandler {
 			for _, provided := range buf[:n] {
 				if allowed == provided {
 					if _, err := conn.Write([]byte{version, provided}); err != nil {
-						ctx.Logger.Warningf("fail to send auth method to source conn, err=%s", err.Error())
+						ctx.Logger().Warningf("fail to send auth method to source conn, err=%s", err.Error())
 						ctx.Abort()
 					} else {
 						ctx.Auth = provided
@@ -76,22 +72,26 @@ func AuthMethodNegotiation(allowedMethods []byte) src.TcpHandler {
 		}
 
 		if _, err := conn.Write([]byte{version, noAcceptMethods}); err != nil {
-			ctx.Logger.Warningf("fail to send noAcceptMethods to source conn, err=%s", err.Error())
+			ctx.Logger().Warningf("fail to send noAcceptMethods to source conn, err=%s", err.Error())
 			ctx.Abort()
 		}
-		ctx.Logger.Warningf("no accept methods")
+		ctx.Logger().Warningf("no accept methods")
 	})
 }
 
-func Auth() src.TcpHandler {
+// Auth authenticates by the negotiated method, authenticator may be nil if only no authentication is allowed
+func Auth(authenticator auth.Authenticator, lockout *src.LockoutMngr) src.TcpHandler {
 	return src.TcpHandleFunc(func(ctx *src.Context) {
-		switch ctx.Auth {
-		case NoAuthenticationRequired:
-			ctx.Logger.Info("no authentication required")
+		switch {
+		case ctx.Auth == NoAuthenticationRequired:
+			ctx.Logger().Info("no authentication required")
+			ctx.Emit(src.Authenticated{Method: ctx.Auth})
+		case ctx.Auth == UsernamePassword && authenticator != nil:
+			passwordAuth(ctx, authenticator, lockout)
 		default:
-			ctx.Logger.Warningf("%x not implement yet", ctx.Auth)
+			ctx.Logger().Warningf("%x not implement yet", ctx.Auth)
 			if err := ctx.SourceConn().Close(); err != nil {
-				ctx.Logger.Warningf("fail to close source conn, err=%s", err.Error())
+				ctx.Logger().Warningf("fail to close source conn, err=%s", err.Error())
 			}
 			ctx.Abort()
 		}
@@ -104,19 +104,19 @@ func CommandNegotiation(allowedMethods []byte) src.TcpHandler {
 		buf := ctx.Buffer()
 
 		if _, err := io.ReadFull(conn, buf[:3]); err != nil {
-			ctx.Logger.Errorf("fail to read header from source conn, err=%s", err.Error())
+			ctx.Logger().Errorf("fail to read header from source conn, err=%s", err.Error())
 			ctx.Abort()
 			return
 		}
 		if err := checkVersion(buf[0]); err != nil {
-			ctx.Logger.Errorf("fail to check version, err=%s", err.Error())
+			ctx.Logger().Errorf("fail to check version, err=%s", err.Error())
 			ctx.AbortAndCloseSourceConn()
 			return
 		}
 		if continue_ := checkCommand(ctx, allowedMethods, buf); !continue_ {
-			ctx.Logger.Warningf("command not support, command=%x", ctx.Cmd)
+			ctx.Logger().Warningf("command not support, command=%x", ctx.Cmd)
 			if _, err := ctx.SourceConn().Write(commandErrorReply(commandNotSupport, buf)); err != nil {
-				ctx.Logger.Errorf("fail to send commandNotSupport reply to source conn, err=%s", err.Error())
+				ctx.Logger().Errorf("fail to send commandNotSupport reply to source conn, err=%s", err.Error())
 			}
 			ctx.AbortAndCloseSourceConn()
 		}
@@ -125,8 +125,10 @@ func CommandNegotiation(allowedMethods []byte) src.TcpHandler {
 		if !continue_ {
 			ctx.AbortAndCloseSourceConn()
 		} else if err != nil {
-			ctx.Logger.Errorf("fail to read addr from source conn, err=%s", err.Error())
+			ctx.Logger().Errorf("fail to read addr from source conn, err=%s", err.Error())
 			ctx.Abort()
+		} else {
+			ctx.Emit(src.CommandParsed{Cmd: ctx.Cmd, Target: ctx.TargetAddr()})
 		}
 	})
 }
@@ -135,13 +137,18 @@ func Command(dialer src.Dialer) src.TcpHandler {
 	return src.TcpHandleFunc(func(ctx *src.Context) {
 		conn := ctx.SourceConn()
 
+		dialer := dialer
+		if d := ctx.Dialer(); d != nil {
+			dialer = d
+		}
+
 		switch ctx.Cmd {
 		case Connect:
-			target, err := dialer.Dial("tcp", ctx.TargetAddr())
+			target, err := dial(ctx, dialer, ctx.TargetAddr())
 			if err != nil {
-				ctx.Logger.Errorf("fail to connect to target conn, err=%s", err.Error())
+				ctx.Logger().Errorf("fail to connect to target conn, err=%s", err.Error())
 				if _, err := conn.Write(commandErrorReply(networkUnreachable, ctx.Buffer())); err != nil {
-					ctx.Logger.Warningf("fail to send reply, err=%s", err.Error())
+					ctx.Logger().Warningf("fail to send reply, err=%s", err.Error())
 					ctx.Abort()
 					return
 				}
@@ -149,17 +156,20 @@ func Command(dialer src.Dialer) src.TcpHandler {
 				return
 			}
 			ctx.SetTargetConn(target)
+			if addr, ok := target.RemoteAddr().(*net.TCPAddr); ok {
+				src.Set(ctx, src.ResolvedIPKey, addr.IP)
+			}
 			if _, err := conn.Write(commandSuccessReply(target.LocalAddr().String(), ctx.Buffer())); err != nil {
-				ctx.Logger.Errorf("fail to send command success reply, err=%s", err.Error())
+				ctx.Logger().Errorf("fail to send command success reply, err=%s", err.Error())
 				if err := target.Close(); err != nil {
-					ctx.Logger.Warningf("fail to close pipe, err=%s", err.Error())
+					ctx.Logger().Warningf("fail to close pipe, err=%s", err.Error())
 				}
 				ctx.Abort()
 			}
 		default:
-			ctx.Logger.Warningf("Cmd %x not implement yet", ctx.Cmd)
+			ctx.Logger().Warningf("Cmd %x not implement yet", ctx.Cmd)
 			if _, err := conn.Write(commandErrorReply(generalSocksServerFailure, ctx.Buffer())); err != nil {
-				ctx.Logger.Warningf("fail to send reply, err=%s", err.Error())
+				ctx.Logger().Warningf("fail to send reply, err=%s", err.Error())
 				ctx.Abort()
 				return
 			}
@@ -168,6 +178,15 @@ func Command(dialer src.Dialer) src.TcpHandler {
 	})
 }
 
+// dial publishes DialStarted and DialFinished around the dial
+func dial(ctx *src.Context, dialer src.Dialer, address string) (net.Conn, error) {
+	ctx.Emit(src.DialStarted{Address: address})
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	ctx.Emit(src.DialFinished{Address: address, Duration: time.Since(start), Err: err})
+	return conn, err
+}
+
 func checkCommand(ctx *src.Context, allowedMethods []byte, buf []byte) bool {
 	ctx.Cmd = buf[1]
 	matched := false
@@ -182,79 +201,23 @@ func checkCommand(ctx *src.Context, allowedMethods []byte, buf []byte) bool {
 func readAddr(c *src.Context, buf []byte) (bool, error) {
 	conn := c.SourceConn()
 
-	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-		return false, err
-	}
-
-	switch buf[0] {
-	case ipv4:
-		if _, err := io.ReadFull(conn, buf[:net.IPv4len]); err != nil {
-			return false, err
-		}
-		c.Host = net.IP(buf[:net.IPv4len]).String()
-	case domain:
-		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return false, err
-		}
-		length := int(buf[0])
-		if _, err := io.ReadFull(conn, buf[:length]); err != nil {
-			return false, err
-		}
-		c.Host = string(buf[:length])
-	case ipv6:
-		if _, err := io.ReadFull(conn, buf[:net.IPv6len]); err != nil {
-			return false, err
-		}
-		c.Host = net.IP(buf[:net.IPv6len]).String()
-	default:
+	host, port, err := socks5.ReadAddr(conn, buf)
+	if errors.Is(err, socks5.ErrAddressTypeNotSupported) {
 		_, err := conn.Write(commandErrorReply(addressTypeNotSupported, buf))
 		return false, err
-	}
-
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+	} else if err != nil {
 		return false, err
 	}
 
-	c.Port = strconv.Itoa(int(buf[0])<<8 | int(buf[1]))
+	c.Host = host
+	c.Port = port
 	return true, nil
 }
 
-// make sure parse the legal addr
-func parseAddr(s string, buf []byte) []byte {
-	host, port, _ := net.SplitHostPort(s)
-
-	ip := net.ParseIP(host)
-	if ip == nil {
-		// domain name
-		buf = append(buf, domain, byte(len(ip)))
-		buf = append(buf, []byte(host)...)
-	} else {
-		if ip4 := ip.To4(); ip4 != nil {
-			buf = append(buf, ipv4)
-			buf = append(buf, ip4...)
-		} else {
-			buf = append(buf, ipv6)
-			buf = append(buf, ip...)
-		}
-	}
-
-	portn, _ := strconv.ParseUint(port, 10, 16)
-	buf = append(buf, byte(portn>>8), byte(portn))
-	return buf
-}
-
 func commandErrorReply(rep byte, buf []byte) []byte {
-	ret := buf[:10]
-	ret[0] = version
-	ret[1] = rep
-	for i := 2; i < len(ret); i++ {
-		ret[i] = 0
-	}
-	return ret
+	return socks5.AppendReply(buf[:0], rep, "")
 }
 
 func commandSuccessReply(addr string, buf []byte) []byte {
-	buf = buf[:0]
-	buf = append(buf, version, succeed, rsv)
-	return parseAddr(addr, buf)
+	return socks5.AppendReply(buf[:0], succeed, addr)
 }
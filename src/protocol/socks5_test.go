@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"socks5-proxy/src"
+)
+
+// echoServer echoes until the FIN of each connection
+func echoServer(tb testing.TB) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// BenchmarkAcceptToPipe runs a whole tunnel per op like a local mode server:
+// accept, handshake, connect, a round trip through the pipe and close
+func BenchmarkAcceptToPipe(b *testing.B) {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	opts := src.DefaultMngrOptions()
+	opts.QuotaPerHour = 1 << 50
+	mngr := src.NewConnQuotaMngr(opts)
+	s := src.NewTcpServer(&src.ListenAddr{Net: "tcp", Addr: "127.0.0.1:0"})
+	s.SetAdmission(src.NewAdmissionMngr(src.AdmissionOptions{}))
+	s.Use(src.RecoveryHandler())
+	s.Use(
+		AuthMethodNegotiation([]byte{NoAuthenticationRequired}),
+		CommandNegotiation([]byte{Connect}),
+		Command(mngr.Dialer()),
+	)
+	s.SetFinalHandler(mngr.PipeHandler())
+	ln, err := s.Listen()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() { _ = s.Serve(ln) }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	}()
+
+	target := echoServer(b)
+	request := append([]byte{version, 1, NoAuthenticationRequired, version, Connect, 0, 1}, target.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(target.Port))
+	// method selection, reply of connect with an ipv4 address, then the echo
+	reply := make([]byte, 2+10+4)
+
+	tunnel := func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		// requests are sent at once, like clients which don't wait for the method selection
+		if _, err := conn.Write(request); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			b.Fatal(err)
+		}
+		if reply[3] != succeed || string(reply[12:]) != "ping" {
+			b.Fatalf("got %x", reply)
+		}
+		_ = conn.(*net.TCPConn).CloseWrite()
+		if _, err := conn.Read(reply); err != io.EOF {
+			b.Fatalf("got %v, want the FIN of the target", err)
+		}
+	}
+	// warm up pools and lazily initialized globals
+	for i := 0; i < 100; i++ {
+		tunnel()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tunnel()
+	}
+}
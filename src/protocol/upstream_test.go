@@ -0,0 +1,276 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"socks5-proxy/src"
+)
+
+// socks5Proxy serves CONNECT with password authentication on loopback, targets are dialed by dialer
+func socks5Proxy(t *testing.T, users passwords, dialer src.Dialer) string {
+	lockout := src.NewLockoutMngr(src.LockoutOptions{MaxFailures: 100, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+	s := src.NewTcpServer(&src.ListenAddr{Net: "tcp", Addr: "127.0.0.1:0"})
+	s.Use(src.RecoveryHandler())
+	s.Use(
+		AuthMethodNegotiation([]byte{UsernamePassword}),
+		Auth(users, lockout),
+		CommandNegotiation([]byte{Connect}),
+		Command(dialer),
+	)
+	s.SetFinalHandler(src.NewConnAccessMngr(src.DefaultMngrOptions()).PipeHandler())
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+// httpProxy answers CONNECT by status, tunnels to the requested target on 200
+type httpProxy struct {
+	addr   string
+	status int
+	// Proxy-Authorization expected, empty accepts any
+	authorization string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newHttpProxy(t *testing.T, status int, authorization string) *httpProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	p := &httpProxy{addr: ln.Addr().String(), status: status, authorization: authorization}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *httpProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, req.Method+" "+req.Host)
+	p.mu.Unlock()
+
+	status := p.status
+	if p.authorization != "" && req.Header.Get("Proxy-Authorization") != p.authorization {
+		status = http.StatusProxyAuthRequired
+	}
+	var target net.Conn
+	if status == http.StatusOK {
+		if target, err = net.Dial("tcp", req.Host); err != nil {
+			status = http.StatusBadGateway
+		} else {
+			defer target.Close()
+		}
+	}
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+	if target == nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, br)
+		_ = target.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+func (p *httpProxy) Requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+// echo sends ping through conn and expects it back
+func echo(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if string(got) != "ping" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	target := echoServer(t).String()
+	addr := socks5Proxy(t, passwords{"alice": "secret"}, src.NewConnAccessMngr(src.DefaultMngrOptions()).Dialer())
+	refusing := socks5Proxy(t, passwords{"alice": "secret"}, src.DialHandleFunc(func(context.Context, string, string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrClosedPipe}
+	}))
+	cases := []struct {
+		name, addr, username, password string
+		// part of the error, empty if connected
+		err string
+	}{
+		{name: "connect", addr: addr, username: "alice", password: "secret"},
+		{name: "wrong password", addr: addr, username: "alice", password: "nope", err: "fail to connect through socks5 proxy"},
+		// the proxy only accepts password authentication
+		{name: "no credentials", addr: addr, err: "fail to connect through socks5 proxy"},
+		{name: "connect refused", addr: refusing, username: "alice", password: "secret", err: "fail to connect through socks5 proxy"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := Socks5Dialer(&net.Dialer{Timeout: 5 * time.Second}, c.addr, c.username, c.password)
+			conn, err := d.DialContext(context.Background(), "tcp", target)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := echo(conn); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHttpDialer(t *testing.T) {
+	target := echoServer(t).String()
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	cases := []struct {
+		name               string
+		status             int
+		authorization      string
+		username, password string
+		err                string
+	}{
+		{name: "connect", status: http.StatusOK},
+		{name: "basic auth", status: http.StatusOK, authorization: basic, username: "alice", password: "secret"},
+		{name: "wrong password", status: http.StatusOK, authorization: basic, username: "alice", password: "nope", err: "status=407"},
+		{name: "no credentials", status: http.StatusOK, authorization: basic, err: "status=407"},
+		{name: "forbidden", status: http.StatusForbidden, err: "status=403"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newHttpProxy(t, c.status, c.authorization)
+			d := HttpDialer(&net.Dialer{Timeout: 5 * time.Second}, p.addr, c.username, c.password)
+			conn, err := d.DialContext(context.Background(), "tcp", target)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// the tunnel starts right after the header
+			if err := echo(conn); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Requests(); len(got) != 1 || got[0] != "CONNECT "+target {
+				t.Fatalf("got requests %v", got)
+			}
+		})
+	}
+
+	// the response is bounded by maxHttpHeaderSize
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nX: "+strings.Repeat("x", maxHttpHeaderSize))
+	}()
+	d := HttpDialer(&net.Dialer{Timeout: 5 * time.Second}, ln.Addr().String(), "", "")
+	if _, err := d.DialContext(context.Background(), "tcp", target); err == nil || !strings.Contains(err.Error(), "header too large") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestParseChain(t *testing.T) {
+	target := echoServer(t).String()
+	socks := socks5Proxy(t, passwords{"alice": "secret"}, src.NewConnAccessMngr(src.DefaultMngrOptions()).Dialer())
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pass"))
+	first, second := newHttpProxy(t, http.StatusOK, basic), newHttpProxy(t, http.StatusOK, "")
+
+	// http, then http, then socks5 reaching the target
+	spec := fmt.Sprintf("http://bob:pass@%s, http://%s,socks5://alice:secret@%s", first.addr, second.addr, socks)
+	d, err := ParseChain(&net.Dialer{Timeout: 5 * time.Second}, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := first.Requests(); len(got) != 1 || got[0] != "CONNECT "+second.addr {
+		t.Fatalf("first hop got %v", got)
+	}
+	if got := second.Requests(); len(got) != 1 || got[0] != "CONNECT "+socks {
+		t.Fatalf("second hop got %v", got)
+	}
+
+	// a hop failing fails the chain
+	d, err = ParseChain(&net.Dialer{Timeout: 5 * time.Second}, fmt.Sprintf("http://%s,socks5://alice:nope@%s", second.addr, socks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", target); err == nil {
+		t.Fatal("chain with a wrong password is connected")
+	}
+
+	for _, spec := range []string{
+		"ftp://127.0.0.1:21",
+		"http://127.0.0.1:3128,https://127.0.0.1:443",
+		"http://[::1",
+		"127.0.0.1:1080",
+		"",
+	} {
+		if _, err := ParseChain(&net.Dialer{}, spec); err == nil {
+			t.Errorf("%q is parsed", spec)
+		}
+	}
+}
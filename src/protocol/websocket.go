@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"socks5-proxy/src"
+	"socks5-proxy/src/socks5"
+	"socks5-proxy/src/websocket"
+)
+
+// WebSocketOptions describes how the server is reached over websocket
+type WebSocketOptions struct {
+	// Host header and tls server name, the dialed address if empty
+	Host string
+	Path string
+	// wss if not nil
+	TLSConfig *tls.Config
+}
+
+// WebSocketDialer tunnels connections to the server in websocket, forward may pass http proxies
+func WebSocketDialer(forward src.Dialer, opts WebSocketOptions) src.Dialer {
+	return src.DialHandleFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		host := opts.Host
+		if host == "" {
+			host = address
+		}
+
+		var ws *websocket.Conn
+		err = socks5.Interruptible(ctx, conn, func() error {
+			if opts.TLSConfig != nil {
+				cfg := opts.TLSConfig.Clone()
+				if cfg.ServerName == "" {
+					cfg.ServerName = hostOnly(host)
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.Handshake(); err != nil {
+					return fmt.Errorf("fail to handshake tls, err=%w", err)
+				}
+				conn = tlsConn
+			}
+			ws, err = websocket.Handshake(conn, host, opts.Path)
+			return err
+		})
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("fail to connect by websocket %s, err=%w", address, err)
+		}
+		return ws, nil
+	})
+}
+
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
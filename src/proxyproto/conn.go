@@ -0,0 +1,187 @@
+package proxyproto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Policy decides which accepted connections may carry a header
+type Policy struct {
+	// senders allowed to send headers, e.g. the load balancer, unix peers are always trusted
+	Trusted []*net.IPNet
+	// header must be received in HeaderTimeout, zero means defaultHeaderTimeout
+	HeaderTimeout time.Duration
+}
+
+// defaultHeaderTimeout bounds the wait for a header, RemoteAddr of a silent sender blocks until then
+const defaultHeaderTimeout = 5 * time.Second
+
+// ParseTrusted parses cidrs like "10.0.0.0/8", single ips are accepted as well
+func ParseTrusted(cidrs []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("illegal cidr %s", s)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// Wrap returns conn itself if the peer is not trusted, otherwise a Conn parsing the header lazily
+func (p *Policy) Wrap(conn net.Conn) net.Conn {
+	if !p.trusted(conn.RemoteAddr()) {
+		return conn
+	}
+	timeout := p.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultHeaderTimeout
+	}
+	return &Conn{Conn: conn, timeout: timeout}
+}
+
+func (p *Policy) trusted(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		for _, n := range p.Trusted {
+			if n.Contains(a.IP) {
+				return true
+			}
+		}
+		return false
+	case *net.UnixAddr:
+		return true
+	default:
+		return false
+	}
+}
+
+// Conn reads the header on first use, so Accept is never blocked by a slow sender.
+// The header is optional, connections from the trusted sender without it are served as is.
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	prefix []byte
+	err    error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+		c.header, c.prefix, c.err = Read(c.Conn)
+		if c.err != nil {
+			c.err = fmt.Errorf("fail to read proxy protocol header, err=%w", c.err)
+		}
+	})
+}
+
+// Header returns the received header, nil if the sender didn't send one
+func (c *Conn) Header() (*Header, error) {
+	c.init()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// WriteTo passes the raw connection to w once the header is consumed, so tcp to tcp copies still splice
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	var total int64
+	if len(c.prefix) > 0 {
+		n, err := w.Write(c.prefix)
+		total += int64(n)
+		c.prefix = c.prefix[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+
+	var n int64
+	var err error
+	if rf, ok := w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(c.Conn)
+	} else {
+		n, err = io.Copy(w, c.Conn)
+	}
+	return total + n, err
+}
+
+// ReadFrom writes to the raw connection, the header only affects reading
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+// RemoteAddr is the client address in header, or the sender address if not carried.
+// It blocks until the header is read, at most the header timeout, so call it from the serving goroutine.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LazyRemoteAddr tells servers RemoteAddr waits for the header, so the client isn't known at accept
+func (c *Conn) LazyRemoteAddr() bool {
+	return true
+}
+
+// LocalAddr is the address the client connected to, usually on the load balancer, it blocks like RemoteAddr
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Dest != nil {
+		return c.header.Dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+var errNotHalfClosable = errors.New("connection can't be half closed")
+
+func (c *Conn) CloseRead() error {
+	if conn, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return conn.CloseRead()
+	}
+	return errNotHalfClosable
+}
+
+func (c *Conn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errNotHalfClosable
+}
@@ -0,0 +1,252 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pair returns both ends of a tcp connection on loopback
+func pair(t *testing.T) (client, server net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func loopback(t *testing.T) *Policy {
+	trusted, err := ParseTrusted([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Policy{Trusted: trusted, HeaderTimeout: time.Second}
+}
+
+// v2 encodes a header of cmd and family with body as is
+func v2(cmd, family byte, body []byte) []byte {
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+func tcp4Body(tlvs ...byte) []byte {
+	b := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0x01, 0xbb}
+	return append(b, tlvs...)
+}
+
+func TestRead(t *testing.T) {
+	source := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+	dest := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	source6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}
+	dest6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	cases := []struct {
+		name   string
+		data   []byte
+		source *net.TCPAddr
+		local  bool
+		prefix string
+		err    error
+	}{
+		{name: "v1 tcp4", data: NewHeader(V1, source, dest).Append(nil), source: source},
+		{name: "v1 tcp6", data: NewHeader(V1, source6, dest6).Append(nil), source: source6},
+		{name: "v1 unknown", data: []byte("PROXY UNKNOWN\r\n"), local: true},
+		{name: "v2 tcp4", data: NewHeader(V2, source, dest).Append(nil), source: source},
+		{name: "v2 tcp6", data: NewHeader(V2, source6, dest6).Append(nil), source: source6},
+		{name: "v2 local", data: v2(v2Local, 0, nil), local: true},
+		{name: "v2 local with addresses", data: v2(v2Local, tcp4, tcp4Body()), local: true},
+		{name: "v2 unix", data: v2(v2Proxy, 0x31, make([]byte, 216)), local: true},
+		{name: "v2 tlvs", data: v2(v2Proxy, tcp4, tcp4Body(0x01, 0, 2, 'h', '2', 0x04, 0, 0)), source: source},
+		{name: "no header", data: []byte("GET"), prefix: "G"},
+
+		{name: "v1 too long", data: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), maxV1Size)...), err: ErrInvalidHeader},
+		{name: "v1 bad prefix", data: []byte("PRXY TCP4 1.1.1.1 2.2.2.2 1 2\r\n"), err: ErrInvalidHeader},
+		{name: "v1 no cr", data: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1 2\n"), err: ErrInvalidHeader},
+		{name: "v1 fields", data: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1\r\n"), err: ErrInvalidHeader},
+		{name: "v1 family", data: []byte("PROXY TCP4 ::1 ::2 1 2\r\n"), err: ErrInvalidHeader},
+		{name: "v1 port", data: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1 65536\r\n"), err: ErrInvalidHeader},
+		{name: "v1 eof", data: []byte("PROXY TCP4 1.1.1.1"), err: io.EOF},
+		{name: "v2 signature", data: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), err: ErrInvalidHeader},
+		{name: "v2 command", data: v2(0x22, tcp4, tcp4Body()), err: ErrInvalidHeader},
+		{name: "v2 addresses truncated", data: v2(v2Proxy, tcp4, tcp4Body()[:10]), err: ErrInvalidHeader},
+		{name: "v2 body truncated", data: v2(v2Proxy, tcp4, tcp4Body())[:20], err: io.ErrUnexpectedEOF},
+		{name: "v2 tlv overflow", data: v2(v2Proxy, tcp4, tcp4Body(0x01, 0, 9, 'h', '2')), err: ErrInvalidHeader},
+		{name: "v2 tlv length truncated", data: v2(v2Proxy, tcp4, tcp4Body(0x01, 0)), err: ErrInvalidHeader},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := bytes.NewReader(append(c.data, "payload"...))
+			h, prefix, err := Read(r)
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Fatalf("got %v, want %v", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(prefix) != c.prefix {
+				t.Fatalf("got prefix %q, want %q", prefix, c.prefix)
+			}
+			switch {
+			case c.prefix != "":
+				if h != nil {
+					t.Fatalf("got header %+v without one", h)
+				}
+				return
+			case c.local:
+				if h == nil || h.Source != nil || h.Dest != nil {
+					t.Fatalf("got %+v, want a header without addresses", h)
+				}
+			case h == nil || h.Source.String() != c.source.String():
+				t.Fatalf("got %+v, want source %s", h, c.source)
+			}
+			// nothing after the header is consumed
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("got payload %q", rest)
+			}
+		})
+	}
+}
+
+func TestConn(t *testing.T) {
+	source := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	dest := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1080}
+
+	cases := []struct {
+		name   string
+		header []byte
+		// empty if the sender address is kept
+		remote string
+	}{
+		{name: "v1", header: NewHeader(V1, source, dest).Append(nil), remote: source.String()},
+		{name: "v2", header: NewHeader(V2, source, dest).Append(nil), remote: source.String()},
+		{name: "local command", header: v2(v2Local, 0, nil)},
+		{name: "no header"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := pair(t)
+			conn := loopback(t).Wrap(server)
+			if _, err := client.Write(append(c.header, "hello"...)); err != nil {
+				t.Fatal(err)
+			}
+
+			remote, local := c.remote, dest.String()
+			if remote == "" {
+				remote, local = client.LocalAddr().String(), client.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != remote {
+				t.Fatalf("got remote %s, want %s", got, remote)
+			}
+			if got := conn.LocalAddr().String(); got != local {
+				t.Fatalf("got local %s, want %s", got, local)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("got %q, err=%v", buf, err)
+			}
+		})
+	}
+}
+
+func TestConnMalformed(t *testing.T) {
+	client, server := pair(t)
+	conn := loopback(t).Wrap(server)
+	if _, err := client.Write([]byte("PROXY TCP4 1.1.1.1\r\nhello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 5)); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("got %v, want an invalid header", err)
+	}
+	// the sender address is kept
+	if got := conn.RemoteAddr().String(); got != client.LocalAddr().String() {
+		t.Fatalf("got remote %s", got)
+	}
+}
+
+func TestUntrustedSender(t *testing.T) {
+	client, server := pair(t)
+	p := &Policy{HeaderTimeout: time.Second}
+	conn := p.Wrap(server)
+	if conn != server {
+		t.Fatal("conn of an untrusted sender is wrapped")
+	}
+
+	// the header is payload, the claimed source is not believed
+	header := NewHeader(V1, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}).Append(nil)
+	if _, err := client.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, header) {
+		t.Fatalf("got %q, err=%v", buf, err)
+	}
+	if got := conn.RemoteAddr().String(); got != client.LocalAddr().String() {
+		t.Fatalf("got remote %s", got)
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	cases := []struct {
+		name string
+		// sent before going silent
+		data []byte
+	}{
+		{name: "silent"},
+		{name: "partial v1", data: []byte("PROXY TCP4 ")},
+		// a length of 64KiB never arrives
+		{name: "v2 length", data: append(append([]byte(nil), v2Signature...), v2Proxy, tcp4, 0xff, 0xff)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := pair(t)
+			p := loopback(t)
+			p.HeaderTimeout = 100 * time.Millisecond
+			conn := p.Wrap(server)
+			if _, err := client.Write(c.data); err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			remote := conn.RemoteAddr()
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("RemoteAddr blocked for %s", elapsed)
+			}
+			if remote.String() != client.LocalAddr().String() {
+				t.Fatalf("got remote %s", remote)
+			}
+			if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("got %v, want a timeout", err)
+			}
+		})
+	}
+}
+
+func TestDefaultHeaderTimeout(t *testing.T) {
+	_, server := pair(t)
+	p := loopback(t)
+	p.HeaderTimeout = 0
+	if conn := p.Wrap(server).(*Conn); conn.timeout != defaultHeaderTimeout {
+		t.Fatalf("got timeout %s, RemoteAddr may block forever", conn.timeout)
+	}
+}
@@ -0,0 +1,215 @@
+// Package proxyproto reads and writes PROXY protocol v1 and v2 headers, which carry
+// the real client address through L4 load balancers.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	V1 = 1
+	V2 = 2
+
+	// the longest v1 header, "PROXY TCP6 <ipv6> <ipv6> 65535 65535\r\n"
+	maxV1Size = 107
+
+	v2FixedSize = 16
+	v2Local     = 0x20
+	v2Proxy     = 0x21
+	tcp4        = 0x11
+	udp4        = 0x12
+	tcp6        = 0x21
+	udp6        = 0x22
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidHeader = errors.New("invalid proxy protocol header")
+
+// Header is the connection seen by the sender, Source and Dest are nil if not carried,
+// e.g. health checks of the load balancer
+type Header struct {
+	Version int
+	Source  *net.TCPAddr
+	Dest    *net.TCPAddr
+}
+
+// NewHeader describes a connection from source to dest, addresses other than tcp are not carried
+func NewHeader(version int, source, dest net.Addr) *Header {
+	h := &Header{Version: version}
+	s, ok1 := source.(*net.TCPAddr)
+	d, ok2 := dest.(*net.TCPAddr)
+	// both addresses should be in the same family
+	if ok1 && ok2 && (s.IP.To4() == nil) == (d.IP.To4() == nil) {
+		h.Source, h.Dest = s, d
+	}
+	return h
+}
+
+// Read reads a header from r without reading any byte after it.
+// If there is no header, the consumed bytes are returned as prefix of the payload.
+func Read(r io.Reader) (h *Header, prefix []byte, err error) {
+	b := make([]byte, 1, maxV1Size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+
+	switch b[0] {
+	case 'P':
+		return readV1(r, b)
+	case v2Signature[0]:
+		return readV2(r, b)
+	default:
+		return nil, b, nil
+	}
+}
+
+func readV1(r io.Reader, b []byte) (*Header, []byte, error) {
+	// byte by byte, so the payload after the header is left in r
+	c := make([]byte, 1)
+	for b[len(b)-1] != '\n' {
+		if len(b) == maxV1Size {
+			return nil, nil, fmt.Errorf("%w, v1 header too long", ErrInvalidHeader)
+		}
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, nil, err
+		}
+		b = append(b, c[0])
+	}
+
+	line := string(b)
+	if !strings.HasPrefix(line, "PROXY ") || !strings.HasSuffix(line, "\r\n") {
+		return nil, nil, ErrInvalidHeader
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+
+	h := &Header{Version: V1}
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		return h, nil, nil
+	case len(fields) == 6 && (fields[1] == "TCP4" || fields[1] == "TCP6"):
+	default:
+		return nil, nil, fmt.Errorf("%w, %q", ErrInvalidHeader, line)
+	}
+
+	var err error
+	if h.Source, err = parseV1Addr(fields[1], fields[2], fields[4]); err != nil {
+		return nil, nil, err
+	}
+	if h.Dest, err = parseV1Addr(fields[1], fields[3], fields[5]); err != nil {
+		return nil, nil, err
+	}
+	return h, nil, nil
+}
+
+func parseV1Addr(family, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (family == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w, illegal ip %s", ErrInvalidHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w, illegal port %s", ErrInvalidHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r io.Reader, b []byte) (*Header, []byte, error) {
+	b = b[:v2FixedSize]
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(b[:len(v2Signature)], v2Signature) {
+		return nil, nil, fmt.Errorf("%w, bad v2 signature", ErrInvalidHeader)
+	}
+
+	cmd, family := b[12], b[13]
+	body := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	h := &Header{Version: V2}
+	switch cmd {
+	case v2Local:
+		return h, nil, nil
+	case v2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("%w, unknown v2 command %#x", ErrInvalidHeader, cmd)
+	}
+
+	var size int
+	switch family {
+	case tcp4, udp4:
+		size = net.IPv4len
+	case tcp6, udp6:
+		size = net.IPv6len
+	default:
+		// unspecified or unix, addresses are not usable
+		return h, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("%w, v2 addresses truncated", ErrInvalidHeader)
+	}
+	// tlvs after addresses are ignored, but must fit in the header
+	for tlvs := body[2*size+4:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 || len(tlvs) < 3+int(binary.BigEndian.Uint16(tlvs[1:3])) {
+			return nil, nil, fmt.Errorf("%w, v2 tlv overflows header", ErrInvalidHeader)
+		}
+		tlvs = tlvs[3+int(binary.BigEndian.Uint16(tlvs[1:3])):]
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	h.Dest = &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return h, nil, nil
+}
+
+// Append appends the header encoded in h.Version to buf
+func (h *Header) Append(buf []byte) []byte {
+	if h.Version == V1 {
+		return h.appendV1(buf)
+	}
+	return h.appendV2(buf)
+}
+
+func (h *Header) appendV1(buf []byte) []byte {
+	if h.Source == nil || h.Dest == nil {
+		return append(buf, "PROXY UNKNOWN\r\n"...)
+	}
+	family := "TCP6"
+	if h.Source.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return append(buf, fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, h.Source.IP.String(), h.Dest.IP.String(), h.Source.Port, h.Dest.Port)...)
+}
+
+func (h *Header) appendV2(buf []byte) []byte {
+	buf = append(buf, v2Signature...)
+	if h.Source == nil || h.Dest == nil {
+		return append(buf, v2Local, 0, 0, 0)
+	}
+
+	family, src, dst := byte(tcp6), h.Source.IP.To16(), h.Dest.IP.To16()
+	if s4, d4 := h.Source.IP.To4(), h.Dest.IP.To4(); s4 != nil && d4 != nil {
+		family, src, dst = tcp4, s4, d4
+	}
+	buf = append(buf, v2Proxy, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(2*len(src)+4))
+	buf = append(buf, src...)
+	buf = append(buf, dst...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(h.Source.Port))
+	return binary.BigEndian.AppendUint16(buf, uint16(h.Dest.Port))
+}
@@ -0,0 +1,407 @@
+//go:build quic
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+var errNoConnection = errors.New("no quic connection")
+
+// Client opens a stream of one shared QUIC connection per dial, the connection is dialed
+// again once it fails. Session tickets are kept, so reconnects send their first flight in 0-RTT.
+type Client struct {
+	addr      *net.UDPAddr
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	sess *session
+}
+
+// NewClient reaches the server on the udp address, tlsConfig needs ServerName unless it's skipped
+func NewClient(address string, tlsConfig *tls.Config) (*Client, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("fail to resolve %s, err=%w", address, err)
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{alpn}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return &Client{addr: addr, tlsConfig: tlsConfig}, nil
+}
+
+// DialContext opens a stream to the server, network and address are ignored
+func (c *Client) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	sess, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := sess.conn
+	stream, err := conn.OpenStreamSync(ctx)
+	if errors.Is(err, quicgo.Err0RTTRejected) {
+		// streams are opened in 1-RTT from now on
+		if conn, err = conn.NextConnection(ctx); err == nil {
+			stream, err = conn.OpenStreamSync(ctx)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to open quic stream, err=%w", err)
+	}
+	stats.Add("streams", 1)
+
+	ret := newConn(stream, conn, sess, nil)
+	select {
+	case <-conn.HandshakeComplete():
+		return ret, nil
+	default:
+		return &earlyConn{sess: sess, conn: ret}, nil
+	}
+}
+
+// session returns the current connection, or dials a new one if it's done
+func (c *Client) session(ctx context.Context) (*session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil && c.sess.conn.Context().Err() == nil {
+		return c.sess, nil
+	}
+
+	ip, err := localIP(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := transport(ip)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tr.DialEarly(ctx, c.addr, c.tlsConfig, clientConfig())
+	if err != nil {
+		closeTransport(tr)
+		return nil, fmt.Errorf("fail to dial quic, err=%w", err)
+	}
+	stats.Add("connections", 1)
+	c.sess = &session{
+		conn:       conn,
+		remote:     c.addr,
+		ip:         ip,
+		local:      tr.Conn.LocalAddr(),
+		transports: []*quicgo.Transport{tr},
+	}
+	go c.watch(c.sess)
+	return c.sess, nil
+}
+
+// watch migrates sess once the local address towards the server changes,
+// and closes its transports once it's done
+func (c *Client) watch(sess *session) {
+	defer sess.close()
+	select {
+	case <-sess.conn.HandshakeComplete():
+		if sess.used0RTT() {
+			stats.Add("0rtt", 1)
+		}
+	case <-sess.conn.Context().Done():
+		return
+	}
+
+	t := time.NewTicker(migrationInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-sess.conn.Context().Done():
+			return
+		}
+		ip, err := localIP(c.addr)
+		if err != nil || ip.Equal(sess.localIP()) {
+			continue
+		}
+		// a failed migration is not retried on the same address, the connection is dialed
+		// again once it times out
+		if err := sess.migrate(sess.conn.Context(), ip); err != nil {
+			logger.Warningf("fail to migrate to %s, err=%s", ip, err.Error())
+		}
+	}
+}
+
+// Migrate moves the connection to a new udp socket on the current local address
+func (c *Client) Migrate(ctx context.Context) error {
+	c.mu.Lock()
+	sess := c.sess
+	c.mu.Unlock()
+	if sess == nil {
+		return errNoConnection
+	}
+	ip, err := localIP(c.addr)
+	if err != nil {
+		return err
+	}
+	return sess.migrate(ctx, ip)
+}
+
+// Close closes the connection, streams opened on it fail
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil {
+		_ = c.sess.conn.CloseWithError(0, "")
+	}
+	return nil
+}
+
+// session is a QUIC connection with the transports of its paths.
+// The path of the connection is switched without locks, so its addresses and state are
+// read under mu, which migrations hold.
+type session struct {
+	conn   *quicgo.Conn
+	remote net.Addr
+
+	mu         sync.Mutex
+	ip         net.IP
+	local      net.Addr
+	path       *quicgo.Path
+	transports []*quicgo.Transport
+}
+
+func (s *session) localIP() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ip
+}
+
+func (s *session) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.local
+}
+
+func (s *session) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+// used0RTT reports whether the server accepted 0-RTT, once the handshake completes
+func (s *session) used0RTT() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.ConnectionState().Used0RTT
+}
+
+// migrate probes a path from ip and switches to it
+func (s *session) migrate(ctx context.Context, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ip = ip
+
+	tr, err := transport(ip)
+	if err != nil {
+		return err
+	}
+	// the transport may be known to the connection from now on, it's closed along with it
+	s.transports = append(s.transports, tr)
+	path, err := s.conn.AddPath(tr)
+	if err != nil {
+		return fmt.Errorf("fail to add path, err=%w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		_ = path.Close()
+		return fmt.Errorf("fail to probe path, err=%w", err)
+	}
+	if err := path.Switch(); err != nil {
+		_ = path.Close()
+		return fmt.Errorf("fail to switch path, err=%w", err)
+	}
+	if s.path != nil {
+		_ = s.path.Close()
+	}
+	s.path, s.local = path, tr.Conn.LocalAddr()
+	stats.Add("migrations", 1)
+	logger.Infof("migrated to %s", tr.Conn.LocalAddr().String())
+	return nil
+}
+
+func (s *session) close() {
+	<-s.conn.Context().Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tr := range s.transports {
+		closeTransport(tr)
+	}
+}
+
+// localIP is the address the system routes to the server from
+func localIP(server *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return nil, fmt.Errorf("fail to route to %s, err=%w", server.String(), err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func transport(ip net.IP) (*quicgo.Transport, error) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("fail to listen udp socket, err=%w", err)
+	}
+	return &quicgo.Transport{Conn: udp}, nil
+}
+
+// closeTransport closes tr along with its udp socket, which is left open by tr.Close
+func closeTransport(tr *quicgo.Transport) {
+	_ = tr.Close()
+	_ = tr.Conn.Close()
+}
+
+// earlyConn is a stream opened before the handshake completes, its data goes in 0-RTT.
+// What's written is kept until then, and written again on a new stream if the server
+// rejects 0-RTT, e.g. after a restart.
+type earlyConn struct {
+	sess *session
+
+	mu      sync.Mutex
+	conn    *Conn
+	written []byte
+	// the FIN is sent again as well
+	finished bool
+	settled  bool
+	// deadlines are set again on the new stream
+	readDeadline, writeDeadline time.Time
+}
+
+// current returns the stream, what's written is dropped once 0-RTT is accepted
+func (c *earlyConn) current(p []byte) *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.settled {
+		select {
+		case <-c.sess.conn.HandshakeComplete():
+			if c.sess.used0RTT() {
+				c.settled, c.written = true, nil
+			}
+		default:
+		}
+	}
+	if !c.settled {
+		c.written = append(c.written, p...)
+	}
+	return c.conn
+}
+
+// reopen writes again on a new stream once 0-RTT of failed is rejected
+func (c *earlyConn) reopen(failed *Conn) (*Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != failed {
+		return c.conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	conn, err := c.sess.conn.NextConnection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail to wait for handshake, err=%w", err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open quic stream, err=%w", err)
+	}
+	ret := newConn(stream, conn, c.sess, nil)
+	_ = ret.SetReadDeadline(c.readDeadline)
+	_ = ret.SetWriteDeadline(c.writeDeadline)
+	if _, err := ret.Write(c.written); err != nil {
+		_ = ret.Close()
+		return nil, err
+	}
+	if c.finished {
+		_ = ret.CloseWrite()
+	}
+	stats.Add("0rtt_rejected", 1)
+	c.conn, c.written, c.settled = ret, nil, true
+	return ret, nil
+}
+
+func (c *earlyConn) Read(p []byte) (int, error) {
+	conn := c.current(nil)
+	n, err := conn.Read(p)
+	if n == 0 && errors.Is(err, quicgo.Err0RTTRejected) {
+		if conn, err = c.reopen(conn); err != nil {
+			return 0, err
+		}
+		return conn.Read(p)
+	}
+	return n, err
+}
+
+func (c *earlyConn) Write(p []byte) (int, error) {
+	conn := c.current(p)
+	n, err := conn.Write(p)
+	if errors.Is(err, quicgo.Err0RTTRejected) {
+		if _, err = c.reopen(conn); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (c *earlyConn) LocalAddr() net.Addr {
+	return c.current(nil).LocalAddr()
+}
+
+func (c *earlyConn) RemoteAddr() net.Addr {
+	return c.current(nil).RemoteAddr()
+}
+
+func (c *earlyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.current(nil).SetDeadline(t)
+}
+
+func (c *earlyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.current(nil).SetReadDeadline(t)
+}
+
+func (c *earlyConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.current(nil).SetWriteDeadline(t)
+}
+
+func (c *earlyConn) CloseWrite() error {
+	conn := c.current(nil)
+	c.mu.Lock()
+	c.finished = !c.settled
+	c.mu.Unlock()
+	return conn.CloseWrite()
+}
+
+func (c *earlyConn) CloseRead() error {
+	return c.current(nil).CloseRead()
+}
+
+func (c *earlyConn) SetLinger(sec int) error {
+	return c.current(nil).SetLinger(sec)
+}
+
+func (c *earlyConn) Close() error {
+	return c.current(nil).Close()
+}
@@ -0,0 +1,86 @@
+//go:build quic
+
+package quic
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// Conn is a bidirectional stream of a QUIC connection, a stream FIN is a tcp FIN:
+// CloseWrite sends one, Read returns io.EOF once the peer sent one.
+type Conn struct {
+	*quicgo.Stream
+	conn  *quicgo.Conn
+	addrs addrs
+
+	reset atomic.Bool
+	once  sync.Once
+	// called once closed, may be nil
+	done func()
+}
+
+// addrs of a connection, the path of a client changes once it migrates
+type addrs interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+func newConn(stream *quicgo.Stream, conn *quicgo.Conn, addrs addrs, done func()) *Conn {
+	return &Conn{Stream: stream, conn: conn, addrs: addrs, done: done}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Stream.Read(p)
+	return n, errOf("read", err)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Stream.Write(p)
+	return n, errOf("write", err)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addrs.LocalAddr()
+}
+
+// RemoteAddr is the current address of the peer, it changes once the agent migrates
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addrs.RemoteAddr()
+}
+
+// CloseWrite sends a FIN, the peer may still send until it closes as well
+func (c *Conn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// CloseRead asks the peer to stop sending
+func (c *Conn) CloseRead() error {
+	c.Stream.CancelRead(codeClosed)
+	return nil
+}
+
+// SetLinger with 0 makes Close reset the stream like tcp, other values are ignored
+func (c *Conn) SetLinger(sec int) error {
+	c.reset.Store(sec == 0)
+	return nil
+}
+
+// Close finishes the stream, or resets it after SetLinger(0), the QUIC connection is kept
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		if c.reset.Load() {
+			c.Stream.CancelWrite(codeReset)
+		} else {
+			_ = c.Stream.Close()
+		}
+		c.Stream.CancelRead(codeClosed)
+		if c.done != nil {
+			c.done()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,170 @@
+//go:build quic
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// Listener accepts the streams of agents' QUIC connections as connections.
+// Streams opened in 0-RTT are accepted once the handshake completes, so a replayed
+// first flight of an agent never repeats its commands.
+type Listener struct {
+	tr    *quicgo.Transport
+	ln    *quicgo.EarlyListener
+	conns chan net.Conn
+	// QUIC connections, the transport is closed once they are done
+	wg sync.WaitGroup
+	// closed once no QUIC connection is added to wg
+	accepting chan struct{}
+	// connections are closed at once instead of drained on Close
+	abort atomic.Bool
+
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+}
+
+// Listen listens on the udp address, network is one of udp, udp4 and udp6
+func Listen(network, address string, tlsConfig *tls.Config) (*Listener, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("fail to resolve %s, err=%w", address, err)
+	}
+	udp, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("fail to listen udp socket, err=%w", err)
+	}
+	return ListenPacket(udp, tlsConfig)
+}
+
+// ListenPacket serves on the udp socket, e.g. one inherited on upgrade, it's closed with the listener
+func ListenPacket(udp net.PacketConn, tlsConfig *tls.Config) (*Listener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{alpn}
+
+	tr := &quicgo.Transport{Conn: udp}
+	ln, err := tr.ListenEarly(tlsConfig, serverConfig())
+	if err != nil {
+		_ = tr.Close()
+		_ = udp.Close()
+		return nil, fmt.Errorf("fail to listen quic, err=%w", err)
+	}
+	l := &Listener{tr: tr, ln: ln, conns: make(chan net.Conn), accepting: make(chan struct{})}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *Listener) acceptConns() {
+	defer close(l.accepting)
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.close(fmt.Errorf("fail to accept quic connection, err=%w", err))
+			return
+		}
+		stats.Add("connections", 1)
+		l.wg.Add(1)
+		go l.acceptStreams(conn)
+	}
+}
+
+// acceptStreams yields the streams of conn after the handshake until it fails or the listener is closed,
+// then closes conn once its last stream is done
+func (l *Listener) acceptStreams(conn *quicgo.Conn) {
+	defer l.wg.Done()
+	// 0-RTT data can be replayed, the finished handshake can't
+	select {
+	case <-conn.HandshakeComplete():
+		if conn.ConnectionState().Used0RTT {
+			stats.Add("0rtt", 1)
+		}
+	case <-conn.Context().Done():
+		return
+	case <-l.ctx.Done():
+		_ = conn.CloseWithError(0, "")
+		return
+	}
+
+	var active sync.WaitGroup
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			break
+		}
+		stats.Add("streams", 1)
+		active.Add(1)
+		c := newConn(stream, conn, conn, active.Done)
+		select {
+		case l.conns <- c:
+		case <-l.ctx.Done():
+			_ = c.SetLinger(0)
+			_ = c.Close()
+		}
+	}
+	if !l.abort.Load() {
+		active.Wait()
+	}
+	_ = conn.CloseWithError(0, "")
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, l.err
+	}
+}
+
+func (l *Listener) close(err error) {
+	l.once.Do(func() {
+		l.err = err
+		l.cancel()
+		_ = l.ln.Close()
+		go func() {
+			<-l.accepting
+			l.wg.Wait()
+			// the udp socket is left open by tr.Close
+			_ = l.tr.Close()
+			_ = l.tr.Conn.Close()
+		}()
+	})
+}
+
+// Close stops accepting, accepted streams are left open and the udp socket is closed
+// once they are done, unless SetDrainOnClose(false).
+func (l *Listener) Close() error {
+	l.close(net.ErrClosed)
+	return nil
+}
+
+// SetDrainOnClose(false) makes Close close QUIC connections at once, so the udp socket
+// passed on upgrade is read by the new process only. Agents redial it.
+func (l *Listener) SetDrainOnClose(drain bool) {
+	l.abort.Store(!drain)
+}
+
+// File dups the udp socket, which is passed on upgrade and served by ListenPacket
+func (l *Listener) File() (*os.File, error) {
+	udp, ok := l.tr.Conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("udp socket %T can not be dup", l.tr.Conn)
+	}
+	return udp.File()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
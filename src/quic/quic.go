@@ -0,0 +1,79 @@
+//go:build quic
+
+// Package quic carries agent connections in streams of one QUIC connection, so flows don't
+// block each other on lossy links. Reconnects send their first streams in 0-RTT, which the server
+// serves once the handshake completes, and the agent migrates the connection to a new path once
+// its address changes.
+package quic
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"syscall"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithField("component", "quic")
+
+const (
+	alpn = "s5"
+	// streams an agent may have open at once
+	maxStreams     = 1 << 14
+	maxIdleTimeout = 45 * time.Second
+	keepAlive      = 15 * time.Second
+	// how long a stream rejected in 0-RTT waits for the handshake to open again
+	handshakeTimeout = 10 * time.Second
+	// how often the agent checks its address towards the server
+	migrationInterval = 2 * time.Second
+	probeTimeout      = 5 * time.Second
+
+	codeClosed quicgo.StreamErrorCode = 0
+	codeReset  quicgo.StreamErrorCode = 1
+)
+
+var stats = new(expvar.Map).Init()
+
+// Stats counts connections, streams, connections resumed in 0-RTT, rejected 0-RTT and migrations
+func Stats() *expvar.Map {
+	return stats
+}
+
+func serverConfig() *quicgo.Config {
+	return &quicgo.Config{
+		Allow0RTT:          true,
+		MaxIdleTimeout:     maxIdleTimeout,
+		MaxIncomingStreams: maxStreams,
+	}
+}
+
+func clientConfig() *quicgo.Config {
+	return &quicgo.Config{
+		MaxIdleTimeout:  maxIdleTimeout,
+		KeepAlivePeriod: keepAlive,
+	}
+}
+
+// errOf passes cancellations by the peer on as resets of tcp, so pipes tell them from failures.
+// Streams cancelled locally are closed.
+func errOf(op string, err error) error {
+	var streamErr *quicgo.StreamError
+	var appErr *quicgo.ApplicationError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &streamErr) && !streamErr.Remote:
+		return &net.OpError{Op: op, Net: "quic", Err: net.ErrClosed}
+	case errors.As(err, &streamErr), errors.As(err, &appErr) && appErr.Remote:
+		errno := syscall.ECONNRESET
+		if op == "write" {
+			errno = syscall.EPIPE
+		}
+		return &net.OpError{Op: op, Net: "quic", Err: errno}
+	default:
+		return err
+	}
+}
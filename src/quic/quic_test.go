@@ -0,0 +1,410 @@
+//go:build quic
+
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// harness is a server and an agent on loopback, the server serves each stream with handle
+type harness struct {
+	t      *testing.T
+	cert   tls.Certificate
+	pool   *x509.CertPool
+	ln     *Listener
+	client *Client
+	handle func(net.Conn)
+
+	mu    sync.Mutex
+	conns []*Conn
+}
+
+func newHarness(t *testing.T, handle func(net.Conn)) *harness {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		t:      t,
+		cert:   tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf},
+		pool:   x509.NewCertPool(),
+		handle: handle,
+	}
+	h.pool.AddCert(leaf)
+
+	h.listen("127.0.0.1:0")
+	h.client, err = NewClient(h.ln.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: h.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = h.client.Close()
+		_ = h.ln.Close()
+	})
+	return h
+}
+
+// listen serves on address with new session ticket keys, so tickets of the last listener are rejected
+func (h *harness) listen(address string) {
+	var ln *Listener
+	var err error
+	// the udp socket of the last listener is closed in background
+	for i := 0; i < 50; i++ {
+		if ln, err = Listen("udp", address, &tls.Config{Certificates: []tls.Certificate{h.cert}}); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.serve(ln)
+}
+
+// serve accepts streams of ln, handled by h.handle
+func (h *harness) serve(ln *Listener) {
+	h.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h.mu.Lock()
+			h.conns = append(h.conns, conn.(*Conn))
+			h.mu.Unlock()
+			go h.handle(conn)
+		}
+	}()
+}
+
+func (h *harness) accepted() []*Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*Conn(nil), h.conns...)
+}
+
+func (h *harness) dial() net.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := h.client.DialContext(ctx, "tcp", "ignored")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// roundTrip sends data and a FIN while reading what comes back until the FIN of the server
+func roundTrip(conn net.Conn, data []byte) ([]byte, error) {
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			errs <- err
+			return
+		}
+		errs <- conn.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	got, err := io.ReadAll(conn)
+	if werr := <-errs; werr != nil {
+		return got, werr
+	}
+	return got, err
+}
+
+func (h *harness) roundTrip(conn net.Conn, data []byte) []byte {
+	got, err := roundTrip(conn, data)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return got
+}
+
+// eventually waits for the stat to change by delta, it's counted in background
+func eventually(t *testing.T, name string, base, delta int64) {
+	for i := 0; i < 100 && stat(name)-base != delta; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stat(name) - base; n != delta {
+		t.Fatalf("%s counted %d times, want %d", name, n, delta)
+	}
+}
+
+func echo(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+	_ = conn.(*Conn).CloseWrite()
+}
+
+func stat(name string) int64 {
+	if v, ok := stats.Get(name).(interface{ Value() int64 }); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestStreamsShareConnection(t *testing.T) {
+	h := newHarness(t, echo)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		conn := h.dial()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer conn.Close()
+			data := bytes.Repeat([]byte{byte(i)}, 64<<10+i)
+			got, err := roundTrip(conn, data)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stream %d: got %d bytes back, want %d, err=%v", i, len(got), len(data), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	conns := h.accepted()
+	if len(conns) != 32 {
+		t.Fatalf("got %d streams, want 32", len(conns))
+	}
+	for _, c := range conns {
+		if c.conn != conns[0].conn {
+			t.Fatal("streams are spread over QUIC connections")
+		}
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	// the server keeps sending after the FIN of the agent
+	h := newHarness(t, func(conn net.Conn) {
+		defer conn.Close()
+		got, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("got "), got...))
+	})
+	conn := h.dial()
+	defer conn.Close()
+	if got := h.roundTrip(conn, []byte("ping")); string(got) != "got ping" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	errs := make(chan error, 1)
+	h := newHarness(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, err := io.Copy(io.Discard, conn)
+		errs <- err
+	})
+	conn := h.dial()
+	if _, err := conn.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.(interface{ SetLinger(int) error }).SetLinger(0)
+	_ = conn.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("got %v, want a reset", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset is not passed on")
+	}
+}
+
+func TestStopSending(t *testing.T) {
+	h := newHarness(t, func(conn net.Conn) {
+		_ = conn.(*Conn).CloseRead()
+	})
+	conn := h.dial()
+	defer conn.Close()
+
+	var err error
+	buf := make([]byte, 32<<10)
+	for i := 0; i < 1000 && err == nil; i++ {
+		_, err = conn.Write(buf)
+	}
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("got %v, want a broken pipe", err)
+	}
+}
+
+func TestResumeIn0RTT(t *testing.T) {
+	var early sync.Map
+	h := newHarness(t, func(conn net.Conn) {
+		// a replayed first flight can't complete the handshake, so it's never served
+		select {
+		case <-conn.(*Conn).conn.HandshakeComplete():
+		default:
+			early.Store(conn, true)
+		}
+		echo(conn)
+	})
+	conn := h.dial()
+	if _, ok := conn.(*earlyConn); ok {
+		t.Fatal("first connection is in 0-RTT without a session ticket")
+	}
+	h.roundTrip(conn, []byte("first"))
+	_ = conn.Close()
+	_ = h.client.Close()
+
+	used := stat("0rtt")
+	conn = h.dial()
+	defer conn.Close()
+	if _, ok := conn.(*earlyConn); !ok {
+		t.Fatal("reconnect is not in 0-RTT")
+	}
+	if got := h.roundTrip(conn, []byte("again")); string(got) != "again" {
+		t.Fatalf("got %q", got)
+	}
+	if !h.client.sess.used0RTT() {
+		t.Fatal("server rejected 0-RTT")
+	}
+	// counted by both sides
+	eventually(t, "0rtt", used, 2)
+	early.Range(func(conn, _ any) bool {
+		t.Fatalf("stream from %s is served before the handshake completes", conn.(net.Conn).RemoteAddr())
+		return false
+	})
+}
+
+func TestRejected0RTTIsSentAgain(t *testing.T) {
+	h := newHarness(t, echo)
+	conn := h.dial()
+	h.roundTrip(conn, []byte("first"))
+	_ = conn.Close()
+	_ = h.client.Close()
+
+	// a restarted server doesn't know the session ticket
+	address := h.ln.Addr().String()
+	_ = h.ln.Close()
+	h.listen(address)
+
+	rejected := stat("0rtt_rejected")
+	conn = h.dial()
+	defer conn.Close()
+	if _, ok := conn.(*earlyConn); !ok {
+		t.Fatal("reconnect is not in 0-RTT")
+	}
+	data := bytes.Repeat([]byte("again"), 1000)
+	if got := h.roundTrip(conn, data); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes back, want %d", len(got), len(data))
+	}
+	eventually(t, "0rtt_rejected", rejected, 1)
+}
+
+func TestMigration(t *testing.T) {
+	h := newHarness(t, echo)
+	conn := h.dial()
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	send := func(msg string) {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Fatalf("got %q, want %q", buf, msg)
+		}
+	}
+	send("hello")
+	before := h.accepted()[0].RemoteAddr().String()
+
+	migrations := stat("migrations")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.client.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the stream keeps going, the server follows the agent to its new address
+	send("world")
+	if after := h.accepted()[0].RemoteAddr().String(); after == before {
+		t.Fatalf("server still sends to %s", before)
+	}
+	eventually(t, "migrations", migrations, 1)
+	if len(h.accepted()) != 1 {
+		t.Fatal("migration opened another stream")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	h := newHarness(t, echo)
+	conn := h.dial()
+	h.roundTrip(conn, []byte("first"))
+	_ = conn.Close()
+	inflight := h.dial()
+	defer inflight.Close()
+	if _, err := inflight.Write([]byte("in flight")); err != nil {
+		t.Fatal(err)
+	}
+	// served before the upgrade
+	if _, err := io.ReadFull(inflight, make([]byte, len("in flight"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new process serves the udp socket of the last one
+	last := h.ln
+	f, err := last.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.FilePacketConn(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := ListenPacket(udp, &tls.Config{Certificates: []tls.Certificate{h.cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serve(ln)
+	t.Cleanup(func() { _ = ln.Close() })
+	last.SetDrainOnClose(false)
+	_ = last.Close()
+
+	// streams of the last process are closed instead of drained, so it stops reading the socket
+	var timeout net.Error
+	if got, err := io.ReadAll(inflight); err == nil || errors.As(err, &timeout) && timeout.Timeout() {
+		t.Fatalf("in-flight stream is drained, got %q, err=%v", got, err)
+	}
+	conn = h.dial()
+	defer conn.Close()
+	if got := h.roundTrip(conn, []byte("again")); string(got) != "again" {
+		t.Fatalf("got %q", got)
+	}
+	if addr := ln.Addr().String(); addr != last.Addr().String() {
+		t.Fatalf("new listener is on %s", addr)
+	}
+}
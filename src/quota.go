@@ -2,6 +2,7 @@ package src
 
 import (
 	"errors"
+	"io"
 	"net"
 	"sync/atomic"
 
@@ -10,12 +11,21 @@ import (
 
 var NotEnoughQuota = errors.New("not enough quota")
 
-const lowLevelMarker = int64(100 * units.KiB)
+const (
+	lowLevelMarker = int64(100 * units.KiB)
+	// bytes handed to the kernel at once by ReadFrom/WriteTo, accounted after each chunk.
+	// Chunks are capped by the quota left, so running out moves at most one byte more.
+	spliceChunk = int64(4 * units.MiB)
+)
 
 type QuotaMngr struct {
 	quotaRead, quotaWritten int64
 }
 
+func NewQuotaMngr(r, w int64) *QuotaMngr {
+	return &QuotaMngr{quotaRead: r, quotaWritten: w}
+}
+
 func (quota *QuotaMngr) Update(r, w int64) {
 	atomic.StoreInt64(&quota.quotaRead, r)
 	atomic.StoreInt64(&quota.quotaWritten, w)
@@ -35,46 +45,232 @@ func (quota *QuotaMngr) TryWrite(n int64) bool {
 	return true
 }
 
+// ReadLeft is the quota left for reads, negative once run out
+func (quota *QuotaMngr) ReadLeft() int64 {
+	return atomic.LoadInt64(&quota.quotaRead)
+}
+
+// WriteLeft is the quota left for writes, negative once run out
+func (quota *QuotaMngr) WriteLeft() int64 {
+	return atomic.LoadInt64(&quota.quotaWritten)
+}
+
 func (quota *QuotaMngr) Enough() bool {
 	return atomic.LoadInt64(&quota.quotaRead)+atomic.LoadInt64(&quota.quotaWritten) > lowLevelMarker
 }
 
-func (quota *QuotaMngr) WrapTcpConnection(conn *net.TCPConn) *QuotaConn {
+// WrapTcpConnection charges quota and every one of extra, e.g. the quota of the user
+func (quota *QuotaMngr) WrapTcpConnection(conn TcpConn, extra ...*QuotaMngr) *QuotaConn {
+	return &QuotaConn{
+		stat:    quotaChain(append([]*QuotaMngr{quota}, extra...)),
+		TcpConn: conn,
+	}
+}
+
+// WrapSourceConnection charges the client side of the pipe, reads are uploads and writes are downloads
+// as if charged on the target, so both ends drain the same quota the same way
+func (quota *QuotaMngr) WrapSourceConnection(conn TcpConn, extra ...*QuotaMngr) *QuotaConn {
 	return &QuotaConn{
-		stat:    quota,
-		TCPConn: conn,
+		stat:    swapped{quotaChain(append([]*QuotaMngr{quota}, extra...))},
+		TcpConn: conn,
+	}
+}
+
+type charger interface {
+	TryRead(n int64) bool
+	TryWrite(n int64) bool
+	ReadLeft() int64
+	WriteLeft() int64
+}
+
+// swapped charges reads as writes and writes as reads
+type swapped struct {
+	charger
+}
+
+func (s swapped) TryRead(n int64) bool {
+	return s.charger.TryWrite(n)
+}
+
+func (s swapped) TryWrite(n int64) bool {
+	return s.charger.TryRead(n)
+}
+
+func (s swapped) ReadLeft() int64 {
+	return s.charger.WriteLeft()
+}
+
+func (s swapped) WriteLeft() int64 {
+	return s.charger.ReadLeft()
+}
+
+// quotaChain is charged in full even if one runs out, the connection is closed anyway
+type quotaChain []*QuotaMngr
+
+func (c quotaChain) TryRead(n int64) bool {
+	ok := true
+	for _, quota := range c {
+		ok = quota.TryRead(n) && ok
+	}
+	return ok
+}
+
+func (c quotaChain) TryWrite(n int64) bool {
+	ok := true
+	for _, quota := range c {
+		ok = quota.TryWrite(n) && ok
+	}
+	return ok
+}
+
+// ReadLeft is the least quota left for reads in the chain
+func (c quotaChain) ReadLeft() int64 {
+	left := c[0].ReadLeft()
+	for _, quota := range c[1:] {
+		left = min(left, quota.ReadLeft())
+	}
+	return left
+}
+
+func (c quotaChain) WriteLeft() int64 {
+	left := c[0].WriteLeft()
+	for _, quota := range c[1:] {
+		left = min(left, quota.WriteLeft())
 	}
+	return left
 }
 
+// WireCounter is implemented by connections resizing data on the wire, e.g. compression
+type WireCounter interface {
+	WireRead() int64
+	WireWritten() int64
+}
+
+// QuotaConn charges bytes of the wrapped connection, tcp or a tunnel like websocket
 type QuotaConn struct {
-	*net.TCPConn
-	stat *QuotaMngr
+	TcpConn
+	stat charger
+	// nil if payload is charged, last totals are owned by the reading and the writing direction
+	wire                  WireCounter
+	wireRead, wireWritten int64
+}
+
+// ChargeWire charges bytes on the wire instead of payload, if the wrapped connection counts them
+func (c *QuotaConn) ChargeWire() {
+	c.wire, _ = c.TcpConn.(WireCounter)
+}
+
+// readCharge is n, or the wire bytes read since the last charge
+func (c *QuotaConn) readCharge(n int64) int64 {
+	if c.wire == nil {
+		return n
+	}
+	total := c.wire.WireRead()
+	n, c.wireRead = total-c.wireRead, total
+	return n
+}
+
+func (c *QuotaConn) writeCharge(n int64) int64 {
+	if c.wire == nil {
+		return n
+	}
+	total := c.wire.WireWritten()
+	n, c.wireWritten = total-c.wireWritten, total
+	return n
 }
 
 func (c *QuotaConn) Read(buf []byte) (int, error) {
-	n, err := c.TCPConn.Read(buf)
+	n, err := c.TcpConn.Read(buf)
 	if err != nil {
 		return n, err
 	}
-	if ok := c.stat.TryRead(int64(n)); !ok {
-		_ = c.Close()
-		return n, &net.OpError{
-			Op: "read", Net: c.RemoteAddr().Network(), Source: c.RemoteAddr(), Addr: c.LocalAddr(), Err: NotEnoughQuota,
-		}
+	if ok := c.stat.TryRead(c.readCharge(int64(n))); !ok {
+		return n, c.notEnough("read")
 	}
 	return n, err
 }
 
 func (c *QuotaConn) Write(buf []byte) (int, error) {
-	n, err := c.TCPConn.Write(buf)
+	n, err := c.TcpConn.Write(buf)
 	if err != nil {
 		return n, err
 	}
-	if ok := c.stat.TryWrite(int64(n)); !ok {
-		_ = c.Close()
-		return n, &net.OpError{
-			Op: "write", Net: c.RemoteAddr().Network(), Source: c.RemoteAddr(), Addr: c.LocalAddr(), Err: NotEnoughQuota,
-		}
+	if ok := c.stat.TryWrite(c.writeCharge(int64(n))); !ok {
+		return n, c.notEnough("write")
 	}
 	return n, err
 }
+
+// ReadFrom keeps accounting while r is passed as is in chunks,
+// so the splice fast path is still taken between tcp connections
+func (c *QuotaConn) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		// one byte over the quota left fails the charge, EOF right at the quota doesn't
+		chunk := min(spliceChunk, c.stat.WriteLeft()+1)
+		if chunk <= 0 {
+			return total, c.notEnough("write")
+		}
+		n, err := copyChunk(c.TcpConn, &io.LimitedReader{R: r, N: chunk})
+		total += n
+		if n > 0 && !c.stat.TryWrite(c.writeCharge(n)) {
+			return total, c.notEnough("write")
+		}
+		// a short chunk means EOF of r
+		if err != nil || n < chunk {
+			return total, err
+		}
+	}
+}
+
+// WriteTo hands the raw connection to w.ReadFrom in chunks, which splices if w is a tcp connection
+func (c *QuotaConn) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		chunk := min(spliceChunk, c.stat.ReadLeft()+1)
+		if chunk <= 0 {
+			return total, c.notEnough("read")
+		}
+		n, err := copyChunk(w, &io.LimitedReader{R: c.TcpConn, N: chunk})
+		total += n
+		if n > 0 && !c.stat.TryRead(c.readCharge(n)) {
+			return total, c.notEnough("read")
+		}
+		if err != nil || n < chunk {
+			return total, err
+		}
+	}
+}
+
+// notEnough closes the connection run out of quota on op
+func (c *QuotaConn) notEnough(op string) error {
+	_ = c.Close()
+	return &net.OpError{
+		Op: op, Net: c.RemoteAddr().Network(), Source: c.RemoteAddr(), Addr: c.LocalAddr(), Err: NotEnoughQuota,
+	}
+}
+
+// CloseWrite charges what the wrapped connection sends to end the stream, e.g. the end frame of compression
+func (c *QuotaConn) CloseWrite() error {
+	err := c.TcpConn.CloseWrite()
+	if n := c.writeCharge(0); n > 0 {
+		// the direction is closed anyway
+		_ = c.stat.TryWrite(n)
+	}
+	return err
+}
+
+// SetLinger passes resets on if the wrapped connection is tcp
+func (c *QuotaConn) SetLinger(sec int) error {
+	if l, ok := c.TcpConn.(interface{ SetLinger(sec int) error }); ok {
+		return l.SetLinger(sec)
+	}
+	return nil
+}
+
+func copyChunk(w io.Writer, r *io.LimitedReader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return copyBuffer(w, r)
+}
@@ -0,0 +1,203 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks5-proxy/src/compress"
+)
+
+func compressed(t *testing.T, conn net.Conn) *compress.Conn {
+	c, err := compress.New(conn, compress.Zstd, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestChargeWire(t *testing.T) {
+	const perHour = 1 << 40
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 4096)
+	cases := []struct {
+		name string
+		// source on servers, target on agents
+		compressed string
+		chargeWire bool
+	}{
+		{name: "server wire", compressed: "source", chargeWire: true},
+		{name: "server payload", compressed: "source"},
+		{name: "agent wire", compressed: "target", chargeWire: true},
+		{name: "agent payload", compressed: "target"},
+		{name: "not compressed", chargeWire: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, source := tcpPair(t)
+			target, sink := tcpPair(t)
+			var (
+				clientConn, sinkConn   net.Conn = client, sink
+				sourceConn, targetConn net.Conn = source, target
+				wire                   *compress.Conn
+			)
+			switch c.compressed {
+			case "source":
+				clientConn, wire = compressed(t, client), compressed(t, source)
+				sourceConn = wire
+			case "target":
+				wire, sinkConn = compressed(t, target), compressed(t, sink)
+				targetConn = wire
+			}
+
+			opts := DefaultMngrOptions()
+			opts.QuotaPerHour, opts.UpdateDur, opts.ChargeWire = perHour, time.Hour, c.chargeWire
+			mngr := NewConnQuotaMngr(opts)
+			ctx := NewContext(context.Background(), sourceConn, nil)
+			defer ctx.Release()
+			ctx.SetTargetConn(targetConn)
+			served := make(chan struct{})
+			go func() {
+				mngr.PipeHandler().ServeTcp(ctx)
+				close(served)
+			}()
+
+			for _, dir := range []struct {
+				name     string
+				from, to net.Conn
+			}{{"up", clientConn, sinkConn}, {"down", sinkConn, clientConn}} {
+				if _, err := dir.from.Write(text); err != nil {
+					t.Fatal(err)
+				}
+				finish(dir.from)
+				_ = dir.to.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if got, err := io.ReadAll(dir.to); err != nil || !bytes.Equal(got, text) {
+					t.Fatalf("%s got %d bytes, err=%v", dir.name, len(got), err)
+				}
+			}
+			select {
+			case <-served:
+			case <-time.After(5 * time.Second):
+				t.Fatal("pipe is not finished")
+			}
+
+			// uploads are charged as written, downloads as read
+			up, down := int64(len(text)), int64(len(text))
+			if c.chargeWire && c.compressed == "source" {
+				up, down = wire.WireRead(), wire.WireWritten()
+			} else if c.chargeWire && c.compressed == "target" {
+				up, down = wire.WireWritten(), wire.WireRead()
+			}
+			if up >= int64(len(text)) && c.chargeWire && wire != nil {
+				t.Fatalf("%d wire bytes of %d payload bytes", up, len(text))
+			}
+			written := perHour - atomic.LoadInt64(&mngr.quota.quotaWritten)
+			read := perHour - atomic.LoadInt64(&mngr.quota.quotaRead)
+			if written != up || read != down {
+				t.Fatalf("charged %d up and %d down, want %d and %d", written, read, up, down)
+			}
+		})
+	}
+}
+
+// readFromRecorder records readers handed to ReadFrom of the raw connection
+type readFromRecorder struct {
+	*net.TCPConn
+	from []io.Reader
+}
+
+func (r *readFromRecorder) ReadFrom(from io.Reader) (int64, error) {
+	r.from = append(r.from, from)
+	return r.TCPConn.ReadFrom(from)
+}
+
+// spliced reports whether every reader is the raw connection limited to a chunk,
+// which (*net.TCPConn).ReadFrom splices on linux
+func spliced(from []io.Reader, raw *net.TCPConn) bool {
+	for _, r := range from {
+		if lr, ok := r.(*io.LimitedReader); !ok || lr.R != raw {
+			return false
+		}
+	}
+	return len(from) > 0
+}
+
+func TestQuotaSplice(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	unlimited := func() *QuotaMngr { return NewQuotaMngr(1<<62, 1<<62) }
+
+	// both directions of a pipe hand the raw connections to ReadFrom
+	client, source := tcpPair(t)
+	target, sink := tcpPair(t)
+	up := &readFromRecorder{TCPConn: target}
+	go func() {
+		_, _ = client.Write(data)
+		_ = client.CloseWrite()
+	}()
+	if n, err := pipeCopy(unlimited().WrapTcpConnection(up), source); n != int64(len(data)) || err != nil {
+		t.Fatalf("copied %d bytes up, err=%v", n, err)
+	}
+	if !spliced(up.from, source) {
+		t.Fatalf("got readers %T up", up.from)
+	}
+	down := &readFromRecorder{TCPConn: source}
+	go func() {
+		_, _ = sink.Write(data)
+		_ = sink.CloseWrite()
+	}()
+	if n, err := pipeCopy(down, unlimited().WrapTcpConnection(target)); n != int64(len(data)) || err != nil {
+		t.Fatalf("copied %d bytes down, err=%v", n, err)
+	}
+	if !spliced(down.from, target) {
+		t.Fatalf("got readers %T down", down.from)
+	}
+}
+
+func TestQuotaChunk(t *testing.T) {
+	const left = 1000
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	cases := []struct {
+		name string
+		// bytes sent before EOF
+		size int
+		want int64
+		err  error
+	}{
+		{name: "run out", size: len(data), want: left + 1, err: NotEnoughQuota},
+		{name: "eof at quota", size: left, want: left},
+		{name: "eof below quota", size: left / 2, want: left / 2},
+	}
+	for _, c := range cases {
+		for _, dir := range []string{"read from", "write to"} {
+			t.Run(c.name+" "+dir, func(t *testing.T) {
+				client, source := tcpPair(t)
+				target, sink := tcpPair(t)
+				go func() {
+					_, _ = io.Copy(io.Discard, sink)
+				}()
+				go func() {
+					_, _ = client.Write(data[:c.size])
+					_ = client.CloseWrite()
+				}()
+				_ = source.SetDeadline(time.Now().Add(5 * time.Second))
+
+				// the user quota runs out while the connection quota doesn't
+				user := NewQuotaMngr(left, left)
+				var n int64
+				var err error
+				if dir == "read from" {
+					n, err = NewQuotaMngr(1<<62, 1<<62).WrapTcpConnection(target, user).ReadFrom(source)
+				} else {
+					n, err = NewQuotaMngr(1<<62, 1<<62).WrapTcpConnection(source, user).WriteTo(target)
+				}
+				if n != c.want || !errors.Is(err, c.err) {
+					t.Fatalf("moved %d bytes, err=%v, want %d bytes, err=%v", n, err, c.want, c.err)
+				}
+			})
+		}
+	}
+}
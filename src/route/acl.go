@@ -0,0 +1,66 @@
+package route
+
+import (
+	"sync/atomic"
+
+	"socks5-proxy/src"
+)
+
+// All matches when every matcher matches
+type All []Matcher
+
+func (a All) Match(ctx *src.Context) bool {
+	for _, m := range a {
+		if !m.Match(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+type aclRule struct {
+	matcher Matcher
+	allow   bool
+}
+
+type aclTable struct {
+	rules        []aclRule
+	defaultAllow bool
+}
+
+// ACL allows or denies connections, the first matched rule wins.
+// Rules can be swapped by Update while serving.
+type ACL struct {
+	table atomic.Pointer[aclTable]
+}
+
+func NewACL(defaultAllow bool) *ACL {
+	acl := &ACL{}
+	acl.table.Store(&aclTable{defaultAllow: defaultAllow})
+	return acl
+}
+
+// Add is not safe while serving, build another acl and Update instead
+func (acl *ACL) Add(m Matcher, allow bool) {
+	t := acl.table.Load()
+	t.rules = append(t.rules, aclRule{matcher: m, allow: allow})
+}
+
+func (acl *ACL) Update(other *ACL) {
+	acl.table.Store(other.table.Load())
+}
+
+func (acl *ACL) Allowed(ctx *src.Context) bool {
+	return acl.Match(ctx).Allow
+}
+
+// Match returns the first matched rule, or the default with index -1
+func (acl *ACL) Match(ctx *src.Context) src.ACLRule {
+	t := acl.table.Load()
+	for i, rule := range t.rules {
+		if rule.matcher.Match(ctx) {
+			return src.ACLRule{Index: i, Allow: rule.allow}
+		}
+	}
+	return src.ACLRule{Index: -1, Allow: t.defaultAllow}
+}
@@ -0,0 +1,209 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"socks5-proxy/src"
+)
+
+const (
+	rejectKind = "reject"
+	viaPrefix  = "via="
+)
+
+// DialerFactory builds the dialer of an outbound from its kind and arguments,
+// forward is the dialer of the previous hop, nil if the outbound is not chained.
+type DialerFactory func(kind string, args []string, forward src.Dialer) (src.Dialer, error)
+
+// LoadFile reads routing rules, e.g.
+//
+//	outbound hk remote 1.2.3.4:1081
+//	outbound corp http 10.0.0.1:3128 user pass
+//	outbound us socks5 5.6.7.8:1080 via=corp
+//	outbound local direct
+//	outbound block reject
+//	geoip /etc/s5/geoip.csv
+//	rule domain-suffix google.com,youtube.com hk
+//	rule cidr 10.0.0.0/8,192.168.0.0/16 local
+//	rule port 25 block
+//	rule geoip CN local
+//	rule user alice hk
+//	default hk
+func LoadFile(path string, factory DialerFactory) (*Router, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open rules file, err=%w", err)
+	}
+	defer func() { _ = f.Close() }()
+	return Load(f, factory)
+}
+
+func Load(r io.Reader, factory DialerFactory) (*Router, error) {
+	b := NewBuilder(factory)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := b.parseLine(strings.Fields(line)); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("fail to read rules, err=%w", err)
+	}
+	return b.Build()
+}
+
+// Builder assembles a router, outbounds should be added before the rules referring them
+type Builder struct {
+	factory   DialerFactory
+	outbounds map[string]*Outbound
+	geoip     *GeoIPDB
+	rules     []Rule
+	def       *Outbound
+}
+
+func NewBuilder(factory DialerFactory) *Builder {
+	return &Builder{
+		factory:   factory,
+		outbounds: make(map[string]*Outbound),
+	}
+}
+
+func (b *Builder) Build() (*Router, error) {
+	if b.def == nil {
+		return nil, fmt.Errorf("default outbound is missing")
+	}
+	router := NewRouter(b.def)
+	for _, rule := range b.rules {
+		router.Add(rule.Matcher, rule.Outbound)
+	}
+	return router, nil
+}
+
+func (b *Builder) parseLine(fields []string) error {
+	switch fields[0] {
+	case "outbound":
+		if len(fields) < 3 {
+			return fmt.Errorf("usage: outbound <name> <kind> [args...] [via=<outbound>]")
+		}
+		args, via := fields[3:], ""
+		if n := len(args); n > 0 && strings.HasPrefix(args[n-1], viaPrefix) {
+			args, via = args[:n-1], strings.TrimPrefix(args[n-1], viaPrefix)
+		}
+		return b.AddOutbound(fields[1], fields[2], args, via)
+	case "geoip":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: geoip <path>")
+		}
+		return b.SetGeoIP(fields[1])
+	case "rule":
+		if len(fields) != 4 {
+			return fmt.Errorf("usage: rule <type> <values> <outbound>")
+		}
+		return b.AddRule(fields[1], strings.Split(fields[2], ","), fields[3])
+	case "default":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: default <outbound>")
+		}
+		return b.SetDefault(fields[1])
+	default:
+		return fmt.Errorf("unknown directive %s", fields[0])
+	}
+}
+
+// AddOutbound creates an outbound, it's dialed through outbound via if not empty
+func (b *Builder) AddOutbound(name, kind string, args []string, via string) error {
+	if _, ok := b.outbounds[name]; ok {
+		return fmt.Errorf("duplicated outbound %s", name)
+	}
+	if kind == rejectKind {
+		b.outbounds[name] = RejectOutbound(name)
+		return nil
+	}
+
+	var forward src.Dialer
+	if via != "" {
+		prev, err := b.outbound(via)
+		if err != nil {
+			return err
+		}
+		if prev.Reject() {
+			return fmt.Errorf("can not chain to reject outbound %s", prev.Name)
+		}
+		forward = prev.Dialer
+	}
+
+	dialer, err := b.factory(kind, args, forward)
+	if err != nil {
+		return fmt.Errorf("fail to create outbound %s, err=%w", name, err)
+	}
+	b.outbounds[name] = NewOutbound(name, dialer)
+	return nil
+}
+
+func (b *Builder) SetGeoIP(path string) error {
+	db, err := LoadGeoIP(path)
+	if err != nil {
+		return err
+	}
+	b.geoip = db
+	return nil
+}
+
+func (b *Builder) AddRule(typ string, values []string, name string) error {
+	out, err := b.outbound(name)
+	if err != nil {
+		return err
+	}
+	m, err := b.matcher(typ, values)
+	if err != nil {
+		return err
+	}
+	b.rules = append(b.rules, Rule{Matcher: m, Outbound: out})
+	return nil
+}
+
+func (b *Builder) SetDefault(name string) error {
+	out, err := b.outbound(name)
+	if err != nil {
+		return err
+	}
+	b.def = out
+	return nil
+}
+
+func (b *Builder) outbound(name string) (*Outbound, error) {
+	out, ok := b.outbounds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown outbound %s", name)
+	}
+	return out, nil
+}
+
+func (b *Builder) matcher(typ string, values []string) (Matcher, error) {
+	switch typ {
+	case "domain-suffix":
+		return DomainSuffix(values), nil
+	case "cidr":
+		return ParseCIDR(values)
+	case "port":
+		return ParsePort(values)
+	case "user":
+		return User(values), nil
+	case "geoip":
+		if b.geoip == nil {
+			return nil, fmt.Errorf("geoip db should be declared before geoip rules")
+		}
+		return b.geoip.Matcher(values), nil
+	default:
+		return nil, fmt.Errorf("unknown rule type %s", typ)
+	}
+}
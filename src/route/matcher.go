@@ -0,0 +1,182 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"socks5-proxy/src"
+)
+
+type Matcher interface {
+	Match(ctx *src.Context) bool
+}
+
+type MatchFunc func(ctx *src.Context) bool
+
+func (fn MatchFunc) Match(ctx *src.Context) bool {
+	return fn(ctx)
+}
+
+// DomainSuffix matches the domain itself and all of its sub domains.
+type DomainSuffix []string
+
+func (d DomainSuffix) Match(ctx *src.Context) bool {
+	host := strings.ToLower(strings.TrimSuffix(ctx.Host, "."))
+	for _, suffix := range d {
+		suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CIDR only matches ip targets, domains are never resolved.
+type CIDR []*net.IPNet
+
+func ParseCIDR(values []string) (CIDR, error) {
+	ret := make(CIDR, 0, len(values))
+	for _, v := range values {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse cidr %s, err=%w", v, err)
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+func (c CIDR) Match(ctx *src.Context) bool {
+	return c.contains(net.ParseIP(ctx.Host))
+}
+
+func (c CIDR) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range c {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type portRange struct {
+	from, to int
+}
+
+type Port []portRange
+
+// ParsePort accepts single ports (443) and ranges (8000-8080).
+func ParsePort(values []string) (Port, error) {
+	ret := make(Port, 0, len(values))
+	for _, v := range values {
+		from, to, found := strings.Cut(v, "-")
+		if !found {
+			to = from
+		}
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("illegal port %s", v)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || t < f {
+			return nil, fmt.Errorf("illegal port %s", v)
+		}
+		ret = append(ret, portRange{from: int(f), to: int(t)})
+	}
+	return ret, nil
+}
+
+func (p Port) Match(ctx *src.Context) bool {
+	port, err := strconv.Atoi(ctx.Port)
+	if err != nil {
+		return false
+	}
+	for _, r := range p {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+type User []string
+
+func (u User) Match(ctx *src.Context) bool {
+	name, ok := src.Get(ctx, src.UserKey)
+	if !ok {
+		return false
+	}
+	for _, user := range u {
+		if user == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Role matches users having any of the roles
+type Role []string
+
+func (r Role) Match(ctx *src.Context) bool {
+	roles, _ := src.Get(ctx, src.RolesKey)
+	for _, want := range r {
+		for _, role := range roles {
+			if role == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GeoIPDB maps networks to country codes.
+type GeoIPDB struct {
+	countries map[string]CIDR
+}
+
+// LoadGeoIP reads a csv file, one "cidr,country" per line.
+func LoadGeoIP(path string) (*GeoIPDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open geoip db, err=%w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	db := &GeoIPDB{countries: make(map[string]CIDR)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cidr, country, found := strings.Cut(line, ",")
+		if !found {
+			return nil, fmt.Errorf("illegal geoip record at line %d", lineNo)
+		}
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("illegal geoip record at line %d, err=%w", lineNo, err)
+		}
+		country = strings.ToUpper(strings.TrimSpace(country))
+		db.countries[country] = append(db.countries[country], ipNet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("fail to read geoip db, err=%w", err)
+	}
+	return db, nil
+}
+
+func (db *GeoIPDB) Matcher(countries []string) Matcher {
+	var nets CIDR
+	for _, c := range countries {
+		nets = append(nets, db.countries[strings.ToUpper(c)]...)
+	}
+	return nets
+}
@@ -0,0 +1,78 @@
+package route
+
+import (
+	"sync/atomic"
+
+	"socks5-proxy/src"
+)
+
+// Outbound is a named way to reach a destination,
+// a nil Dialer means the connection should be rejected.
+type Outbound struct {
+	Name   string
+	Dialer src.Dialer
+}
+
+func NewOutbound(name string, dialer src.Dialer) *Outbound {
+	return &Outbound{
+		Name:   name,
+		Dialer: dialer,
+	}
+}
+
+func RejectOutbound(name string) *Outbound {
+	return &Outbound{
+		Name: name,
+	}
+}
+
+func (out *Outbound) Reject() bool {
+	return out.Dialer == nil
+}
+
+type Rule struct {
+	Matcher  Matcher
+	Outbound *Outbound
+}
+
+type table struct {
+	rules []Rule
+	def   *Outbound
+}
+
+// Router chooses an outbound per connection, the first matched rule wins.
+// Rules can be swapped by Update while serving.
+type Router struct {
+	table atomic.Pointer[table]
+}
+
+func NewRouter(def *Outbound) *Router {
+	r := &Router{}
+	r.table.Store(&table{def: def})
+	return r
+}
+
+// Add is not safe while serving, build another router and Update instead
+func (r *Router) Add(m Matcher, out *Outbound) {
+	t := r.table.Load()
+	t.rules = append(t.rules, Rule{Matcher: m, Outbound: out})
+}
+
+// Update swaps in the rules of other, connections already routed are not affected
+func (r *Router) Update(other *Router) {
+	r.table.Store(other.table.Load())
+}
+
+func (r *Router) Default() *Outbound {
+	return r.table.Load().def
+}
+
+func (r *Router) Match(ctx *src.Context) *Outbound {
+	t := r.table.Load()
+	for _, rule := range t.rules {
+		if rule.Matcher.Match(ctx) {
+			return rule.Outbound
+		}
+	}
+	return t.def
+}
@@ -0,0 +1,260 @@
+package route
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"socks5-proxy/src"
+)
+
+// target is a connection to host:port of user, empty if anonymous
+func target(t *testing.T, host, port, user string, roles ...string) *src.Context {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	ctx := src.NewContext(context.Background(), a, nil)
+	t.Cleanup(ctx.Release)
+	ctx.Host, ctx.Port = host, port
+	if user != "" {
+		src.Set(ctx, src.UserKey, user)
+	}
+	if len(roles) > 0 {
+		src.Set(ctx, src.RolesKey, roles)
+	}
+	return ctx
+}
+
+// dialers builds outbounds of any kind but "broken", args are not checked
+func dialers(kind string, args []string, forward src.Dialer) (src.Dialer, error) {
+	if kind == "broken" {
+		return nil, os.ErrInvalid
+	}
+	return src.DialHandleFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, os.ErrInvalid
+	}), nil
+}
+
+func geoip(t *testing.T, records string) string {
+	path := filepath.Join(t.TempDir(), "geoip.csv")
+	if err := os.WriteFile(path, []byte(records), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMatchers(t *testing.T) {
+	cidr, err := ParseCIDR([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := ParsePort([]string{"443", "8000-8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name       string
+		matcher    Matcher
+		host, port string
+		user       string
+		roles      []string
+		want       bool
+	}{
+		{name: "domain itself", matcher: DomainSuffix{"google.com"}, host: "google.com", want: true},
+		{name: "sub domain", matcher: DomainSuffix{"google.com"}, host: "mail.google.com", want: true},
+		{name: "case and dots", matcher: DomainSuffix{".Google.COM"}, host: "Mail.Google.com.", want: true},
+		{name: "suffix of a label", matcher: DomainSuffix{"google.com"}, host: "notgoogle.com"},
+		{name: "parent domain", matcher: DomainSuffix{"mail.google.com"}, host: "google.com"},
+		{name: "cidr v4", matcher: cidr, host: "10.1.2.3", want: true},
+		{name: "cidr v6", matcher: cidr, host: "2001:db8::1", want: true},
+		{name: "cidr outside", matcher: cidr, host: "192.168.1.1"},
+		// domains are never resolved
+		{name: "cidr domain", matcher: cidr, host: "10.example.com"},
+		{name: "port", matcher: port, port: "443", want: true},
+		{name: "port range from", matcher: port, port: "8000", want: true},
+		{name: "port range to", matcher: port, port: "8080", want: true},
+		{name: "port outside", matcher: port, port: "8081"},
+		{name: "port illegal", matcher: port, port: "https"},
+		{name: "user", matcher: User{"alice", "bob"}, user: "bob", want: true},
+		{name: "other user", matcher: User{"alice"}, user: "bob"},
+		{name: "anonymous", matcher: User{"alice"}},
+		{name: "role", matcher: Role{"admin"}, user: "bob", roles: []string{"dev", "admin"}, want: true},
+		{name: "other role", matcher: Role{"admin"}, user: "bob", roles: []string{"dev"}},
+		{name: "all", matcher: All{DomainSuffix{"google.com"}, port}, host: "google.com", port: "443", want: true},
+		{name: "all but one", matcher: All{DomainSuffix{"google.com"}, port}, host: "google.com", port: "80"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.matcher.Match(target(t, c.host, c.port, c.user, c.roles...)); got != c.want {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name  string
+		parse func() error
+	}{
+		{name: "cidr", parse: func() error { _, err := ParseCIDR([]string{"10.0.0.0/33"}); return err }},
+		{name: "cidr without mask", parse: func() error { _, err := ParseCIDR([]string{"10.0.0.1"}); return err }},
+		{name: "port", parse: func() error { _, err := ParsePort([]string{"https"}); return err }},
+		{name: "port too large", parse: func() error { _, err := ParsePort([]string{"65536"}); return err }},
+		{name: "port range reversed", parse: func() error { _, err := ParsePort([]string{"8080-8000"}); return err }},
+	}
+	for _, c := range cases {
+		if err := c.parse(); err == nil {
+			t.Errorf("illegal %s is parsed", c.name)
+		}
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	db, err := LoadGeoIP(geoip(t, "# cidr,country\n1.0.1.0/24,cn\n1.0.2.0/23, CN\n\n8.8.8.0/24,US\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		countries []string
+		host      string
+		want      bool
+	}{
+		{countries: []string{"CN"}, host: "1.0.1.1", want: true},
+		{countries: []string{"cn"}, host: "1.0.3.255", want: true},
+		{countries: []string{"CN"}, host: "8.8.8.8"},
+		{countries: []string{"CN", "US"}, host: "8.8.8.8", want: true},
+		{countries: []string{"JP"}, host: "1.0.1.1"},
+		{countries: []string{"CN"}, host: "cn.example.com"},
+	}
+	for _, c := range cases {
+		if got := db.Matcher(c.countries).Match(target(t, c.host, "443", "")); got != c.want {
+			t.Errorf("%s in %v got %v, want %v", c.host, c.countries, got, c.want)
+		}
+	}
+
+	for _, records := range []string{"1.0.1.0/24\n", "1.0.1.0/33,CN\n"} {
+		if _, err := LoadGeoIP(geoip(t, records)); err == nil {
+			t.Errorf("illegal record %q is loaded", records)
+		}
+	}
+	if _, err := LoadGeoIP(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("missing db is loaded")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	db := geoip(t, "1.0.1.0/24,CN\n")
+	rules := `
+# first matched rule wins
+outbound hk remote 1.2.3.4:1081
+outbound corp http 10.0.0.1:3128 user pass
+outbound us socks5 5.6.7.8:1080 via=corp
+outbound local direct
+outbound block reject
+geoip ` + db + `
+rule port 25 block
+rule user alice us
+rule domain-suffix google.com hk
+rule cidr 10.0.0.0/8,192.168.0.0/16 local
+rule domain-suffix mail.google.com local
+rule geoip CN local
+default hk
+`
+	router, err := Load(strings.NewReader(rules), dialers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, host, port, user string
+		want                   string
+	}{
+		{name: "port before user", host: "mail.example.com", port: "25", user: "alice", want: "block"},
+		{name: "user before domain", host: "google.com", port: "443", user: "alice", want: "us"},
+		{name: "domain", host: "google.com", port: "443", want: "hk"},
+		// shadowed by the earlier google.com rule
+		{name: "shadowed", host: "mail.google.com", port: "443", want: "hk"},
+		{name: "cidr", host: "192.168.1.1", port: "443", want: "local"},
+		{name: "geoip", host: "1.0.1.1", port: "443", want: "local"},
+		{name: "default", host: "example.com", port: "443", want: "hk"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := router.Match(target(t, c.host, c.port, c.user)); got.Name != c.want {
+				t.Fatalf("got %s, want %s", got.Name, c.want)
+			}
+		})
+	}
+	if !router.Match(target(t, "example.com", "25", "")).Reject() || router.Default().Reject() {
+		t.Fatal("reject outbound is not rejecting")
+	}
+
+	// rules are swapped at once
+	other, err := Load(strings.NewReader("outbound local direct\ndefault local\n"), dialers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Update(other)
+	if got := router.Match(target(t, "google.com", "443", "")); got.Name != "local" {
+		t.Fatalf("got %s after update", got.Name)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name, rules string
+		// part of the error
+		want string
+	}{
+		{name: "unknown directive", rules: "route x\n", want: "line 1: unknown directive route"},
+		{name: "unknown rule type", rules: "outbound a direct\nrule domain google.com a\ndefault a\n", want: "line 2: unknown rule type domain"},
+		{name: "bad cidr", rules: "outbound a direct\nrule cidr 10.0.0.0/33 a\ndefault a\n", want: "line 2: fail to parse cidr 10.0.0.0/33"},
+		{name: "bad port", rules: "outbound a direct\nrule port 1-x a\ndefault a\n", want: "line 2: illegal port 1-x"},
+		{name: "unknown outbound", rules: "outbound a direct\nrule port 25 b\ndefault a\n", want: "line 2: unknown outbound b"},
+		{name: "duplicated outbound", rules: "outbound a direct\noutbound a direct\n", want: "line 2: duplicated outbound a"},
+		{name: "outbound usage", rules: "outbound a\n", want: "line 1: usage: outbound"},
+		{name: "rule usage", rules: "outbound a direct\nrule port 25\n", want: "line 2: usage: rule"},
+		{name: "broken outbound", rules: "outbound a broken\n", want: "line 1: fail to create outbound a"},
+		{name: "via unknown", rules: "outbound a socks5 1.2.3.4:1080 via=b\n", want: "line 1: unknown outbound b"},
+		{name: "via reject", rules: "outbound b reject\noutbound a socks5 1.2.3.4:1080 via=b\n", want: "line 2: can not chain to reject outbound b"},
+		{name: "geoip undeclared", rules: "outbound a direct\nrule geoip CN a\n", want: "line 2: geoip db should be declared before geoip rules"},
+		{name: "missing default", rules: "outbound a direct\n", want: "default outbound is missing"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Load(strings.NewReader(c.rules), dialers)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("got %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl := NewACL(true)
+	acl.Add(User{"mallory"}, false)
+	acl.Add(All{User{"mallory"}, DomainSuffix{"example.com"}}, true)
+	acl.Add(Port{{from: 25, to: 25}}, false)
+
+	cases := []struct {
+		name, host, port, user string
+		index                  int
+		allow                  bool
+	}{
+		// the later rule allowing mallory never matches
+		{name: "first match", host: "example.com", port: "443", user: "mallory", index: 0},
+		{name: "port", host: "example.com", port: "25", user: "alice", index: 2},
+		{name: "default", host: "example.com", port: "443", user: "alice", index: -1, allow: true},
+	}
+	for _, c := range cases {
+		got := acl.Match(target(t, c.host, c.port, c.user))
+		if got.Index != c.index || got.Allow != c.allow {
+			t.Errorf("%s got %+v, want index %d, allow %v", c.name, got, c.index, c.allow)
+		}
+	}
+}
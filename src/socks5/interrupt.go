@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, which fails blocked io at once
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Interruptible runs fn doing blocking io on conn, e.g. a handshake, which fails once ctx is done.
+// Errors of fn are wrapped by the error of ctx if it's done meanwhile.
+func Interruptible(ctx context.Context, conn net.Conn, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// no goroutine is parked until ctx is done
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(aLongTimeAgo)
+		close(interrupted)
+	})
+	err := fn()
+	if !stop() {
+		// the past deadline must not outlive fn
+		<-interrupted
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if err == nil {
+		return nil
+	}
+	ctxErr := ctx.Err()
+	// conn may time out before the timer of ctx fires
+	if ctxErr == nil && hasDeadline && !time.Now().Before(deadline) {
+		ctxErr = context.DeadlineExceeded
+	}
+	if ctxErr != nil {
+		return fmt.Errorf("%w, err=%s", ctxErr, err.Error())
+	}
+	return err
+}
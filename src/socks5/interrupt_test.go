@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterruptible(t *testing.T) {
+	// cancelled while blocked
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := Interruptible(ctx, a, func() error {
+		_, err := a.Read(make([]byte, 1))
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	// the deadline of ctx applies, then it's cleared for the caller
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = Interruptible(ctx, a, func() error {
+		_, err := a.Read(make([]byte, 1))
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	go func() { _, _ = b.Write([]byte("x")) }()
+	if _, err := a.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("deadline is left on conn, err=%v", err)
+	}
+
+	// done right after fn succeeds, the past deadline doesn't outlive it
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := Interruptible(ctx, a, func() error {
+		cancel()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = b.Write([]byte("x")) }()
+	if _, err := a.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("deadline is left on conn, err=%v", err)
+	}
+}
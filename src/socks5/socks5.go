@@ -0,0 +1,290 @@
+// Package socks5 holds the wire encoding of rfc1928 and rfc1929,
+// shared by the server handlers and the client.
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Version = 0x05
+	Rsv     = 0x00
+
+	NoAuthenticationRequired = 0x00
+	UsernamePassword         = 0x02
+	NoAcceptableMethods      = 0xff
+
+	IPv4   = 0x01
+	Domain = 0x03
+	IPv6   = 0x04
+
+	Connect      = 0x01
+	Bind         = 0x02
+	UdpAssociate = 0x03
+
+	Succeeded               = 0x00
+	GeneralFailure          = 0x01
+	ConnectionNotAllowed    = 0x02
+	NetworkUnreachable      = 0x03
+	HostUnreachable         = 0x04
+	ConnectionRefused       = 0x05
+	TtlExpired              = 0x06
+	CommandNotSupported     = 0x07
+	AddressTypeNotSupported = 0x08
+
+	UserPassVersion = 0x01
+	UserPassSucceed = 0x00
+	UserPassFailure = 0x01
+
+	// atyp + len + domain + port
+	MaxAddrSize = 1 + 1 + 255 + 2
+	// ver + cmd + rsv + addr
+	MaxRequestSize = 1 + 1 + 1 + MaxAddrSize
+	// ver + len + username + len + password
+	MaxUserPassSize = 1 + 1 + 255 + 1 + 255
+)
+
+var (
+	ErrVersion                 = errors.New("unknown protocol")
+	ErrAddressTypeNotSupported = errors.New("address type not supported")
+)
+
+// ReplyError is returned when the server answers a command with a failure
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	switch byte(e) {
+	case GeneralFailure:
+		return "general socks server failure"
+	case ConnectionNotAllowed:
+		return "connection not allowed by ruleset"
+	case NetworkUnreachable:
+		return "network unreachable"
+	case HostUnreachable:
+		return "host unreachable"
+	case ConnectionRefused:
+		return "connection refused"
+	case TtlExpired:
+		return "ttl expired"
+	case CommandNotSupported:
+		return "command not supported"
+	case AddressTypeNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown reply %x", byte(e))
+	}
+}
+
+// Addr is a socks address, the host may be a domain name
+type Addr struct {
+	Host string
+	Port string
+}
+
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host, a.Port)
+}
+
+func CheckVersion(v byte) error {
+	if v == Version {
+		return nil
+	}
+	return ErrVersion
+}
+
+// AppendAddr encodes host:port as atyp + addr + port
+func AppendAddr(buf []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return buf, err
+	}
+	portn, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return buf, fmt.Errorf("illegal port %s", port)
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return buf, fmt.Errorf("domain name too long")
+		}
+		buf = append(buf, Domain, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, IPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, IPv6)
+		buf = append(buf, ip.To16()...)
+	}
+
+	buf = append(buf, byte(portn>>8), byte(portn))
+	return buf, nil
+}
+
+// ReadAddr decodes atyp + addr + port from r, buf should hold at least MaxAddrSize bytes
+func ReadAddr(r io.Reader, buf []byte) (host, port string, err error) {
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", "", err
+	}
+
+	switch buf[0] {
+	case IPv4:
+		if _, err := io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return "", "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case Domain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", "", err
+		}
+		length := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:length]); err != nil {
+			return "", "", err
+		}
+		host = string(buf[:length])
+	case IPv6:
+		if _, err := io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return "", "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	default:
+		return "", "", ErrAddressTypeNotSupported
+	}
+
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(buf[0])<<8 | int(buf[1])), nil
+}
+
+// ParseAddr decodes atyp + addr + port from b, returns the encoded length
+func ParseAddr(b []byte) (host, port string, n int, err error) {
+	if len(b) < 1 {
+		return "", "", 0, io.ErrUnexpectedEOF
+	}
+
+	switch b[0] {
+	case IPv4:
+		n = 1 + net.IPv4len
+	case Domain:
+		if len(b) < 2 {
+			return "", "", 0, io.ErrUnexpectedEOF
+		}
+		n = 2 + int(b[1])
+	case IPv6:
+		n = 1 + net.IPv6len
+	default:
+		return "", "", 0, ErrAddressTypeNotSupported
+	}
+	if len(b) < n+2 {
+		return "", "", 0, io.ErrUnexpectedEOF
+	}
+
+	switch b[0] {
+	case Domain:
+		host = string(b[2:n])
+	default:
+		host = net.IP(b[1:n]).String()
+	}
+	return host, strconv.Itoa(int(b[n])<<8 | int(b[n+1])), n + 2, nil
+}
+
+// AppendRequest encodes a command request
+func AppendRequest(buf []byte, cmd byte, addr string) ([]byte, error) {
+	buf = append(buf, Version, cmd, Rsv)
+	return AppendAddr(buf, addr)
+}
+
+// AppendReply encodes a command reply, an empty addr is sent as 0.0.0.0:0
+func AppendReply(buf []byte, rep byte, addr string) []byte {
+	buf = append(buf, Version, rep, Rsv)
+	if addr != "" {
+		if ret, err := AppendAddr(buf, addr); err == nil {
+			return ret
+		}
+	}
+	return append(buf, IPv4, 0, 0, 0, 0, 0, 0)
+}
+
+// ReadReply decodes a command reply, returns the bound address on success
+func ReadReply(r io.Reader, buf []byte) (*Addr, error) {
+	if _, err := io.ReadFull(r, buf[:3]); err != nil {
+		return nil, err
+	}
+	if err := CheckVersion(buf[0]); err != nil {
+		return nil, err
+	}
+	rep := buf[1]
+
+	host, port, err := ReadAddr(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if rep != Succeeded {
+		return nil, ReplyError(rep)
+	}
+	return &Addr{Host: host, Port: port}, nil
+}
+
+// AppendUserPass encodes a rfc1929 username/password request
+func AppendUserPass(buf []byte, username, password string) ([]byte, error) {
+	if len(username) == 0 || len(username) > 255 || len(password) > 255 {
+		return buf, fmt.Errorf("illegal username or password length")
+	}
+	buf = append(buf, UserPassVersion, byte(len(username)))
+	buf = append(buf, username...)
+	buf = append(buf, byte(len(password)))
+	buf = append(buf, password...)
+	return buf, nil
+}
+
+// ReadUserPass decodes a rfc1929 username/password request
+func ReadUserPass(r io.Reader, buf []byte) (username, password string, err error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != UserPassVersion {
+		return "", "", fmt.Errorf("unknown username/password version %x", buf[0])
+	}
+
+	n := int(buf[1])
+	if _, err := io.ReadFull(r, buf[:n+1]); err != nil {
+		return "", "", err
+	}
+	username = string(buf[:n])
+
+	n = int(buf[n])
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return "", "", err
+	}
+	return username, string(buf[:n]), nil
+}
+
+// AppendUdpHeader encodes the header of a udp datagram, fragments are not supported
+func AppendUdpHeader(buf []byte, addr string) ([]byte, error) {
+	buf = append(buf, Rsv, Rsv, 0)
+	return AppendAddr(buf, addr)
+}
+
+// ParseUdpHeader decodes a udp datagram, returns the address and the payload
+func ParseUdpHeader(b []byte) (*Addr, []byte, error) {
+	if len(b) < 3 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if b[2] != 0 {
+		return nil, nil, fmt.Errorf("fragmented datagram is not supported")
+	}
+	host, port, n, err := ParseAddr(b[3:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Addr{Host: host, Port: port}, b[3+n:], nil
+}
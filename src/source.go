@@ -0,0 +1,97 @@
+package src
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// SourceRules decide which client ips are served, Deny wins over Allow and empty Allow allows all
+type SourceRules struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// SourceFilter drops clients by source ip before any byte is read, non-ip clients are always allowed
+type SourceFilter struct {
+	rules atomic.Pointer[SourceRules]
+}
+
+func NewSourceFilter(rules SourceRules) *SourceFilter {
+	f := &SourceFilter{}
+	f.rules.Store(&rules)
+	return f
+}
+
+// Update takes effect on new connections
+func (f *SourceFilter) Update(rules SourceRules) {
+	f.rules.Store(&rules)
+}
+
+func (f *SourceFilter) Rules() SourceRules {
+	return *f.rules.Load()
+}
+
+func (f *SourceFilter) Allowed(addr net.Addr) bool {
+	ip, ok := ipOf(addr)
+	if !ok {
+		return true
+	}
+	rules := f.rules.Load()
+	for _, p := range rules.Deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(rules.Allow) == 0 {
+		return true
+	}
+	for _, p := range rules.Allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrKnown reports whether the client address of conn is known at accept. Conns taking it from
+// the peer, e.g. from a PROXY header, report LazyRemoteAddr, wrappers are unwrapped by NetConn.
+func addrKnown(conn net.Conn) bool {
+	for {
+		if c, ok := conn.(interface{ LazyRemoteAddr() bool }); ok {
+			return !c.LazyRemoteAddr()
+		}
+		c, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return true
+		}
+		conn = c.NetConn()
+	}
+}
+
+// ParsePrefixes parses cidrs and single ips, mapped ipv4 is unmapped to match clients
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("illegal cidr %s", s)
+			}
+			ip = ip.Unmap()
+			ret = append(ret, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("illegal cidr %s", s)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		ret = append(ret, p.Masked())
+	}
+	return ret, nil
+}
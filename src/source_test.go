@@ -0,0 +1,208 @@
+package src
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"socks5-proxy/src/proxyproto"
+)
+
+func prefixes(t *testing.T, cidrs ...string) []netip.Prefix {
+	ps, err := ParsePrefixes(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+func TestSourceFilter(t *testing.T) {
+	f := NewSourceFilter(SourceRules{
+		Allow: prefixes(t, "127.0.0.1", "127.0.0.2/31", "::ffff:10.0.0.0/104"),
+		Deny:  prefixes(t, "127.0.0.3", "10.1.0.0/16"),
+	})
+	cases := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{addr: tcpAddr("127.0.0.1"), allowed: true},
+		{addr: tcpAddr("127.0.0.2"), allowed: true},
+		// deny wins over allow
+		{addr: tcpAddr("127.0.0.3")},
+		{addr: tcpAddr("127.0.0.4")},
+		{addr: tcpAddr("::ffff:127.0.0.1"), allowed: true},
+		{addr: tcpAddr("10.2.0.1"), allowed: true},
+		{addr: tcpAddr("10.1.0.1")},
+		{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, allowed: true},
+		{addr: &net.UnixAddr{Name: "@", Net: "unix"}, allowed: true},
+	}
+	for _, c := range cases {
+		if got := f.Allowed(c.addr); got != c.allowed {
+			t.Errorf("%s allowed=%v, want %v", c.addr, got, c.allowed)
+		}
+	}
+
+	// empty allow allows all but denied
+	f.Update(SourceRules{Deny: prefixes(t, "127.0.0.3")})
+	if !f.Allowed(tcpAddr("192.0.2.1")) || f.Allowed(tcpAddr("127.0.0.3")) {
+		t.Fatal("update is not applied")
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	cases := []struct {
+		cidr string
+		want string
+	}{
+		{cidr: "127.0.0.1", want: "127.0.0.1/32"},
+		{cidr: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{cidr: "::1", want: "::1/128"},
+		{cidr: "::ffff:127.0.0.1", want: "127.0.0.1/32"},
+		{cidr: "::ffff:10.0.0.0/104", want: "10.0.0.0/8"},
+		{cidr: "localhost"},
+		{cidr: "10.0.0.0/33"},
+	}
+	for _, c := range cases {
+		ps, err := ParsePrefixes([]string{c.cidr})
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%s is parsed as %v", c.cidr, ps)
+			}
+			continue
+		}
+		if err != nil || ps[0].String() != c.want {
+			t.Errorf("%s got %v, err=%v, want %s", c.cidr, ps, err, c.want)
+		}
+	}
+}
+
+func TestTcpServerSources(t *testing.T) {
+	admission := NewAdmissionMngr(AdmissionOptions{})
+	policy := &proxyproto.Policy{Trusted: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 9).To4(), Mask: net.CIDRMask(32, 32)}}}
+	s := NewTcpServer(&ListenAddr{Net: "tcp", Addr: "127.0.0.1:0"})
+	s.SetAdmission(admission)
+	s.SetSourceFilter(NewSourceFilter(SourceRules{
+		Allow: prefixes(t, "127.0.0.1", "127.0.0.2/31", "127.0.0.9"),
+		Deny:  prefixes(t, "127.0.0.3"),
+	}))
+	s.WrapConn(policy.Wrap)
+	// greets, then holds the session until the client closes
+	s.SetFinalHandler(TcpHandleFunc(func(ctx *Context) {
+		_, _ = ctx.SourceConn().Write([]byte("ok"))
+		_, _ = io.Copy(io.Discard, ctx.SourceConn())
+	}))
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(ln) }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	}()
+
+	dial := func(ip, header string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write([]byte(header))
+		return conn
+	}
+	served := func(conn net.Conn) bool {
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(conn, buf)
+		return err == nil
+	}
+
+	cases := []struct {
+		name, ip, header string
+		served           bool
+	}{
+		{name: "allowed", ip: "127.0.0.1", served: true},
+		{name: "allowed cidr", ip: "127.0.0.2", served: true},
+		{name: "denied", ip: "127.0.0.3"},
+		{name: "not listed", ip: "127.0.0.4"},
+		{name: "allowed by header", ip: "127.0.0.9", header: "PROXY TCP4 127.0.0.2 127.0.0.1 40000 1080\r\n", served: true},
+		{name: "denied by header", ip: "127.0.0.9", header: "PROXY TCP4 127.0.0.3 127.0.0.1 40000 1080\r\n"},
+		// headers of untrusted senders are not parsed, the sender itself is checked
+		{name: "untrusted header", ip: "127.0.0.4", header: "PROXY TCP4 127.0.0.2 127.0.0.1 40000 1080\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := dial(c.ip, c.header)
+			defer conn.Close()
+			if got := served(conn); got != c.served {
+				t.Fatalf("served=%v, want %v", got, c.served)
+			}
+		})
+	}
+	if got := s.Stats().Get("rejected_source").String(); got != "4" {
+		t.Fatalf("got %s sources rejected", got)
+	}
+
+	// denied clients don't take sessions, so they can't lock allowed clients out
+	for deadline := time.Now().Add(5 * time.Second); admission.Stats().Get("sessions").String() != "0"; {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions are not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	admission.UpdateOptions(AdmissionOptions{MaxSessions: 1})
+	held := dial("127.0.0.1", "")
+	defer held.Close()
+	if !served(held) {
+		t.Fatal("session is not held")
+	}
+	for _, ip := range []string{"127.0.0.3", "127.0.0.4", "127.0.0.4"} {
+		conn := dial(ip, "")
+		if served(conn) {
+			t.Fatalf("%s is served", ip)
+		}
+		conn.Close()
+	}
+	if got := admission.Stats().Get("rejected_sessions"); got != nil {
+		t.Fatalf("got %s sessions rejected by denied sources", got)
+	}
+	conn := dial("127.0.0.2", "")
+	defer conn.Close()
+	if served(conn) || admission.Stats().Get("rejected_sessions").String() != "1" {
+		t.Fatal("allowed client is not rejected by the session cap")
+	}
+}
+
+func TestAddrKnown(t *testing.T) {
+	client, server := tcpPair(t)
+	policy := &proxyproto.Policy{Trusted: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}}}
+	trusted := policy.Wrap(server)
+	cases := []struct {
+		name  string
+		conn  net.Conn
+		known bool
+	}{
+		{name: "raw", conn: client, known: true},
+		{name: "proxy protocol", conn: trusted},
+		{name: "wrapped proxy protocol", conn: netConn{trusted}},
+		{name: "wrapped raw", conn: netConn{client}, known: true},
+	}
+	for _, c := range cases {
+		if got := addrKnown(c.conn); got != c.known {
+			t.Errorf("%s got %v, want %v", c.name, got, c.known)
+		}
+	}
+}
+
+// netConn wraps like tls.Conn and aead.Conn
+type netConn struct {
+	net.Conn
+}
+
+func (c netConn) NetConn() net.Conn {
+	return c.Conn
+}
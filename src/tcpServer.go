@@ -1,27 +1,92 @@
 package src
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"io/fs"
 	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 var logger = logrus.WithField("component", "tcp server")
 
+// ListenAddr describes where to listen, network is one of tcp, tcp4, tcp6 and unix,
+// or udp, udp4 and udp6 for listeners set by SetListen
+type ListenAddr struct {
+	Net  string
+	Addr string
+	// file permission of unix socket, zero keeps the default
+	Perm os.FileMode
+}
+
+func (a *ListenAddr) Network() string {
+	return a.Net
+}
+
+func (a *ListenAddr) String() string {
+	return a.Addr
+}
+
+var ErrServerClosed = errors.New("tcp server closed")
+
+const (
+	minAcceptDelay   = 5 * time.Millisecond
+	maxAcceptDelay   = time.Second
+	minRelistenDelay = time.Second
+	maxRelistenDelay = 30 * time.Second
+)
+
+var temporaryErrnos = []error{
+	syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+	syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN,
+}
+
 type TcpServer struct {
 	addr net.Addr
 
 	handlers     []TcpHandler
 	finalHandler TcpHandler
+	wrapConn     func(net.Conn) net.Conn
+	wrapListener func(net.Listener) net.Listener
+	listen       func() (net.Listener, error)
+	admission    *AdmissionMngr
+	sources      *SourceFilter
+	relisten     bool
+	stats        *expvar.Map
+	events       *Bus
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	done     chan struct{}
+	conns    sync.WaitGroup
+	// parent of connection contexts, cancelled if connections are not drained in time
+	baseCtx   context.Context
+	cancelAll context.CancelFunc
 }
 
 func NewTcpServer(addr net.Addr) *TcpServer {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &TcpServer{
-		addr: addr,
+		addr:      addr,
+		stats:     new(expvar.Map).Init(),
+		done:      make(chan struct{}),
+		baseCtx:   ctx,
+		cancelAll: cancel,
 	}
 }
 
+func (s *TcpServer) Addr() net.Addr {
+	return s.addr
+}
+
 func (s *TcpServer) Use(handlers ...TcpHandler) {
 	s.handlers = append(s.handlers, handlers...)
 }
@@ -30,6 +95,47 @@ func (s *TcpServer) SetFinalHandler(handler TcpHandler) {
 	s.finalHandler = handler
 }
 
+// WrapConn wraps accepted connections before handlers, e.g. to read PROXY protocol headers
+func (s *TcpServer) WrapConn(fn func(net.Conn) net.Conn) {
+	s.wrapConn = fn
+}
+
+// WrapListener serves another protocol on top of the listener, e.g. websocket.
+// Listener keeps returning the raw one, which is passed on upgrade.
+func (s *TcpServer) WrapListener(fn func(net.Listener) net.Listener) {
+	s.wrapListener = fn
+}
+
+// SetListen replaces how Listen creates the listener, e.g. for quic over udp
+func (s *TcpServer) SetListen(fn func() (net.Listener, error)) {
+	s.listen = fn
+}
+
+// SetAdmission limits connections before handlers, may be shared by servers
+func (s *TcpServer) SetAdmission(mngr *AdmissionMngr) {
+	s.admission = mngr
+}
+
+// SetSourceFilter drops disallowed clients before handlers, may be shared by servers
+func (s *TcpServer) SetSourceFilter(f *SourceFilter) {
+	s.sources = f
+}
+
+// SetRelisten makes Serve listen again when the listener fails permanently
+func (s *TcpServer) SetRelisten(relisten bool) {
+	s.relisten = relisten
+}
+
+// SetEvents publishes connection events to bus, may be shared by servers
+func (s *TcpServer) SetEvents(bus *Bus) {
+	s.events = bus
+}
+
+// Stats counts accept errors, relistens and dropped sources
+func (s *TcpServer) Stats() *expvar.Map {
+	return s.stats
+}
+
 func (s *TcpServer) Handlers() []TcpHandler {
 	ret := make([]TcpHandler, 0, len(s.handlers)+1)
 	for _, h := range s.handlers {
@@ -40,22 +146,272 @@ func (s *TcpServer) Handlers() []TcpHandler {
 }
 
 func (s *TcpServer) ListenAndServe() error {
-	listener, err := net.Listen("tcp", s.addr.String())
+	listener, err := s.Listen()
 	if err != nil {
-		return fmt.Errorf("fail to listen tcp socket, err=%w", err)
+		return err
 	}
+	return s.Serve(listener)
+}
 
-	logger.Infof("start listen to tcp socket on %s", listener.Addr().String())
+// Serve accepts connections on listener until Shutdown, the listener may be inherited.
+// Temporary accept errors are retried with backoff, permanent ones end Serve unless re-listen is enabled.
+func (s *TcpServer) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
 
+	for {
+		logger.Infof("start serving %s socket on %s", s.addr.Network(), listener.Addr().String())
+		served := listener
+		if s.wrapListener != nil {
+			served = s.wrapListener(listener)
+		}
+		err := s.acceptLoop(served)
+		if served != listener {
+			// stops whatever the wrapping listener serves, e.g. http
+			_ = served.Close()
+		}
+		if s.isClosed() {
+			return ErrServerClosed
+		}
+		if !s.relisten {
+			return err
+		}
+
+		logger.Errorf("listener on %s failed, relisten, err=%s", s.addr.String(), err.Error())
+		if listener, err = s.relistenLoop(served); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *TcpServer) acceptLoop(listener net.Listener) error {
+	// handlers are fixed once serving, shared by all connections
+	handlers := s.Handlers()
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			return fmt.Errorf("fail to accept conn, err=%w", err)
+			if s.isClosed() || !isTemporary(err) {
+				return fmt.Errorf("fail to accept conn, err=%w", err)
+			}
+
+			// back off like net/http, 5ms doubling to 1s
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			s.stats.Add("temporary_errors", 1)
+			logger.Warningf("fail to accept conn on %s, retry in %s, err=%s", s.addr.String(), delay, err.Error())
+			if !s.sleep(delay) {
+				return ErrServerClosed
+			}
+			continue
+		}
+		delay = 0
+
+		// the sender address, RemoteAddr of wrapped conns may block
+		addr := conn.RemoteAddr()
+		if s.wrapConn != nil {
+			conn = s.wrapConn(conn)
 		}
 
+		// disallowed clients don't take a session, unless the address is carried in a PROXY header
+		checked := addrKnown(conn)
+		if checked && !s.sourceAllowed(conn) {
+			continue
+		}
+		release := func() {}
+		if s.admission != nil {
+			if release, err = s.admission.AcquireSession(); err != nil {
+				logger.Debugf("reject conn from %s, err=%s", addr.String(), err.Error())
+				_ = conn.Close()
+				continue
+			}
+		}
+
+		s.conns.Add(1)
 		go func() {
-			ctx := NewContext(conn, s.Handlers())
-			ctx.Next()
+			defer s.conns.Done()
+			defer release()
+			s.serveConn(conn, handlers, checked)
 		}()
 	}
 }
+
+// relistenLoop replaces the failed listener, retrying until it succeeds or the server is shut down
+func (s *TcpServer) relistenLoop(failed net.Listener) (net.Listener, error) {
+	_ = failed.Close()
+
+	delay := minRelistenDelay
+	for {
+		listener, err := s.Listen()
+		if err == nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				_ = listener.Close()
+				return nil, ErrServerClosed
+			}
+			s.listener = listener
+			s.stats.Add("relistens", 1)
+			return listener, nil
+		}
+
+		logger.Errorf("fail to relisten on %s, retry in %s, err=%s", s.addr.String(), delay, err.Error())
+		if !s.sleep(delay) {
+			return nil, ErrServerClosed
+		}
+		if delay *= 2; delay > maxRelistenDelay {
+			delay = maxRelistenDelay
+		}
+	}
+}
+
+// sleep returns false if the server is shut down meanwhile
+func (s *TcpServer) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// isTemporary reports accept errors worth retrying, e.g. running out of file descriptors
+func isTemporary(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range temporaryErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceAllowed closes conns of disallowed clients
+func (s *TcpServer) sourceAllowed(conn net.Conn) bool {
+	if s.sources == nil || s.sources.Allowed(conn.RemoteAddr()) {
+		return true
+	}
+	s.stats.Add("rejected_source", 1)
+	logger.Debugf("drop conn from %s, source not allowed", conn.RemoteAddr().String())
+	_ = conn.Close()
+	return false
+}
+
+// serveConn runs handlers on conn, the source is checked here unless checked by the accept loop
+func (s *TcpServer) serveConn(conn net.Conn, handlers []TcpHandler, checked bool) {
+	// the real client address is carried in a PROXY header, read out of the accept loop
+	if !checked && !s.sourceAllowed(conn) {
+		return
+	}
+	if s.admission != nil {
+		release, err := s.admission.AcquireIP(conn.RemoteAddr())
+		if err != nil {
+			logger.Debugf("reject conn from %s, err=%s", conn.RemoteAddr().String(), err.Error())
+			_ = conn.Close()
+			return
+		}
+		defer release()
+	}
+
+	ctx := NewContext(s.baseCtx, conn, handlers)
+	defer ctx.Release()
+	ctx.bus = s.events
+
+	start := time.Now()
+	ctx.Emit(Accepted{Listener: s.addr})
+	ctx.Next()
+	ctx.Emit(Closed{Duration: time.Since(start), Pipe: ctx.pipe})
+}
+
+// Listener returns the serving listener, nil before Serve
+func (s *TcpServer) Listener() net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listener
+}
+
+// Shutdown stops accepting and waits for in-flight connections until ctx is done,
+// then cancels the remaining ones
+func (s *TcpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.cancelAll()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+func (s *TcpServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Listen creates the listener of addr, stale unix socket file is removed
+func (s *TcpServer) Listen() (net.Listener, error) {
+	if s.listen != nil {
+		return s.listen()
+	}
+	network := s.addr.Network()
+	if network != "unix" {
+		listener, err := net.Listen(network, s.addr.String())
+		if err != nil {
+			return nil, fmt.Errorf("fail to listen %s socket, err=%w", network, err)
+		}
+		return listener, nil
+	}
+
+	// remove the socket file left by last run
+	path := s.addr.String()
+	if info, err := os.Stat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("fail to remove stale unix socket, err=%w", err)
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("fail to stat unix socket, err=%w", err)
+	}
+
+	listener, err := net.Listen(network, path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to listen unix socket, err=%w", err)
+	}
+	if addr, ok := s.addr.(*ListenAddr); ok && addr.Perm != 0 {
+		if err := os.Chmod(path, addr.Perm); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("fail to chmod unix socket, err=%w", err)
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,241 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not supported")
+	}
+	// socket paths are limited to about 100 bytes, t.TempDir may be too long
+	dir, err := os.MkdirTemp("", "s5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s5.sock")
+
+	// the socket file is left behind as if the last run crashed
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket is not left, err=%v", err)
+	}
+
+	s := NewTcpServer(&ListenAddr{Net: "unix", Addr: path, Perm: 0600})
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&fs.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("got mode %s, want a socket of 0600", info.Mode())
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// other files are never removed
+	file := filepath.Join(dir, "s5.conf")
+	if err := os.WriteFile(file, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTcpServer(&ListenAddr{Net: "unix", Addr: file}).Listen(); err == nil {
+		t.Fatal("listened on a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Fatalf("regular file is replaced, err=%v", err)
+	}
+	if _, err := NewTcpServer(&ListenAddr{Net: "unix", Addr: filepath.Join(dir, "missing", "s5.sock")}).Listen(); err == nil {
+		t.Fatal("listened in a missing directory")
+	}
+}
+
+// flakyListener fails the first failures accepts with err, recording when each accept is called
+type flakyListener struct {
+	net.Listener
+	err error
+
+	mu       sync.Mutex
+	failures int
+	calls    []time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, time.Now())
+	fail := l.failures > 0
+	l.failures--
+	l.mu.Unlock()
+	if fail {
+		return nil, l.err
+	}
+	return l.Listener.Accept()
+}
+
+func (l *flakyListener) Calls() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.calls...)
+}
+
+// greetServer writes hi to every conn
+func greetServer(t *testing.T) *TcpServer {
+	s := NewTcpServer(&ListenAddr{Net: "tcp", Addr: "127.0.0.1:0"})
+	s.SetFinalHandler(TcpHandleFunc(func(ctx *Context) {
+		_, _ = ctx.SourceConn().Write([]byte("hi"))
+		_ = ctx.SourceConn().Close()
+	}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s
+}
+
+func greeted(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if string(got) != "hi" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func statOf(s *TcpServer, name string) int64 {
+	if v, ok := s.Stats().Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// running out of fds, delays are 5ms, 10ms, 20ms, 40ms
+	flaky := &flakyListener{Listener: ln, failures: 4, err: &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}}
+	s := greetServer(t)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(flaky) }()
+
+	if err := greeted(ln.Addr().String()); err != nil {
+		t.Fatalf("server is not recovered, err=%v", err)
+	}
+	calls := flaky.Calls()
+	if len(calls) < 5 {
+		t.Fatalf("got %d accepts, want 4 failed and 1 served", len(calls))
+	}
+	for i := 1; i < 5; i++ {
+		if gap, want := calls[i].Sub(calls[i-1]), minAcceptDelay<<(i-1); gap < want {
+			t.Fatalf("accept %d retried in %s, want at least %s", i, gap, want)
+		}
+	}
+	if got := statOf(s, "temporary_errors"); got != 4 {
+		t.Fatalf("got %d temporary errors, want 4", got)
+	}
+	if s.Listener() != flaky {
+		t.Fatal("listener is replaced on temporary errors")
+	}
+
+	// permanent errors end Serve
+	flaky.mu.Lock()
+	flaky.failures, flaky.err = 1, errors.New("broken")
+	flaky.mu.Unlock()
+	go func() { _ = greeted(ln.Addr().String()) }()
+	select {
+	case err := <-served:
+		if err == nil || errors.Is(err, ErrServerClosed) {
+			t.Fatalf("got %v, want the accept error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server keeps serving after a permanent error")
+	}
+}
+
+func TestRelisten(t *testing.T) {
+	s := greetServer(t)
+	s.SetRelisten(true)
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first relisten fails, the second one is retried after minRelistenDelay
+	var relistens int
+	var second net.Listener
+	s.SetListen(func() (net.Listener, error) {
+		if relistens++; relistens == 1 {
+			return nil, syscall.EADDRINUSE
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		second = ln
+		return ln, err
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(first) }()
+	if err := greeted(first.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the listener dies while the server is not shut down
+	start := time.Now()
+	_ = first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for statOf(s, "relistens") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if statOf(s, "relistens") != 1 {
+		t.Fatal("server does not relisten")
+	}
+	if time.Since(start) < minRelistenDelay {
+		t.Fatalf("failed relisten retried in %s, want at least %s", time.Since(start), minRelistenDelay)
+	}
+	if s.Listener() != second {
+		t.Fatal("new listener is not served")
+	}
+	if err := greeted(second.Addr().String()); err != nil {
+		t.Fatalf("server is not serving after relisten, err=%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("got %v after shutdown, want %v", err, ErrServerClosed)
+	}
+}
@@ -0,0 +1,243 @@
+// Package upgrade inherits listeners from systemd socket activation or from
+// the previous process of a zero-downtime binary upgrade, udp sockets of quic included.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// fds passed by systemd start from 3
+	listenFdsStart = 3
+
+	envListenPid = "LISTEN_PID"
+	envListenFds = "LISTEN_FDS"
+	envFdNames   = "LISTEN_FDNAMES"
+
+	// set by the previous process, LISTEN_PID is unknown before exec
+	envUpgradeFds   = "S5_UPGRADE_FDS"
+	envUpgradeReady = "S5_UPGRADE_READY_FD"
+)
+
+var logger = logrus.WithField("component", "upgrade")
+
+// Pool holds inherited listeners and udp sockets until they are taken
+type Pool struct {
+	listeners []net.Listener
+	packets   []net.PacketConn
+	readyFd   int
+}
+
+// Inherit collects listeners passed by systemd or by the previous process
+func Inherit() (*Pool, error) {
+	p := &Pool{readyFd: -1}
+
+	n, err := inheritedFds()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFdsStart+i), fmt.Sprintf("listener-%d", i))
+		l, err := net.FileListener(f)
+		if err != nil {
+			// not a stream socket, e.g. the udp socket of quic
+			if pc, perr := net.FilePacketConn(f); perr == nil {
+				_ = f.Close()
+				logger.Infof("inherit %s socket on %s", pc.LocalAddr().Network(), pc.LocalAddr().String())
+				p.packets = append(p.packets, pc)
+				continue
+			}
+		}
+		_ = f.Close()
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("fail to inherit listener fd %d, err=%w", listenFdsStart+i, err)
+		}
+		logger.Infof("inherit %s listener on %s", l.Addr().Network(), l.Addr().String())
+		p.listeners = append(p.listeners, l)
+	}
+
+	if v := os.Getenv(envUpgradeReady); v != "" {
+		if p.readyFd, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("illegal %s, err=%w", envUpgradeReady, err)
+		}
+	}
+
+	for _, env := range []string{envListenPid, envListenFds, envFdNames, envUpgradeFds, envUpgradeReady} {
+		_ = os.Unsetenv(env)
+	}
+	return p, nil
+}
+
+func inheritedFds() (int, error) {
+	if v := os.Getenv(envUpgradeFds); v != "" {
+		return strconv.Atoi(v)
+	}
+	if os.Getenv(envListenPid) != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	return strconv.Atoi(os.Getenv(envListenFds))
+}
+
+// Take removes and returns the inherited listener bound to network/address
+func (p *Pool) Take(network, address string) (net.Listener, bool) {
+	for i, l := range p.listeners {
+		if sameAddr(l.Addr(), network, address) {
+			p.listeners = append(p.listeners[:i], p.listeners[i+1:]...)
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// TakePacket removes and returns the inherited udp socket bound to network/address
+func (p *Pool) TakePacket(network, address string) (net.PacketConn, bool) {
+	for i, pc := range p.packets {
+		if sameAddr(pc.LocalAddr(), network, address) {
+			p.packets = append(p.packets[:i], p.packets[i+1:]...)
+			return pc, true
+		}
+	}
+	return nil, false
+}
+
+// Close closes listeners and udp sockets not taken
+func (p *Pool) Close() {
+	for _, l := range p.listeners {
+		logger.Warningf("inherited listener on %s is not configured, close it", l.Addr().String())
+		_ = l.Close()
+	}
+	for _, pc := range p.packets {
+		logger.Warningf("inherited udp socket on %s is not configured, close it", pc.LocalAddr().String())
+		_ = pc.Close()
+	}
+	p.listeners, p.packets = nil, nil
+}
+
+// Ready tells the previous process that all listeners are serving
+func (p *Pool) Ready() {
+	if p.readyFd < 0 {
+		return
+	}
+	f := os.NewFile(uintptr(p.readyFd), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		logger.Warningf("fail to notify previous process, err=%s", err.Error())
+	}
+	_ = f.Close()
+	p.readyFd = -1
+}
+
+func sameAddr(addr net.Addr, network, address string) bool {
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return network == "unix" && a.Name == address
+	case *net.TCPAddr:
+		if !strings.HasPrefix(network, "tcp") {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, address)
+		return err == nil && sameIPPort(a.IP, a.Port, want.IP, want.Port)
+	case *net.UDPAddr:
+		if !strings.HasPrefix(network, "udp") {
+			return false
+		}
+		want, err := net.ResolveUDPAddr(network, address)
+		return err == nil && sameIPPort(a.IP, a.Port, want.IP, want.Port)
+	default:
+		return false
+	}
+}
+
+func sameIPPort(ip net.IP, port int, wantIP net.IP, wantPort int) bool {
+	if wantPort != port {
+		return false
+	}
+	if wantIP == nil || wantIP.IsUnspecified() {
+		return ip == nil || ip.IsUnspecified()
+	}
+	return wantIP.Equal(ip)
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Spawn execs the current binary with listeners passed down,
+// returns once the new process is serving or fails to start in timeout
+func Spawn(listeners []net.Listener, timeout time.Duration) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("fail to locate executable, err=%w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener on %s can not be passed", l.Addr().String())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("fail to dup listener on %s, err=%w", l.Addr().String(), err)
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("fail to create ready pipe, err=%w", err)
+	}
+	defer func() { _ = r.Close() }()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envUpgradeFds, len(listeners)),
+		fmt.Sprintf("%s=%d", envUpgradeReady, listenFdsStart+len(listeners)),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("fail to start new process, err=%w", err)
+	}
+	_ = w.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			logger.Infof("new process %d is ready", cmd.Process.Pid)
+			go func() { _ = cmd.Wait() }()
+			return cmd.Process, nil
+		}
+		// the pipe is closed without notification, the new process failed
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, errors.New("new process exited before ready")
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, errors.New("new process is not ready in time")
+	}
+}
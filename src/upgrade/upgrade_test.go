@@ -0,0 +1,234 @@
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// envChild runs TestInheritChild as the inheriting process, either by upgrade or by systemd
+const envChild = "S5_UPGRADE_TEST_CHILD"
+
+func TestSameAddr(t *testing.T) {
+	any6 := &net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	cases := []struct {
+		addr             net.Addr
+		network, address string
+		want             bool
+	}{
+		{addr: any6, network: "tcp", address: ":1080", want: true},
+		{addr: any6, network: "tcp", address: "[::]:1080", want: true},
+		{addr: any6, network: "tcp", address: "0.0.0.0:1080", want: true},
+		{addr: any6, network: "tcp6", address: "[::]:1080", want: true},
+		{addr: any6, network: "tcp", address: "127.0.0.1:1080"},
+		{addr: any6, network: "tcp", address: ":1081"},
+		// the port of :0 is only known after listening, it never matches
+		{addr: any6, network: "tcp", address: ":0"},
+		{addr: &net.TCPAddr{IP: net.IPv4zero, Port: 0}, network: "tcp", address: ":0", want: true},
+		{addr: loopback, network: "tcp", address: "127.0.0.1:1080", want: true},
+		{addr: loopback, network: "tcp4", address: "127.0.0.1:1080", want: true},
+		{addr: loopback, network: "tcp", address: ":1080"},
+		{addr: loopback, network: "tcp", address: "127.0.0.2:1080"},
+		{addr: loopback, network: "unix", address: "127.0.0.1:1080"},
+		{addr: loopback, network: "tcp", address: "127.0.0.1"},
+		{addr: &net.UnixAddr{Name: "/run/s5.sock", Net: "unix"}, network: "unix", address: "/run/s5.sock", want: true},
+		{addr: &net.UnixAddr{Name: "/run/s5.sock", Net: "unix"}, network: "unix", address: "/run/s6.sock"},
+		{addr: &net.UnixAddr{Name: "/run/s5.sock", Net: "unix"}, network: "tcp", address: "/run/s5.sock"},
+		{addr: &net.UDPAddr{IP: net.IPv4zero, Port: 1080}, network: "udp", address: ":1080", want: true},
+		{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, network: "udp4", address: "127.0.0.1:1080", want: true},
+		{addr: &net.UDPAddr{IP: net.IPv4zero, Port: 1080}, network: "tcp", address: ":1080"},
+		{addr: any6, network: "udp", address: ":1080"},
+	}
+	for _, c := range cases {
+		if got := sameAddr(c.addr, c.network, c.address); got != c.want {
+			t.Errorf("%s %s against %s got %v, want %v", c.network, c.address, c.addr, got, c.want)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	a, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	p := &Pool{listeners: []net.Listener{a, b}, packets: []net.PacketConn{udp}, readyFd: -1}
+
+	if l, ok := p.Take("tcp", b.Addr().String()); !ok || l != b {
+		t.Fatalf("got %v, want the listener on %s", l, b.Addr())
+	}
+	if _, ok := p.Take("udp", udp.LocalAddr().String()); ok {
+		t.Fatal("udp socket is taken as a listener")
+	}
+	if pc, ok := p.TakePacket("udp", udp.LocalAddr().String()); !ok || pc != udp {
+		t.Fatalf("got %v, want the udp socket on %s", pc, udp.LocalAddr())
+	}
+	// taken once only
+	if _, ok := p.Take("tcp", b.Addr().String()); ok {
+		t.Fatal("listener is taken twice")
+	}
+	if _, ok := p.Take("unix", a.Addr().String()); ok {
+		t.Fatal("tcp listener is taken as unix")
+	}
+
+	// listeners not taken are closed
+	p.Close()
+	if _, err := a.Accept(); err == nil {
+		t.Fatal("listener not taken is still open")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("taken listener is closed by the pool, err=%v", err)
+	}
+	p.Ready()
+}
+
+func TestInherit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fds are not inherited on windows")
+	}
+	for _, by := range []string{"upgrade", "systemd"} {
+		t.Run(by, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			f, err := ln.(*net.TCPListener).File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			// the udp socket of a quic listener
+			udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer udp.Close()
+			uf, err := udp.(*net.UDPConn).File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer uf.Close()
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestInheritChild$")
+			cmd.Stderr = os.Stderr
+			cmd.ExtraFiles = []*os.File{f, uf, w}
+			cmd.Env = append(os.Environ(), envChild+"="+by,
+				"S5_UPGRADE_TEST_ADDR="+ln.Addr().String(), "S5_UPGRADE_TEST_UDP="+udp.LocalAddr().String())
+			if by == "upgrade" {
+				cmd.Env = append(cmd.Env, envUpgradeFds+"=2", fmt.Sprintf("%s=%d", envUpgradeReady, listenFdsStart+2))
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			_ = w.Close()
+			defer func() {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+			}()
+
+			// the child tells it's serving by the ready fd in upgrades only
+			if by == "upgrade" {
+				_ = r.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := r.Read(make([]byte, 1)); err != nil {
+					t.Fatalf("child is not ready, err=%v", err)
+				}
+			}
+			// the parent stops accepting, connections and datagrams reach the child
+			_ = ln.Close()
+			_ = f.Close()
+			_ = udp.Close()
+			_ = uf.Close()
+			pc, err := net.Dial("udp", udp.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := pc.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 16)
+			if n, err := pc.Read(buf); err != nil || string(buf[:n]) != "child" {
+				t.Fatalf("got %q, err=%v", buf[:n], err)
+			}
+			conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(conn)
+			if err != nil || string(got) != "child" {
+				t.Fatalf("got %q, err=%v", got, err)
+			}
+		})
+	}
+}
+
+// TestInheritChild serves one connection on the inherited listener, it's run by TestInherit
+func TestInheritChild(t *testing.T) {
+	by := os.Getenv(envChild)
+	if by == "" {
+		t.Skip("run by TestInherit")
+	}
+	if by == "systemd" {
+		// systemd sets them for the pid it starts
+		_ = os.Setenv(envListenPid, strconv.Itoa(os.Getpid()))
+		_ = os.Setenv(envListenFds, "2")
+	}
+	p, err := Inherit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{envListenPid, envListenFds, envUpgradeFds, envUpgradeReady} {
+		if os.Getenv(env) != "" {
+			t.Fatalf("%s is passed on", env)
+		}
+	}
+	ln, ok := p.Take("tcp", os.Getenv("S5_UPGRADE_TEST_ADDR"))
+	if !ok {
+		t.Fatal("listener is not inherited")
+	}
+	defer ln.Close()
+	udp, ok := p.TakePacket("udp", os.Getenv("S5_UPGRADE_TEST_UDP"))
+	if !ok {
+		t.Fatal("udp socket is not inherited")
+	}
+	defer udp.Close()
+	p.Close()
+	p.Ready()
+
+	buf := make([]byte, 16)
+	n, from, err := udp.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("got %q, err=%v", buf[:n], err)
+	}
+	_, _ = udp.WriteTo([]byte("child"), from)
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("child"))
+	_ = conn.Close()
+}
@@ -0,0 +1,229 @@
+// Package websocket tunnels byte streams in binary messages of RFC 6455, which passes
+// networks only allowing http. There are no extensions, text messages are read as binary.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	maxHeaderSize     = 14
+	closeNormal       = 1000
+	// close frames are best effort when closing, a stuck peer doesn't block Close
+	closeWriteTimeout = time.Second
+)
+
+var ErrProtocol = errors.New("websocket protocol error")
+
+// Conn is a byte stream over websocket messages, a close frame is a FIN:
+// CloseWrite sends one, Read returns io.EOF once the peer sent one.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+	// clients mask frames they send and servers mask none
+	client bool
+
+	rmu        sync.Mutex
+	remaining  int64
+	mask       [4]byte
+	masked     bool
+	maskPos    int
+	readClosed bool
+
+	wmu       sync.Mutex
+	wbuf      []byte
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{Conn: conn, br: br, client: client}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.remaining == 0 {
+		if c.readClosed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads headers until a data frame, answering pings on the way
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	op := head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	// servers require masked frames of clients, clients require unmasked ones
+	if masked := head[1]&maskBit != 0; masked == c.client {
+		return fmt.Errorf("%w: unexpected mask", ErrProtocol)
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return fmt.Errorf("%w: illegal length", ErrProtocol)
+		}
+	}
+	c.masked, c.maskPos = !c.client, 0
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > maxControlPayload || head[0]&finBit == 0 {
+			return fmt.Errorf("%w: illegal control frame", ErrProtocol)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+		}
+		switch op {
+		case opClose:
+			c.readClosed = true
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown opcode %x", ErrProtocol, op)
+	}
+}
+
+// Write sends p as a single binary message
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	buf := append(c.wbuf[:0], finBit|op, 0)
+	switch n := len(payload); {
+	case n <= 125:
+		buf[1] = byte(n)
+	case n <= 0xffff:
+		buf[1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf[1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if !c.client {
+		buf = append(buf, payload...)
+	} else {
+		buf[1] |= maskBit
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	}
+	if cap(buf) <= maxHeaderSize+64<<10 {
+		c.wbuf = buf
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// CloseWrite sends a close frame, the peer may still send until it closes as well
+func (c *Conn) CloseWrite() error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], closeNormal)
+	return c.writeFrame(opClose, payload[:])
+}
+
+// CloseRead makes following reads return io.EOF
+func (c *Conn) CloseRead() error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.readClosed, c.remaining = true, 0
+	return nil
+}
+
+func (c *Conn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	_ = c.CloseWrite()
+	return c.Conn.Close()
+}
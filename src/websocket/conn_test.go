@@ -0,0 +1,429 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// loopback returns both ends of a tcp connection, buffered by the kernel unlike net.Pipe
+func loopback(t *testing.T) (a, b net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	_ = a.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = b.SetDeadline(time.Now().Add(5 * time.Second))
+	return a, b
+}
+
+// pair returns a client and a server conn talking to each other
+func pair(t *testing.T) (client, server *Conn) {
+	a, b := loopback(t)
+	return newConn(a, bufio.NewReader(a), true), newConn(b, bufio.NewReader(b), false)
+}
+
+// peer returns a conn and the raw end of its peer, which reads and writes frames by hand
+func peer(t *testing.T, client bool) (*Conn, net.Conn) {
+	a, b := loopback(t)
+	return newConn(a, bufio.NewReader(a), client), b
+}
+
+// frame encodes a frame, masked if mask is not nil
+func frame(head byte, mask []byte, payload []byte) []byte {
+	buf := []byte{head, 0}
+	switch n := len(payload); {
+	case n <= 125:
+		buf[1] = byte(n)
+	case n <= 0xffff:
+		buf[1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf[1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if mask == nil {
+		return append(buf, payload...)
+	}
+	buf[1] |= maskBit
+	buf = append(buf, mask...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i&3])
+	}
+	return buf
+}
+
+// readFrame decodes a frame sent to the raw end
+func readFrame(t *testing.T, r io.Reader) (head byte, mask []byte, payload []byte) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := uint64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, _ = io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, _ = io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if h[1]&maskBit != 0 {
+		mask = make([]byte, 4)
+		_, _ = io.ReadFull(r, mask)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return h[0], mask, payload
+}
+
+func TestConn(t *testing.T) {
+	// lengths at the boundaries of 7, 16 and 64 bit encodings
+	for _, size := range []int{1, 125, 126, 0xffff, 0x10000, 1 << 20} {
+		client, server := pair(t)
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+
+		for _, dir := range []struct {
+			name     string
+			from, to *Conn
+		}{{"up", client, server}, {"down", server, client}} {
+			go func() { _, _ = dir.from.Write(data) }()
+			got := make([]byte, size)
+			if _, err := io.ReadFull(dir.to, got); err != nil {
+				t.Fatalf("%s %d bytes, err=%v", dir.name, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s %d bytes are corrupted", dir.name, size)
+			}
+		}
+	}
+}
+
+func TestMasking(t *testing.T) {
+	payload := []byte("masked payload")
+
+	// clients mask with a fresh key per frame, servers don't
+	client, raw := peer(t, true)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head, mask1, got := readFrame(t, raw)
+	if head != finBit|opBinary || mask1 == nil || bytes.Equal(got, payload) {
+		t.Fatalf("client frame %x is not masked", head)
+	}
+	for i := range got {
+		got[i] ^= mask1[i&3]
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q", got)
+	}
+	if _, mask2, _ := readFrame(t, raw); bytes.Equal(mask1, mask2) {
+		t.Fatal("mask is reused")
+	}
+
+	server, raw := peer(t, false)
+	if _, err := server.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if head, mask, got := readFrame(t, raw); head != finBit|opBinary || mask != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("server frame %x is masked", head)
+	}
+
+	cases := []struct {
+		name   string
+		client bool
+		mask   []byte
+	}{
+		{name: "unmasked frame to server"},
+		{name: "masked frame to client", client: true, mask: []byte{1, 2, 3, 4}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, raw := peer(t, c.client)
+			_, _ = raw.Write(frame(finBit|opBinary, c.mask, payload))
+			if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, ErrProtocol) {
+				t.Fatalf("got %v, want a protocol error", err)
+			}
+		})
+	}
+}
+
+func TestControlFrames(t *testing.T) {
+	mask := []byte{0xa1, 0xb2, 0xc3, 0xd4}
+	cases := []struct {
+		name   string
+		frames [][]byte
+		// read by the server until the close frame or an error
+		want string
+		err  error
+		// payload of the pong replied, nil if none
+		pong []byte
+	}{
+		{name: "ping between data", frames: [][]byte{
+			frame(finBit|opBinary, mask, []byte("hello ")),
+			frame(finBit|opPing, mask, []byte("are you there")),
+			frame(finBit|opBinary, mask, []byte("world")),
+			frame(finBit|opClose, mask, nil),
+		}, want: "hello world", pong: []byte("are you there")},
+		{name: "pong ignored", frames: [][]byte{
+			frame(finBit|opPong, mask, []byte("unsolicited")),
+			frame(finBit|opBinary, mask, []byte("data")),
+			frame(finBit|opClose, mask, nil),
+		}, want: "data"},
+		{name: "fragments and text", frames: [][]byte{
+			frame(opText, mask, []byte("frag")),
+			frame(finBit|opPing, mask, nil),
+			frame(finBit|opContinuation, mask, []byte("ments")),
+			frame(finBit|opClose, mask, nil),
+		}, want: "fragments", pong: []byte{}},
+		{name: "empty message", frames: [][]byte{
+			frame(finBit|opBinary, mask, nil),
+			frame(finBit|opBinary, mask, []byte("after")),
+			frame(finBit|opClose, mask, nil),
+		}, want: "after"},
+		{name: "fragmented control frame", frames: [][]byte{frame(opPing, mask, nil)}, err: ErrProtocol},
+		{name: "long control frame", frames: [][]byte{frame(finBit|opPing, mask, make([]byte, 126))}, err: ErrProtocol},
+		{name: "reserved bits", frames: [][]byte{frame(finBit|0x40|opBinary, mask, []byte("x"))}, err: ErrProtocol},
+		{name: "unknown opcode", frames: [][]byte{frame(finBit|0x3, mask, []byte("x"))}, err: ErrProtocol},
+		{name: "truncated payload", frames: [][]byte{frame(finBit|opBinary, mask, []byte("truncated"))[:10]}, want: "trun", err: io.ErrUnexpectedEOF},
+		{name: "truncated header", frames: [][]byte{{finBit | opBinary}}, err: io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, raw := peer(t, false)
+			for _, f := range c.frames {
+				_, _ = raw.Write(f)
+			}
+			_ = raw.(*net.TCPConn).CloseWrite()
+
+			got, err := io.ReadAll(server)
+			if !errors.Is(err, c.err) || string(got) != c.want {
+				t.Fatalf("got %q, err=%v, want %q, err=%v", got, err, c.want, c.err)
+			}
+			if c.pong == nil {
+				return
+			}
+			head, mask, payload := readFrame(t, raw)
+			if head != finBit|opPong || mask != nil || !bytes.Equal(payload, c.pong) {
+				t.Fatalf("got frame %x with %q, want a pong", head, payload)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Run("close write", func(t *testing.T) {
+		client, server := pair(t)
+		_, _ = client.Write([]byte("request"))
+		if err := client.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("write after close frame got %v", err)
+		}
+		if got, err := io.ReadAll(server); string(got) != "request" || err != nil {
+			t.Fatalf("server got %q, err=%v", got, err)
+		}
+		// the other direction is still open
+		_, _ = server.Write([]byte("response"))
+		_ = server.CloseWrite()
+		if got, err := io.ReadAll(client); string(got) != "response" || err != nil {
+			t.Fatalf("client got %q, err=%v", got, err)
+		}
+	})
+
+	t.Run("close frame", func(t *testing.T) {
+		client, raw := peer(t, true)
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		head, mask, payload := readFrame(t, raw)
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+		if head != finBit|opClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != closeNormal {
+			t.Fatalf("got frame %x with %x, want a normal close", head, payload)
+		}
+		if _, err := raw.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("got %v, want the FIN", err)
+		}
+	})
+
+	t.Run("close read", func(t *testing.T) {
+		client, server := pair(t)
+		_, _ = client.Write([]byte("ignored"))
+		_ = server.CloseRead()
+		if n, err := server.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+			t.Fatalf("got %d bytes, err=%v", n, err)
+		}
+	})
+
+	// a peer not reading doesn't block Close, the close frame is best effort
+	t.Run("stuck peer", func(t *testing.T) {
+		a, _ := net.Pipe()
+		conn := newConn(a, bufio.NewReader(a), false)
+		start := time.Now()
+		_ = conn.Close()
+		if d := time.Since(start); d > closeWriteTimeout+time.Second {
+			t.Fatalf("close took %s", d)
+		}
+	})
+}
+
+// certificate returns a self signed certificate of localhost and a pool trusting it
+func certificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestListener(t *testing.T) {
+	cert, pool := certificate(t)
+	cases := []struct {
+		name string
+		tls  bool
+		// root cas of the client, the system ones if nil
+		roots *x509.CertPool
+		path  string
+		ok    bool
+	}{
+		{name: "ws", path: "/tunnel", ok: true},
+		{name: "wss private ca", tls: true, roots: pool, path: "/tunnel", ok: true},
+		{name: "wrong path", path: "/other"},
+		{name: "untrusted certificate", tls: true, path: "/tunnel"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tlsConfig *tls.Config
+			if c.tls {
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			}
+			l := NewListener(raw, "/tunnel", tlsConfig)
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+
+			conn, err := net.Dial("tcp", raw.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if c.tls {
+				conn = tls.Client(conn, &tls.Config{ServerName: "localhost", RootCAs: c.roots})
+			}
+			ws, err := Handshake(conn, "localhost", c.path)
+			if (err == nil) != c.ok {
+				t.Fatalf("got err=%v", err)
+			}
+			if err != nil {
+				return
+			}
+			_, _ = ws.Write([]byte("echo"))
+			_ = ws.CloseWrite()
+			if got, err := io.ReadAll(ws); string(got) != "echo" || err != nil {
+				t.Fatalf("got %q, err=%v", got, err)
+			}
+		})
+	}
+}
+
+func TestListenerRejectsPlainRequests(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(raw, "/tunnel", nil)
+	defer l.Close()
+	base := "http://" + raw.Addr().String()
+
+	cases := []struct {
+		path   string
+		header map[string]string
+		status int
+	}{
+		{path: "/", status: http.StatusNotFound},
+		{path: "/tunnel", status: http.StatusUpgradeRequired},
+		{path: "/tunnel", header: map[string]string{
+			"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Key": "x", "Sec-WebSocket-Version": "8",
+		}, status: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(http.MethodGet, base+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("%s got %d, want %d", c.path, resp.StatusCode, c.status)
+		}
+	}
+}
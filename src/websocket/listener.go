@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithField("component", "websocket")
+
+// handshakes slower than this are dropped, so idle http connections don't pile up
+const handshakeTimeout = 10 * time.Second
+
+// Listener serves http on a raw listener and accepts the upgraded connections on path,
+// other requests are answered with 404
+type Listener struct {
+	raw   net.Listener
+	path  string
+	srv   *http.Server
+	conns chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// NewListener starts serving raw, tls is served if tlsConfig is not nil
+func NewListener(raw net.Listener, path string, tlsConfig *tls.Config) *Listener {
+	l := &Listener{
+		raw:   raw,
+		path:  path,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	l.srv = &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: handshakeTimeout,
+		IdleTimeout:       handshakeTimeout,
+		ErrorLog:          log.New(logger.WriterLevel(logrus.DebugLevel), "", 0),
+	}
+
+	served := raw
+	if tlsConfig != nil {
+		served = tls.NewListener(raw, tlsConfig)
+	}
+	go func() {
+		err := l.srv.Serve(served)
+		l.close(fmt.Errorf("fail to serve http, err=%w", err))
+	}()
+	return l
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		logger.Debugf("fail to upgrade conn from %s, err=%s", r.RemoteAddr, err.Error())
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) close(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+		_ = l.srv.Close()
+	})
+}
+
+// Close stops accepting, upgraded connections are left open
+func (l *Listener) Close() error {
+	l.close(net.ErrClosed)
+	if err := l.raw.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.raw.Addr()
+}